@@ -0,0 +1,118 @@
+package graphqlws
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Internal message type of the AppSync protocol acknowledging started
+// operations
+const gqlStartAck = "start_ack"
+
+// AppSyncConfig enables compatibility with the AWS AppSync realtime
+// protocol, so that clients written against AppSync, e.g. those of AWS
+// Amplify, can connect. AppSync clients connect with the graphql-ws
+// subprotocol and pass their auth headers as base64-encoded JSON in the
+// header query parameter of the upgrade request; connections with this
+// parameter use the AppSync protocol, others the legacy protocol.
+//
+// The Authorization header (or else the x-api-key header) is
+// authenticated as the auth token of the connection. Operations are
+// acknowledged with start_ack messages and completed when they are
+// stopped, and the auth headers clients send along with each operation
+// are kept in the authorization extension of its start payload. Clients
+// close connections that don't receive a keep-alive message within the
+// connection timeout, so KeepAliveInterval should be set.
+type AppSyncConfig struct {
+	// ConnectionTimeout is sent to clients in the connection_ack
+	// payload; defaults to 5 minutes.
+	ConnectionTimeout time.Duration
+}
+
+var appSyncProtocol = &protocol{
+	subprotocol: SubprotocolGraphQLWS,
+	incoming: map[string]string{
+		"connection_init": gqlConnectionInit,
+		"start":           gqlStart,
+		"stop":            gqlStop,
+	},
+	outgoing: map[string]string{
+		gqlConnectionAck:       "connection_ack",
+		gqlConnectionError:     "connection_error",
+		gqlConnectionKeepAlive: "ka",
+		gqlStartAck:            "start_ack",
+		gqlData:                "data",
+		gqlError:               "error",
+		gqlComplete:            "complete",
+	},
+	appSync: true,
+}
+
+// isAppSyncRequest reports whether an upgrade request comes from an
+// AppSync client.
+func isAppSyncRequest(r *http.Request) bool {
+	return r != nil && r.URL != nil && r.URL.Query().Get("header") != ""
+}
+
+// appSyncAuthToken returns the auth token in the auth headers of an
+// AppSync upgrade request.
+func appSyncAuthToken(r *http.Request) string {
+	if r == nil || r.URL == nil {
+		return ""
+	}
+	encoded := r.URL.Query().Get("header")
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		decoded, err = base64.URLEncoding.DecodeString(encoded)
+	}
+	if err != nil {
+		return ""
+	}
+	headers := map[string]interface{}{}
+	if err := json.Unmarshal(decoded, &headers); err != nil {
+		return ""
+	}
+	for _, name := range []string{"Authorization", "authorization", "x-api-key"} {
+		if token, ok := headers[name].(string); ok && token != "" {
+			return token
+		}
+	}
+	return ""
+}
+
+// appSyncAckPayload returns the connection_ack payload of AppSync
+// connections.
+func appSyncAckPayload(config *AppSyncConfig) map[string]interface{} {
+	timeout := config.ConnectionTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	return map[string]interface{}{"connectionTimeoutMs": timeout.Milliseconds()}
+}
+
+// appSyncStartPayload is the payload of AppSync start messages, which
+// carry the operation as a JSON string.
+type appSyncStartPayload struct {
+	Data       string                 `json:"data"`
+	Extensions map[string]interface{} `json:"extensions"`
+}
+
+// decodeAppSyncStart decodes the payload of an AppSync start message.
+func decodeAppSyncStart(codec Codec, raw []byte, data *StartMessagePayload) error {
+	payload := appSyncStartPayload{}
+	if err := codec.Unmarshal(raw, &payload); err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(payload.Data), data); err != nil {
+		return err
+	}
+	if authorization, ok := payload.Extensions["authorization"]; ok {
+		if data.Extensions == nil {
+			data.Extensions = make(map[string]interface{})
+		}
+		data.Extensions["authorization"] = authorization
+	}
+	return nil
+}
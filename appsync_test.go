@@ -0,0 +1,77 @@
+package graphqlws_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/meandrewdev/graphqlws"
+)
+
+func TestAppSync_ClientsUseTheAppSyncProtocol(t *testing.T) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		AppSync:             &graphqlws.AppSyncConfig{},
+		Authenticate: func(token string) (interface{}, error) {
+			if token != "secret" {
+				return nil, errors.New("invalid token")
+			}
+			return "ada", nil
+		},
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	}))
+	defer srv.Close()
+
+	headers := base64.StdEncoding.EncodeToString([]byte(`{"Authorization": "secret", "host": "example.com"}`))
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + wsMountPath + "?header=" + headers + "&payload=e30="
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Sec-WebSocket-Protocol": {graphqlws.SubprotocolGraphQLWS}})
+	if err != nil {
+		t.Fatalf("could not connect to websocket server: %v", err)
+	}
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	ack := readOperationMessage(t, ws)
+	payload, _ := ack.Payload.(map[string]interface{})
+	if ack.Type != "connection_ack" || payload["connectionTimeoutMs"] != float64(300000) {
+		t.Fatalf("unexpected ack: %v", ack)
+	}
+
+	writeMessage(t, ws, map[string]interface{}{
+		"id":   "1",
+		"type": "start",
+		"payload": map[string]interface{}{
+			"data": `{"query": "subscription { ` + subscriptionName + ` { payload } }"}`,
+			"extensions": map[string]interface{}{
+				"authorization": map[string]interface{}{"Authorization": "secret"},
+			},
+		},
+	})
+	if msg := readOperationMessage(t, ws); msg.Type != "start_ack" || msg.ID != "1" {
+		t.Fatalf("expected start_ack, received: %v", msg)
+	}
+	s := receiveSubscription(t, subscriptions)
+	if s.Connection.User() != "ada" {
+		t.Errorf("unexpected user: %v", s.Connection.User())
+	}
+
+	s.SendData(&graphqlws.DataMessagePayload{Data: "hello"})
+	if msg := readOperationMessage(t, ws); msg.Type != "data" || msg.ID != "1" {
+		t.Errorf("expected data message, received: %v", msg)
+	}
+
+	writeMessage(t, ws, map[string]interface{}{"id": "1", "type": "stop"})
+	if msg := readOperationMessage(t, ws); msg.Type != "complete" || msg.ID != "1" {
+		t.Errorf("expected complete message, received: %v", msg)
+	}
+}
@@ -0,0 +1,649 @@
+// Package client is a GraphQL WS client for Go services and integration
+// tests. It keeps a connection to a graphql-ws or graphql-transport-ws
+// endpoint open, reconnecting with exponential backoff whenever it drops,
+// and subscribes again to all active subscriptions once reconnected:
+//
+//	c := client.NewClient(client.Config{URL: "wss://example.com/subscriptions"})
+//	defer c.Close()
+//
+//	results, err := c.Subscribe(ctx, "subscription { ticks }", nil)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	for result := range results {
+//		log.Printf("%s", result.Data)
+//	}
+//
+// Execute runs operations with callbacks instead of channels, and
+// Config.OnStatus reports changes of the connection's status. Operations
+// are resumed by the server instead if it has sessions enabled; see
+// graphqlws.SessionConfig.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/meandrewdev/graphqlws"
+)
+
+const (
+	// Default bounds of the backoff between connection attempts
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+
+	// Default time the server may take to acknowledge a connection
+	defaultAckTimeout = 10 * time.Second
+
+	// Default number of results buffered for each subscription
+	defaultResultBuffer = 16
+
+	// Timeout for messages and close frames written to the server
+	writeTimeout = 10 * time.Second
+)
+
+// ErrClosed is returned by Subscribe once the client has been closed.
+var ErrClosed = errors.New("client: client is closed")
+
+// Config configures a client.
+type Config struct {
+	// URL is the ws:// or wss:// URL of the endpoint.
+	URL string
+
+	// Header holds the HTTP headers of upgrade requests (optional), e.g.
+	// an Authorization header.
+	Header http.Header
+
+	// Subprotocol is the protocol to speak; defaults to
+	// graphqlws.SubprotocolGraphQLTransportWS.
+	Subprotocol string
+
+	// InitPayload is the payload of connection_init messages (optional),
+	// e.g. with an authToken.
+	InitPayload map[string]interface{}
+
+	// Dialer dials the endpoint; defaults to websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+
+	// MinBackoff and MaxBackoff bound the time waited between connection
+	// attempts, which doubles with each failed attempt, with a random
+	// jitter; they default to 100 milliseconds and 30 seconds.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// AckTimeout is the time the server may take to acknowledge a
+	// connection; defaults to 10 seconds.
+	AckTimeout time.Duration
+
+	// ReadTimeout is the time after which connections that haven't
+	// received anything, not even keep-alive messages or pings, are
+	// considered dead and reconnected (optional).
+	ReadTimeout time.Duration
+
+	// ResultBuffer is the number of results buffered for each
+	// subscription; defaults to 16. Reading from the connection pauses
+	// while a subscription's buffer is full.
+	ResultBuffer int
+
+	// OnStatus is called whenever the status of the connection changes
+	// (optional), with the error that made the client reconnect.
+	OnStatus func(status Status, err error)
+}
+
+// Status is the status of a client's connection.
+type Status int
+
+// Statuses of connections: connected once the server has acknowledged
+// a connection, reconnecting once it dropped or connecting failed, and
+// closed once the client has been closed.
+const (
+	StatusConnected Status = iota
+	StatusReconnecting
+	StatusClosed
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusConnected:
+		return "connected"
+	case StatusReconnecting:
+		return "reconnecting"
+	case StatusClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// Result is a result of an operation sent by the server.
+type Result struct {
+	Data       json.RawMessage            `json:"data"`
+	Errors     []gqlerrors.FormattedError `json:"errors"`
+	Extensions map[string]interface{}     `json:"extensions,omitempty"`
+}
+
+// Client is a GraphQL WS client, which runs any number of operations over
+// one connection. It is safe for concurrent use.
+type Client interface {
+	// Subscribe starts a subscription and returns the channel its results
+	// are delivered on. The channel is closed once the server completes
+	// the subscription, once it fails with an error, which is delivered
+	// as the last result, or once ctx is cancelled, which stops it.
+	Subscribe(ctx context.Context, query string, variables map[string]interface{}) (<-chan Result, error)
+
+	// Execute starts an operation and calls its handlers with its results
+	// until it ends; cancelling ctx stops it.
+	Execute(ctx context.Context, operation Operation, handlers OperationHandlers) error
+
+	// Close stops all operations and closes the connection.
+	Close() error
+}
+
+/**
+ * The default implementation of the Client interface.
+ */
+
+type client struct {
+	config    Config
+	messages  *messageTypes
+	logger    graphqlws.Logger
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce *sync.Once
+
+	// Done once the operations have ended
+	running *sync.WaitGroup
+
+	// The active operations, the ID of the last one, the current
+	// connection (or nil while disconnected) and the session token
+	// issued by the server, guarded by mutex
+	operations   map[string]*operation
+	lastID       uint64
+	conn         *websocket.Conn
+	sessionToken string
+	mutex        *sync.Mutex
+
+	// Held while writing to the connection
+	writeMutex *sync.Mutex
+}
+
+// NewClient creates a client that connects to the endpoint in the
+// background; subscriptions are started as soon as it's connected.
+func NewClient(config Config) Client {
+	if config.Subprotocol == "" {
+		config.Subprotocol = graphqlws.SubprotocolGraphQLTransportWS
+	}
+	if config.Dialer == nil {
+		config.Dialer = websocket.DefaultDialer
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = defaultMinBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = defaultMaxBackoff
+	}
+	if config.AckTimeout <= 0 {
+		config.AckTimeout = defaultAckTimeout
+	}
+	if config.ResultBuffer <= 0 {
+		config.ResultBuffer = defaultResultBuffer
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &client{
+		config:     config,
+		messages:   messageTypesFor(config.Subprotocol),
+		logger:     graphqlws.NewLogger("client"),
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		closeOnce:  &sync.Once{},
+		running:    &sync.WaitGroup{},
+		operations: make(map[string]*operation),
+		mutex:      &sync.Mutex{},
+		writeMutex: &sync.Mutex{},
+	}
+	go c.run()
+	return c
+}
+
+func (c *client) Subscribe(ctx context.Context, query string, variables map[string]interface{}) (<-chan Result, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	results := make(chan Result, c.config.ResultBuffer)
+	deliver := func(result Result) {
+		select {
+		case results <- result:
+		case <-ctx.Done():
+		}
+	}
+
+	err := c.start(ctx, cancel, Operation{Query: query, Variables: variables}, OperationHandlers{
+		OnData: deliver,
+		OnError: func(errs []gqlerrors.FormattedError) {
+			deliver(Result{Errors: errs})
+			close(results)
+		},
+		OnComplete: func() {
+			close(results)
+		},
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return results, nil
+}
+
+func (c *client) Execute(ctx context.Context, operation Operation, handlers OperationHandlers) error {
+	ctx, cancel := context.WithCancel(ctx)
+	if err := c.start(ctx, cancel, operation, handlers); err != nil {
+		cancel()
+		return err
+	}
+	return nil
+}
+
+// start registers an operation and starts it if the client is connected;
+// operations are started once connected otherwise.
+func (c *client) start(ctx context.Context, cancel context.CancelFunc, op Operation, handlers OperationHandlers) error {
+	payload, err := json.Marshal(graphqlws.StartMessagePayload{
+		Query:         op.Query,
+		Variables:     op.Variables,
+		OperationName: op.OperationName,
+	})
+	if err != nil {
+		return err
+	}
+
+	o := &operation{
+		payload:  payload,
+		handlers: handlers,
+		ctx:      ctx,
+		cancel:   cancel,
+		mutex:    &sync.Mutex{},
+	}
+
+	// The client is closed while holding the mutex, so that no operation
+	// is added once Close waits for them to end
+	c.mutex.Lock()
+	if c.ctx.Err() != nil {
+		c.mutex.Unlock()
+		return ErrClosed
+	}
+	c.running.Add(1)
+	c.lastID++
+	o.id = strconv.FormatUint(c.lastID, 10)
+	c.operations[o.id] = o
+	conn := c.conn
+	c.mutex.Unlock()
+
+	if conn != nil {
+		c.subscribe(conn, o)
+	}
+
+	go func() {
+		defer c.running.Done()
+		select {
+		case <-ctx.Done():
+		case <-c.ctx.Done():
+		}
+		c.stop(o)
+	}()
+	return nil
+}
+
+func (c *client) Close() error {
+	c.closeOnce.Do(func() {
+		c.mutex.Lock()
+		c.cancel()
+		conn := c.conn
+		c.mutex.Unlock()
+		if conn != nil {
+			// Closing normally tells the server not to keep the session
+			c.writeMutex.Lock()
+			conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(writeTimeout),
+			)
+			c.writeMutex.Unlock()
+			conn.Close()
+		}
+	})
+	<-c.done
+	c.running.Wait()
+	return nil
+}
+
+// run keeps the client connected until it's closed.
+func (c *client) run() {
+	defer close(c.done)
+	defer c.setStatus(StatusClosed, nil)
+
+	attempt := 0
+	for {
+		conn, resumed, err := c.connect()
+		if err == nil {
+			attempt = 0
+			err = c.serve(conn, resumed)
+		}
+		if c.ctx.Err() != nil {
+			return
+		}
+
+		c.logger.WithFields(graphqlws.Fields{
+			"err": err,
+		}).Warn("Connection failed, reconnecting")
+		c.setStatus(StatusReconnecting, err)
+
+		select {
+		case <-time.After(c.backoff(attempt)):
+		case <-c.ctx.Done():
+			return
+		}
+		attempt++
+	}
+}
+
+func (c *client) setStatus(status Status, err error) {
+	if c.config.OnStatus != nil {
+		c.config.OnStatus(status, err)
+	}
+}
+
+// backoff returns the time to wait before the next connection attempt,
+// with a jitter of up to 50%.
+func (c *client) backoff(attempt int) time.Duration {
+	backoff := c.config.MinBackoff
+	for i := 0; i < attempt && backoff < c.config.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > c.config.MaxBackoff {
+		backoff = c.config.MaxBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// connect dials the endpoint and initializes the connection. It returns
+// the IDs of the operations the server resumed.
+func (c *client) connect() (*websocket.Conn, map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, c.config.AckTimeout)
+	defer cancel()
+
+	dialer := *c.config.Dialer
+	dialer.Subprotocols = []string{c.config.Subprotocol}
+	conn, _, err := dialer.DialContext(ctx, c.config.URL, c.config.Header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Give up waiting for the ack once the client is closed
+	connected := make(chan struct{})
+	defer close(connected)
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			conn.Close()
+		case <-connected:
+		}
+	}()
+
+	payload := make(map[string]interface{}, len(c.config.InitPayload)+1)
+	for key, value := range c.config.InitPayload {
+		payload[key] = value
+	}
+	c.mutex.Lock()
+	if c.sessionToken != "" {
+		payload["sessionToken"] = c.sessionToken
+	}
+	c.mutex.Unlock()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetWriteDeadline(deadline)
+	conn.SetReadDeadline(deadline)
+	if err := conn.WriteJSON(message{Type: "connection_init", Payload: data}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	for {
+		msg := message{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+
+		switch msg.Type {
+		case "connection_ack":
+			c.extendReadDeadline(conn)
+			return conn, c.acknowledged(msg.Payload), nil
+		case "connection_error":
+			conn.Close()
+			return nil, nil, errors.New("client: connection rejected: " + string(msg.Payload))
+		}
+	}
+}
+
+// acknowledged records the session token of an ack payload and returns
+// the IDs of the operations the server resumed.
+func (c *client) acknowledged(payload json.RawMessage) map[string]bool {
+	ack := struct {
+		SessionToken      string   `json:"sessionToken"`
+		ResumedOperations []string `json:"resumedOperations"`
+	}{}
+	json.Unmarshal(payload, &ack)
+
+	c.mutex.Lock()
+	c.sessionToken = ack.SessionToken
+	c.mutex.Unlock()
+
+	resumed := make(map[string]bool, len(ack.ResumedOperations))
+	for _, id := range ack.ResumedOperations {
+		resumed[id] = true
+	}
+	return resumed
+}
+
+// serve starts the active operations the server didn't resume and reads
+// from the connection until it drops.
+func (c *client) serve(conn *websocket.Conn, resumed map[string]bool) error {
+	defer conn.Close()
+
+	c.mutex.Lock()
+	c.conn = conn
+	operations := make([]*operation, 0, len(c.operations))
+	for id, o := range c.operations {
+		if !resumed[id] {
+			operations = append(operations, o)
+		}
+	}
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		c.conn = nil
+		c.mutex.Unlock()
+	}()
+
+	// Close was called while connecting
+	if c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
+
+	c.logger.WithFields(graphqlws.Fields{
+		"resumed": len(resumed),
+	}).Debug("Connected")
+	c.setStatus(StatusConnected, nil)
+
+	for _, o := range operations {
+		c.subscribe(conn, o)
+	}
+
+	// Pings are answered as usual and count as activity
+	conn.SetPingHandler(func(data string) error {
+		c.extendReadDeadline(conn)
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeTimeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+
+	for {
+		msg := message{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		c.extendReadDeadline(conn)
+		c.handleMessage(conn, msg)
+	}
+}
+
+// extendReadDeadline extends the time by which the connection has to
+// receive something, if ReadTimeout is set.
+func (c *client) extendReadDeadline(conn *websocket.Conn) {
+	if c.config.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
+	} else {
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// handleMessage handles a message received from the server.
+func (c *client) handleMessage(conn *websocket.Conn, msg message) {
+	switch msg.Type {
+	case c.messages.data:
+		if o := c.operation(msg.ID); o != nil {
+			result := Result{}
+			if err := json.Unmarshal(msg.Payload, &result); err != nil {
+				c.logger.WithFields(graphqlws.Fields{
+					"id":  msg.ID,
+					"err": err,
+				}).Warn("Invalid data message")
+				return
+			}
+			o.data(result)
+		}
+
+	case "error":
+		if o := c.removeOperation(msg.ID); o != nil {
+			o.fail(decodeErrors(msg.Payload))
+		}
+
+	case "complete":
+		if o := c.removeOperation(msg.ID); o != nil {
+			o.complete()
+		}
+
+	case "ping":
+		c.write(conn, message{Type: "pong"})
+	}
+}
+
+// decodeErrors decodes the payload of an error message, which is a list
+// of errors in the graphql-transport-ws protocol and may be a single error
+// in the graphql-ws protocol.
+func decodeErrors(payload json.RawMessage) []gqlerrors.FormattedError {
+	errs := []gqlerrors.FormattedError{}
+	if err := json.Unmarshal(payload, &errs); err == nil {
+		return errs
+	}
+	single := gqlerrors.FormattedError{}
+	if err := json.Unmarshal(payload, &single); err != nil {
+		single.Message = string(payload)
+	}
+	return []gqlerrors.FormattedError{single}
+}
+
+func (c *client) operation(id string) *operation {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.operations[id]
+}
+
+func (c *client) removeOperation(id string) *operation {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	o := c.operations[id]
+	delete(c.operations, id)
+	return o
+}
+
+// subscribe sends the start message of an operation.
+func (c *client) subscribe(conn *websocket.Conn, o *operation) {
+	c.write(conn, message{
+		ID:      o.id,
+		Type:    c.messages.subscribe,
+		Payload: o.payload,
+	})
+}
+
+// stop stops an operation whose context is done, telling the server if
+// the operation is still active.
+func (c *client) stop(o *operation) {
+	o.cancel()
+
+	c.mutex.Lock()
+	active := c.operations[o.id] == o
+	delete(c.operations, o.id)
+	conn := c.conn
+	c.mutex.Unlock()
+
+	if active && conn != nil && c.ctx.Err() == nil {
+		c.write(conn, message{ID: o.id, Type: c.messages.unsubscribe})
+	}
+	o.complete()
+}
+
+// write writes a message to the connection; failures surface as read
+// errors, which make the client reconnect.
+func (c *client) write(conn *websocket.Conn, msg message) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := conn.WriteJSON(msg); err != nil {
+		c.logger.WithFields(graphqlws.Fields{
+			"type": msg.Type,
+			"err":  err,
+		}).Debug("Writing message failed")
+		conn.Close()
+	}
+}
+
+/**
+ * Messages of the supported protocols.
+ */
+
+type message struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// messageTypes are the types of the messages that differ between the
+// graphql-ws and graphql-transport-ws protocols.
+type messageTypes struct {
+	subscribe   string
+	unsubscribe string
+	data        string
+}
+
+func messageTypesFor(subprotocol string) *messageTypes {
+	if subprotocol == graphqlws.SubprotocolGraphQLWS {
+		return &messageTypes{subscribe: "start", unsubscribe: "stop", data: "data"}
+	}
+	return &messageTypes{subscribe: "subscribe", unsubscribe: "complete", data: "next"}
+}
@@ -0,0 +1,311 @@
+package client_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/client"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	m.Run()
+}
+
+func buildSchema(t *testing.T) *graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"hello": &graphql.Field{Type: graphql.String},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"ticks": &graphql.Field{Type: graphql.Int},
+			},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("could not build schema: %v", err)
+	}
+	return &schema
+}
+
+type server struct {
+	*httptest.Server
+	subscriptions chan *graphqlws.Subscription
+	stopped       chan string
+}
+
+func startServer(t *testing.T, sessions *graphqlws.SessionConfig) *server {
+	srv := &server{
+		subscriptions: make(chan *graphqlws.Subscription, 4),
+		stopped:       make(chan string, 4),
+	}
+	srv.Server = httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildSchema(t)),
+		Sessions:            sessions,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				if len(errs) == 0 {
+					srv.subscriptions <- s
+				}
+			},
+			StopSubscription: func(opID string) {
+				srv.stopped <- opID
+			},
+		},
+	}))
+	return srv
+}
+
+func (srv *server) url() string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func (srv *server) subscription(t *testing.T) *graphqlws.Subscription {
+	select {
+	case s := <-srv.subscriptions:
+		return s
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription was not started")
+		return nil
+	}
+}
+
+func receive(t *testing.T, results <-chan client.Result) client.Result {
+	select {
+	case result, ok := <-results:
+		if !ok {
+			t.Fatal("results channel was closed")
+		}
+		return result
+	case <-time.After(2 * time.Second):
+		t.Fatal("no result received")
+		return client.Result{}
+	}
+}
+
+func TestClient_SubscriptionsReceiveResults(t *testing.T) {
+	for _, subprotocol := range []string{graphqlws.SubprotocolGraphQLWS, graphqlws.SubprotocolGraphQLTransportWS} {
+		t.Run(subprotocol, func(t *testing.T) {
+			srv := startServer(t, nil)
+			defer srv.Close()
+
+			c := client.NewClient(client.Config{URL: srv.url(), Subprotocol: subprotocol})
+			defer c.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			results, err := c.Subscribe(ctx, "subscription { ticks }", nil)
+			if err != nil {
+				t.Fatalf("Subscribe fails: %v", err)
+			}
+			s := srv.subscription(t)
+
+			s.SendData(&graphqlws.DataMessagePayload{Data: map[string]interface{}{"ticks": 1}})
+			if result := receive(t, results); string(result.Data) != `{"ticks":1}` {
+				t.Errorf("unexpected result: %s", result.Data)
+			}
+
+			// Cancelling the context stops the subscription
+			cancel()
+			select {
+			case opID := <-srv.stopped:
+				if opID != s.ID {
+					t.Errorf("unexpected subscription stopped: %s", opID)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("subscription was not stopped")
+			}
+			if _, ok := <-results; ok {
+				t.Error("results channel of stopped subscription is open")
+			}
+		})
+	}
+}
+
+func TestClient_SubscriptionsCompletedByTheServerAreClosed(t *testing.T) {
+	srv := startServer(t, nil)
+	defer srv.Close()
+
+	c := client.NewClient(client.Config{URL: srv.url()})
+	defer c.Close()
+
+	results, _ := c.Subscribe(context.Background(), "subscription { ticks }", nil)
+	s := srv.subscription(t)
+
+	s.Connection.TrySendComplete(s.ID)
+	select {
+	case _, ok := <-results:
+		if ok {
+			t.Error("unexpected result")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("results channel of completed subscription is open")
+	}
+}
+
+func TestClient_ClientsReconnectAndSubscribeAgain(t *testing.T) {
+	srv := startServer(t, nil)
+	defer srv.Close()
+
+	statuses := make(chan client.Status, 8)
+	c := client.NewClient(client.Config{
+		URL:        srv.url(),
+		MinBackoff: 10 * time.Millisecond,
+		OnStatus: func(status client.Status, err error) {
+			statuses <- status
+		},
+	})
+
+	results, _ := c.Subscribe(context.Background(), "subscription { ticks }", nil)
+	first := srv.subscription(t)
+
+	first.Connection.Close(websocket.CloseTryAgainLater, "Try again later")
+	second := srv.subscription(t)
+	if second.ID != first.ID || second.Connection == first.Connection {
+		t.Errorf("subscription was not started again on a new connection")
+	}
+
+	second.SendData(&graphqlws.DataMessagePayload{Data: map[string]interface{}{"ticks": 2}})
+	if result := receive(t, results); string(result.Data) != `{"ticks":2}` {
+		t.Errorf("unexpected result: %s", result.Data)
+	}
+
+	c.Close()
+	close(statuses)
+	expected := []client.Status{
+		client.StatusConnected,
+		client.StatusReconnecting,
+		client.StatusConnected,
+		client.StatusClosed,
+	}
+	i := 0
+	for status := range statuses {
+		if i >= len(expected) || status != expected[i] {
+			t.Fatalf("unexpected status %d: %s", i, status)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("expected %d statuses, got %d", len(expected), i)
+	}
+}
+
+func TestClient_OperationsShareTheConnection(t *testing.T) {
+	srv := startServer(t, nil)
+	defer srv.Close()
+
+	c := client.NewClient(client.Config{URL: srv.url()})
+	defer c.Close()
+
+	data := make(chan string, 4)
+	failed := make(chan []gqlerrors.FormattedError, 1)
+	completed := make(chan string, 2)
+	execute := func(ctx context.Context, name string, query string) {
+		err := c.Execute(ctx, client.Operation{Query: query}, client.OperationHandlers{
+			OnData: func(result client.Result) {
+				data <- name + " " + string(result.Data)
+			},
+			OnError: func(errs []gqlerrors.FormattedError) {
+				failed <- errs
+			},
+			OnComplete: func() {
+				completed <- name
+			},
+		})
+		if err != nil {
+			t.Fatalf("Execute fails: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	execute(ctx, "first", "subscription { ticks }")
+	execute(context.Background(), "second", "subscription { ticks }")
+	execute(context.Background(), "invalid", "subscription { unknown }")
+
+	first, second := srv.subscription(t), srv.subscription(t)
+	if first.Connection != second.Connection {
+		t.Error("operations don't share the connection")
+	}
+	if first.ID > second.ID {
+		first, second = second, first
+	}
+	first.SendData(&graphqlws.DataMessagePayload{Data: 1})
+	second.SendData(&graphqlws.DataMessagePayload{Data: 2})
+	for _, expected := range []string{"first 1", "second 2"} {
+		select {
+		case received := <-data:
+			if received != expected {
+				t.Errorf("expected %q, received %q", expected, received)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no data received")
+		}
+	}
+
+	select {
+	case errs := <-failed:
+		if len(errs) == 0 {
+			t.Error("invalid operation failed without errors")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("invalid operation didn't fail")
+	}
+
+	// Cancelling the context completes only that operation
+	cancel()
+	select {
+	case name := <-completed:
+		if name != "first" {
+			t.Errorf("unexpected operation completed: %s", name)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("cancelled operation was not completed")
+	}
+
+	c.Close()
+	if name := <-completed; name != "second" {
+		t.Errorf("unexpected operation completed: %s", name)
+	}
+}
+
+func TestClient_SessionsAreResumedInsteadOfSubscribingAgain(t *testing.T) {
+	srv := startServer(t, &graphqlws.SessionConfig{Store: graphqlws.NewMemorySessionStore()})
+	defer srv.Close()
+
+	c := client.NewClient(client.Config{URL: srv.url(), MinBackoff: 10 * time.Millisecond})
+	defer c.Close()
+
+	results, _ := c.Subscribe(context.Background(), "subscription { ticks }", nil)
+	first := srv.subscription(t)
+
+	first.Connection.Close(websocket.CloseTryAgainLater, "Try again later")
+	resumed := srv.subscription(t)
+	if resumed.ID != first.ID {
+		t.Errorf("unexpected resumed subscription: %s", resumed.ID)
+	}
+
+	// Subscribing again would start the subscription twice
+	select {
+	case s := <-srv.subscriptions:
+		t.Fatalf("resumed subscription %s was started again", s.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	resumed.SendData(&graphqlws.DataMessagePayload{Data: map[string]interface{}{"ticks": 3}})
+	if result := receive(t, results); string(result.Data) != `{"ticks":3}` {
+		t.Errorf("unexpected result: %s", result.Data)
+	}
+}
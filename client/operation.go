@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// Operation is a GraphQL operation run by a client, typically a
+// subscription.
+type Operation struct {
+	Query         string
+	Variables     map[string]interface{}
+	OperationName string
+}
+
+// OperationHandlers are the callbacks of an operation (all optional).
+// The handlers of all operations of a client are called one at a time,
+// from the goroutine reading from the connection, so handlers that block
+// hold up the other operations.
+type OperationHandlers struct {
+	// OnData is called with each result sent by the server.
+	OnData func(Result)
+
+	// OnError is called once the operation has failed with errors, which
+	// ends it.
+	OnError func([]gqlerrors.FormattedError)
+
+	// OnComplete is called once the operation has ended otherwise: the
+	// server completed it, its context has been cancelled or the client
+	// has been closed.
+	OnComplete func()
+}
+
+/**
+ * Operations and their handlers.
+ */
+
+type operation struct {
+	id       string
+	payload  json.RawMessage
+	handlers OperationHandlers
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	// Held while calling handlers; ended is set once OnError or
+	// OnComplete has been called
+	ended bool
+	mutex *sync.Mutex
+}
+
+// data calls OnData unless the operation has ended.
+func (o *operation) data(result Result) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if !o.ended && o.handlers.OnData != nil {
+		o.handlers.OnData(result)
+	}
+}
+
+// fail ends the operation with OnError.
+func (o *operation) fail(errs []gqlerrors.FormattedError) {
+	o.end(func() {
+		if o.handlers.OnError != nil {
+			o.handlers.OnError(errs)
+		}
+	})
+}
+
+// complete ends the operation with OnComplete.
+func (o *operation) complete() {
+	o.end(func() {
+		if o.handlers.OnComplete != nil {
+			o.handlers.OnComplete()
+		}
+	})
+}
+
+// end calls handler unless the operation has ended already, and then
+// cancels the operation's context.
+func (o *operation) end(handler func()) {
+	o.mutex.Lock()
+	if !o.ended {
+		o.ended = true
+		handler()
+	}
+	o.mutex.Unlock()
+	o.cancel()
+}
@@ -0,0 +1,186 @@
+package graphqlws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// ClusterConfig enables routing messages to the connections of users and
+// to connections held by other instances of a cluster; see
+// Handler.RouteToUser and Handler.RouteToConnection.
+type ClusterConfig struct {
+	// Registry is shared by all instances, e.g. the one of the redis
+	// package.
+	Registry ClusterRegistry
+
+	// Node identifies the instance in the cluster; defaults to a random
+	// UUID.
+	Node string
+
+	// UserID returns the ID of a user of an initialized connection, which
+	// identifies the user across instances; defaults to fmt.Sprint.
+	UserID func(user interface{}) string
+}
+
+// ClusterConnection is a connection registered with a cluster registry.
+type ClusterConnection struct {
+	Node string `json:"node"`
+	ID   string `json:"id"`
+	User string `json:"user,omitempty"`
+}
+
+// RoutedMessage is a data message for the subscriptions of connections
+// held by any instance of a cluster. Messages are routed to the
+// connections of User or to those listed in ConnectionIDs; the
+// registry delivers them to each instance holding one of them with
+// ConnectionIDs set to its own.
+type RoutedMessage struct {
+	User          string
+	ConnectionIDs []string
+	Payload       *DataMessagePayload
+}
+
+// ClusterRegistry maps users and connections to the instances holding
+// them and routes messages between instances. Implementations are safe
+// for concurrent use.
+type ClusterRegistry interface {
+	// Register records that an instance holds a connection.
+	Register(ctx context.Context, conn ClusterConnection) error
+
+	// Unregister removes a connection from the registry.
+	Unregister(ctx context.Context, conn ClusterConnection) error
+
+	// Route sends a message to the instances holding its connections.
+	Route(ctx context.Context, msg RoutedMessage) error
+
+	// Receive calls deliver for the messages routed to an instance. It is
+	// called once by each handler.
+	Receive(node string, deliver func(RoutedMessage))
+}
+
+/**
+ * The membership of a handler in a cluster.
+ */
+
+type clusterNode struct {
+	registry      ClusterRegistry
+	node          string
+	userID        func(user interface{}) string
+	connections   ConnectionRegistry
+	subscriptions SubscriptionManager
+	logger        Logger
+}
+
+// newClusterNode joins a cluster, if one is configured, delivering the
+// messages routed to the node to local connections.
+func newClusterNode(
+	config *ClusterConfig,
+	connections ConnectionRegistry,
+	subscriptions SubscriptionManager,
+	logger Logger,
+) *clusterNode {
+	if config == nil || config.Registry == nil {
+		return nil
+	}
+	c := &clusterNode{
+		registry:      config.Registry,
+		node:          config.Node,
+		userID:        config.UserID,
+		connections:   connections,
+		subscriptions: subscriptions,
+		logger:        logger,
+	}
+	if c.node == "" {
+		c.node = uuid.New().String()
+	}
+	if c.userID == nil {
+		c.userID = func(user interface{}) string {
+			return fmt.Sprint(user)
+		}
+	}
+	c.registry.Receive(c.node, c.deliver)
+	return c
+}
+
+// member returns how a connection is registered with the cluster.
+func (c *clusterNode) member(conn Connection) ClusterConnection {
+	member := ClusterConnection{Node: c.node, ID: conn.ID()}
+	if user := conn.User(); user != nil {
+		member.User = c.userID(user)
+	}
+	return member
+}
+
+func (c *clusterNode) register(conn Connection) {
+	if c == nil {
+		return
+	}
+	if err := c.registry.Register(context.Background(), c.member(conn)); err != nil {
+		c.logger.WithFields(Fields{
+			"conn": conn.ID(),
+			"err":  err,
+		}).Warn("Failed to register connection with cluster")
+	}
+}
+
+func (c *clusterNode) unregister(conn Connection) {
+	if c == nil {
+		return
+	}
+	if err := c.registry.Unregister(context.Background(), c.member(conn)); err != nil {
+		c.logger.WithFields(Fields{
+			"conn": conn.ID(),
+			"err":  err,
+		}).Warn("Failed to unregister connection from cluster")
+	}
+}
+
+// deliver sends a routed message to the subscriptions of its local
+// connections.
+func (c *clusterNode) deliver(msg RoutedMessage) {
+	subscriptions := c.subscriptions.Subscriptions()
+	sent := 0
+	for _, id := range msg.ConnectionIDs {
+		conn, ok := c.connections.Get(id)
+		if !ok {
+			continue
+		}
+		for _, subscription := range subscriptions[conn] {
+			subscription.SendData(msg.Payload)
+			sent++
+		}
+	}
+
+	c.logger.WithFields(Fields{
+		"connections":   len(msg.ConnectionIDs),
+		"subscriptions": sent,
+	}).Debug("Deliver routed message")
+}
+
+// ErrNoCluster is returned by the routing methods of handlers without a
+// cluster.
+var ErrNoCluster = errors.New("graphqlws: handler has no cluster")
+
+// RouteToUser sends a data message to the subscriptions of all
+// connections of a user, on whichever instances of the cluster they are
+// held; user is an ID as returned by ClusterConfig.UserID. It requires
+// HandlerConfig.Cluster and fails if the message couldn't be routed.
+func (h *Handler) RouteToUser(ctx context.Context, user string, payload *DataMessagePayload) error {
+	if h.cluster == nil {
+		return ErrNoCluster
+	}
+	return h.cluster.registry.Route(ctx, RoutedMessage{User: user, Payload: payload})
+}
+
+// RouteToConnection sends a data message to the subscriptions of a
+// connection, on whichever instance of the cluster it is held; see
+// RouteToUser.
+func (h *Handler) RouteToConnection(ctx context.Context, connID string, payload *DataMessagePayload) error {
+	if h.cluster == nil {
+		return ErrNoCluster
+	}
+	return h.cluster.registry.Route(ctx, RoutedMessage{ConnectionIDs: []string{connID}, Payload: payload})
+}
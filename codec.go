@@ -0,0 +1,102 @@
+package graphqlws
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Codec encodes the messages sent to clients and decodes the messages
+// received from them. Its methods have the signatures of json.Marshal and
+// json.Unmarshal, so that drop-in replacements for encoding/json such as
+// jsoniter or sonic can be used as they are, e.g.:
+//
+//	Codec: jsoniter.ConfigCompatibleWithStandardLibrary
+//
+// Codecs must be safe for concurrent use. Payloads of incoming messages
+// are first decoded into json.RawMessage values, which codecs fill with
+// the payloads in their own encoding, and then decoded further.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is the default codec, which uses encoding/json.
+var JSONCodec Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) MarshalTo(buf *bytes.Buffer, v interface{}) error {
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	// Drop the newline the encoder terminates values with
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
+
+// BufferCodec is implemented by codecs that can encode values into a
+// buffer, which connections take from their BufferPool instead of having
+// Marshal allocate the encoding of every message.
+type BufferCodec interface {
+	Codec
+
+	// MarshalTo appends the encoding of v to buf; buf is left as it was
+	// if encoding fails.
+	MarshalTo(buf *bytes.Buffer, v interface{}) error
+}
+
+// BinaryCodec is implemented by codecs whose messages are written in
+// binary rather than text frames, e.g. MessagePack codecs.
+type BinaryCodec interface {
+	Codec
+	Binary() bool
+}
+
+// frameTypeFor returns the type of the WebSocket frames the messages of a
+// codec are written in.
+func frameTypeFor(codec Codec) int {
+	if binary, ok := codec.(BinaryCodec); ok && binary.Binary() {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// codecSubprotocols returns the subprotocols clients may negotiate to use
+// one of a handler's codecs, e.g. "graphql-ws+msgpack", followed by the
+// subprotocols themselves, so that codecs are preferred.
+func codecSubprotocols(subprotocols []string, codecs map[string]Codec) []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make([]string, 0, len(subprotocols)*(len(names)+1))
+	for _, name := range names {
+		for _, subprotocol := range subprotocols {
+			out = append(out, subprotocol+"+"+name)
+		}
+	}
+	return append(out, subprotocols...)
+}
+
+// splitSubprotocol splits a negotiated subprotocol into the subprotocol
+// proper and the name of the codec it asks for, if any.
+func splitSubprotocol(subprotocol string) (string, string) {
+	if i := strings.LastIndex(subprotocol, "+"); i >= 0 {
+		return subprotocol[:i], subprotocol[i+1:]
+	}
+	return subprotocol, ""
+}
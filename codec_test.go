@@ -0,0 +1,91 @@
+package graphqlws_test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/meandrewdev/graphqlws"
+)
+
+// countingCodec counts the messages encoded and decoded with encoding/json.
+type countingCodec struct {
+	marshals   int32
+	unmarshals int32
+}
+
+func (c *countingCodec) Marshal(v interface{}) ([]byte, error) {
+	atomic.AddInt32(&c.marshals, 1)
+	return json.Marshal(v)
+}
+
+func (c *countingCodec) Unmarshal(data []byte, v interface{}) error {
+	atomic.AddInt32(&c.unmarshals, 1)
+	return json.Unmarshal(data, v)
+}
+
+func TestHandler_CodecsEncodeAndDecodeMessages(t *testing.T) {
+	schema, _ := buildSchema()
+	codec := &countingCodec{}
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Codec:               codec,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	if msg := readOperationMessage(t, ws); msg.Type != "connection_ack" {
+		t.Fatalf("expected connection_ack, received: %v", msg)
+	}
+
+	if atomic.LoadInt32(&codec.marshals) == 0 {
+		t.Error("codec did not encode the messages sent to the client")
+	}
+	if atomic.LoadInt32(&codec.unmarshals) == 0 {
+		t.Error("codec did not decode the messages received from the client")
+	}
+}
+
+// binaryCodec is a JSON codec whose messages are written in binary frames.
+type binaryCodec struct {
+	countingCodec
+}
+
+func (c *binaryCodec) Binary() bool {
+	return true
+}
+
+func TestHandler_BinaryCodecsUseBinaryFrames(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Codecs:              map[string]graphqlws.Codec{"binary": &binaryCodec{}},
+	}))
+	defer srv.Close()
+
+	ws := dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLWS+"+binary")
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"connection_init"}`)); err != nil {
+		t.Fatalf("could not send message: %v", err)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	frameType, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("could not read message: %v", err)
+	}
+	if frameType != websocket.BinaryMessage {
+		t.Errorf("unexpected frame type: %d", frameType)
+	}
+	var msg graphqlws.OperationMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "connection_ack" {
+		t.Errorf("expected connection_ack, received: %s", data)
+	}
+}
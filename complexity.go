@@ -0,0 +1,190 @@
+package graphqlws
+
+import (
+	"math"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// Scores are capped so that documents spreading fragments many times
+// can't overflow them
+const maxComplexityScore = math.MaxInt32
+
+// ComplexityFunc returns the complexity score of a field in a query
+// document, given the combined score of the fields selected from it.
+type ComplexityFunc func(field *ast.Field, childComplexity int) int
+
+// defaultComplexity scores each field with one point.
+func defaultComplexity(field *ast.Field, childComplexity int) int {
+	return 1 + childComplexity
+}
+
+// operationDefinitionsWithName returns the operations of a document with
+// the given name, or all operations if the name is empty.
+func operationDefinitionsWithName(
+	doc *ast.Document,
+	name string,
+) []*ast.OperationDefinition {
+	defs := []*ast.OperationDefinition{}
+	for _, node := range doc.Definitions {
+		if def, ok := node.(*ast.OperationDefinition); ok {
+			if name == "" || (def.Name != nil && def.Name.Value == name) {
+				defs = append(defs, def)
+			}
+		}
+	}
+	return defs
+}
+
+// fragmentDefinitions returns the fragments of a document by name.
+func fragmentDefinitions(doc *ast.Document) map[string]*ast.FragmentDefinition {
+	fragments := map[string]*ast.FragmentDefinition{}
+	for _, node := range doc.Definitions {
+		if def, ok := node.(*ast.FragmentDefinition); ok && def.Name != nil {
+			fragments[def.Name.Value] = def
+		}
+	}
+	return fragments
+}
+
+// queryComplexity returns the highest complexity score among the
+// operations of a document with the given name.
+func queryComplexity(doc *ast.Document, operationName string, complexity ComplexityFunc) int {
+	if complexity == nil {
+		complexity = defaultComplexity
+	}
+
+	scorer := &complexityScorer{
+		fragments:  fragmentDefinitions(doc),
+		complexity: complexity,
+		scores:     map[string]int{},
+		visiting:   map[string]bool{},
+	}
+	max := 0
+	for _, def := range operationDefinitionsWithName(doc, operationName) {
+		score := scorer.selectionSet(def.SelectionSet)
+		if score > max {
+			max = score
+		}
+	}
+	return max
+}
+
+// complexityScorer scores the selection sets of a document. The score of
+// each fragment is computed once, so that fragments spread many times
+// don't have to be walked again for every spread.
+type complexityScorer struct {
+	fragments  map[string]*ast.FragmentDefinition
+	complexity ComplexityFunc
+	scores     map[string]int
+	visiting   map[string]bool
+}
+
+func (c *complexityScorer) selectionSet(set *ast.SelectionSet) int {
+	if set == nil {
+		return 0
+	}
+
+	score := 0
+	for _, selection := range set.Selections {
+		switch s := selection.(type) {
+		case *ast.Field:
+			score = addScores(score, c.complexity(s, c.selectionSet(s.SelectionSet)))
+		case *ast.InlineFragment:
+			score = addScores(score, c.selectionSet(s.SelectionSet))
+		case *ast.FragmentSpread:
+			score = addScores(score, c.fragment(s.Name.Value))
+		}
+	}
+	return score
+}
+
+func (c *complexityScorer) fragment(name string) int {
+	if score, ok := c.scores[name]; ok {
+		return score
+	}
+	// Skip fragments spread into themselves; such documents are rejected
+	// by validation anyway
+	fragment := c.fragments[name]
+	if fragment == nil || c.visiting[name] {
+		return 0
+	}
+	c.visiting[name] = true
+	score := c.selectionSet(fragment.SelectionSet)
+	delete(c.visiting, name)
+	c.scores[name] = score
+	return score
+}
+
+// addScores adds two complexity scores, capping the sum at
+// maxComplexityScore.
+func addScores(a int, b int) int {
+	if a > maxComplexityScore-b {
+		return maxComplexityScore
+	}
+	return a + b
+}
+
+// queryDepth returns the deepest nesting of fields among the operations
+// of a document with the given name; top-level fields have a depth of one.
+func queryDepth(doc *ast.Document, operationName string) int {
+	measurer := &depthMeasurer{
+		fragments: fragmentDefinitions(doc),
+		depths:    map[string]int{},
+		visiting:  map[string]bool{},
+	}
+	max := 0
+	for _, def := range operationDefinitionsWithName(doc, operationName) {
+		depth := measurer.selectionSet(def.SelectionSet)
+		if depth > max {
+			max = depth
+		}
+	}
+	return max
+}
+
+// depthMeasurer measures the depth of the selection sets of a document,
+// measuring each fragment once like complexityScorer.
+type depthMeasurer struct {
+	fragments map[string]*ast.FragmentDefinition
+	depths    map[string]int
+	visiting  map[string]bool
+}
+
+func (m *depthMeasurer) selectionSet(set *ast.SelectionSet) int {
+	if set == nil {
+		return 0
+	}
+
+	max := 0
+	for _, selection := range set.Selections {
+		depth := 0
+		switch s := selection.(type) {
+		case *ast.Field:
+			depth = 1 + m.selectionSet(s.SelectionSet)
+		case *ast.InlineFragment:
+			depth = m.selectionSet(s.SelectionSet)
+		case *ast.FragmentSpread:
+			depth = m.fragment(s.Name.Value)
+		}
+		if depth > max {
+			max = depth
+		}
+	}
+	return max
+}
+
+func (m *depthMeasurer) fragment(name string) int {
+	if depth, ok := m.depths[name]; ok {
+		return depth
+	}
+	fragment := m.fragments[name]
+	if fragment == nil || m.visiting[name] {
+		return 0
+	}
+	m.visiting[name] = true
+	depth := m.selectionSet(fragment.SelectionSet)
+	delete(m.visiting, name)
+	m.depths[name] = depth
+	return depth
+}
@@ -0,0 +1,174 @@
+package graphqlws
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConfigError is returned by HandlerConfig.Validate, listing all problems
+// found in a configuration.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "graphqlws: invalid handler config: " + strings.Join(e.Problems, "; ")
+}
+
+// NewValidatedHandler is like NewHandler, but returns the error of
+// validating the configuration instead of a handler that fails once it
+// serves connections.
+func NewValidatedHandler(config HandlerConfig) (*Handler, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return NewHandler(config), nil
+}
+
+// WithDefaults returns a copy of the configuration with the documented
+// defaults filled in for unset fields, as NewHandler applies them.
+// Keep-alive messages stay disabled unless KeepAliveInterval is set.
+func (config HandlerConfig) WithDefaults() HandlerConfig {
+	if len(config.Subprotocols) == 0 {
+		config.Subprotocols = []string{SubprotocolGraphQLTransportWS, SubprotocolGraphQLWS}
+	}
+	if config.PingInterval > 0 {
+		if config.PongWait == 0 {
+			config.PongWait = config.PingInterval
+		}
+		if config.MaxMissedPings == 0 {
+			config.MaxMissedPings = 1
+		}
+	}
+	if config.MaxMessageSize == 0 {
+		config.MaxMessageSize = readLimit
+	}
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = writeTimeout
+	}
+	if config.SendQueueSize == 0 {
+		config.SendQueueSize = sendQueueSize
+	}
+	if config.Codec == nil {
+		config.Codec = JSONCodec
+	}
+	if config.BufferPool == nil {
+		config.BufferPool = DefaultBufferPool
+	}
+	return config
+}
+
+// Validate checks the configuration for mistakes that would otherwise
+// only show at runtime: a missing subscription manager, negative limits
+// and timeouts, unknown subprotocols and options that have no effect
+// without others.
+func (config HandlerConfig) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if config.SubscriptionManager == nil {
+		problem("SubscriptionManager is required")
+	}
+	for _, subprotocol := range config.Subprotocols {
+		if subprotocol != SubprotocolGraphQLTransportWS && subprotocol != SubprotocolGraphQLWS {
+			problem("unknown subprotocol %q", subprotocol)
+		}
+	}
+	for name, codec := range config.Codecs {
+		if name == "" || codec == nil {
+			problem("codec %q is invalid", name)
+		}
+	}
+
+	for name, value := range map[string]time.Duration{
+		"ConnectionInitWaitTimeout": config.ConnectionInitWaitTimeout,
+		"KeepAliveInterval":         config.KeepAliveInterval,
+		"IdleTimeout":               config.IdleTimeout,
+		"MaxConnectionAge":          config.MaxConnectionAge,
+		"PingInterval":              config.PingInterval,
+		"PongWait":                  config.PongWait,
+		"HandshakeTimeout":          config.HandshakeTimeout,
+		"WriteTimeout":              config.WriteTimeout,
+		"SlowClientTimeout":         config.SlowClientTimeout,
+		"BatchDelay":                config.BatchDelay,
+		"DeduplicationWindow":       config.DeduplicationWindow,
+	} {
+		if value < 0 {
+			problem("%s must not be negative", name)
+		}
+	}
+	for name, value := range map[string]int64{
+		"MaxMissedPings":                int64(config.MaxMissedPings),
+		"ReadBufferSize":                int64(config.ReadBufferSize),
+		"WriteBufferSize":               int64(config.WriteBufferSize),
+		"CompressionThreshold":          int64(config.CompressionThreshold),
+		"MaxMessageSize":                config.MaxMessageSize,
+		"MaxSubscriptionsPerConnection": int64(config.MaxSubscriptionsPerConnection),
+		"SubscriptionRateBurst":         int64(config.SubscriptionRateBurst),
+		"MaxConnectionsPerUser":         int64(config.MaxConnectionsPerUser),
+		"MaxConnectionsPerIP":           int64(config.MaxConnectionsPerIP),
+		"MaxComplexity":                 int64(config.MaxComplexity),
+		"MaxQueryDepth":                 int64(config.MaxQueryDepth),
+		"MaxQueryLength":                int64(config.MaxQueryLength),
+		"MaxVariablesSize":              int64(config.MaxVariablesSize),
+		"MaxOperationNameLength":        int64(config.MaxOperationNameLength),
+		"SendQueueSize":                 int64(config.SendQueueSize),
+		"SlowClientBacklog":             int64(config.SlowClientBacklog),
+		"MaxBatchSize":                  int64(config.MaxBatchSize),
+	} {
+		if value < 0 {
+			problem("%s must not be negative", name)
+		}
+	}
+	if config.SubscriptionRateLimit < 0 {
+		problem("SubscriptionRateLimit must not be negative")
+	}
+	for messageType, limit := range config.MessageRateLimits {
+		if limit.Rate < 0 || limit.Burst < 0 {
+			problem("MessageRateLimits[%q] must not be negative", messageType)
+		}
+	}
+
+	if config.PongWait > 0 && config.PingInterval == 0 {
+		problem("PongWait requires PingInterval")
+	}
+	if config.MaxMissedPings > 0 && config.PingInterval == 0 {
+		problem("MaxMissedPings requires PingInterval")
+	}
+	if config.CloseOnSubscriptionLimit && config.MaxSubscriptionsPerConnection == 0 {
+		problem("CloseOnSubscriptionLimit requires MaxSubscriptionsPerConnection")
+	}
+	if (config.CloseOnSubscriptionRateLimit || config.SubscriptionRateBurst > 0) && config.SubscriptionRateLimit == 0 {
+		problem("CloseOnSubscriptionRateLimit and SubscriptionRateBurst require SubscriptionRateLimit")
+	}
+	if config.Complexity != nil && config.MaxComplexity == 0 {
+		problem("Complexity requires MaxComplexity")
+	}
+	if config.CompressionThreshold > 0 && !config.EnableCompression {
+		problem("CompressionThreshold requires EnableCompression")
+	}
+	if config.Transport != nil && (config.Upgrader != nil || config.ReadBufferSize != 0 ||
+		config.WriteBufferSize != 0 || config.HandshakeTimeout != 0 || config.EnableCompression) {
+		problem("Upgrader, buffer sizes, HandshakeTimeout and EnableCompression don't apply to a custom Transport")
+	}
+	if config.TrustedDocuments != nil && config.PersistedQueries != nil {
+		problem("PersistedQueries doesn't apply with TrustedDocuments")
+	}
+	if config.Sessions != nil && config.Sessions.Store == nil {
+		problem("Sessions requires a Store")
+	}
+	if config.Resume != nil && config.Resume.Store == nil {
+		problem("Resume requires a Store")
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	// Map iteration order is random
+	sort.Strings(problems)
+	return &ConfigError{Problems: problems}
+}
@@ -0,0 +1,53 @@
+package graphqlws_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+func TestHandlerConfig_InvalidConfigsAreRejected(t *testing.T) {
+	handler, err := graphqlws.NewValidatedHandler(graphqlws.HandlerConfig{
+		PongWait:      time.Second,
+		MaxQueryDepth: -1,
+	})
+	if handler != nil {
+		t.Error("expected no handler for invalid config")
+	}
+
+	var configErr *graphqlws.ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("expected config error, received: %v", err)
+	}
+	expected := []string{
+		"MaxQueryDepth must not be negative",
+		"PongWait requires PingInterval",
+		"SubscriptionManager is required",
+	}
+	if !reflect.DeepEqual(configErr.Problems, expected) {
+		t.Errorf("expected problems %q, received: %q", expected, configErr.Problems)
+	}
+
+	schema, _ := buildSchema()
+	if _, err := graphqlws.NewValidatedHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+	}); err != nil {
+		t.Errorf("unexpected error for valid config: %v", err)
+	}
+}
+
+func TestHandlerConfig_DefaultsAreFilledIn(t *testing.T) {
+	config := graphqlws.HandlerConfig{PingInterval: time.Second, SendQueueSize: 64}.WithDefaults()
+	if config.PongWait != time.Second || config.MaxMissedPings != 1 {
+		t.Errorf("unexpected ping defaults: %v, %d", config.PongWait, config.MaxMissedPings)
+	}
+	if config.SendQueueSize != 64 || config.WriteTimeout != 10*time.Second || config.MaxMessageSize != 4096 {
+		t.Errorf("unexpected defaults: %+v", config)
+	}
+	if config.KeepAliveInterval != 0 || config.Codec != graphqlws.JSONCodec {
+		t.Errorf("unexpected defaults: %+v", config)
+	}
+}
@@ -1,15 +1,21 @@
 package graphqlws
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -24,18 +30,57 @@ const (
 	gqlError               = "error"
 	gqlComplete            = "complete"
 	gqlStop                = "stop"
+	gqlPing                = "ping"
+	gqlPong                = "pong"
 
-	// Maximum size of incoming messages
+	// Extension message types for refreshing the authentication of
+	// an initialized connection
+	gqlConnectionRefresh    = "connection_refresh"
+	gqlConnectionRefreshAck = "connection_refresh_ack"
+
+	// Extension message type for acknowledging data messages
+	gqlAck = "ack"
+
+	// Default maximum size of incoming messages
 	readLimit = 4096
 
-	// Timeout for outgoing messages
+	// Default timeout for outgoing messages
 	writeTimeout = 10 * time.Second
+
+	// Timeout for close frames sent to clients that don't keep up with
+	// the messages sent to them
+	evictTimeout = 100 * time.Millisecond
+
+	// Number of operation messages that may wait for a worker before
+	// reading from the client pauses
+	operationQueueSize = 16
+)
+
+// Errors returned by Connection.Err, which tell why a connection has
+// been closed; failed reads are returned as they are.
+var (
+	// ErrClosedByClient is returned once the client has terminated the
+	// connection or closed it with a normal close code.
+	ErrClosedByClient = errors.New("graphqlws: connection closed by client")
+
+	// ErrClosedByServer is returned once the connection has been closed
+	// by the server, e.g. because of a limit or a shutdown.
+	ErrClosedByServer = errors.New("graphqlws: connection closed by server")
+
+	// ErrHeartbeatTimeout is returned once the client has missed more
+	// than MaxMissedPings pings, which usually means that its network
+	// connection has died.
+	ErrHeartbeatTimeout = errors.New("graphqlws: connection timed out")
 )
 
 // InitMessagePayload defines the parameters of a connection
 // init message.
 type InitMessagePayload struct {
 	AuthToken string `json:"authToken"`
+
+	// SessionToken is an optional token the server issued to a previous
+	// connection to resume its operations; see SessionConfig.
+	SessionToken string `json:"sessionToken,omitempty"`
 }
 
 // StartMessagePayload defines the parameters of an operation that
@@ -44,12 +89,37 @@ type StartMessagePayload struct {
 	Query         string                 `json:"query"`
 	Variables     map[string]interface{} `json:"variables"`
 	OperationName string                 `json:"operationName"`
+
+	// DocumentID refers to a trusted document instead of sending the
+	// query (optional); see HandlerConfig.TrustedDocuments.
+	DocumentID string `json:"documentId,omitempty"`
+
+	// ResumeToken is an optional token previously issued by the
+	// server to resume the operation from a known stream position.
+	ResumeToken string `json:"resumeToken,omitempty"`
+
+	// Extensions holds protocol extensions of the operation, e.g.
+	// automatic persisted queries.
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
 }
 
 // DataMessagePayload defines the result data of an operation.
 type DataMessagePayload struct {
-	Data   interface{} `json:"data"`
-	Errors []error     `json:"errors"`
+	Data       interface{}            `json:"data"`
+	Errors     []error                `json:"errors"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+
+	// HasNext and Incremental are set on the payloads of results delivered
+	// incrementally with @defer and @stream: HasNext is true on every
+	// payload but the last, and Incremental holds the partial results of
+	// subsequent payloads, which have no data. See NewInitialPayload and
+	// NewSubsequentPayload.
+	HasNext     *bool                `json:"hasNext,omitempty"`
+	Incremental []IncrementalPayload `json:"incremental,omitempty"`
+
+	// MessageID identifies the message for deduplication (optional); it
+	// isn't sent to the client. See ConnectionConfig.DeduplicationWindow.
+	MessageID string `json:"-"`
 }
 
 // OperationMessage represents a GraphQL WebSocket message.
@@ -71,15 +141,79 @@ func (msg OperationMessage) String() string {
 // into a user (or returns an error if that isn't possible).
 type AuthenticateFunc func(token string) (interface{}, error)
 
+// ConnectionAuthenticateFunc is a function that resolves an auth token
+// into a user with access to the connection being authenticated, e.g. to
+// store additional state on it.
+type ConnectionAuthenticateFunc func(conn Connection, token string) (interface{}, error)
+
+// RefreshAuthFunc is a function that resolves a new auth token presented
+// over an initialized connection into a user, e.g. to replace an expiring
+// JWT without reconnecting. The connection still holds the current user,
+// so implementations can check that the token belongs to the same user.
+type RefreshAuthFunc func(conn Connection, token string) (interface{}, error)
+
+// AckPayloadFunc is a function that returns the payload of the
+// connection_ack sent to an authenticated client, given the payload of
+// its connection_init, e.g. server capabilities, a session ID or the
+// keep-alive interval for client libraries to configure themselves with.
+type AckPayloadFunc func(conn Connection, initPayload map[string]interface{}) map[string]interface{}
+
+// ValidateStartFunc is a function that checks the payload of a start
+// message before the operation is started, returning the errors to send
+// to the client if it may not be started.
+type ValidateStartFunc func(conn Connection, payload *StartMessagePayload) []error
+
+// TransformDataFunc is a function that transforms the result data of an
+// operation before it is sent to the client, e.g. to redact fields, add
+// extensions or localize content for the connection's user.
+type TransformDataFunc func(conn Connection, opID string, payload *DataMessagePayload) *DataMessagePayload
+
+// Operations that connection errors occur in.
+const (
+	ErrorOpRead   = "read"
+	ErrorOpDecode = "decode"
+	ErrorOpEncode = "encode"
+	ErrorOpWrite  = "write"
+)
+
+// ConnectionError is an error of a connection or, if OperationID is set,
+// of the message of one of its operations.
+type ConnectionError struct {
+	Connection  Connection
+	OperationID string
+
+	// Op is the operation that failed: reading or decoding a message
+	// received from the client, or encoding or writing a message sent.
+	Op string
+
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
 // ConnectionEventHandlers define the event handlers for a connection.
 // Event handlers allow other system components to react to events such
 // as the connection closing or an operation being started or stopped.
 type ConnectionEventHandlers struct {
+	// Open is called when the connection has been established, before
+	// any messages are exchanged with the client.
+	Open func(Connection)
+
 	// Close is called whenever the connection is closed, regardless of
 	// whether this happens because of an error or a deliberate termination
 	// by the client.
 	Close func(Connection)
 
+	// Init is called whenever the client has successfully initialized
+	// the connection, with the payload of its connection_init message.
+	Init func(Connection, map[string]interface{})
+
 	// StartOperation is called whenever the client demands that a GraphQL
 	// operation be started (typically a subscription). Event handlers
 	// are expected to take the necessary steps to register the operation
@@ -91,6 +225,23 @@ type ConnectionEventHandlers struct {
 	// are expected to unregister the operation and stop sending result
 	// data to the client.
 	StopOperation func(Connection, string)
+
+	// SendFailed is called whenever a message can't be encoded or written
+	// to the client. It is called from the write loop, so messages sent
+	// from it may wait for a full send queue under OverflowBlock that only
+	// the write loop can empty; it should send them from a goroutine.
+	SendFailed func(Connection, error)
+
+	// SlowClient is called before the connection of a slow client is
+	// closed; see ConnectionConfig.SlowClientBacklog. The connection's
+	// statistics still include its send backlog.
+	SlowClient func(Connection)
+
+	// Error is called whenever the connection fails to read, decode,
+	// encode or write a message. Reads failing because the connection was
+	// closed normally by either side are not reported. Errors encoding or
+	// writing messages are reported from the write loop, as SendFailed.
+	Error func(*ConnectionError)
 }
 
 // ConnectionConfig defines the configuration parameters of a
@@ -98,6 +249,225 @@ type ConnectionEventHandlers struct {
 type ConnectionConfig struct {
 	Authenticate  AuthenticateFunc
 	EventHandlers ConnectionEventHandlers
+
+	// ID is the ID of the connection (optional); defaults to a random
+	// UUID. IDs need to be unique to the server.
+	ID string
+
+	// Context is the parent of the connection's context (optional), e.g.
+	// to carry request-scoped values; defaults to context.Background().
+	Context context.Context
+
+	// Request is the HTTP request the connection was upgraded from
+	// (optional); see Connection.Request.
+	Request *http.Request
+
+	// ClientIP is the resolved IP address of the client (optional);
+	// defaults to the host of the connection's remote address.
+	ClientIP string
+
+	// AuthenticateConnection is used instead of Authenticate if set.
+	AuthenticateConnection ConnectionAuthenticateFunc
+
+	// RefreshAuth authenticates connection_refresh messages, which carry
+	// a new auth token in the same payload format as connection_init.
+	// If RefreshAuth is nil, AuthenticateConnection or Authenticate is used
+	// instead; refreshing is not supported if all of them are nil. On success, the
+	// user of the connection is replaced and a connection_refresh_ack is
+	// sent. Otherwise graphql-ws clients receive a connection_error and
+	// keep their previous user, while graphql-transport-ws connections are
+	// closed with code 4403.
+	RefreshAuth RefreshAuthFunc
+
+	// AckPayload returns the payload of connection_ack messages
+	// (optional). Keys the package sets itself, e.g. the session token,
+	// take precedence over those it returns.
+	AckPayload AckPayloadFunc
+
+	// ConnectionInitWaitTimeout is the time clients have to send a
+	// connection_init message before the connection is closed with code
+	// 4408. Zero disables the timeout.
+	ConnectionInitWaitTimeout time.Duration
+
+	// KeepAliveInterval is the interval at which keep-alive messages are
+	// sent to the client once the connection is acknowledged: "ka" messages
+	// for graphql-ws clients and pings for graphql-transport-ws clients.
+	// Zero disables keep-alive messages.
+	KeepAliveInterval time.Duration
+
+	// IdleTimeout closes the connection with close code 1000 once it has
+	// had no active operations and hasn't received a message for the
+	// given time (optional). WebSocket control frames don't count as
+	// messages, so answering pings doesn't keep connections open.
+	IdleTimeout time.Duration
+
+	// MaxConnectionAge gracefully closes the connection after the given
+	// time (optional), with a random jitter of up to 10% in either
+	// direction to spread out reconnects: active operations are completed
+	// and the connection is closed with close code 1012 (service restart),
+	// which makes clients reconnect, e.g. to rotate credentials.
+	MaxConnectionAge time.Duration
+
+	// PingInterval is the interval at which WebSocket ping frames are sent
+	// to the client. Connections that don't answer a ping with a pong
+	// within PongWait (which defaults to PingInterval) are considered dead
+	// and closed. Zero disables pings.
+	PingInterval time.Duration
+	PongWait     time.Duration
+
+	// MaxMissedPings is the number of consecutive pings a client may leave
+	// unanswered before its connection is closed with ErrHeartbeatTimeout;
+	// defaults to 1. Pongs of graphql-transport-ws clients count as well.
+	MaxMissedPings int
+
+	// CompressionThreshold is the minimum size in bytes of data messages
+	// that are compressed, if permessage-deflate compression has been
+	// negotiated. Other messages are sent uncompressed. Zero compresses
+	// all messages.
+	CompressionThreshold int
+
+	// MaxMessageSize is the maximum size in bytes of messages received
+	// from the client; defaults to 4096. Larger messages close the
+	// connection with close code 1009 (message too big).
+	MaxMessageSize int64
+
+	// MaxOperations is the maximum number of operations a client may have
+	// active at the same time (optional). Operations exceeding the limit
+	// are rejected with an error with code SUBSCRIPTION_LIMIT_EXCEEDED or,
+	// if CloseOnOperationLimit is set, close the connection with code 4429.
+	MaxOperations         int
+	CloseOnOperationLimit bool
+
+	// OperationRateLimit is the number of start and stop messages per
+	// second a client may send on average, with bursts of up to
+	// OperationRateBurst messages (optional). Starts exceeding the rate
+	// are rejected with an error with code RATE_LIMITED, while stops are
+	// still processed so that no operation is left running. If
+	// CloseOnOperationRateLimit is set, exceeding the rate closes the
+	// connection with code 4429 instead.
+	OperationRateLimit        float64
+	OperationRateBurst        int
+	CloseOnOperationRateLimit bool
+
+	// MessageRateLimits limits the rate of incoming messages by type
+	// (optional), keyed as in ConnectionStats.MessagesByType, e.g. to
+	// tolerate many stops but throttle unknown messages. The limits
+	// apply in addition to OperationRateLimit.
+	MessageRateLimits map[string]MessageRateLimit
+
+	// StrictProtocol makes connections of other subprotocols enforce
+	// the operation rules of the graphql-transport-ws protocol: start
+	// and stop messages received before the connection has been
+	// acknowledged close it with code 4401 (unauthorized), and starting
+	// an operation with the ID of an active one closes it with code 4409.
+	StrictProtocol bool
+
+	// WriteTimeout is the time writing a message to the client may take
+	// before the connection is considered stalled and closed, which also
+	// removes its subscriptions; defaults to 10 seconds.
+	WriteTimeout time.Duration
+
+	// SendQueueSize is the number of messages that may wait to be written
+	// to the client; defaults to 16. SendQueueOverflow decides what
+	// happens to data messages sent while the queue is full: senders wait
+	// for room by default. Other messages are never dropped, don't close
+	// connections under OverflowClose and only wait for room under
+	// OverflowBlock.
+	SendQueueSize     int
+	SendQueueOverflow OverflowPolicy
+
+	// SlowClientBacklog and SlowClientTimeout evict slow clients
+	// (optional): connections that have had more than SlowClientBacklog
+	// messages waiting to be written for longer than SlowClientTimeout
+	// are closed with close code 1008 (policy violation), after calling
+	// the SlowClient event handler.
+	SlowClientBacklog int
+	SlowClientTimeout time.Duration
+
+	// MaxBatchSize makes the connection write up to MaxBatchSize data
+	// messages waiting to be written as an array in a single frame
+	// (optional), which only clients that expect such batches can read.
+	// BatchDelay is the time to wait for further messages to batch before
+	// writing a data message; by default, only messages that have piled up
+	// while writing are batched.
+	MaxBatchSize int
+	BatchDelay   time.Duration
+
+	// ValidateStart is called with the payload of every start message
+	// before StartOperation (optional), e.g. to require variables, ban
+	// fields or check tenants. Operations it returns errors for are
+	// rejected with an error message and never started.
+	ValidateStart ValidateStartFunc
+
+	// TransformData is called with every data message sent to the
+	// client (optional) and returns the payload to send instead; returning
+	// nil drops the message. Payloads may be shared among subscribers, so
+	// implementations must return a new payload rather than modify it.
+	TransformData TransformDataFunc
+
+	// ErrorFormatter converts the errors of error messages and data
+	// payloads into the GraphQL errors sent to the client (optional).
+	// Without it, errors are sent as they are, except over the
+	// graphql-transport-ws protocol, which uses DefaultErrorFormatter.
+	ErrorFormatter ErrorFormatter
+
+	// Codec encodes and decodes the messages exchanged with the client;
+	// defaults to JSONCodec. Messages of codecs implementing BinaryCodec
+	// are written in binary frames.
+	Codec Codec
+
+	// BufferPool provides the buffers messages are encoded into by codecs
+	// implementing BufferCodec; defaults to DefaultBufferPool.
+	BufferPool BufferPool
+
+	// Workers handle the start and stop messages of the connection
+	// (optional), which are otherwise handled as they are read. Operation
+	// messages are still handled one at a time and in order.
+	Workers WorkerPool
+
+	// Sessions enables resuming the operations of the connection on the
+	// client's next connection if it drops (optional).
+	Sessions *SessionConfig
+
+	// Transcript enables recording the most recent protocol messages of
+	// the connection (optional); see TranscriptConfig.
+	Transcript *TranscriptConfig
+
+	// Acks enables at-least-once delivery of data messages, which the
+	// client acknowledges (optional); see AckConfig.
+	Acks *AckConfig
+
+	// DeduplicationWindow enables suppressing duplicate data messages
+	// (optional): data messages of an operation with the MessageID of
+	// another message sent for it within the window are dropped, e.g.
+	// for events that upstream brokers delivered twice.
+	DeduplicationWindow time.Duration
+
+	// AppSync enables the AWS AppSync realtime protocol for connections
+	// from AppSync clients (optional); see AppSyncConfig.
+	AppSync *AppSyncConfig
+
+	// Poller reads from the socket once it becomes readable instead of
+	// from a goroutine blocked on it (optional). The connection then only
+	// holds goroutines while it reads or writes messages; sockets that
+	// don't implement PollableSocket are read from a goroutine still.
+	Poller Poller
+
+	// IncomingMiddleware and OutgoingMiddleware wrap the handling of
+	// messages received from and sent to the client (optional); see
+	// Middleware.
+	IncomingMiddleware []Middleware
+	OutgoingMiddleware []Middleware
+
+	// OperationMiddleware wraps the handling of start and stop messages
+	// (optional). Unlike incoming middleware, it runs where operations
+	// are started and stopped, which is on the connection's workers if
+	// it has any.
+	OperationMiddleware []Middleware
+
+	// MessageTypes handles messages of custom types received over
+	// initialized connections (optional); see MessageTypes.
+	MessageTypes MessageTypes
 }
 
 // Connection is an interface to represent GraphQL WebSocket connections.
@@ -113,8 +483,57 @@ type Connection interface {
 	// subscription) to the client.
 	SendData(string, *DataMessagePayload)
 
-	// SendError sends an error to the client.
+	// SendError sends an error to the client. The graphql-transport-ws
+	// protocol has no connection-level error messages; connections using
+	// it are closed with the error as the close reason instead.
 	SendError(error)
+
+	// TrySendComplete completes an active operation (typically a
+	// subscription) on behalf of the server. It returns false if there is
+	// no active operation with the given ID, e.g. because the client has
+	// already stopped it; otherwise it sends a complete message to the
+	// client, unregisters the operation and returns true.
+	TrySendComplete(string) bool
+
+	// Close terminates the connection with the given WebSocket close code
+	// (e.g. 4401 for unauthorized clients) and reason. The close frame is
+	// sent after all messages queued before it; closing the connection
+	// then removes its subscriptions as usual.
+	Close(code int, reason string)
+
+	// Set stores a value under the given key on the connection, so that
+	// applications can attach arbitrary per-connection state.
+	Set(key string, value interface{})
+
+	// Get returns the value stored under the given key, if any.
+	Get(key string) (interface{}, bool)
+
+	// InitPayload returns the payload of the connection_init message sent
+	// by the client (or nil if the connection hasn't been initialized).
+	InitPayload() map[string]interface{}
+
+	// Stats returns a snapshot of the connection's statistics.
+	Stats() ConnectionStats
+
+	// Context returns the context of the connection, which carries the
+	// values of the upgrade request and is cancelled once the connection
+	// is closed.
+	Context() context.Context
+
+	// Err returns nil while the connection is open and why it has been
+	// closed afterwards: ErrClosedByClient, ErrClosedByServer,
+	// ErrHeartbeatTimeout or the error reading from the client failed with.
+	Err() error
+
+	// Request returns the HTTP request the connection was upgraded from
+	// (or nil if it's unknown), e.g. to read headers, cookies and query
+	// parameters. Its body has been consumed by the upgrade.
+	Request() *http.Request
+
+	// RemoteAddr returns the network address of the peer, which may be a
+	// proxy; ClientIP returns the resolved IP address of the client.
+	RemoteAddr() net.Addr
+	ClientIP() string
 }
 
 /**
@@ -123,13 +542,105 @@ type Connection interface {
 
 type connection struct {
 	id         string
-	ws         *websocket.Conn
+	ws         Socket
 	config     ConnectionConfig
-	logger     *log.Entry
-	outgoing   chan OperationMessage
+	logger     Logger
+	codec      Codec
+	frameType  int
+	buffers    BufferPool
+	queue      *sendQueue
 	user       interface{}
 	closeMutex *sync.Mutex
 	closed     bool
+	closeErr   error
+
+	// Closed once the connection has been closed and cleaned up
+	done chan struct{}
+
+	// Closed when the write loop exits, so that senders don't block
+	// once messages can no longer be written
+	writeDone chan struct{}
+
+	// The negotiated protocol and whether the client has successfully
+	// initialized the connection; initialized is only accessed from the
+	// read loop
+	protocol    *protocol
+	initialized bool
+
+	// Close the connection if it isn't initialized in time and once it
+	// has reached its maximum age (optional)
+	initTimer *time.Timer
+	ageTimer  *time.Timer
+
+	// The socket if it's read when the poller reports it as readable, in
+	// which case messages are written by goroutines started on demand;
+	// writing is set while such a goroutine runs
+	pollable PollableSocket
+	writing  int32
+
+	// Whether the socket is watched by the poller and the time by which
+	// the client has to answer pings, guarded by pollMutex
+	polling   bool
+	pongDue   time.Time
+	pollMutex *sync.Mutex
+
+	// The user, application-defined values, the init payload and the
+	// session token, guarded by valuesMutex
+	values       map[string]interface{}
+	initPayload  map[string]interface{}
+	sessionToken string
+	valuesMutex  *sync.RWMutex
+
+	// Active operations by ID and the time the last one ended, guarded
+	// by operationsMutex
+	operations      map[string]bool
+	operationsEnded time.Time
+	operationsMutex *sync.Mutex
+
+	// The start payloads of active operations by ID if sessions are
+	// enabled, guarded by operationsMutex
+	startPayloads map[string]*StartMessagePayload
+
+	// Rate limit of start and stop messages; only used by the read loop
+	operationRate *tokenBucket
+
+	// Rate limits of messages by type; only used by the read loop
+	messageRates map[string]*tokenBucket
+
+	// Start and stop messages waiting for a worker if the connection has
+	// workers; handlingOperations is set while a worker handles them
+	operationMessages  chan OperationMessage
+	handlingOperations int32
+
+	// Handlers of incoming, outgoing and operation messages, wrapped in
+	// middleware
+	handleIncoming  MessageHandler
+	handleOutgoing  MessageHandler
+	handleOperation MessageHandler
+
+	// The time the connection was established and its traffic
+	connectedAt time.Time
+	counters    *connectionCounters
+
+	// The recent messages of the connection, if transcripts are enabled
+	transcript *transcript
+
+	// The data messages the client hasn't acknowledged, if acks are
+	// enabled
+	acks *ackTracker
+
+	// The message IDs of recent data messages, if a deduplication window
+	// is set
+	dedup *deduplicator
+
+	// Cancelled once the connection has been closed
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type closeFrame struct {
+	code   int
+	reason string
 }
 
 func operationMessageForType(messageType string) OperationMessage {
@@ -138,22 +649,109 @@ func operationMessageForType(messageType string) OperationMessage {
 	}
 }
 
-// NewConnection establishes a GraphQL WebSocket connection. It implements
-// the GraphQL WebSocket protocol by managing its internal state and handling
-// the client-server communication.
-func NewConnection(ws *websocket.Conn, config ConnectionConfig) Connection {
+// NewConnection establishes a GraphQL WebSocket connection over a WebSocket
+// connection, typically a *websocket.Conn. It implements the GraphQL
+// WebSocket protocol by managing its internal state and handling the
+// client-server communication.
+func NewConnection(ws Socket, config ConnectionConfig) Connection {
 	conn := new(connection)
-	conn.id = uuid.New().String()
+	conn.id = config.ID
+	if conn.id == "" {
+		conn.id = uuid.New().String()
+	}
 	conn.ws = ws
+	subprotocol, _ := splitSubprotocol(ws.Subprotocol())
+	conn.protocol = protocolForSubprotocol(subprotocol)
+	if config.AppSync != nil && conn.protocol == graphqlWSProtocol && isAppSyncRequest(config.Request) {
+		conn.protocol = appSyncProtocol
+	}
 	conn.config = config
 	conn.logger = NewLogger("connection/" + conn.id)
+	conn.codec = config.Codec
+	if conn.codec == nil {
+		conn.codec = JSONCodec
+	}
+	conn.frameType = frameTypeFor(conn.codec)
+	conn.buffers = config.BufferPool
+	if conn.buffers == nil {
+		conn.buffers = DefaultBufferPool
+	}
 	conn.closed = false
 	conn.closeMutex = &sync.Mutex{}
+	conn.done = make(chan struct{})
+	conn.writeDone = make(chan struct{})
+	conn.values = make(map[string]interface{})
+	conn.valuesMutex = &sync.RWMutex{}
+	conn.operations = make(map[string]bool)
+	conn.startPayloads = make(map[string]*StartMessagePayload)
+	conn.operationsMutex = &sync.Mutex{}
+	conn.operationRate = newTokenBucket(config.OperationRateLimit, config.OperationRateBurst)
+	if config.Workers != nil {
+		conn.operationMessages = make(chan OperationMessage, operationQueueSize)
+	}
+	conn.connectedAt = time.Now()
+	conn.counters = &connectionCounters{byType: newMessageTypeCounters(config.MessageTypes)}
+	conn.messageRates = newMessageRates(config.MessageRateLimits)
+	if config.Transcript != nil {
+		conn.transcript = newTranscript(config.Transcript)
+	}
+	if config.Acks != nil {
+		conn.acks = newAckTracker(config.Acks)
+	}
+	if config.DeduplicationWindow > 0 {
+		conn.dedup = newDeduplicator(config.DeduplicationWindow)
+	}
+	conn.pollMutex = &sync.Mutex{}
+	if config.Poller != nil {
+		if pollable, ok := ws.(PollableSocket); ok {
+			conn.pollable = pollable
+		}
+	}
+
+	parent := config.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	conn.ctx, conn.cancel = context.WithCancel(parent)
+
+	conn.queue = newSendQueue(config.SendQueueSize, conn.protocol.outgoingType(gqlData), config.SlowClientBacklog)
+
+	conn.handleIncoming = chainMiddleware(conn.handleMessage, config.IncomingMiddleware)
+	conn.handleOutgoing = chainMiddleware(conn.queueMessage, config.OutgoingMiddleware)
+	conn.handleOperation = chainMiddleware(conn.runOperation, config.OperationMiddleware)
+
+	if config.ConnectionInitWaitTimeout > 0 {
+		conn.initTimer = time.AfterFunc(config.ConnectionInitWaitTimeout, func() {
+			conn.logger.Warn("Connection initialisation timed out")
+			conn.closeWithCode(closeInitTimeout, "Connection initialisation timeout")
+		})
+	}
+
+	if config.MaxConnectionAge > 0 {
+		jitter := time.Duration((rand.Float64()*0.2 - 0.1) * float64(config.MaxConnectionAge))
+		conn.ageTimer = time.AfterFunc(config.MaxConnectionAge+jitter, conn.expire)
+	}
+
+	if config.EventHandlers.Open != nil {
+		config.EventHandlers.Open(conn)
+	}
+
+	if conn.pollable == nil {
+		go conn.writeLoop()
+	}
+	conn.startReading()
+
+	if config.PingInterval > 0 {
+		conn.every(config.PingInterval, conn.ping)
+	}
 
-	conn.outgoing = make(chan OperationMessage)
+	if config.SlowClientBacklog > 0 && config.SlowClientTimeout > 0 {
+		conn.every(config.SlowClientTimeout/4, conn.checkSlowClient)
+	}
 
-	go conn.writeLoop()
-	go conn.readLoop()
+	if config.IdleTimeout > 0 {
+		conn.every(config.IdleTimeout/4, conn.checkIdle)
+	}
 
 	conn.logger.Info("Created connection")
 
@@ -164,182 +762,1483 @@ func (conn *connection) ID() string {
 	return conn.id
 }
 
+func (conn *connection) Context() context.Context {
+	return conn.ctx
+}
+
+func (conn *connection) Err() error {
+	conn.closeMutex.Lock()
+	defer conn.closeMutex.Unlock()
+	if !conn.closed {
+		return nil
+	}
+	return conn.closeErr
+}
+
+// setCloseError records why the connection is being closed, unless a
+// reason has been recorded already.
+func (conn *connection) setCloseError(err error) {
+	conn.closeMutex.Lock()
+	if conn.closeErr == nil {
+		conn.closeErr = err
+	}
+	conn.closeMutex.Unlock()
+}
+
+func (conn *connection) Request() *http.Request {
+	return conn.config.Request
+}
+
+func (conn *connection) RemoteAddr() net.Addr {
+	return conn.ws.RemoteAddr()
+}
+
+func (conn *connection) ClientIP() string {
+	if conn.config.ClientIP != "" {
+		return conn.config.ClientIP
+	}
+	return hostOf(conn.ws.RemoteAddr().String())
+}
+
 func (conn *connection) User() interface{} {
+	conn.valuesMutex.RLock()
+	defer conn.valuesMutex.RUnlock()
 	return conn.user
 }
 
+func (conn *connection) setUser(user interface{}) {
+	conn.valuesMutex.Lock()
+	conn.user = user
+	conn.valuesMutex.Unlock()
+}
+
+func (conn *connection) Set(key string, value interface{}) {
+	conn.valuesMutex.Lock()
+	conn.values[key] = value
+	conn.valuesMutex.Unlock()
+}
+
+func (conn *connection) Get(key string) (interface{}, bool) {
+	conn.valuesMutex.RLock()
+	value, ok := conn.values[key]
+	conn.valuesMutex.RUnlock()
+	return value, ok
+}
+
+func (conn *connection) InitPayload() map[string]interface{} {
+	conn.valuesMutex.RLock()
+	defer conn.valuesMutex.RUnlock()
+	return conn.initPayload
+}
+
 func (conn *connection) SendData(opID string, data *DataMessagePayload) {
+	if conn.dedup != nil && data.MessageID != "" && conn.dedup.duplicate(opID, data.MessageID) {
+		conn.logger.WithFields(Fields{
+			"op":      opID,
+			"message": data.MessageID,
+		}).Debug("Dropped duplicate message")
+		return
+	}
+
+	if conn.config.TransformData != nil {
+		data = conn.config.TransformData(conn, opID, data)
+		if data == nil {
+			return
+		}
+	}
+
+	if conn.config.ErrorFormatter != nil && (len(data.Errors) > 0 || len(data.Incremental) > 0) {
+		data = formatDataErrors(data, conn.config.ErrorFormatter)
+	}
+
 	msg := operationMessageForType(gqlData)
 	msg.ID = opID
+	if conn.acks == nil {
+		msg.Payload = data
+		conn.send(msg)
+		return
+	}
+	if conn.isClosed() {
+		return
+	}
+
+	// Sequence numbers are issued in the order messages are queued
+	conn.acks.mutex.Lock()
+	data, ok := conn.acks.retain(opID, data)
 	msg.Payload = data
-	conn.closeMutex.Lock()
-	if !conn.closed {
-		conn.outgoing <- msg
+	conn.send(msg)
+	conn.acks.mutex.Unlock()
+
+	if !ok {
+		conn.logger.Warn("Too many unacknowledged messages")
+		conn.closeWithCode(websocket.CloseTryAgainLater, "Too many unacknowledged messages")
 	}
-	conn.closeMutex.Unlock()
 }
 
 func (conn *connection) SendError(err error) {
+	if conn.protocol.strict {
+		conn.closeWithCode(closeInternalServerError, err.Error())
+		return
+	}
+
 	msg := operationMessageForType(gqlError)
 	msg.Payload = err.Error()
-	conn.closeMutex.Lock()
-	if !conn.closed {
-		conn.outgoing <- msg
-	}
-	conn.closeMutex.Unlock()
+	conn.send(msg)
 }
 
-func (conn *connection) sendOperationErrors(opID string, errs []error) {
-	if conn.closed {
-		return
+func (conn *connection) TrySendComplete(opID string) bool {
+	// Unregister the operation first so that a concurrent stop from the
+	// client and a server-side completion can't both succeed
+	if !conn.removeOperation(opID) {
+		return false
 	}
-	msg := operationMessageForType(gqlError)
+
+	msg := operationMessageForType(gqlComplete)
 	msg.ID = opID
-	msg.Payload = errs
-	conn.closeMutex.Lock()
-	if !conn.closed {
-		conn.outgoing <- msg
+	conn.send(msg)
+
+	// Notify event handlers so the subscription is removed
+	if conn.config.EventHandlers.StopOperation != nil {
+		conn.config.EventHandlers.StopOperation(conn, opID)
 	}
-	conn.closeMutex.Unlock()
+
+	return true
 }
 
-func (conn *connection) close() {
-	// Close the write loop by closing the outgoing messages channels
-	conn.closeMutex.Lock()
-	conn.closed = true
-	close(conn.outgoing)
-	conn.closeMutex.Unlock()
+func (conn *connection) sendOperationErrors(opID string, errs []error) {
+	msg := operationMessageForType(gqlError)
+	msg.ID = opID
+	msg.Payload = conn.protocol.operationErrors(errs, conn.config.ErrorFormatter)
+	conn.send(msg)
+}
 
-	// Notify event handlers
-	if conn.config.EventHandlers.Close != nil {
-		conn.config.EventHandlers.Close(conn)
+// closeWithCode sends a close frame with the given code and reason to the
+// client and closes the WebSocket connection. This terminates the read loop,
+// which then cleans up the GraphQL WS connection.
+func (conn *connection) closeWithCode(code int, reason string) {
+	if len(reason) > maxCloseReasonLength {
+		reason = reason[:maxCloseReasonLength]
 	}
 
-	conn.logger.Info("Closed connection")
+	conn.logger.WithFields(Fields{
+		"code":   code,
+		"reason": reason,
+	}).Debug("Close connection")
+
+	conn.setCloseError(ErrClosedByServer)
+	conn.ws.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		conn.writeDeadline(),
+	)
+	conn.closeSocket()
 }
 
-func (conn *connection) writeLoop() {
-	// Close the WebSocket connection when leaving the write loop;
-	// this ensures the read loop is also terminated and the connection
-	// closed cleanly
-	defer conn.ws.Close()
+// evict closes the connection of a client that doesn't keep up with the
+// messages sent to it with close code 1008 (policy violation). The close
+// frame is given up on quickly, as the client is unlikely to read it.
+func (conn *connection) evict(reason string) {
+	conn.ws.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason),
+		time.Now().Add(evictTimeout),
+	)
+	conn.closeSocket()
+}
 
-	for {
-		select {
-		// Take the next outgoing message from the channel
-		case msg, ok := <-conn.outgoing:
-			// Close the write loop when the outgoing messages channel is closed;
-			// this will close the connection
-			if !ok {
-				return
-			}
+// terminate closes the connection with a close code from within the
+// read loop, which must return right after, or a worker.
+func (conn *connection) terminate(code int, reason string) {
+	conn.closeWithCode(code, reason)
+	conn.close()
+}
 
-			conn.logger.WithFields(log.Fields{
-				"msg": msg.String(),
-			}).Debug("Send message")
+// send translates a message into the negotiated protocol and passes it
+// to the outgoing middleware; messages that the protocol doesn't support
+// are skipped.
+func (conn *connection) send(msg OperationMessage) {
+	msg.Type = conn.protocol.outgoingType(msg.Type)
+	if msg.Type == "" {
+		return
+	}
+	conn.handleOutgoing(conn, msg)
+}
 
-			conn.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+// queueMessage queues a message for the write loop unless the connection
+// has been closed already, applying the overflow policy if the send queue
+// is full.
+func (conn *connection) queueMessage(_ Connection, msg OperationMessage) {
+	conn.closeMutex.Lock()
+	defer conn.closeMutex.Unlock()
 
-			// Send the message to the client; if this times out, the WebSocket
-			// connection will be corrupt, hence we need to close the write loop
-			// and the connection immediately
-			if err := conn.ws.WriteJSON(msg); err != nil {
-				conn.logger.WithFields(log.Fields{
-					"err": err,
-				}).Warn("Sending message failed")
+	for !conn.closed {
+		switch conn.queue.push(msg, conn.config.SendQueueOverflow) {
+		case pushFull:
+			// Wait for the write loop to make room without holding the
+			// close mutex, since the write loop may call event handlers
+			// that close the connection or send messages before it is done
+			conn.closeMutex.Unlock()
+			select {
+			case <-conn.queue.space:
+				conn.closeMutex.Lock()
+				continue
+			case <-conn.writeDone:
+				conn.closeMutex.Lock()
 				return
 			}
+		case pushDropped:
+			conn.logger.WithFields(Fields{
+				"id":   msg.ID,
+				"type": msg.Type,
+			}).Debug("Send queue full, dropped message")
+		case pushOverflow:
+			// The close mutex is held already
+			conn.logger.Warn("Send queue overflow")
+			if conn.closeErr == nil {
+				conn.closeErr = ErrClosedByServer
+			}
+			conn.evict("Send queue overflow")
 		}
+		conn.wakeWriter()
+		return
 	}
 }
 
-func (conn *connection) readLoop() {
-	// Close the WebSocket connection when leaving the read loop
-	defer conn.ws.Close()
+// writeDeadline returns the deadline for writing a message now.
+func (conn *connection) writeDeadline() time.Time {
+	if conn.config.WriteTimeout > 0 {
+		return time.Now().Add(conn.config.WriteTimeout)
+	}
+	return time.Now().Add(writeTimeout)
+}
 
-	conn.ws.SetReadLimit(readLimit)
+// addOperation registers an operation and reports whether it
+// wasn't active already. Its start payload is kept for resuming it if
+// sessions are enabled.
+func (conn *connection) addOperation(opID string, data *StartMessagePayload) bool {
+	conn.operationsMutex.Lock()
+	defer conn.operationsMutex.Unlock()
+	if conn.operations[opID] {
+		return false
+	}
+	conn.operations[opID] = true
+	if conn.config.Sessions != nil {
+		conn.startPayloads[opID] = data
+	}
+	return true
+}
 
-	for {
-		// Read the next message received from the client
-		rawPayload := json.RawMessage{}
-		msg := OperationMessage{
-			Payload: &rawPayload,
-		}
-		err := conn.ws.ReadJSON(&msg)
+// exceedsOperationLimit returns true if adding the operation would exceed
+// the maximum number of active operations.
+func (conn *connection) exceedsOperationLimit(opID string) bool {
+	if conn.config.MaxOperations <= 0 {
+		return false
+	}
+	conn.operationsMutex.Lock()
+	defer conn.operationsMutex.Unlock()
+	return !conn.operations[opID] && len(conn.operations) >= conn.config.MaxOperations
+}
 
-		// If this causes an error, close the connection and read loop immediately;
-		// see https://github.com/gorilla/websocket/blob/master/conn.go#L924 for
-		// more information on why this is necessary
-		if err != nil {
-			conn.logger.WithFields(log.Fields{
-				"reason": err,
-			}).Warn("Closing connection")
-			conn.close()
-			return
-		}
+// allowOperationMessage reports whether a start or stop message is within
+// the connection's operation rate limit.
+func (conn *connection) allowOperationMessage(msg OperationMessage) bool {
+	if conn.operationRate.allow() {
+		return true
+	}
+	conn.logger.WithFields(Fields{
+		"op":   msg.ID,
+		"type": msg.Type,
+	}).Warn("Operation rate limit exceeded")
+	return false
+}
 
-		conn.logger.WithFields(log.Fields{
-			"id":   msg.ID,
-			"type": msg.Type,
-		}).Debug("Received message")
+// removeOperation unregisters an operation and reports whether
+// it was active.
+func (conn *connection) removeOperation(opID string) bool {
+	conn.operationsMutex.Lock()
+	defer conn.operationsMutex.Unlock()
+	if !conn.operations[opID] {
+		return false
+	}
+	delete(conn.operations, opID)
+	delete(conn.startPayloads, opID)
+	if conn.dedup != nil {
+		conn.dedup.forget(opID)
+	}
+	if len(conn.operations) == 0 {
+		conn.operationsEnded = time.Now()
+	}
+	return true
+}
 
-		switch msg.Type {
+func (conn *connection) close() {
+	// Close the write loop by closing the send queue
+	conn.closeMutex.Lock()
+	if conn.closed {
+		conn.closeMutex.Unlock()
+		return
+	}
+	conn.closed = true
+	if conn.closeErr == nil {
+		conn.closeErr = ErrClosedByServer
+	}
+	conn.queue.close()
+	conn.closeMutex.Unlock()
+	conn.wakeWriter()
 
-		// When the GraphQL WS connection is initiated, send an ACK back
-		case gqlConnectionInit:
-			data := InitMessagePayload{}
-			if err := json.Unmarshal(rawPayload, &data); err != nil {
-				conn.SendError(errors.New("Invalid GQL_CONNECTION_INIT payload"))
-			} else {
-				if conn.config.Authenticate != nil {
-					user, err := conn.config.Authenticate(data.AuthToken)
-					if err != nil {
-						msg := operationMessageForType(gqlConnectionError)
-						msg.Payload = fmt.Sprintf("Failed to authenticate user: %v", err)
-						conn.outgoing <- msg
-					} else {
-						conn.user = user
-						conn.outgoing <- operationMessageForType(gqlConnectionAck)
-					}
-				} else {
-					conn.outgoing <- operationMessageForType(gqlConnectionAck)
-				}
-			}
+	if conn.initTimer != nil {
+		conn.initTimer.Stop()
+	}
+	if conn.ageTimer != nil {
+		conn.ageTimer.Stop()
+	}
 
-		// Let event handlers deal with starting operations
-		case gqlStart:
-			if conn.config.EventHandlers.StartOperation != nil {
-				data := StartMessagePayload{}
-				if err := json.Unmarshal(rawPayload, &data); err != nil {
-					conn.SendError(errors.New("Invalid GQL_START payload"))
-				} else {
-					errs := conn.config.EventHandlers.StartOperation(conn, msg.ID, &data)
-					if errs != nil {
-						conn.sendOperationErrors(msg.ID, errs)
-					}
-				}
-			}
+	conn.saveSession()
 
-		// Let event handlers deal with stopping operations
-		case gqlStop:
-			if conn.config.EventHandlers.StopOperation != nil {
-				conn.config.EventHandlers.StopOperation(conn, msg.ID)
-			}
+	if conn.transcript != nil && conn.config.Transcript.OnClose != nil {
+		conn.config.Transcript.OnClose(conn, conn.transcript.snapshot())
+	}
+
+	// Notify event handlers
+	if conn.config.EventHandlers.Close != nil {
+		conn.config.EventHandlers.Close(conn)
+	}
+
+	conn.cancel()
+	close(conn.done)
+
+	conn.logger.Info("Closed connection")
+}
+
+// sessionAckPayload returns the payload of a connection_ack message with
+// the connection's session token and the operations resumed from session.
+func (conn *connection) sessionAckPayload(session *Session) map[string]interface{} {
+	conn.valuesMutex.Lock()
+	if conn.sessionToken == "" {
+		conn.sessionToken = newSessionToken()
+	}
+	payload := map[string]interface{}{"sessionToken": conn.sessionToken}
+	conn.valuesMutex.Unlock()
+
+	if session != nil {
+		payload["resumedOperations"] = sessionOperationIDs(session)
+	}
+	return payload
+}
+
+// resumeSession starts the operations of a session again, in the order
+// of their IDs.
+func (conn *connection) resumeSession(session *Session) {
+	conn.logger.WithField("operations", len(session.Operations)).Info("Resuming session")
+
+	if conn.acks != nil {
+		conn.resendUnacked(session)
+	}
+
+	if conn.config.EventHandlers.StartOperation == nil {
+		return
+	}
+	for _, opID := range sessionOperationIDs(session) {
+		if conn.isClosed() {
+			return
+		}
+		conn.startOperation(opID, session.Operations[opID])
+	}
+}
+
+// resendUnacked sends the unacknowledged messages of the resumed
+// operations of a session again, before the operations send new ones, and
+// continues their sequence numbers.
+func (conn *connection) resendUnacked(session *Session) {
+	conn.acks.mutex.Lock()
+	defer conn.acks.mutex.Unlock()
+
+	conn.acks.sequence = session.Sequence
+	for _, unacked := range session.Unacked {
+		if session.Operations[unacked.OperationID] == nil {
+			continue
+		}
+		conn.acks.unacked = append(conn.acks.unacked, unacked)
+
+		msg := operationMessageForType(gqlData)
+		msg.ID = unacked.OperationID
+		msg.Payload = unacked.Payload
+		conn.send(msg)
+	}
+
+	conn.logger.WithField("messages", len(conn.acks.unacked)).Debug("Resent unacknowledged messages")
+}
+
+func sessionOperationIDs(session *Session) []string {
+	ids := make([]string, 0, len(session.Operations))
+	for id := range session.Operations {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// saveSession keeps the active operations of a connection that dropped
+// for the grace period of its session, so that the client can resume
+// them once it has reconnected.
+func (conn *connection) saveSession() {
+	config := conn.config.Sessions
+	if config == nil || config.Store == nil || conn.Err() == ErrClosedByClient {
+		return
+	}
+
+	conn.valuesMutex.RLock()
+	token := conn.sessionToken
+	user := conn.user
+	conn.valuesMutex.RUnlock()
+	if token == "" {
+		return
+	}
+
+	conn.operationsMutex.Lock()
+	operations := make(map[string]*StartMessagePayload, len(conn.startPayloads))
+	for id, data := range conn.startPayloads {
+		operations[id] = data
+	}
+	conn.operationsMutex.Unlock()
+	if len(operations) == 0 {
+		return
+	}
+
+	session := &Session{
+		Token:      token,
+		User:       user,
+		Operations: operations,
+		ExpiresAt:  time.Now().Add(config.gracePeriod()),
+	}
+	if conn.acks != nil {
+		session.Sequence, session.Unacked = conn.acks.snapshot()
+	}
+
+	err := config.Store.Save(session)
+	if err != nil {
+		conn.logger.WithFields(Fields{
+			"err": err,
+		}).Warn("Saving session failed")
+	}
+}
+
+func (conn *connection) Close(code int, reason string) {
+	conn.queueClose(code, reason)
+}
+
+// queueClose makes the write loop send a close frame after the messages
+// queued before it, unless the connection has been closed already.
+func (conn *connection) queueClose(code int, reason string) {
+	if len(reason) > maxCloseReasonLength {
+		reason = reason[:maxCloseReasonLength]
+	}
+
+	conn.logger.WithFields(Fields{
+		"code":   code,
+		"reason": reason,
+	}).Debug("Close connection")
+
+	conn.setCloseError(ErrClosedByServer)
+	conn.queue.pushClose(closeFrame{code, reason})
+	conn.wakeWriter()
+}
+
+// activeOperations returns the IDs of all active operations.
+func (conn *connection) activeOperations() []string {
+	conn.operationsMutex.Lock()
+	defer conn.operationsMutex.Unlock()
+	ids := make([]string, 0, len(conn.operations))
+	for id := range conn.operations {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// shutdown gracefully closes the connection: it completes all active
+// operations, makes the write loop send a close frame once all queued
+// messages are written and waits for the connection to be cleaned up.
+// The connection is closed immediately if ctx expires first.
+func (conn *connection) shutdown(ctx context.Context, code int, reason string) {
+	for _, opID := range conn.activeOperations() {
+		conn.TrySendComplete(opID)
+	}
+
+	conn.queueClose(code, reason)
+
+	select {
+	case <-conn.done:
+	case <-ctx.Done():
+		conn.setCloseError(ErrClosedByServer)
+		conn.closeSocket()
+	}
+}
+
+// expire gracefully closes a connection that has reached its maximum
+// age; clients that don't read the close frame in time are disconnected.
+func (conn *connection) expire() {
+	conn.logger.Info("Closing connection that reached its maximum age")
+
+	ctx, cancel := context.WithDeadline(context.Background(), conn.writeDeadline())
+	defer cancel()
+	conn.shutdown(ctx, websocket.CloseServiceRestart, "Maximum connection age reached")
+}
+
+func (conn *connection) writeLoop() {
+	// Close the WebSocket connection when leaving the write loop;
+	// this ensures the read loop is also terminated and the connection
+	// closed cleanly
+	defer conn.closeSocket()
+	defer close(conn.writeDone)
+
+	for {
+		// Leave the write loop when the queue has been closed, which
+		// means the connection has been closed
+		<-conn.queue.ready
+		if conn.queue.isClosed() || !conn.writeQueuedMessages() {
+			return
+		}
+	}
+}
+
+// writeQueuedMessages writes the messages in the send queue until it is
+// empty. It returns false if the write loop needs to be left because a
+// close frame has been sent or writing failed, which leaves the WebSocket
+// connection corrupt.
+func (conn *connection) writeQueuedMessages() bool {
+	// Give further data messages a chance to be queued for the batch
+	if conn.batching() && conn.config.BatchDelay > 0 && conn.queue.nextIsData() {
+		timer := time.NewTimer(conn.config.BatchDelay)
+		select {
+		case <-timer.C:
+		case <-conn.ctx.Done():
+			timer.Stop()
+		}
+	}
+
+	for {
+		queued, ok := conn.queue.pop()
+		if !ok {
+			return true
+		}
+
+		// Send a close frame to the client and leave the write loop, which
+		// makes the read loop close the connection
+		if frame := queued.frame; frame != nil {
+			conn.ws.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(frame.code, frame.reason),
+				conn.writeDeadline(),
+			)
+			return false
+		}
+
+		if conn.batching() && queued.msg.Type == conn.queue.dataType {
+			batch := append([]OperationMessage{queued.msg}, conn.queue.popData(conn.config.MaxBatchSize-1)...)
+			if len(batch) > 1 {
+				if !conn.writeBatch(batch) {
+					return false
+				}
+				continue
+			}
+		}
+
+		if !conn.writeMessage(queued.msg) {
+			return false
+		}
+	}
+}
+
+// wakeWriter starts a goroutine writing the queued messages of a polled
+// connection unless one is running already.
+func (conn *connection) wakeWriter() {
+	if conn.pollable != nil && atomic.CompareAndSwapInt32(&conn.writing, 0, 1) {
+		go conn.writeOnDemand()
+	}
+}
 
-		// When the GraphQL WS connection is terminated by the client,
-		// close the connection and close the read loop
-		case gqlConnectionTerminate:
-			conn.logger.Debug("Connection terminated by client")
-			conn.close()
+// writeOnDemand writes queued messages until the queue is empty, taking
+// the place of the write loop of polled connections.
+func (conn *connection) writeOnDemand() {
+	for {
+		if conn.queue.isClosed() || !conn.writeQueuedMessages() {
+			// Leave writing set, so that no further writers are started
+			close(conn.writeDone)
+			conn.closeSocket()
 			return
+		}
+
+		// Messages queued before writing was cleared failed to start a
+		// writer, so they are written by this one
+		atomic.StoreInt32(&conn.writing, 0)
+		if !conn.queue.pending() || !atomic.CompareAndSwapInt32(&conn.writing, 0, 1) {
+			return
+		}
+	}
+}
+
+func (conn *connection) batching() bool {
+	return conn.config.MaxBatchSize > 1
+}
+
+// writeMessage writes a message to the client. It returns false if
+// writing failed; messages that can't be encoded are skipped.
+func (conn *connection) writeMessage(msg OperationMessage) bool {
+	buf, ok := conn.encodeMessage(msg)
+	if !ok {
+		return true
+	}
+	defer conn.buffers.Put(buf)
+	if !conn.writeFrame(buf.Bytes(), msg.Type == conn.queue.dataType, msg.ID, 1) {
+		return false
+	}
+	conn.record(TranscriptOutbound, msg)
+	return true
+}
+
+// writeBatch writes data messages as an array in a single frame; if the
+// batch fails to be encoded, its messages are written one by one instead.
+func (conn *connection) writeBatch(batch []OperationMessage) bool {
+	conn.logger.WithFields(Fields{
+		"messages": len(batch),
+	}).Debug("Send batch")
+
+	buf, err := conn.marshal(batch)
+	if err != nil {
+		for _, msg := range batch {
+			if !conn.writeMessage(msg) {
+				return false
+			}
+		}
+		return true
+	}
+	defer conn.buffers.Put(buf)
+	if !conn.writeFrame(buf.Bytes(), true, "", len(batch)) {
+		return false
+	}
+	for _, msg := range batch {
+		conn.record(TranscriptOutbound, msg)
+	}
+	return true
+}
+
+// record adds a message to the transcript of the connection, if it has
+// one.
+func (conn *connection) record(direction string, msg OperationMessage) {
+	if conn.transcript != nil {
+		conn.transcript.record(direction, msg, transcriptPayload(msg))
+	}
+}
+
+func (conn *connection) encodeMessage(msg OperationMessage) (*bytes.Buffer, bool) {
+	// The message is only encoded for the log if debug messages are logged
+	conn.logger.WithFields(Fields{
+		"msg": msg,
+	}).Debug("Send message")
+
+	buf, err := conn.marshal(msg)
+	if err != nil {
+		conn.logger.WithFields(Fields{
+			"err": err,
+		}).Warn("Encoding message failed")
+		conn.sendFailed(err)
+		conn.reportError(ErrorOpEncode, msg.ID, err)
+		return nil, false
+	}
+	return buf, true
+}
+
+// marshal encodes v into a buffer, which the caller returns to the buffer
+// pool once it has been written.
+func (conn *connection) marshal(v interface{}) (*bytes.Buffer, error) {
+	codec, ok := conn.codec.(BufferCodec)
+	if !ok {
+		data, err := conn.codec.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewBuffer(data), nil
+	}
+
+	buf := conn.buffers.Get()
+	if err := codec.MarshalTo(buf, v); err != nil {
+		conn.buffers.Put(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// writeFrame writes a frame with one or, for batches, several encoded
+// messages; opID is the ID of the operation the frame belongs to, if any.
+func (conn *connection) writeFrame(data []byte, isData bool, opID string, messages int) bool {
+	conn.ws.SetWriteDeadline(conn.writeDeadline())
+
+	// Only compress data messages above the threshold if compression
+	// has been negotiated for the connection
+	if conn.config.CompressionThreshold > 0 {
+		conn.ws.EnableWriteCompression(
+			isData && len(data) >= conn.config.CompressionThreshold,
+		)
+	}
+
+	// Send the message to the client; if this times out, the WebSocket
+	// connection will be corrupt, hence we need to close the write loop
+	// and the connection immediately
+	if err := conn.ws.WriteMessage(conn.frameType, data); err != nil {
+		conn.logger.WithFields(Fields{
+			"err": err,
+		}).Warn("Sending message failed")
+		conn.sendFailed(err)
+		conn.reportError(ErrorOpWrite, opID, err)
+		return false
+	}
+	conn.counters.sent(messages, len(data))
+	return true
+}
+
+// sendFailed notifies event handlers of a message that couldn't be sent.
+func (conn *connection) sendFailed(err error) {
+	if conn.config.EventHandlers.SendFailed != nil {
+		conn.config.EventHandlers.SendFailed(conn, err)
+	}
+}
+
+// reportError notifies event handlers of a failure of the connection.
+func (conn *connection) reportError(op string, opID string, err error) {
+	if conn.config.EventHandlers.Error != nil {
+		conn.config.EventHandlers.Error(&ConnectionError{
+			Connection:  conn,
+			OperationID: opID,
+			Op:          op,
+			Err:         err,
+		})
+	}
+}
+
+// authenticator returns the function that authenticates the connection's
+// auth tokens, or nil if connections are not authenticated.
+func (conn *connection) authenticator() RefreshAuthFunc {
+	if conn.config.AuthenticateConnection != nil {
+		return RefreshAuthFunc(conn.config.AuthenticateConnection)
+	}
+	if authenticate := conn.config.Authenticate; authenticate != nil {
+		return func(_ Connection, token string) (interface{}, error) {
+			return authenticate(token)
+		}
+	}
+	return nil
+}
+
+// every calls tick every interval until it returns false or the
+// connection is closed. It runs on timers rather than a goroutine of its
+// own, so that idle connections don't hold goroutines.
+func (conn *connection) every(interval time.Duration, tick func() bool) {
+	time.AfterFunc(interval, func() {
+		select {
+		case <-conn.done:
+			return
+		default:
+		}
+		if tick() {
+			conn.every(interval, tick)
+		}
+	})
+}
+
+func (conn *connection) keepAlive() bool {
+	conn.send(operationMessageForType(gqlConnectionKeepAlive))
+	return true
+}
+
+// pongDeadline returns the time by which the client has to answer
+// the next ping.
+func (conn *connection) pongDeadline() time.Time {
+	pongWait := conn.config.PongWait
+	if pongWait <= 0 {
+		pongWait = conn.config.PingInterval
+	}
+	missedPings := conn.config.MaxMissedPings
+	if missedPings <= 0 {
+		missedPings = 1
+	}
+	return time.Now().Add(time.Duration(missedPings)*conn.config.PingInterval + pongWait)
+}
+
+func (conn *connection) ping() bool {
+	// Polled sockets have no read pending that the read deadline could
+	// make fail, so the pong deadline is checked here instead
+	if conn.pollable != nil && conn.missedPong() {
+		conn.logger.Warn("Closing connection that missed the pong deadline")
+		conn.setCloseError(ErrHeartbeatTimeout)
+		conn.closeSocket()
+		return false
+	}
+
+	// Control frames may be written concurrently with the write loop
+	err := conn.ws.WriteControl(
+		websocket.PingMessage,
+		nil,
+		conn.writeDeadline(),
+	)
+	return err == nil
+}
+
+// setPongDeadline extends the time by which the client has to answer
+// pings.
+func (conn *connection) setPongDeadline() error {
+	deadline := conn.pongDeadline()
+	conn.pollMutex.Lock()
+	conn.pongDue = deadline
+	conn.pollMutex.Unlock()
+	return conn.ws.SetReadDeadline(deadline)
+}
+
+func (conn *connection) missedPong() bool {
+	conn.pollMutex.Lock()
+	defer conn.pollMutex.Unlock()
+	return conn.polling && time.Now().After(conn.pongDue)
+}
+
+// checkSlowClient closes the connection once the client has had more
+// than SlowClientBacklog messages waiting for longer than
+// SlowClientTimeout.
+func (conn *connection) checkSlowClient() bool {
+	if conn.queue.slowFor() < conn.config.SlowClientTimeout {
+		return true
+	}
+
+	conn.logger.WithFields(Fields{
+		"timeout": conn.config.SlowClientTimeout,
+	}).Warn("Evicting slow client")
+	if conn.config.EventHandlers.SlowClient != nil {
+		conn.config.EventHandlers.SlowClient(conn)
+	}
+	conn.setCloseError(ErrClosedByServer)
+	conn.evict("Slow client")
+	return false
+}
+
+// checkIdle closes the connection once it has been idle for longer than
+// IdleTimeout: it hasn't had active operations and hasn't received
+// messages since.
+func (conn *connection) checkIdle() bool {
+	conn.operationsMutex.Lock()
+	active := len(conn.operations) > 0
+	idleSince := conn.operationsEnded
+	conn.operationsMutex.Unlock()
+	if active {
+		return true
+	}
+
+	if idleSince.Before(conn.connectedAt) {
+		idleSince = conn.connectedAt
+	}
+	if lastReceived := atomic.LoadInt64(&conn.counters.lastReceived); lastReceived > idleSince.UnixNano() {
+		idleSince = time.Unix(0, lastReceived)
+	}
+	if time.Since(idleSince) < conn.config.IdleTimeout {
+		return true
+	}
+
+	conn.logger.WithFields(Fields{
+		"timeout": conn.config.IdleTimeout,
+	}).Info("Closing idle connection")
+	conn.queueClose(websocket.CloseNormalClosure, "Idle timeout")
+	return false
+}
+
+// startReading prepares the socket for reading and reads messages either
+// in a read loop or whenever the poller reports the socket as readable.
+func (conn *connection) startReading() {
+	// Exceeding the limit makes the WebSocket connection send a close
+	// frame with code 1009 and fail reading, which closes the connection
+	if conn.config.MaxMessageSize > 0 {
+		conn.ws.SetReadLimit(conn.config.MaxMessageSize)
+	} else {
+		conn.ws.SetReadLimit(readLimit)
+	}
+
+	// Reading fails once the client misses the pong deadline, which
+	// closes the connection
+	if conn.config.PingInterval > 0 {
+		conn.setPongDeadline()
+		conn.ws.SetPongHandler(func(string) error {
+			return conn.setPongDeadline()
+		})
+	}
+
+	if conn.pollable == nil {
+		go conn.readLoop()
+		return
+	}
+
+	// Frames that arrived with the handshake are read right away, as the
+	// poller only reports data that hasn't been read yet
+	conn.pollMutex.Lock()
+	conn.polling = true
+	conn.pollMutex.Unlock()
+	if conn.pollable.Buffered() > 0 {
+		conn.readable()
+	} else if !conn.watch() {
+		go conn.readLoop()
+	}
+}
+
+func (conn *connection) readLoop() {
+	// Close the WebSocket connection when leaving the read loop
+	defer conn.closeSocket()
+
+	for conn.readNext(conn.ws.ReadMessage) {
+	}
+}
+
+// readable is called by the poller once the socket has become readable.
+// It reads the messages that have arrived in a goroutine, which ends once
+// the socket is watched again.
+func (conn *connection) readable() {
+	go func() {
+		for {
+			if !conn.readNext(conn.pollable.ReadFrame) {
+				conn.closeSocket()
+				return
+			}
+			if conn.pollable.Buffered() == 0 {
+				break
+			}
+		}
+
+		if !conn.watch() {
+			conn.readLoop()
+		}
+	}()
+}
+
+// watch makes the poller report when the socket becomes readable again.
+// It returns false if the poller fails to watch the socket, which then
+// needs to be read in a read loop.
+func (conn *connection) watch() bool {
+	conn.pollMutex.Lock()
+	defer conn.pollMutex.Unlock()
+
+	// The socket has been closed in the meantime
+	if !conn.polling {
+		return true
+	}
+
+	if err := conn.config.Poller.Watch(conn.pollable.NetConn(), conn.readable); err != nil {
+		conn.logger.WithFields(Fields{
+			"err": err,
+		}).Warn("Polling socket failed, reading in a read loop")
+		conn.polling = false
+		return false
+	}
+	return true
+}
+
+// closeSocket closes the WebSocket connection. Polled sockets are closed
+// immediately, as there is no read pending that would fail and close
+// the connection, and are unwatched first, since the poller must not
+// watch their file descriptors once they are reused.
+func (conn *connection) closeSocket() {
+	conn.pollMutex.Lock()
+	polling := conn.polling
+	if polling {
+		conn.config.Poller.Unwatch(conn.pollable.NetConn())
+		conn.polling = false
+	}
+	conn.pollMutex.Unlock()
+
+	conn.ws.Close()
+
+	// Closing may wait for the close mutex, which callers may hold
+	if polling {
+		go conn.close()
+	}
+}
 
-		// GraphQL WS protocol messages that are not handled represent
-		// a bug in our implementation; make this very obvious by logging
-		// an error
+// readNext reads and handles the next message received from the client.
+// It returns false once the connection has been closed.
+func (conn *connection) readNext(read func() (int, []byte, error)) bool {
+	rawPayload := json.RawMessage{}
+	msg := OperationMessage{
+		Payload: &rawPayload,
+	}
+	// Frames of either type are decoded with the codec, regardless
+	// of the type messages are written in
+	messageType, data, err := read()
+	if err != nil {
+		conn.setCloseError(readCloseError(err))
+		if unexpectedReadError(err) {
+			conn.reportError(ErrorOpRead, "", err)
+		}
+	} else if messageType == websocket.PingMessage || messageType == websocket.PongMessage {
+		// Control frames have been handled by the socket
+		return true
+	} else {
+		conn.counters.received(len(data))
+		if err = conn.codec.Unmarshal(data, &msg); err != nil {
+			conn.reportError(ErrorOpDecode, "", err)
+		}
+	}
+
+	// If this causes an error, close the connection and read loop immediately;
+	// see https://github.com/gorilla/websocket/blob/master/conn.go#L924 for
+	// more information on why this is necessary
+	if err != nil {
+		conn.logger.WithFields(Fields{
+			"reason": err,
+		}).Warn("Closing connection")
+		conn.setCloseError(err)
+		conn.close()
+		return false
+	}
+
+	conn.logger.WithFields(Fields{
+		"id":   msg.ID,
+		"type": msg.Type,
+	}).Debug("Received message")
+
+	conn.record(TranscriptInbound, msg)
+	conn.handleIncoming(conn, msg)
+
+	// Stop reading once handling the message closed the connection
+	return !conn.isClosed()
+}
+
+// scheduleOperation handles a start or stop message, with the
+// connection's workers if it has any.
+func (conn *connection) scheduleOperation(msg OperationMessage) {
+	if conn.operationMessages == nil {
+		conn.handleOperation(conn, msg)
+		return
+	}
+
+	select {
+	case conn.operationMessages <- msg:
+	case <-conn.done:
+		return
+	}
+	if atomic.CompareAndSwapInt32(&conn.handlingOperations, 0, 1) {
+		conn.config.Workers.Go(conn.runOperations)
+	}
+}
+
+// runOperations handles the queued operation messages on a worker.
+func (conn *connection) runOperations() {
+	for {
+		select {
+		case msg := <-conn.operationMessages:
+			if !conn.isClosed() {
+				conn.handleOperation(conn, msg)
+			}
+			continue
 		default:
-			conn.logger.WithFields(log.Fields{
-				"msg": msg.String(),
-			}).Error("Unhandled message")
+		}
+
+		// Messages queued before handlingOperations was cleared failed to
+		// schedule a worker, so they are handled by this one
+		atomic.StoreInt32(&conn.handlingOperations, 0)
+		if len(conn.operationMessages) == 0 || !atomic.CompareAndSwapInt32(&conn.handlingOperations, 0, 1) {
+			return
+		}
+	}
+}
+
+// runOperation starts or stops an operation, once the message has passed
+// the operation middleware; operation messages are handled by one
+// goroutine at a time.
+func (conn *connection) runOperation(_ Connection, msg OperationMessage) {
+	if conn.protocol.incomingType(msg.Type) == gqlStop {
+		conn.removeOperation(msg.ID)
+		if conn.config.EventHandlers.StopOperation != nil {
+			conn.config.EventHandlers.StopOperation(conn, msg.ID)
+		}
+
+		// AppSync clients wait for stopped operations to complete
+		if conn.protocol.appSync {
+			complete := operationMessageForType(gqlComplete)
+			complete.ID = msg.ID
+			conn.send(complete)
+		}
+		return
+	}
+
+	if conn.config.EventHandlers.StartOperation == nil {
+		return
+	}
+
+	data := StartMessagePayload{}
+	var err error
+	if conn.protocol.appSync {
+		err = decodeAppSyncStart(conn.codec, rawMessagePayload(msg, conn.codec), &data)
+	} else {
+		err = conn.codec.Unmarshal(rawMessagePayload(msg, conn.codec), &data)
+	}
+	if err != nil {
+		if conn.protocol.strict {
+			conn.terminate(closeBadRequest, "Invalid subscribe payload")
+			return
+		}
+		conn.SendError(errors.New("Invalid GQL_START payload"))
+		return
+	}
+
+	conn.startOperation(msg.ID, &data)
+}
+
+// startOperation starts an operation requested by the client or resumed
+// from a session.
+func (conn *connection) startOperation(opID string, data *StartMessagePayload) {
+	// Operations are only added by one goroutine at a time, so the number
+	// of active operations can't grow until the operation is added
+	if conn.exceedsOperationLimit(opID) {
+		conn.logger.WithField("op", opID).Warn("Too many operations")
+		if conn.config.CloseOnOperationLimit {
+			conn.terminate(closeTooManyRequests, "Too many subscriptions")
+			return
+		}
+		conn.sendOperationErrors(opID, []error{newOperationError(
+			fmt.Sprintf("Too many subscriptions, at most %d are allowed", conn.config.MaxOperations),
+			ErrCodeSubscriptionLimit,
+		)})
+		return
+	}
+
+	if conn.config.ValidateStart != nil {
+		if errs := conn.config.ValidateStart(conn, data); len(errs) > 0 {
+			conn.logger.WithFields(Fields{
+				"op":     opID,
+				"errors": errs,
+			}).Debug("Invalid operation")
+			conn.sendOperationErrors(opID, errs)
+			return
+		}
+	}
+
+	// Register the operation before starting it, so it can be
+	// completed as soon as the subscription is added
+	added := conn.addOperation(opID, data)
+	if !added && conn.strictOperations() {
+		conn.terminate(closeSubscriberExists, fmt.Sprintf("Subscriber for %s already exists", opID))
+		return
+	}
+
+	errs := conn.config.EventHandlers.StartOperation(conn, opID, data)
+	if errs != nil {
+		conn.sendOperationErrors(opID, errs)
+		if added {
+			conn.removeOperation(opID)
+		}
+	} else if conn.protocol.appSync {
+		ack := operationMessageForType(gqlStartAck)
+		ack.ID = opID
+		conn.send(ack)
+	}
+}
+
+// mergePayload adds the entries of src to dst, which is allocated if it
+// is nil and src isn't empty.
+func mergePayload(dst map[string]interface{}, src map[string]interface{}) map[string]interface{} {
+	if len(src) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = make(map[string]interface{}, len(src))
+	}
+	for key, value := range src {
+		dst[key] = value
+	}
+	return dst
+}
+
+// strictOperations reports whether operation messages follow the rules
+// of the graphql-transport-ws protocol; see ConnectionConfig.StrictProtocol.
+func (conn *connection) strictOperations() bool {
+	return conn.protocol.strict || conn.config.StrictProtocol
+}
+
+// unexpectedReadError reports whether a read error is a failure rather
+// than the client or the server closing the connection normally.
+func unexpectedReadError(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	if _, ok := err.(*websocket.CloseError); ok {
+		return websocket.IsUnexpectedCloseError(err,
+			websocket.CloseNormalClosure,
+			websocket.CloseGoingAway,
+			websocket.CloseNoStatusReceived,
+		)
+	}
+	return true
+}
+
+// readCloseError returns the reason for closing a connection that
+// reading from failed with err. Reads only time out once the client
+// has missed the pong deadline.
+func readCloseError(err error) error {
+	if errors.Is(err, net.ErrClosed) {
+		return ErrClosedByServer
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrHeartbeatTimeout
+	}
+	if !unexpectedReadError(err) {
+		return ErrClosedByClient
+	}
+	return err
+}
+
+// isClosed reports whether the connection has been closed.
+func (conn *connection) isClosed() bool {
+	conn.closeMutex.Lock()
+	defer conn.closeMutex.Unlock()
+	return conn.closed
+}
+
+// handleMessage handles a message received from the client once it has
+// passed the incoming middleware; it is only called from the read loop.
+func (conn *connection) handleMessage(_ Connection, msg OperationMessage) {
+	rawPayload := rawMessagePayload(msg, conn.codec)
+
+	// Ack messages are only part of the protocol if acks are enabled
+	messageType := conn.protocol.incomingType(msg.Type)
+	if messageType == gqlAck && conn.acks == nil {
+		messageType = ""
+	}
+	if !conn.allowMessageType(conn.countedMessageType(messageType, msg), msg) {
+		return
+	}
+
+	switch messageType {
+
+	// When the GraphQL WS connection is initiated, send an ACK back
+	case gqlConnectionInit:
+		// The graphql-transport-ws protocol allows only one init
+		// message per connection
+		if conn.protocol.strict && conn.initialized {
+			conn.terminate(closeTooManyInitRequests, "Too many initialisation requests")
+			return
+		}
+
+		if conn.initTimer != nil {
+			conn.initTimer.Stop()
+		}
+
+		// The init payload is optional in the graphql-transport-ws protocol
+		data := InitMessagePayload{}
+		payload := map[string]interface{}{}
+		if len(rawPayload) > 0 && string(rawPayload) != "null" {
+			err := conn.codec.Unmarshal(rawPayload, &data)
+			if err == nil {
+				err = conn.codec.Unmarshal(rawPayload, &payload)
+			}
+			if err != nil {
+				if conn.protocol.strict {
+					conn.terminate(closeBadRequest, "Invalid connection_init payload")
+					return
+				}
+				conn.SendError(errors.New("Invalid GQL_CONNECTION_INIT payload"))
+				return
+			}
+		}
+
+		// AppSync clients pass their auth headers in the upgrade request
+		if conn.protocol.appSync && data.AuthToken == "" {
+			data.AuthToken = appSyncAuthToken(conn.config.Request)
+		}
+
+		if authenticate := conn.authenticator(); authenticate != nil {
+			user, err := authenticate(conn, data.AuthToken)
+			if err != nil {
+				if conn.protocol.strict {
+					conn.terminate(closeForbidden, "Forbidden")
+					return
+				}
+				msg := operationMessageForType(gqlConnectionError)
+				msg.Payload = fmt.Sprintf("Failed to authenticate user: %v", err)
+				conn.send(msg)
+				return
+			}
+			conn.setUser(user)
+		}
+
+		conn.valuesMutex.Lock()
+		conn.initPayload = payload
+		conn.valuesMutex.Unlock()
+
+		if conn.config.EventHandlers.Init != nil {
+			conn.config.EventHandlers.Init(conn, payload)
+		}
+
+		var ackPayload map[string]interface{}
+		if conn.config.AckPayload != nil {
+			ackPayload = mergePayload(ackPayload, conn.config.AckPayload(conn, payload))
+		}
+		var session *Session
+		if config := conn.config.Sessions; config != nil && config.Store != nil {
+			if data.SessionToken != "" {
+				session = takeSession(config, data.SessionToken, conn.User())
+			}
+			ackPayload = mergePayload(ackPayload, conn.sessionAckPayload(session))
+		}
+		if conn.protocol.appSync {
+			ackPayload = mergePayload(ackPayload, appSyncAckPayload(conn.config.AppSync))
+		}
+
+		ack := operationMessageForType(gqlConnectionAck)
+		if ackPayload != nil {
+			ack.Payload = ackPayload
+		}
+		conn.send(ack)
+
+		// Start sending keep-alive messages once the connection has
+		// been acknowledged for the first time
+		if !conn.initialized && conn.config.KeepAliveInterval > 0 {
+			conn.send(operationMessageForType(gqlConnectionKeepAlive))
+			conn.every(conn.config.KeepAliveInterval, conn.keepAlive)
+		}
+		conn.initialized = true
+
+		if session != nil {
+			conn.resumeSession(session)
+		}
+
+	// Replace the user of an initialized connection if the client
+	// presents a new, valid auth token
+	case gqlConnectionRefresh:
+		if !conn.initialized {
+			if conn.protocol.strict {
+				conn.terminate(closeUnauthorized, "Unauthorized")
+				return
+			}
+			conn.SendError(errors.New("Cannot refresh authentication before GQL_CONNECTION_INIT"))
+			return
+		}
+
+		refresh := conn.config.RefreshAuth
+		if refresh == nil {
+			refresh = conn.authenticator()
+		}
+		if refresh == nil {
+			if conn.protocol.strict {
+				conn.terminate(closeBadRequest, "Invalid message received")
+				return
+			}
+			conn.SendError(errors.New("Refreshing authentication is not supported"))
+			return
+		}
+
+		data := InitMessagePayload{}
+		if err := conn.codec.Unmarshal(rawPayload, &data); err != nil {
+			if conn.protocol.strict {
+				conn.terminate(closeBadRequest, "Invalid connection_refresh payload")
+				return
+			}
+			conn.SendError(errors.New("Invalid GQL_CONNECTION_REFRESH payload"))
+			return
+		}
+
+		user, err := refresh(conn, data.AuthToken)
+		if err != nil {
+			conn.logger.WithField("err", err).Warn("Failed to refresh authentication")
+			if conn.protocol.strict {
+				conn.terminate(closeForbidden, "Forbidden")
+				return
+			}
+			msg := operationMessageForType(gqlConnectionError)
+			msg.Payload = fmt.Sprintf("Failed to authenticate user: %v", err)
+			conn.send(msg)
+			return
+		}
+
+		conn.setUser(user)
+		conn.send(operationMessageForType(gqlConnectionRefreshAck))
+
+	// Let event handlers deal with starting operations
+	case gqlStart:
+		// The graphql-transport-ws protocol requires operations to be
+		// started after the connection has been acknowledged
+		if conn.strictOperations() && !conn.initialized {
+			conn.terminate(closeUnauthorized, "Unauthorized")
+			return
+		}
+
+		if !conn.allowOperationMessage(msg) {
+			if conn.config.CloseOnOperationRateLimit {
+				conn.terminate(closeTooManyRequests, "Too many requests")
+				return
+			}
+			conn.sendOperationErrors(msg.ID, []error{newOperationError(
+				"Too many subscriptions started, try again later",
+				ErrCodeRateLimit,
+			)})
+			return
+		}
+
+		conn.scheduleOperation(msg)
+
+	// Let event handlers deal with stopping operations
+	case gqlStop:
+		if conn.strictOperations() && !conn.initialized {
+			conn.terminate(closeUnauthorized, "Unauthorized")
+			return
+		}
+		if !conn.allowOperationMessage(msg) && conn.config.CloseOnOperationRateLimit {
+			conn.terminate(closeTooManyRequests, "Too many requests")
+			return
+		}
+
+		conn.scheduleOperation(msg)
+
+	// Answer pings from graphql-transport-ws clients; their pongs
+	// extend the pong deadline like those of the WebSocket protocol
+	case gqlPing:
+		conn.send(operationMessageForType(gqlPong))
+
+	case gqlPong:
+		if conn.config.PingInterval > 0 {
+			conn.setPongDeadline()
+		}
+
+	// Forget the data messages the client has acknowledged
+	case gqlAck:
+		data := AckMessagePayload{}
+		if err := conn.codec.Unmarshal(rawPayload, &data); err != nil {
+			if conn.protocol.strict {
+				conn.terminate(closeBadRequest, "Invalid ack payload")
+				return
+			}
+			conn.SendError(errors.New("Invalid GQL_ACK payload"))
+			return
+		}
+		conn.acks.ack(data.Sequence)
+
+	// When the GraphQL WS connection is terminated by the client,
+	// close the connection and close the read loop
+	case gqlConnectionTerminate:
+		conn.logger.Debug("Connection terminated by client")
+		conn.setCloseError(ErrClosedByClient)
+		conn.close()
+		return
+
+	// GraphQL WS protocol messages that are not handled represent
+	// a bug in our implementation; make this very obvious by logging
+	// an error. Messages that are not part of the graphql-transport-ws
+	// protocol close the connection.
+	default:
+		if conn.handleCustomMessage(msg) {
+			return
+		}
+
+		conn.logger.WithFields(Fields{
+			"msg": msg.String(),
+		}).Error("Unhandled message")
+
+		if conn.protocol.strict {
+			conn.terminate(closeBadRequest, "Invalid message received")
+			return
 		}
 	}
 }
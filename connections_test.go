@@ -0,0 +1,1429 @@
+package graphqlws_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/meandrewdev/graphqlws"
+)
+
+// Helpers
+
+func dialServer(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	return dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLWS)
+}
+
+func dialServerWithSubprotocol(
+	t *testing.T,
+	srv *httptest.Server,
+	subprotocol string,
+) *websocket.Conn {
+	header := http.Header{}
+	header["Sec-WebSocket-Protocol"] = []string{subprotocol}
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + wsMountPath
+	ws, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("could not connect to websocket server: %v", err)
+	}
+	return ws
+}
+
+func readOperationMessage(t *testing.T, ws *websocket.Conn) graphqlws.OperationMessage {
+	msg := graphqlws.OperationMessage{}
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("could not read message: %v", err)
+	}
+	return msg
+}
+
+func startSubscription(t *testing.T, ws *websocket.Conn, opID string) {
+	err := ws.WriteJSON(map[string]interface{}{
+		"id":   opID,
+		"type": "start",
+		"payload": map[string]interface{}{
+			"query": "subscription { " + subscriptionName + " { payload } }",
+		},
+	})
+	if err != nil {
+		t.Fatalf("could not start subscription: %v", err)
+	}
+}
+
+func waitForConnection(
+	t *testing.T,
+	manager graphqlws.SubscriptionManager,
+) graphqlws.Connection {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for conn := range manager.Subscriptions() {
+			return conn
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no connection with subscriptions registered")
+	return nil
+}
+
+// Tests
+
+func TestConnection_TrySendCompleteCompletesActiveOperations(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := startServer(sm)
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	conn := waitForConnection(t, sm)
+
+	if conn.TrySendComplete("missing") {
+		t.Error("TrySendComplete reports success for an unknown operation")
+	}
+
+	if !conn.TrySendComplete("1") {
+		t.Fatal("TrySendComplete fails to complete an active operation")
+	}
+
+	msg := readOperationMessage(t, ws)
+	if msg.Type != "complete" || msg.ID != "1" {
+		t.Errorf("unexpected message received: %v", msg)
+	}
+
+	if len(sm.Subscriptions()) != 0 {
+		t.Error("TrySendComplete doesn't remove the subscription")
+	}
+
+	if conn.TrySendComplete("1") {
+		t.Error("TrySendComplete completes the same operation twice")
+	}
+}
+
+func TestConnection_ConnectionsAreClosedIfNotInitializedInTime(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager:       graphqlws.NewSubscriptionManager(schema),
+		ConnectionInitWaitTimeout: 50 * time.Millisecond,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	expectClose(t, ws, 4408)
+}
+
+func TestConnection_InitializedConnectionsAreKeptOpen(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager:       graphqlws.NewSubscriptionManager(schema),
+		ConnectionInitWaitTimeout: 50 * time.Millisecond,
+	}))
+	defer srv.Close()
+
+	ws := dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLTransportWS)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	readOperationMessage(t, ws)
+
+	time.Sleep(100 * time.Millisecond)
+
+	writeMessage(t, ws, map[string]interface{}{"type": "ping"})
+	if msg := readOperationMessage(t, ws); msg.Type != "pong" {
+		t.Fatalf("expected pong, received: %v", msg)
+	}
+}
+
+func TestConnection_KeepAliveMessagesAreSentPeriodically(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		KeepAliveInterval:   20 * time.Millisecond,
+	}))
+	defer srv.Close()
+
+	// Legacy clients receive "ka" messages...
+	legacy := dialServer(t, srv)
+	defer legacy.Close()
+
+	writeMessage(t, legacy, map[string]interface{}{
+		"type":    "connection_init",
+		"payload": map[string]interface{}{},
+	})
+	for _, expected := range []string{"connection_ack", "ka", "ka", "ka"} {
+		if msg := readOperationMessage(t, legacy); msg.Type != expected {
+			t.Fatalf("expected %s, received: %v", expected, msg)
+		}
+	}
+
+	// ...while graphql-transport-ws clients are pinged
+	modern := dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLTransportWS)
+	defer modern.Close()
+
+	writeMessage(t, modern, map[string]interface{}{"type": "connection_init"})
+	for _, expected := range []string{"connection_ack", "ping", "ping"} {
+		if msg := readOperationMessage(t, modern); msg.Type != expected {
+			t.Fatalf("expected %s, received: %v", expected, msg)
+		}
+	}
+}
+
+func TestConnection_KeepAliveMessagesAreDisabledByDefault(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := startServer(graphqlws.NewSubscriptionManager(schema))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{
+		"type":    "connection_init",
+		"payload": map[string]interface{}{},
+	})
+	readOperationMessage(t, ws)
+
+	ws.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, message, err := ws.ReadMessage(); err == nil {
+		t.Fatalf("unexpected message received: %s", message)
+	}
+}
+
+func startPingServer() (*httptest.Server, chan graphqlws.Connection) {
+	schema, _ := buildSchema()
+	closed := make(chan graphqlws.Connection, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		PingInterval:        20 * time.Millisecond,
+		PongWait:            20 * time.Millisecond,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			Close: func(conn graphqlws.Connection) {
+				closed <- conn
+			},
+		},
+	}))
+	return srv, closed
+}
+
+func TestConnection_ConnectionsAnsweringPingsAreKeptOpen(t *testing.T) {
+	srv, closed := startPingServer()
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	// Reading makes the client answer pings automatically
+	pings := make(chan bool, 100)
+	ws.SetPingHandler(func(data string) error {
+		pings <- true
+		return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go ws.ReadMessage()
+
+	select {
+	case <-closed:
+		t.Fatal("connection answering pings was closed")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if len(pings) < 2 {
+		t.Errorf("expected multiple pings, received %d", len(pings))
+	}
+}
+
+func TestConnection_ConnectionsMissingPongsAreClosed(t *testing.T) {
+	srv, closed := startPingServer()
+	defer srv.Close()
+
+	// Not reading means the client never answers pings
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	select {
+	case conn := <-closed:
+		if err := conn.Err(); err != graphqlws.ErrHeartbeatTimeout {
+			t.Errorf("expected heartbeat timeout, received: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection missing pongs was not closed")
+	}
+}
+
+func TestConnection_ConnectionsMayMissSomePings(t *testing.T) {
+	schema, _ := buildSchema()
+	closed := make(chan graphqlws.Connection, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		PingInterval:        20 * time.Millisecond,
+		PongWait:            20 * time.Millisecond,
+		MaxMissedPings:      5,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			Close: func(conn graphqlws.Connection) {
+				closed <- conn
+			},
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	select {
+	case <-closed:
+		t.Fatal("connection was closed before missing 5 pings")
+	case <-time.After(80 * time.Millisecond):
+	}
+
+	select {
+	case conn := <-closed:
+		if err := conn.Err(); err != graphqlws.ErrHeartbeatTimeout {
+			t.Errorf("expected heartbeat timeout, received: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection missing pongs was not closed")
+	}
+}
+
+func TestConnection_ConnectionsTerminatedByClientAreReportedAsSuch(t *testing.T) {
+	srv, closed := startPingServer()
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_terminate"})
+
+	select {
+	case conn := <-closed:
+		if err := conn.Err(); err != graphqlws.ErrClosedByClient {
+			t.Errorf("expected connection closed by client, received: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("terminated connection was not closed")
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	read *int64
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+// receivedDataSize returns the number of bytes read from the network to
+// receive a large, well compressible data message.
+func receivedDataSize(t *testing.T, threshold int) int64 {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager:  graphqlws.NewSubscriptionManager(schema),
+		EnableCompression:    true,
+		CompressionThreshold: threshold,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	}))
+	defer srv.Close()
+
+	var read int64
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			return countingConn{conn, &read}, err
+		},
+	}
+	header := http.Header{}
+	header["Sec-WebSocket-Protocol"] = []string{graphqlws.SubprotocolGraphQLWS}
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + wsMountPath
+	ws, _, err := dialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("could not connect to websocket server: %v", err)
+	}
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	s := <-subscriptions
+
+	before := atomic.LoadInt64(&read)
+	s.SendData(&graphqlws.DataMessagePayload{Data: strings.Repeat("a", 20000)})
+	readOperationMessage(t, ws)
+	return atomic.LoadInt64(&read) - before
+}
+
+func TestConnection_DataMessagesAboveThresholdAreCompressed(t *testing.T) {
+	if size := receivedDataSize(t, 1000); size > 5000 {
+		t.Errorf("data message above threshold not compressed: %d bytes", size)
+	}
+	if size := receivedDataSize(t, 100000); size < 20000 {
+		t.Errorf("data message below threshold compressed: %d bytes", size)
+	}
+}
+
+func TestConnection_OversizedMessagesCloseConnections(t *testing.T) {
+	schema, _ := buildSchema()
+	closed := make(chan graphqlws.Connection, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		MaxMessageSize:      100,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			Close: func(conn graphqlws.Connection) {
+				closed <- conn
+			},
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{
+		"id":   "1",
+		"type": "start",
+		"payload": map[string]interface{}{
+			"query": strings.Repeat("a", 200),
+		},
+	})
+	expectClose(t, ws, websocket.CloseMessageTooBig)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close handler not called for oversized message")
+	}
+}
+
+func TestConnection_StalledWritesCloseConnections(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	closed := make(chan graphqlws.Connection, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		WriteTimeout:        50 * time.Millisecond,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+			Close: func(conn graphqlws.Connection) {
+				closed <- conn
+			},
+		},
+	}))
+	defer srv.Close()
+
+	// Never read, so that the client's receive buffers fill up
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	s := <-subscriptions
+
+	sent := make(chan bool)
+	go func() {
+		payload := &graphqlws.DataMessagePayload{Data: strings.Repeat("a", 1<<20)}
+		for i := 0; i < 100; i++ {
+			s.SendData(payload)
+		}
+		sent <- true
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled connection was not closed")
+	}
+
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sending data to a stalled connection blocks")
+	}
+
+	if len(sm.Subscriptions()) != 0 {
+		t.Error("subscriptions of stalled connection were not removed")
+	}
+}
+
+func TestConnection_CloseTerminatesConnectionsWithCloseCode(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := startServer(sm)
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	conn := waitForConnection(t, sm)
+
+	conn.Close(4401, "Unauthorized")
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := ws.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok || closeErr.Code != 4401 || closeErr.Text != "Unauthorized" {
+		t.Fatalf("connection not closed with 4401 Unauthorized: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(sm.Subscriptions()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriptions of closed connection were not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnection_ValuesCanBeAttachedToConnections(t *testing.T) {
+	schema, _ := buildSchema()
+	closed := make(chan interface{}, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				s.Connection.Set("tenant", "acme")
+			},
+			Close: func(conn graphqlws.Connection) {
+				tenant, _ := conn.Get("tenant")
+				closed <- tenant
+			},
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	startSubscription(t, ws, "1")
+	ws.WriteJSON(map[string]interface{}{"type": "connection_terminate"})
+	defer ws.Close()
+
+	select {
+	case tenant := <-closed:
+		if tenant != "acme" {
+			t.Errorf("unexpected value: %v", tenant)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+}
+
+func TestConnection_InitPayloadIsExposed(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	initialized := make(chan map[string]interface{}, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			Init: func(conn graphqlws.Connection, payload map[string]interface{}) {
+				initialized <- payload
+			},
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{
+		"type": "connection_init",
+		"payload": map[string]interface{}{
+			"authToken":     "token",
+			"clientVersion": "1.2.3",
+		},
+	})
+	readOperationMessage(t, ws)
+
+	if payload := <-initialized; payload["clientVersion"] != "1.2.3" {
+		t.Errorf("unexpected init payload passed to Init: %v", payload)
+	}
+
+	startSubscription(t, ws, "1")
+	conn := waitForConnection(t, sm)
+	if payload := conn.InitPayload(); payload["authToken"] != "token" {
+		t.Errorf("unexpected init payload stored on connection: %v", payload)
+	}
+}
+
+func TestConnection_AckPayloadIsCustomizable(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		AckPayload: func(conn graphqlws.Connection, initPayload map[string]interface{}) map[string]interface{} {
+			return map[string]interface{}{
+				"keepAlive":     30000,
+				"clientVersion": initPayload["clientVersion"],
+			}
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{
+		"type":    "connection_init",
+		"payload": map[string]interface{}{"clientVersion": "1.2.3"},
+	})
+	ack := readOperationMessage(t, ws)
+	payload, _ := ack.Payload.(map[string]interface{})
+	if ack.Type != "connection_ack" || payload["keepAlive"] != float64(30000) || payload["clientVersion"] != "1.2.3" {
+		t.Errorf("unexpected ack: %v", ack)
+	}
+}
+
+func startRefreshServer(sm graphqlws.SubscriptionManager) *httptest.Server {
+	return httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		Authenticate: func(token string) (interface{}, error) {
+			return "user:" + token, nil
+		},
+		RefreshAuth: func(conn graphqlws.Connection, token string) (interface{}, error) {
+			if token == "bad" {
+				return nil, errors.New("invalid token")
+			}
+			return conn.User().(string) + "+" + token, nil
+		},
+	}))
+}
+
+func TestConnection_AuthenticationCanBeRefreshed(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := startRefreshServer(sm)
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{
+		"type":    "connection_init",
+		"payload": map[string]interface{}{"authToken": "old"},
+	})
+	readOperationMessage(t, ws)
+
+	startSubscription(t, ws, "1")
+	conn := waitForConnection(t, sm)
+
+	writeMessage(t, ws, map[string]interface{}{
+		"type":    "connection_refresh",
+		"payload": map[string]interface{}{"authToken": "new"},
+	})
+	if msg := readOperationMessage(t, ws); msg.Type != "connection_refresh_ack" {
+		t.Fatalf("expected connection_refresh_ack, received: %v", msg)
+	}
+	if conn.User() != "user:old+new" {
+		t.Errorf("user not replaced: %v", conn.User())
+	}
+
+	// Failed refreshes keep the previous user
+	writeMessage(t, ws, map[string]interface{}{
+		"type":    "connection_refresh",
+		"payload": map[string]interface{}{"authToken": "bad"},
+	})
+	if msg := readOperationMessage(t, ws); msg.Type != "connection_error" {
+		t.Fatalf("expected connection_error, received: %v", msg)
+	}
+	if conn.User() != "user:old+new" {
+		t.Errorf("user replaced by failed refresh: %v", conn.User())
+	}
+	if len(sm.Subscriptions()[conn]) != 1 {
+		t.Error("refreshing authentication drops subscriptions")
+	}
+}
+
+func TestConnection_FailedRefreshesCloseTransportWSConnections(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := startRefreshServer(graphqlws.NewSubscriptionManager(schema))
+	defer srv.Close()
+
+	ws := dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLTransportWS)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	readOperationMessage(t, ws)
+
+	writeMessage(t, ws, map[string]interface{}{
+		"type":    "connection_refresh",
+		"payload": map[string]interface{}{"authToken": "bad"},
+	})
+	expectClose(t, ws, 4403)
+}
+
+func TestConnection_RefreshesAreAuthenticatedWithoutTheRequest(t *testing.T) {
+	schema, _ := buildSchema()
+	requests := make(chan *http.Request, 2)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		AuthenticateRequest: func(conn graphqlws.Connection, r *http.Request, token string) (interface{}, error) {
+			requests <- r
+			return token, nil
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{
+		"type":    "connection_init",
+		"payload": map[string]interface{}{"authToken": "old"},
+	})
+	readOperationMessage(t, ws)
+	writeMessage(t, ws, map[string]interface{}{
+		"type":    "connection_refresh",
+		"payload": map[string]interface{}{"authToken": "new"},
+	})
+	if msg := readOperationMessage(t, ws); msg.Type != "connection_refresh_ack" {
+		t.Fatalf("expected connection_refresh_ack, received: %v", msg)
+	}
+
+	if init, refresh := <-requests, <-requests; init == nil || refresh != nil {
+		t.Errorf("unexpected requests: %v, %v", init, refresh)
+	}
+}
+
+func TestConnection_MiddlewareWrapsMessages(t *testing.T) {
+	schema, _ := buildSchema()
+	users := make(chan interface{}, 1)
+	sent := make(chan string, 10)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+		EventHandlers: graphqlws.CustomEventHandlers{
+			Init: func(conn graphqlws.Connection, payload map[string]interface{}) {
+				users <- conn.User()
+			},
+		},
+		IncomingMiddleware: []graphqlws.Middleware{
+			func(next graphqlws.MessageHandler) graphqlws.MessageHandler {
+				return func(conn graphqlws.Connection, msg graphqlws.OperationMessage) {
+					// Drop pings and rewrite init payloads
+					switch msg.Type {
+					case "ping":
+						return
+					case "connection_init":
+						msg.Payload = map[string]interface{}{"authToken": "alice"}
+					}
+					next(conn, msg)
+				}
+			},
+		},
+		OutgoingMiddleware: []graphqlws.Middleware{
+			func(next graphqlws.MessageHandler) graphqlws.MessageHandler {
+				return func(conn graphqlws.Connection, msg graphqlws.OperationMessage) {
+					sent <- msg.Type
+					next(conn, msg)
+				}
+			},
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLTransportWS)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{"type": "ping"})
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	if msg := readOperationMessage(t, ws); msg.Type != "connection_ack" {
+		t.Fatalf("expected connection_ack, received: %v", msg)
+	}
+
+	if user := <-users; user != "alice" {
+		t.Errorf("incoming middleware doesn't rewrite payloads: %v", user)
+	}
+	if msgType := <-sent; msgType != "connection_ack" {
+		t.Errorf("outgoing middleware isn't called for %v", msgType)
+	}
+}
+
+func TestConnection_DataCanBeTransformed(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		TransformData: func(
+			conn graphqlws.Connection,
+			opID string,
+			payload *graphqlws.DataMessagePayload,
+		) *graphqlws.DataMessagePayload {
+			if opID == "drop" {
+				return nil
+			}
+			return &graphqlws.DataMessagePayload{
+				Data:       payload.Data,
+				Extensions: map[string]interface{}{"op": opID},
+			}
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "drop")
+	startSubscription(t, ws, "1")
+	conn := waitForConnection(t, sm)
+
+	conn.SendData("drop", &graphqlws.DataMessagePayload{Data: "dropped"})
+	conn.SendData("1", &graphqlws.DataMessagePayload{Data: "sent"})
+
+	msg := readOperationMessage(t, ws)
+	payload, _ := msg.Payload.(map[string]interface{})
+	extensions, _ := payload["extensions"].(map[string]interface{})
+	if msg.ID != "1" || extensions["op"] != "1" {
+		t.Errorf("data isn't transformed: %v", msg)
+	}
+}
+
+func TestConnection_InvalidStartsAreRejected(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		ValidateStart: func(conn graphqlws.Connection, payload *graphqlws.StartMessagePayload) []error {
+			if payload.Variables["tenant"] == nil {
+				return []error{errors.New("Variable tenant is required")}
+			}
+			return nil
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	if msg := readOperationMessage(t, ws); msg.Type != "error" || msg.ID != "1" {
+		t.Fatalf("expected error, received: %v", msg)
+	}
+
+	writeMessage(t, ws, map[string]interface{}{
+		"id":   "2",
+		"type": "start",
+		"payload": map[string]interface{}{
+			"query":     "subscription { " + subscriptionName + " { payload } }",
+			"variables": map[string]interface{}{"tenant": "acme"},
+		},
+	})
+	conn := waitForConnection(t, sm)
+	if subscriptions := sm.Subscriptions()[conn]; len(subscriptions) != 1 || subscriptions["2"] == nil {
+		t.Errorf("only valid subscriptions should be added: %v", subscriptions)
+	}
+}
+
+func TestConnection_ErrorsAreReported(t *testing.T) {
+	schema, _ := buildSchema()
+	errs := make(chan *graphqlws.ConnectionError, 10)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		EventHandlers: graphqlws.CustomEventHandlers{
+			Error: func(err *graphqlws.ConnectionError) {
+				errs <- err
+			},
+		},
+	}))
+	defer srv.Close()
+
+	// Connections closed normally don't report errors
+	ws := dialServer(t, srv)
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	ws.Close()
+
+	ws = dialServer(t, srv)
+	defer ws.Close()
+	ws.WriteMessage(websocket.TextMessage, []byte("{"))
+
+	select {
+	case err := <-errs:
+		if err.Op != graphqlws.ErrorOpDecode || err.Connection == nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("decode error was not reported")
+	}
+
+	select {
+	case err := <-errs:
+		t.Errorf("unexpected error: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestConnection_ErrorsCanBeFormatted(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		ErrorFormatter: func(err error) gqlerrors.FormattedError {
+			formatted := graphqlws.DefaultErrorFormatter(err)
+			formatted.Extensions = map[string]interface{}{"code": "BAD_QUERY"}
+			return formatted
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	readOperationMessage(t, ws)
+
+	writeMessage(t, ws, map[string]interface{}{
+		"id":      "1",
+		"type":    "start",
+		"payload": map[string]interface{}{"query": "subscription { unknown }"},
+	})
+
+	msg := readOperationMessage(t, ws)
+	errs, _ := msg.Payload.([]interface{})
+	if msg.Type != "error" || len(errs) == 0 {
+		t.Fatalf("expected error, received: %v", msg)
+	}
+	err, _ := errs[0].(map[string]interface{})
+	extensions, _ := err["extensions"].(map[string]interface{})
+	if err["message"] == "" || extensions["code"] != "BAD_QUERY" {
+		t.Errorf("error isn't formatted: %v", err)
+	}
+}
+
+func TestConnection_ErrorsCarryExtensions(t *testing.T) {
+	schema, _ := buildSchema()
+	conns := make(chan graphqlws.Connection, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		EventHandlers: graphqlws.CustomEventHandlers{
+			Open: func(conn graphqlws.Connection, r *http.Request) {
+				conns <- conn
+			},
+		},
+		ValidateStart: func(conn graphqlws.Connection, payload *graphqlws.StartMessagePayload) []error {
+			return []error{graphqlws.WithExtensions(
+				errors.New("Tenant is suspended"),
+				map[string]interface{}{"code": "TENANT_SUSPENDED"},
+			)}
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+	conn := <-conns
+
+	extensions := func(msg graphqlws.OperationMessage, errs []interface{}) map[string]interface{} {
+		if len(errs) == 0 {
+			t.Fatalf("expected errors, received: %v", msg)
+		}
+		err, _ := errs[0].(map[string]interface{})
+		extensions, _ := err["extensions"].(map[string]interface{})
+		return extensions
+	}
+
+	startSubscription(t, ws, "1")
+	msg := readOperationMessage(t, ws)
+	errs, _ := msg.Payload.([]interface{})
+	if code := extensions(msg, errs)["code"]; msg.Type != "error" || code != "TENANT_SUSPENDED" {
+		t.Errorf("error message has no extensions: %v", msg)
+	}
+
+	conn.SendData("2", &graphqlws.DataMessagePayload{
+		Errors: []error{graphqlws.NewError("Upstream unavailable", map[string]interface{}{"retryable": true})},
+	})
+	msg = readOperationMessage(t, ws)
+	payload, _ := msg.Payload.(map[string]interface{})
+	errs, _ = payload["errors"].([]interface{})
+	if retryable := extensions(msg, errs)["retryable"]; msg.Type != "data" || retryable != true {
+		t.Errorf("data errors have no extensions: %v", msg)
+	}
+}
+
+func TestConnection_SendQueueOverflowCanDropMessages(t *testing.T) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		SendQueueSize:       1,
+		SendQueueOverflow:   graphqlws.OverflowDropNewest,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	}))
+	defer srv.Close()
+
+	// Don't read until all data has been sent, so that the queue fills up
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	s := <-subscriptions
+
+	sent := make(chan bool)
+	go func() {
+		payload := &graphqlws.DataMessagePayload{Data: strings.Repeat("a", 1<<20)}
+		for i := 0; i < 20; i++ {
+			s.SendData(payload)
+		}
+		sent <- true
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sending data to a slow client blocks")
+	}
+
+	received := 0
+	for {
+		ws.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		if _, _, err := ws.ReadMessage(); err != nil {
+			break
+		}
+		received++
+	}
+	if received == 0 || received >= 20 {
+		t.Errorf("expected some messages to be dropped, received %d", received)
+	}
+}
+
+func TestConnection_SendFailedHandlersCanCloseConnectionsWhileSendersWait(t *testing.T) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		SendQueueSize:       1,
+		SendQueueOverflow:   graphqlws.OverflowBlock,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+			SendFailed: func(conn graphqlws.Connection, err error) {
+				// Give the sender time to fill up the queue
+				time.Sleep(50 * time.Millisecond)
+				conn.Close(websocket.CloseInternalServerErr, "Encoding failed")
+			},
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	s := <-subscriptions
+
+	// Data that can't be encoded fails in the write loop while the
+	// sender waits for room in the queue
+	sent := make(chan bool)
+	go func() {
+		s.SendData(&graphqlws.DataMessagePayload{Data: make(chan int)})
+		for i := 0; i < 10; i++ {
+			s.SendData(&graphqlws.DataMessagePayload{Data: "a"})
+		}
+		sent <- true
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the connection from SendFailed deadlocks")
+	}
+}
+
+func TestConnection_SendQueueOverflowCanCloseConnections(t *testing.T) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	closed := make(chan graphqlws.Connection, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		SendQueueSize:       1,
+		SendQueueOverflow:   graphqlws.OverflowClose,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+			Close: func(conn graphqlws.Connection) {
+				closed <- conn
+			},
+		},
+	}))
+	defer srv.Close()
+
+	// Never read, so that the queue fills up
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	s := <-subscriptions
+
+	go func() {
+		payload := &graphqlws.DataMessagePayload{Data: strings.Repeat("a", 1<<20)}
+		for i := 0; i < 20; i++ {
+			s.SendData(payload)
+		}
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection of slow client was not closed")
+	}
+}
+
+// stalledSocket is a socket whose writes wait until it is released, so
+// that send queues can be filled deterministically.
+type stalledSocket struct {
+	writing  chan []byte
+	released chan struct{}
+	closed   chan struct{}
+}
+
+func newStalledSocket() *stalledSocket {
+	return &stalledSocket{
+		writing:  make(chan []byte, 16),
+		released: make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (s *stalledSocket) Subprotocol() string  { return graphqlws.SubprotocolGraphQLWS }
+func (s *stalledSocket) RemoteAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func (s *stalledSocket) ReadMessage() (int, []byte, error) {
+	<-s.closed
+	return 0, nil, errors.New("closed")
+}
+
+func (s *stalledSocket) SetReadDeadline(time.Time) error           { return nil }
+func (s *stalledSocket) SetReadLimit(int64)                        {}
+func (s *stalledSocket) SetPongHandler(func(string) error)         {}
+func (s *stalledSocket) SetWriteDeadline(time.Time) error          { return nil }
+func (s *stalledSocket) EnableWriteCompression(bool)               {}
+func (s *stalledSocket) WriteControl(int, []byte, time.Time) error { return nil }
+
+func (s *stalledSocket) WriteMessage(messageType int, data []byte) error {
+	s.writing <- append([]byte(nil), data...)
+	<-s.released
+	return nil
+}
+
+func (s *stalledSocket) Close() error {
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	return nil
+}
+
+func TestConnection_SendQueueOverflowOnlyClosesConnectionsForData(t *testing.T) {
+	ws := newStalledSocket()
+	defer ws.Close()
+	closed := make(chan struct{}, 1)
+	conn := graphqlws.NewConnection(ws, graphqlws.ConnectionConfig{
+		SendQueueSize:     1,
+		SendQueueOverflow: graphqlws.OverflowClose,
+		EventHandlers: graphqlws.ConnectionEventHandlers{
+			Close: func(graphqlws.Connection) {
+				closed <- struct{}{}
+			},
+		},
+	})
+
+	// The first message is being written and the second fills the queue
+	conn.SendData("1", &graphqlws.DataMessagePayload{Data: "a"})
+	<-ws.writing
+	conn.SendData("1", &graphqlws.DataMessagePayload{Data: "b"})
+
+	conn.SendError(errors.New("not a data message"))
+	select {
+	case <-closed:
+		t.Fatal("connection was closed for an error message")
+	default:
+	}
+	close(ws.released)
+
+	var written []string
+	for len(written) < 2 {
+		select {
+		case data := <-ws.writing:
+			var msg struct{ Type string }
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			}
+			written = append(written, msg.Type)
+		case <-closed:
+			t.Fatal("connection was closed for an error message")
+		case <-time.After(5 * time.Second):
+			t.Fatalf("queued messages were not written: %v", written)
+		}
+	}
+	if written[0] != "data" || written[1] != "error" {
+		t.Errorf("unexpected messages: %v", written)
+	}
+}
+
+func TestConnection_SlowClientsAreEvicted(t *testing.T) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	slow := make(chan graphqlws.ConnectionStats, 1)
+	closed := make(chan graphqlws.Connection, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		SendQueueSize:       100,
+		SlowClientBacklog:   2,
+		SlowClientTimeout:   200 * time.Millisecond,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+			SlowClient: func(conn graphqlws.Connection) {
+				slow <- conn.Stats()
+			},
+			Close: func(conn graphqlws.Connection) {
+				closed <- conn
+			},
+		},
+	}))
+	defer srv.Close()
+
+	// Never read, so that messages back up
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	s := <-subscriptions
+
+	payload := &graphqlws.DataMessagePayload{Data: strings.Repeat("a", 1<<20)}
+	for i := 0; i < 20; i++ {
+		s.SendData(payload)
+	}
+
+	select {
+	case stats := <-slow:
+		if stats.SendBacklog <= 2 || time.Since(stats.SendBacklogSince) < 200*time.Millisecond {
+			t.Errorf("unexpected backlog of slow client: %+v", stats)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow client was not evicted")
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection of slow client was not closed")
+	}
+}
+
+func TestConnection_DataMessagesAreBatched(t *testing.T) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		MaxBatchSize:        10,
+		BatchDelay:          100 * time.Millisecond,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	s := <-subscriptions
+	for i := 0; i < 3; i++ {
+		s.SendData(&graphqlws.DataMessagePayload{Data: i})
+	}
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batch []graphqlws.OperationMessage
+	if err := json.Unmarshal(data, &batch); err != nil {
+		t.Fatalf("expected a batch, received: %s", data)
+	}
+	if len(batch) != 3 {
+		t.Fatalf("expected a batch of 3 messages, received: %s", data)
+	}
+	for _, msg := range batch {
+		if msg.ID != "1" || msg.Type != "data" {
+			t.Errorf("unexpected message in batch: %v", msg)
+		}
+	}
+}
+
+func TestConnection_WorkersHandleOperationsInOrder(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		Workers:             graphqlws.NewWorkerPool(2),
+		ValidateStart: func(conn graphqlws.Connection, payload *graphqlws.StartMessagePayload) []error {
+			<-release
+			return nil
+		},
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				started <- struct{}{}
+			},
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLTransportWS)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	if msg := readOperationMessage(t, ws); msg.Type != "connection_ack" {
+		t.Fatalf("expected connection_ack, received: %v", msg)
+	}
+
+	// Pings are answered while the subscription is still being started
+	writeMessage(t, ws, map[string]interface{}{
+		"id":      "1",
+		"type":    "subscribe",
+		"payload": map[string]interface{}{"query": "subscription { " + subscriptionName + " { payload } }"},
+	})
+	writeMessage(t, ws, map[string]interface{}{"id": "1", "type": "complete"})
+	writeMessage(t, ws, map[string]interface{}{"type": "ping"})
+	if msg := readOperationMessage(t, ws); msg.Type != "pong" {
+		t.Fatalf("expected pong, received: %v", msg)
+	}
+
+	// The subscription is stopped once it has been started
+	close(release)
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription was not started")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(sm.Subscriptions()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if subscriptions := sm.Subscriptions(); len(subscriptions) > 0 {
+		t.Errorf("subscription was not stopped: %v", subscriptions)
+	}
+}
+
+func TestConnection_OperationMiddlewareWrapsOperationsOnWorkers(t *testing.T) {
+	schema, _ := buildSchema()
+	var validating int32
+	handled := make(chan string, 2)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Workers:             graphqlws.NewWorkerPool(2),
+		ValidateStart: func(conn graphqlws.Connection, payload *graphqlws.StartMessagePayload) []error {
+			atomic.StoreInt32(&validating, 1)
+			return nil
+		},
+		OperationMiddleware: []graphqlws.Middleware{
+			func(next graphqlws.MessageHandler) graphqlws.MessageHandler {
+				return func(conn graphqlws.Connection, msg graphqlws.OperationMessage) {
+					atomic.StoreInt32(&validating, 0)
+					next(conn, msg)
+					if atomic.LoadInt32(&validating) == 1 {
+						handled <- msg.Type
+					}
+				}
+			},
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	writeMessage(t, ws, map[string]interface{}{
+		"id":      "1",
+		"type":    "start",
+		"payload": map[string]interface{}{"query": "subscription { " + subscriptionName + " { payload } }"},
+	})
+
+	// The middleware returns once the worker started the operation
+	select {
+	case msgType := <-handled:
+		if msgType != "start" {
+			t.Errorf("unexpected message type: %s", msgType)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("operation middleware didn't wrap the start")
+	}
+}
+
+func TestConnection_IdleConnectionsAreClosed(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		IdleTimeout:         50 * time.Millisecond,
+	}))
+	defer srv.Close()
+
+	idle := dialServer(t, srv)
+	defer idle.Close()
+	active := dialServer(t, srv)
+	defer active.Close()
+
+	writeMessage(t, idle, map[string]interface{}{"type": "connection_init"})
+	readOperationMessage(t, idle)
+	writeMessage(t, active, map[string]interface{}{"type": "connection_init"})
+	readOperationMessage(t, active)
+	startSubscription(t, active, "1")
+
+	expectClose(t, idle, websocket.CloseNormalClosure)
+
+	// Connections with active subscriptions are kept open
+	active.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err := active.ReadMessage()
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("connection with an active subscription was closed: %v", err)
+	}
+}
+
+func TestConnection_ConnectionsAreClosedAtTheirMaximumAge(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		MaxConnectionAge:    50 * time.Millisecond,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	readOperationMessage(t, ws)
+	startSubscription(t, ws, "1")
+
+	if msg := readOperationMessage(t, ws); msg.Type != "complete" || msg.ID != "1" {
+		t.Fatalf("expected complete, received: %v", msg)
+	}
+	expectClose(t, ws, websocket.CloseServiceRestart)
+}
@@ -0,0 +1,72 @@
+package graphqlws
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// detachedContext carries the values of its parent without its deadline
+// and cancellation, e.g. those of an upgrade request, whose context is
+// cancelled as soon as the request has been hijacked.
+type detachedContext struct {
+	parent context.Context
+}
+
+func detachContext(parent context.Context) context.Context {
+	return detachedContext{parent: parent}
+}
+
+func (c detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (c detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (c detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// operationContexts holds the cancel functions of the contexts of a
+// connection's active operations.
+type operationContexts struct {
+	cancels map[string]context.CancelFunc
+	mutex   *sync.Mutex
+}
+
+func newOperationContexts() *operationContexts {
+	return &operationContexts{
+		cancels: make(map[string]context.CancelFunc),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// add registers the cancel function of an operation's context and reports
+// whether it was added, which it isn't if the operation is active already.
+func (o *operationContexts) add(opID string, cancel context.CancelFunc) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.cancels[opID] != nil {
+		return false
+	}
+	o.cancels[opID] = cancel
+	return true
+}
+
+// cancel cancels the context of an operation and unregisters it.
+func (o *operationContexts) cancel(opID string) {
+	o.mutex.Lock()
+	cancel := o.cancels[opID]
+	delete(o.cancels, opID)
+	o.mutex.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
@@ -0,0 +1,90 @@
+package graphqlws
+
+import (
+	"sync"
+	"time"
+)
+
+// IdentifiedEvent is implemented by published events that carry a
+// message ID, e.g. the ID an upstream broker assigned to the message the
+// event was created from. Executing a subscription for such an event sets
+// the MessageID of the result, so that connections with a deduplication
+// window suppress retried publishes of the same event; see
+// ConnectionConfig.DeduplicationWindow.
+type IdentifiedEvent interface {
+	MessageID() string
+}
+
+// eventMessageID returns the message ID of an event, if it has one.
+func eventMessageID(event interface{}) string {
+	if identified, ok := event.(IdentifiedEvent); ok {
+		return identified.MessageID()
+	}
+	return ""
+}
+
+/**
+ * Suppressing duplicate data messages.
+ */
+
+type seenMessage struct {
+	id     string
+	seenAt time.Time
+}
+
+// deduplicator remembers the message IDs of the data messages sent for
+// each operation of a connection during a window.
+type deduplicator struct {
+	window time.Duration
+
+	// The IDs seen by operation, in the order they were seen and as sets,
+	// guarded by mutex
+	seen  map[string][]seenMessage
+	ids   map[string]map[string]bool
+	mutex *sync.Mutex
+}
+
+func newDeduplicator(window time.Duration) *deduplicator {
+	return &deduplicator{
+		window: window,
+		seen:   make(map[string][]seenMessage),
+		ids:    make(map[string]map[string]bool),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// duplicate records a message ID of an operation and reports whether it
+// has been seen within the window already.
+func (d *deduplicator) duplicate(opID string, id string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// Forget the IDs that have left the window
+	now := time.Now()
+	seen := d.seen[opID]
+	expired := 0
+	for expired < len(seen) && now.Sub(seen[expired].seenAt) >= d.window {
+		delete(d.ids[opID], seen[expired].id)
+		expired++
+	}
+	seen = seen[expired:]
+
+	if d.ids[opID][id] {
+		d.seen[opID] = seen
+		return true
+	}
+	if d.ids[opID] == nil {
+		d.ids[opID] = make(map[string]bool)
+	}
+	d.ids[opID][id] = true
+	d.seen[opID] = append(seen, seenMessage{id: id, seenAt: now})
+	return false
+}
+
+// forget forgets the message IDs of an operation that has ended.
+func (d *deduplicator) forget(opID string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.seen, opID)
+	delete(d.ids, opID)
+}
@@ -0,0 +1,83 @@
+package graphqlws_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+type identifiedMessage struct {
+	id   string
+	text string
+}
+
+func (m identifiedMessage) MessageID() string {
+	return m.id
+}
+
+func TestConnection_DuplicateMessagesAreSuppressedWithinTheWindow(t *testing.T) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		DeduplicationWindow: 100 * time.Millisecond,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	readOperationMessage(t, ws)
+	startSubscription(t, ws, "1")
+	s := receiveSubscription(t, subscriptions)
+
+	send := func(id string, data string) {
+		s.SendData(&graphqlws.DataMessagePayload{Data: data, MessageID: id})
+	}
+	send("a", "first")
+	send("a", "retried")
+	send("b", "second")
+	send("", "unidentified")
+	send("", "unidentified")
+	time.Sleep(150 * time.Millisecond)
+	send("a", "after window")
+
+	for _, expected := range []string{"first", "second", "unidentified", "unidentified", "after window"} {
+		msg := readOperationMessage(t, ws)
+		payload, _ := msg.Payload.(map[string]interface{})
+		if payload["data"] != expected {
+			t.Errorf("expected %q, received: %v", expected, msg)
+		}
+		if _, ok := payload["MessageID"]; ok {
+			t.Error("message ID was sent to the client")
+		}
+	}
+}
+
+func TestPubSub_ResultsOfIdentifiedEventsHaveTheirMessageIDs(t *testing.T) {
+	ps := graphqlws.NewPubSub(graphqlws.PubSubConfig{Schema: buildPubSubSchema()})
+
+	conn := &mockWebSocketConnection{id: "1"}
+	var received *graphqlws.DataMessagePayload
+	ps.AddSubscription(conn, &graphqlws.Subscription{
+		ID:         "1",
+		Connection: conn,
+		Query:      "subscription { message }",
+		SendData: func(data *graphqlws.DataMessagePayload) {
+			received = data
+		},
+	})
+
+	ps.Publish(context.Background(), "message", identifiedMessage{id: "msg-1", text: "hello"})
+	if received == nil || received.MessageID != "msg-1" {
+		t.Errorf("unexpected result: %+v", received)
+	}
+}
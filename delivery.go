@@ -0,0 +1,122 @@
+package graphqlws
+
+import (
+	"sync"
+)
+
+const (
+	// Default number of unacknowledged data messages retained per
+	// connection
+	defaultMaxUnacked = 1000
+
+	// Key of the delivery extension of data messages
+	deliveryExtension = "delivery"
+)
+
+// AckConfig enables at-least-once delivery of data messages. Every data
+// message carries a sequence number in the delivery extension of its
+// payload, e.g. {"delivery": {"sequence": 7}}, and is retained by the
+// server until the client acknowledges it with an ack message, e.g.
+// {"type": "ack", "payload": {"sequence": 7}}, which acknowledges all
+// messages up to that sequence number.
+//
+// With sessions (see SessionConfig), the unacknowledged messages of a
+// connection that dropped are kept with its session and sent again, with
+// their original sequence numbers, once the client has resumed it;
+// clients discard messages with sequence numbers they have seen already.
+// Messages dropped by the send queue's overflow policy are only sent again
+// after reconnecting, so the default policy, which blocks, suits
+// at-least-once delivery best.
+type AckConfig struct {
+	// MaxUnacked is the number of unacknowledged messages retained per
+	// connection; connections exceeding it are closed with code 1013 (try
+	// again later), so that their clients resume them once they have
+	// caught up. Defaults to 1000.
+	MaxUnacked int
+}
+
+// AckMessagePayload defines the parameters of an ack message.
+type AckMessagePayload struct {
+	Sequence uint64 `json:"sequence"`
+}
+
+// UnackedMessage is a data message that the client hasn't acknowledged.
+type UnackedMessage struct {
+	Sequence    uint64
+	OperationID string
+	Payload     *DataMessagePayload
+}
+
+/**
+ * Tracking unacknowledged messages.
+ */
+
+type ackTracker struct {
+	maxUnacked int
+
+	// The last sequence number issued and the unacknowledged messages in
+	// the order of their sequence numbers, guarded by mutex. The mutex is
+	// held while messages are queued, so that they are queued in order.
+	sequence uint64
+	unacked  []UnackedMessage
+	mutex    *sync.Mutex
+}
+
+func newAckTracker(config *AckConfig) *ackTracker {
+	maxUnacked := config.MaxUnacked
+	if maxUnacked <= 0 {
+		maxUnacked = defaultMaxUnacked
+	}
+	return &ackTracker{
+		maxUnacked: maxUnacked,
+		mutex:      &sync.Mutex{},
+	}
+}
+
+// retain issues the next sequence number for a data message and retains
+// the message; the caller holds the mutex. It returns false if the client
+// has too many unacknowledged messages.
+func (t *ackTracker) retain(opID string, data *DataMessagePayload) (*DataMessagePayload, bool) {
+	t.sequence++
+	data = withDeliverySequence(data, t.sequence)
+	t.unacked = append(t.unacked, UnackedMessage{
+		Sequence:    t.sequence,
+		OperationID: opID,
+		Payload:     data,
+	})
+	return data, len(t.unacked) <= t.maxUnacked
+}
+
+// ack forgets the messages up to the given sequence number.
+func (t *ackTracker) ack(sequence uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	i := 0
+	for i < len(t.unacked) && t.unacked[i].Sequence <= sequence {
+		i++
+	}
+	t.unacked = append([]UnackedMessage(nil), t.unacked[i:]...)
+}
+
+// snapshot returns the last sequence number issued and the
+// unacknowledged messages.
+func (t *ackTracker) snapshot() (uint64, []UnackedMessage) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.sequence, append([]UnackedMessage(nil), t.unacked...)
+}
+
+// withDeliverySequence returns a copy of a data message payload with the
+// sequence number in the delivery extension.
+func withDeliverySequence(data *DataMessagePayload, sequence uint64) *DataMessagePayload {
+	extensions := make(map[string]interface{}, len(data.Extensions)+1)
+	for key, value := range data.Extensions {
+		extensions[key] = value
+	}
+	extensions[deliveryExtension] = map[string]interface{}{"sequence": sequence}
+
+	copied := *data
+	copied.Extensions = extensions
+	return &copied
+}
@@ -0,0 +1,112 @@
+package graphqlws_test
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/meandrewdev/graphqlws"
+)
+
+func startAckServer(acks *graphqlws.AckConfig) (*httptest.Server, chan *graphqlws.Subscription, chan graphqlws.Connection) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 4)
+	closed := make(chan graphqlws.Connection, 1)
+	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Sessions:            &graphqlws.SessionConfig{Store: graphqlws.NewMemorySessionStore()},
+		Acks:                acks,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+			Close: func(conn graphqlws.Connection) {
+				closed <- conn
+			},
+		},
+	})
+	return httptest.NewServer(handler), subscriptions, closed
+}
+
+// readDelivery reads a data message and returns its data and the sequence
+// number of its delivery extension.
+func readDelivery(t *testing.T, ws *websocket.Conn) (interface{}, float64) {
+	msg := readOperationMessage(t, ws)
+	payload, _ := msg.Payload.(map[string]interface{})
+	extensions, _ := payload["extensions"].(map[string]interface{})
+	delivery, _ := extensions["delivery"].(map[string]interface{})
+	sequence, _ := delivery["sequence"].(float64)
+	if msg.Type != "data" || sequence == 0 {
+		t.Fatalf("expected data message with a sequence number, received: %v", msg)
+	}
+	return payload["data"], sequence
+}
+
+func TestDelivery_UnackedMessagesAreSentAgainAfterResuming(t *testing.T) {
+	srv, subscriptions, closed := startAckServer(&graphqlws.AckConfig{})
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	token := initSession(t, ws, "")["sessionToken"].(string)
+	startSubscription(t, ws, "1")
+	s := receiveSubscription(t, subscriptions)
+
+	for _, data := range []string{"one", "two", "three"} {
+		s.SendData(&graphqlws.DataMessagePayload{Data: data})
+	}
+	for i := 1; i <= 3; i++ {
+		if _, sequence := readDelivery(t, ws); sequence != float64(i) {
+			t.Errorf("expected sequence number %d, received %v", i, sequence)
+		}
+	}
+	writeMessage(t, ws, map[string]interface{}{"type": "ack", "payload": map[string]interface{}{"sequence": 1}})
+
+	// Wait for the ack to be handled before the connection drops
+	time.Sleep(50 * time.Millisecond)
+	dropConnection(ws)
+	<-closed
+
+	ws = dialServer(t, srv)
+	defer ws.Close()
+	initSession(t, ws, token)
+
+	// The unacknowledged messages are sent before new ones
+	s = receiveSubscription(t, subscriptions)
+	s.SendData(&graphqlws.DataMessagePayload{Data: "four"})
+	for _, expected := range []struct {
+		data     string
+		sequence float64
+	}{{"two", 2}, {"three", 3}, {"four", 4}} {
+		data, sequence := readDelivery(t, ws)
+		if data != expected.data || sequence != expected.sequence {
+			t.Errorf("expected %s (%v), received %v (%v)", expected.data, expected.sequence, data, sequence)
+		}
+	}
+}
+
+func TestDelivery_ConnectionsWithTooManyUnackedMessagesAreClosed(t *testing.T) {
+	srv, subscriptions, _ := startAckServer(&graphqlws.AckConfig{MaxUnacked: 2})
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+	initSession(t, ws, "")
+	startSubscription(t, ws, "1")
+	s := receiveSubscription(t, subscriptions)
+
+	for i := 0; i < 3; i++ {
+		s.SendData(&graphqlws.DataMessagePayload{Data: i})
+	}
+
+	// Messages still queued are retained for the session
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+				t.Errorf("connection not closed with code 1013: %v", err)
+			}
+			return
+		}
+	}
+}
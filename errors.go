@@ -0,0 +1,109 @@
+package graphqlws
+
+import (
+	"errors"
+
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/location"
+)
+
+// Codes in the extensions of errors that reject operations because
+// they exceed one of the configured limits, violate a policy or carry
+// invalid input.
+const (
+	ErrCodeSubscriptionLimit     = "SUBSCRIPTION_LIMIT_EXCEEDED"
+	ErrCodeRateLimit             = "RATE_LIMITED"
+	ErrCodeComplexityLimit       = "COMPLEXITY_LIMIT_EXCEEDED"
+	ErrCodeQueryDepthLimit       = "QUERY_DEPTH_EXCEEDED"
+	ErrCodeIntrospectionDisabled = "INTROSPECTION_DISABLED"
+	ErrCodeInvalidVariables      = "BAD_USER_INPUT"
+	ErrCodePayloadTooLarge       = "PAYLOAD_TOO_LARGE"
+)
+
+// newOperationError creates a GraphQL error with a machine-readable
+// code in its extensions.
+func newOperationError(message string, code string) error {
+	return NewError(message, map[string]interface{}{"code": code})
+}
+
+// NewError creates a GraphQL error with extensions, e.g. an error code or
+// a retryable flag that clients can branch on. It can be returned from
+// any hook that rejects operations and be used in data payloads.
+func NewError(message string, extensions map[string]interface{}) error {
+	return gqlerrors.FormattedError{
+		Message:    message,
+		Locations:  []location.SourceLocation{},
+		Extensions: extensions,
+	}
+}
+
+// WithExtensions converts an error into a GraphQL error with the given
+// extensions added to those it already has.
+func WithExtensions(err error, extensions map[string]interface{}) error {
+	formatted := DefaultErrorFormatter(err)
+	merged := make(map[string]interface{}, len(formatted.Extensions)+len(extensions))
+	for key, value := range formatted.Extensions {
+		merged[key] = value
+	}
+	for key, value := range extensions {
+		merged[key] = value
+	}
+	formatted.Extensions = merged
+	return formatted
+}
+
+// ErrorFormatter is a function that converts an error sent to a client,
+// e.g. one returned by AddSubscription or a resolver, into the GraphQL
+// error object it is serialized as.
+type ErrorFormatter func(err error) gqlerrors.FormattedError
+
+// DefaultErrorFormatter keeps GraphQL errors as they are and converts
+// other errors into GraphQL errors with their message and, for errors
+// implementing gqlerrors.ExtendedError, their extensions.
+func DefaultErrorFormatter(err error) gqlerrors.FormattedError {
+	formatted := gqlerrors.FormatError(err)
+	if formatted.Extensions == nil {
+		var extended gqlerrors.ExtendedError
+		if errors.As(err, &extended) {
+			formatted.Extensions = extended.Extensions()
+		}
+	}
+	return formatted
+}
+
+// formatErrors converts errors into GraphQL errors with a formatter.
+func formatErrors(errs []error, format ErrorFormatter) []gqlerrors.FormattedError {
+	out := make([]gqlerrors.FormattedError, len(errs))
+	for i, err := range errs {
+		out[i] = format(err)
+	}
+	return out
+}
+
+// formatDataErrors returns a copy of a data payload with formatted errors;
+// payloads may be shared among subscribers and are not modified.
+func formatDataErrors(data *DataMessagePayload, format ErrorFormatter) *DataMessagePayload {
+	formatted := *data
+	formatted.Errors = formatErrorValues(data.Errors, format)
+	if len(data.Incremental) > 0 {
+		formatted.Incremental = make([]IncrementalPayload, len(data.Incremental))
+		for i, incremental := range data.Incremental {
+			incremental.Errors = formatErrorValues(incremental.Errors, format)
+			formatted.Incremental[i] = incremental
+		}
+	}
+	return &formatted
+}
+
+// formatErrorValues is like formatErrors, but returns the GraphQL errors
+// as errors; it returns nil if there are no errors.
+func formatErrorValues(errs []error, format ErrorFormatter) []error {
+	if len(errs) == 0 {
+		return nil
+	}
+	out := make([]error, len(errs))
+	for i, err := range formatErrors(errs, format) {
+		out[i] = err
+	}
+	return out
+}
@@ -0,0 +1,244 @@
+// Package etcd coordinates the instances of a cluster through etcd, so
+// that event sources which must be consumed once, e.g. polled tables or
+// change streams, are consumed by a single instance per partition, which
+// publishes their events to the cluster.
+package etcd
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/meandrewdev/graphqlws"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+const (
+	// Default prefix of the election keys of partitions
+	defaultPrefix = "/graphqlws/partitions/"
+
+	// Default lifetime of the leases of instances
+	defaultTTL = 10 * time.Second
+
+	// Default time to wait before consuming a partition again
+	defaultRetryDelay = time.Second
+)
+
+// Leadership is the leadership of an instance over a partition.
+type Leadership interface {
+	// Done is closed once the leadership has been lost, e.g. because the
+	// lease of the instance expired.
+	Done() <-chan struct{}
+
+	// Resign gives up the leadership.
+	Resign(ctx context.Context) error
+}
+
+// Elector elects the leaders of partitions among instances.
+type Elector interface {
+	// Campaign blocks until the instance leads the partition, or returns
+	// the error of ctx once it is done.
+	Campaign(ctx context.Context, partition string) (Leadership, error)
+}
+
+// Config defines the configuration of a coordinator.
+type Config struct {
+	// Client connects to the etcd cluster that leaders are elected in.
+	Client *clientv3.Client
+
+	// Prefix is prepended to the partitions to form the keys of their
+	// elections; defaults to "/graphqlws/partitions/".
+	Prefix string
+
+	// Node identifies the instance as a candidate; defaults to a random
+	// UUID.
+	Node string
+
+	// TTL is the lifetime of the lease of the instance, after which the
+	// partitions of an instance that died are taken over by others;
+	// defaults to 10 seconds.
+	TTL time.Duration
+
+	// Partitions lists the partitions of the event source.
+	Partitions []string
+
+	// Consume consumes a partition while the instance leads it, e.g. by
+	// polling it and publishing its events to a subscription manager.
+	// Its context is cancelled once the leadership is lost. Partitions
+	// are consumed again after RetryDelay, which defaults to a second,
+	// if Consume returns while the instance still leads them.
+	Consume    func(ctx context.Context, partition string) error
+	RetryDelay time.Duration
+
+	// Elector elects the leaders of partitions (optional); defaults to
+	// etcd elections with a lease of Client.
+	Elector Elector
+}
+
+// Coordinator consumes the partitions of an event source that the
+// instance has been elected to lead.
+type Coordinator interface {
+	// Run campaigns for the leadership of all partitions and consumes
+	// those the instance leads until ctx is done, which returns nil, or
+	// campaigning fails.
+	Run(ctx context.Context) error
+}
+
+/**
+ * The default implementation of the Coordinator interface.
+ */
+
+type coordinator struct {
+	config Config
+	logger graphqlws.Logger
+}
+
+// NewCoordinator creates a coordinator.
+func NewCoordinator(config Config) Coordinator {
+	if config.Prefix == "" {
+		config.Prefix = defaultPrefix
+	}
+	if config.Node == "" {
+		config.Node = uuid.New().String()
+	}
+	if config.TTL <= 0 {
+		config.TTL = defaultTTL
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = defaultRetryDelay
+	}
+	return &coordinator{
+		config: config,
+		logger: graphqlws.NewLogger("etcd"),
+	}
+}
+
+func (c *coordinator) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	elector := c.config.Elector
+	if elector == nil {
+		session, err := concurrency.NewSession(
+			c.config.Client,
+			concurrency.WithTTL(int(c.config.TTL/time.Second)),
+			concurrency.WithContext(ctx),
+		)
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+		elector = &sessionElector{session: session, prefix: c.config.Prefix, node: c.config.Node}
+	}
+
+	errs := make(chan error, len(c.config.Partitions))
+	wg := &sync.WaitGroup{}
+	for _, partition := range c.config.Partitions {
+		partition := partition
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.lead(ctx, elector, partition); err != nil {
+				errs <- err
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// lead campaigns for a partition and consumes it whenever the instance
+// leads it, until ctx is done.
+func (c *coordinator) lead(ctx context.Context, elector Elector, partition string) error {
+	for {
+		leadership, err := elector.Campaign(ctx, partition)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			leadership.Resign(context.Background())
+			return nil
+		}
+
+		c.logger.WithField("partition", partition).Info("Leading partition")
+		c.consume(ctx, leadership, partition)
+
+		// Resign, so that another instance may take over while this one
+		// campaigns again
+		leadership.Resign(context.Background())
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// consume consumes a partition until the leadership is lost or ctx is done.
+func (c *coordinator) consume(ctx context.Context, leadership Leadership, partition string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-leadership.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		if err := c.config.Consume(ctx, partition); err != nil && ctx.Err() == nil {
+			c.logger.WithFields(graphqlws.Fields{
+				"partition": partition,
+				"err":       err,
+			}).Warn("Failed to consume partition")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.config.RetryDelay):
+		}
+	}
+}
+
+/**
+ * Elections with etcd.
+ */
+
+type sessionElector struct {
+	session *concurrency.Session
+	prefix  string
+	node    string
+}
+
+func (e *sessionElector) Campaign(ctx context.Context, partition string) (Leadership, error) {
+	election := concurrency.NewElection(e.session, e.prefix+partition)
+	if err := election.Campaign(ctx, e.node); err != nil {
+		return nil, err
+	}
+	return &sessionLeadership{election: election, session: e.session}, nil
+}
+
+type sessionLeadership struct {
+	election *concurrency.Election
+	session  *concurrency.Session
+}
+
+func (l *sessionLeadership) Done() <-chan struct{} {
+	return l.session.Done()
+}
+
+func (l *sessionLeadership) Resign(ctx context.Context) error {
+	return l.election.Resign(ctx)
+}
@@ -0,0 +1,103 @@
+package etcd_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	graphqlwsetcd "github.com/meandrewdev/graphqlws/etcd"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	m.Run()
+}
+
+// elector elects the first candidate of each partition until it resigns.
+type elector struct {
+	leaders map[string]chan struct{}
+	mutex   *sync.Mutex
+}
+
+type leadership struct {
+	elector   *elector
+	partition string
+	done      chan struct{}
+}
+
+func (e *elector) Campaign(ctx context.Context, partition string) (graphqlwsetcd.Leadership, error) {
+	for {
+		e.mutex.Lock()
+		current, taken := e.leaders[partition]
+		if !taken {
+			done := make(chan struct{})
+			e.leaders[partition] = done
+			e.mutex.Unlock()
+			return &leadership{elector: e, partition: partition, done: done}, nil
+		}
+		e.mutex.Unlock()
+
+		select {
+		case <-current:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (l *leadership) Done() <-chan struct{} {
+	return l.done
+}
+
+func (l *leadership) Resign(ctx context.Context) error {
+	l.elector.mutex.Lock()
+	defer l.elector.mutex.Unlock()
+	if l.elector.leaders[l.partition] == l.done {
+		delete(l.elector.leaders, l.partition)
+		close(l.done)
+	}
+	return nil
+}
+
+func TestCoordinator_PartitionsAreConsumedByOneInstance(t *testing.T) {
+	e := &elector{leaders: make(map[string]chan struct{}), mutex: &sync.Mutex{}}
+	consumers := make(map[string][]string)
+	mutex := &sync.Mutex{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	for _, node := range []string{"a", "b"} {
+		node := node
+		coordinator := graphqlwsetcd.NewCoordinator(graphqlwsetcd.Config{
+			Node:       node,
+			Partitions: []string{"orders", "invoices"},
+			Elector:    e,
+			Consume: func(ctx context.Context, partition string) error {
+				mutex.Lock()
+				consumers[partition] = append(consumers[partition], node)
+				mutex.Unlock()
+				<-ctx.Done()
+				return nil
+			},
+		})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := coordinator.Run(ctx); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	wg.Wait()
+
+	for _, partition := range []string{"orders", "invoices"} {
+		if len(consumers[partition]) != 1 {
+			t.Errorf("expected partition %s to be consumed by one instance, got %v", partition, consumers[partition])
+		}
+	}
+}
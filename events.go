@@ -0,0 +1,176 @@
+package graphqlws
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// EventType is the type of a lifecycle event.
+type EventType string
+
+// Types of lifecycle events.
+const (
+	// EventConnectionOpened is emitted when a connection has been
+	// established, with the HTTP request it was upgraded from.
+	EventConnectionOpened EventType = "connection_opened"
+
+	// EventAuthenticated is emitted when a connection has been initialized
+	// and its user, if any, authenticated.
+	EventAuthenticated EventType = "authenticated"
+
+	// EventOperationStarted is emitted when a subscription has been added
+	// to the subscription manager.
+	EventOperationStarted EventType = "operation_started"
+
+	// EventDataSent is emitted when a data message is queued for a client.
+	EventDataSent EventType = "data_sent"
+
+	// EventOperationStopped is emitted when a subscription is stopped by
+	// the client or completed by the server.
+	EventOperationStopped EventType = "operation_stopped"
+
+	// EventConnectionClosed is emitted when a connection has been closed.
+	EventConnectionClosed EventType = "connection_closed"
+
+	// EventSlowClient is emitted before the connection of a slow client
+	// is closed; see HandlerConfig.SlowClientBacklog.
+	EventSlowClient EventType = "slow_client"
+
+	// EventError is emitted when a request can't be upgraded, an operation
+	// can't be started or a connection fails; see ConnectionError.
+	EventError EventType = "error"
+)
+
+// Event is a lifecycle event of a handler's connections. Only the fields
+// that apply to the type of event are set.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Connection is the connection the event happened on; it is nil for
+	// failed upgrade requests.
+	Connection Connection
+
+	// Request is the HTTP request of opened connections and failed
+	// upgrades.
+	Request *http.Request
+
+	// OperationID identifies the operation of operation, data and error
+	// events.
+	OperationID string
+
+	// Subscription is the started subscription.
+	Subscription *Subscription
+
+	// Data is the payload of the data message sent.
+	Data *DataMessagePayload
+
+	// Errors are the errors of error events.
+	Errors []error
+}
+
+// EventListener is a function that is called with lifecycle events.
+// Listeners are called synchronously by the goroutine emitting the event,
+// e.g. the read loop of a connection, and should return quickly.
+type EventListener func(Event)
+
+// EventBus delivers lifecycle events to any number of listeners. It is
+// safe for concurrent use.
+type EventBus interface {
+	// Subscribe registers a listener for events of the given types, or of
+	// all types if none are given. It returns a function that unregisters
+	// the listener.
+	Subscribe(listener EventListener, types ...EventType) (unsubscribe func())
+
+	// Emit delivers an event to the listeners of its type, setting its
+	// time if it is zero.
+	Emit(Event)
+}
+
+/**
+ * The default implementation of the EventBus interface.
+ */
+
+type eventListener struct {
+	listener EventListener
+	types    map[EventType]bool
+}
+
+type eventBus struct {
+	listeners map[int]*eventListener
+	nextID    int
+	mutex     *sync.RWMutex
+}
+
+// NewEventBus creates a new event bus without listeners.
+func NewEventBus() EventBus {
+	return &eventBus{
+		listeners: make(map[int]*eventListener),
+		mutex:     &sync.RWMutex{},
+	}
+}
+
+func (b *eventBus) Subscribe(listener EventListener, types ...EventType) func() {
+	l := &eventListener{listener: listener}
+	if len(types) > 0 {
+		l.types = make(map[EventType]bool, len(types))
+		for _, t := range types {
+			l.types[t] = true
+		}
+	}
+
+	b.mutex.Lock()
+	id := b.nextID
+	b.nextID++
+	b.listeners[id] = l
+	b.mutex.Unlock()
+
+	return func() {
+		b.mutex.Lock()
+		delete(b.listeners, id)
+		b.mutex.Unlock()
+	}
+}
+
+func (b *eventBus) Emit(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	// Call the listeners without holding the lock, so that they may
+	// subscribe and unsubscribe
+	b.mutex.RLock()
+	listeners := make([]EventListener, 0, len(b.listeners))
+	for _, l := range b.listeners {
+		if l.types == nil || l.types[event.Type] {
+			listeners = append(listeners, l.listener)
+		}
+	}
+	b.mutex.RUnlock()
+
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
+
+// emitEvent emits an event on a bus unless it is nil.
+func emitEvent(bus EventBus, event Event) {
+	if bus != nil {
+		bus.Emit(event)
+	}
+}
+
+// dataSentEvents is an outgoing middleware that emits data events for the
+// data messages sent to clients.
+func dataSentEvents(bus EventBus) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(conn Connection, msg OperationMessage) {
+			next(conn, msg)
+
+			if data, ok := msg.Payload.(*DataMessagePayload); ok && (msg.Type == "data" || msg.Type == "next") {
+				bus.Emit(Event{Type: EventDataSent, Connection: conn, OperationID: msg.ID, Data: data})
+			}
+		}
+	}
+}
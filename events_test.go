@@ -0,0 +1,94 @@
+package graphqlws_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/meandrewdev/graphqlws"
+)
+
+func TestEventBus_ListenersReceiveEventsOfTheirTypes(t *testing.T) {
+	bus := graphqlws.NewEventBus()
+
+	all := []graphqlws.EventType{}
+	closed := []graphqlws.EventType{}
+	unsubscribe := bus.Subscribe(func(event graphqlws.Event) {
+		all = append(all, event.Type)
+	})
+	bus.Subscribe(func(event graphqlws.Event) {
+		if event.Time.IsZero() {
+			t.Error("event time is not set")
+		}
+		closed = append(closed, event.Type)
+	}, graphqlws.EventConnectionClosed)
+
+	bus.Emit(graphqlws.Event{Type: graphqlws.EventConnectionOpened})
+	bus.Emit(graphqlws.Event{Type: graphqlws.EventConnectionClosed})
+	unsubscribe()
+	bus.Emit(graphqlws.Event{Type: graphqlws.EventConnectionClosed})
+
+	if len(all) != 2 {
+		t.Errorf("listener for all events received: %v", all)
+	}
+	if len(closed) != 2 {
+		t.Errorf("listener for closed connections received: %v", closed)
+	}
+}
+
+func TestHandler_LifecycleEventsAreEmitted(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewPublishingSubscriptionManager(schema)
+	bus := graphqlws.NewEventBus()
+
+	events := make(chan graphqlws.Event, 16)
+	bus.Subscribe(func(event graphqlws.Event) {
+		events <- event
+	})
+
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		Events:              bus,
+	}))
+	defer srv.Close()
+
+	next := func(expected graphqlws.EventType) graphqlws.Event {
+		select {
+		case event := <-events:
+			if event.Type != expected {
+				t.Fatalf("expected %s event, received: %v", expected, event)
+			}
+			return event
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s event was not emitted", expected)
+		}
+		return graphqlws.Event{}
+	}
+
+	ws := dialServer(t, srv)
+	if event := next(graphqlws.EventConnectionOpened); event.Request == nil {
+		t.Error("opened connection has no request")
+	}
+
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	next(graphqlws.EventAuthenticated)
+
+	startSubscription(t, ws, "1")
+	if event := next(graphqlws.EventOperationStarted); event.OperationID != "1" || event.Subscription == nil {
+		t.Errorf("unexpected start event: %v", event)
+	}
+
+	sm.Publish(context.Background(), subscriptionName, map[string]interface{}{"payload": "hello"})
+	if event := next(graphqlws.EventDataSent); event.Data == nil || event.OperationID != "1" {
+		t.Errorf("unexpected data event: %v", event)
+	}
+
+	writeMessage(t, ws, map[string]interface{}{"id": "1", "type": "stop"})
+	next(graphqlws.EventOperationStopped)
+
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	ws.Close()
+	next(graphqlws.EventConnectionClosed)
+}
@@ -0,0 +1,43 @@
+package graphqlws
+
+import "errors"
+
+// ErrUnsupportedConnection is returned by SendMessage for connections
+// that aren't served over WebSockets.
+var ErrUnsupportedConnection = errors.New("graphqlws: connection doesn't support custom messages")
+
+// MessageTypes maps custom message types to their handlers, so that
+// applications can implement vendor extensions, e.g. presence pings or
+// uploads of client metrics, over the sockets of GraphQL connections.
+//
+// Handlers are called from the read loop of a connection, in the order
+// of its messages, with payloads as *json.RawMessage values; they should
+// hand off slow work. The message types of the connection's subprotocol
+// take precedence, and messages received before the connection has been
+// initialized are handled as unknown messages.
+type MessageTypes map[string]MessageHandler
+
+// SendMessage sends a message of a custom type to a client. The type isn't
+// translated into one of its subprotocol, and the payload is encoded with
+// the codec of the connection. The message is dropped if the connection
+// has been closed; ErrUnsupportedConnection is returned for connections
+// that aren't served over WebSockets.
+func SendMessage(conn Connection, msg OperationMessage) error {
+	c, ok := conn.(*connection)
+	if !ok {
+		return ErrUnsupportedConnection
+	}
+	c.handleOutgoing(c, msg)
+	return nil
+}
+
+// handleCustomMessage passes a message of a custom type to its handler;
+// it returns false if there's none.
+func (conn *connection) handleCustomMessage(msg OperationMessage) bool {
+	handler := conn.config.MessageTypes[msg.Type]
+	if handler == nil || !conn.initialized {
+		return false
+	}
+	handler(conn, msg)
+	return true
+}
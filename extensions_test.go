@@ -0,0 +1,69 @@
+package graphqlws_test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+func TestMessageTypes_CustomMessagesAreHandled(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		MessageTypes: graphqlws.MessageTypes{
+			"presence": func(conn graphqlws.Connection, msg graphqlws.OperationMessage) {
+				payload := map[string]interface{}{}
+				json.Unmarshal(*msg.Payload.(*json.RawMessage), &payload)
+				graphqlws.SendMessage(conn, graphqlws.OperationMessage{
+					Type:    "presence_ack",
+					Payload: map[string]interface{}{"status": payload["status"]},
+				})
+			},
+		},
+	}))
+	defer srv.Close()
+
+	for _, subprotocol := range []string{graphqlws.SubprotocolGraphQLWS, graphqlws.SubprotocolGraphQLTransportWS} {
+		ws := dialServerWithSubprotocol(t, srv, subprotocol)
+		writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+		readOperationMessage(t, ws)
+
+		writeMessage(t, ws, map[string]interface{}{
+			"type":    "presence",
+			"payload": map[string]interface{}{"status": "away"},
+		})
+		msg := readOperationMessage(t, ws)
+		payload, _ := msg.Payload.(map[string]interface{})
+		if msg.Type != "presence_ack" || payload["status"] != "away" {
+			t.Errorf("%s: unexpected message: %v", subprotocol, msg)
+		}
+		ws.Close()
+	}
+}
+
+func TestMessageTypes_CustomMessagesRequireInitialization(t *testing.T) {
+	schema, _ := buildSchema()
+	handled := make(chan struct{}, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		MessageTypes: graphqlws.MessageTypes{
+			"presence": func(conn graphqlws.Connection, msg graphqlws.OperationMessage) {
+				handled <- struct{}{}
+			},
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLTransportWS)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{"type": "presence"})
+	expectClose(t, ws, 4400)
+	select {
+	case <-handled:
+		t.Error("message of uninitialized connection was handled")
+	default:
+	}
+}
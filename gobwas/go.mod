@@ -0,0 +1,29 @@
+module github.com/meandrewdev/graphqlws/gobwas
+
+go 1.17
+
+require (
+	github.com/gobwas/ws v1.1.0
+	github.com/gorilla/websocket v1.4.2
+	github.com/graphql-go/graphql v0.8.0
+	github.com/meandrewdev/graphqlws v0.0.0-00010101000000-000000000000
+	github.com/sirupsen/logrus v1.8.1
+)
+
+require (
+	github.com/gobwas/httphead v0.1.0 // indirect
+	github.com/gobwas/pool v0.2.1 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/mattn/go-colorable v0.1.8 // indirect
+	github.com/mattn/go-isatty v0.0.12 // indirect
+	github.com/mgutz/ansi v0.0.0-20200706080929-d51e80ef957d // indirect
+	github.com/onsi/ginkgo v1.16.5 // indirect
+	github.com/onsi/gomega v1.18.1 // indirect
+	github.com/stretchr/testify v1.8.0 // indirect
+	github.com/x-cray/logrus-prefixed-formatter v0.5.2 // indirect
+	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d // indirect
+	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
+	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211 // indirect
+)
+
+replace github.com/meandrewdev/graphqlws => ../
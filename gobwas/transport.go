@@ -0,0 +1,306 @@
+// Package gobwas runs graphqlws handlers on gobwas/ws instead of
+// gorilla/websocket. Its connections don't hold on to read and write
+// buffers while they are idle, which cuts the memory taken by servers
+// with many connections:
+//
+//	graphqlws.NewHandler(graphqlws.HandlerConfig{
+//		SubscriptionManager: subscriptionManager,
+//		Transport:           gobwas.NewTransport(gobwas.Config{}),
+//	})
+//
+// Its sockets implement graphqlws.PollableSocket, so connections can also
+// be read by a poller such as those of the netpoll package. Compression
+// is not supported.
+package gobwas
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/gorilla/websocket"
+	"github.com/meandrewdev/graphqlws"
+)
+
+// Time that replies to control frames may take to be written
+const controlTimeout = time.Second
+
+var errWriteTimeout = errors.New("gobwas: timed out waiting to write")
+
+// Config configures a gobwas/ws transport.
+type Config struct {
+	// HandshakeTimeout is the time writing handshake responses may take
+	// (optional).
+	HandshakeTimeout time.Duration
+}
+
+type transport struct {
+	config Config
+}
+
+// NewTransport creates a transport that upgrades requests with gobwas/ws.
+func NewTransport(config Config) graphqlws.Transport {
+	return &transport{config: config}
+}
+
+func (t *transport) Upgrade(w http.ResponseWriter, r *http.Request, subprotocols []string) (graphqlws.Socket, error) {
+	// Negotiate subprotocols in the server's order of preference rather
+	// than the client's
+	selected := selectSubprotocol(websocket.Subprotocols(r), subprotocols)
+	upgrader := ws.HTTPUpgrader{
+		Timeout: t.config.HandshakeTimeout,
+		Protocol: func(subprotocol string) bool {
+			return subprotocol == selected
+		},
+	}
+
+	conn, rw, handshake, err := upgrader.Upgrade(r, w)
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
+	return newSocket(conn, rw.Reader, handshake.Protocol), nil
+}
+
+func selectSubprotocol(offered []string, subprotocols []string) string {
+	for _, subprotocol := range subprotocols {
+		for _, candidate := range offered {
+			if candidate == subprotocol {
+				return subprotocol
+			}
+		}
+	}
+	return ""
+}
+
+/**
+ * Sockets implementing graphqlws.Socket with gobwas/ws.
+ */
+
+type socket struct {
+	conn        net.Conn
+	subprotocol string
+
+	// Only used by the goroutine reading messages; handshake holds the
+	// bytes of frames read along with the handshake
+	reader      *wsutil.Reader
+	handshake   *io.LimitedReader
+	readLimit   int64
+	pongHandler func(string) error
+
+	// Held while writing a frame; control frames give up waiting for it
+	// once their deadline has passed
+	writeLock     chan struct{}
+	writeDeadline time.Time
+}
+
+func newSocket(conn net.Conn, buffered *bufio.Reader, subprotocol string) *socket {
+	// Only keep the buffer of the handshake if the client has already
+	// sent frames
+	source := io.Reader(conn)
+	var handshake *io.LimitedReader
+	if buffered != nil && buffered.Buffered() > 0 {
+		handshake = &io.LimitedReader{R: buffered, N: int64(buffered.Buffered())}
+		source = io.MultiReader(handshake, conn)
+	}
+
+	s := &socket{
+		conn:        conn,
+		subprotocol: subprotocol,
+		handshake:   handshake,
+		writeLock:   make(chan struct{}, 1),
+	}
+	s.reader = &wsutil.Reader{
+		Source:         source,
+		State:          ws.StateServerSide,
+		CheckUTF8:      true,
+		OnIntermediate: s.handleControl,
+	}
+	return s
+}
+
+func (s *socket) Subprotocol() string {
+	return s.subprotocol
+}
+
+func (s *socket) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *socket) ReadMessage() (int, []byte, error) {
+	return s.readFrame(false)
+}
+
+// ReadFrame implements graphqlws.PollableSocket.
+func (s *socket) ReadFrame() (int, []byte, error) {
+	return s.readFrame(true)
+}
+
+// readFrame reads the next message and, if returnControl is set, returns
+// after handling a control frame.
+func (s *socket) readFrame(returnControl bool) (int, []byte, error) {
+	for {
+		header, err := s.reader.NextFrame()
+		if err != nil {
+			return 0, nil, s.readError(err)
+		}
+		if header.OpCode.IsControl() {
+			if err := s.handleControl(header, s.reader); err != nil {
+				return 0, nil, s.readError(err)
+			}
+			if returnControl {
+				return int(header.OpCode), nil, nil
+			}
+			continue
+		}
+
+		r := io.Reader(s.reader)
+		if s.readLimit > 0 {
+			r = io.LimitReader(r, s.readLimit+1)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return 0, nil, s.readError(err)
+		}
+		if s.readLimit > 0 && int64(len(data)) > s.readLimit {
+			return 0, nil, s.readError(wsutil.ErrFrameTooLarge)
+		}
+		return int(header.OpCode), data, nil
+	}
+}
+
+// readError converts errors into those returned by gorilla/websocket.
+func (s *socket) readError(err error) error {
+	switch err {
+	case wsutil.ErrFrameTooLarge:
+		s.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseMessageTooBig, ""),
+			time.Now().Add(controlTimeout),
+		)
+		return websocket.ErrReadLimit
+	case io.EOF, io.ErrUnexpectedEOF:
+		return &websocket.CloseError{
+			Code: websocket.CloseAbnormalClosure,
+			Text: io.ErrUnexpectedEOF.Error(),
+		}
+	}
+	return err
+}
+
+// handleControl handles a control frame with its unmasked payload.
+func (s *socket) handleControl(header ws.Header, payload io.Reader) error {
+	data, err := ioutil.ReadAll(payload)
+	if err != nil {
+		return err
+	}
+
+	switch header.OpCode {
+	case ws.OpPing:
+		s.WriteControl(websocket.PongMessage, data, time.Now().Add(controlTimeout))
+	case ws.OpPong:
+		if s.pongHandler != nil {
+			return s.pongHandler(string(data))
+		}
+	case ws.OpClose:
+		// Echo the close code, as gorilla/websocket does
+		closeErr := &websocket.CloseError{Code: websocket.CloseNoStatusReceived}
+		reply := []byte{}
+		if len(data) >= 2 {
+			code, reason := ws.ParseCloseFrameData(data)
+			closeErr.Code, closeErr.Text = int(code), reason
+			reply = websocket.FormatCloseMessage(closeErr.Code, "")
+		}
+		s.WriteControl(websocket.CloseMessage, reply, time.Now().Add(controlTimeout))
+		return closeErr
+	}
+	return nil
+}
+
+// NetConn implements graphqlws.PollableSocket.
+func (s *socket) NetConn() net.Conn {
+	return s.conn
+}
+
+// Buffered implements graphqlws.PollableSocket; frames are read from the
+// network connection as they are needed, except for the bytes that were
+// read along with the handshake.
+func (s *socket) Buffered() int {
+	if s.handshake == nil {
+		return 0
+	}
+	return int(s.handshake.N)
+}
+
+func (s *socket) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+func (s *socket) SetReadLimit(limit int64) {
+	s.readLimit = limit
+	s.reader.MaxFrameSize = limit
+}
+
+func (s *socket) SetPongHandler(h func(appData string) error) {
+	s.pongHandler = h
+}
+
+func (s *socket) WriteMessage(messageType int, data []byte) error {
+	s.writeLock <- struct{}{}
+	defer func() { <-s.writeLock }()
+
+	s.conn.SetWriteDeadline(s.writeDeadline)
+	return s.writeFrame(ws.OpCode(messageType), data)
+}
+
+func (s *socket) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	timer := time.NewTimer(time.Until(deadline))
+	select {
+	case s.writeLock <- struct{}{}:
+		timer.Stop()
+	case <-timer.C:
+		return errWriteTimeout
+	}
+	defer func() { <-s.writeLock }()
+
+	s.conn.SetWriteDeadline(deadline)
+	return s.writeFrame(ws.OpCode(messageType), data)
+}
+
+// writeFrame writes a frame with a single system call; s.writeLock must
+// be held by the caller.
+func (s *socket) writeFrame(opCode ws.OpCode, data []byte) error {
+	header := bytes.NewBuffer(make([]byte, 0, ws.MaxHeaderSize))
+	err := ws.WriteHeader(header, ws.Header{
+		Fin:    true,
+		OpCode: opCode,
+		Length: int64(len(data)),
+	})
+	if err != nil {
+		return err
+	}
+
+	buffers := net.Buffers{header.Bytes(), data}
+	_, err = buffers.WriteTo(s.conn)
+	return err
+}
+
+func (s *socket) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline = t
+	return nil
+}
+
+func (s *socket) EnableWriteCompression(enable bool) {}
+
+func (s *socket) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,162 @@
+package gobwas_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/gobwas"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	m.Run()
+}
+
+func buildSchema(t *testing.T) *graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"hello": &graphql.Field{Type: graphql.String},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"ticks": &graphql.Field{Type: graphql.Int},
+			},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("could not build schema: %v", err)
+	}
+	return &schema
+}
+
+func dial(t *testing.T, srv *httptest.Server, header http.Header) (*websocket.Conn, *http.Response, error) {
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Sec-WebSocket-Protocol", graphqlws.SubprotocolGraphQLWS+", "+graphqlws.SubprotocolGraphQLTransportWS)
+	return websocket.DefaultDialer.Dial(url, header)
+}
+
+func read(t *testing.T, ws *websocket.Conn) graphqlws.OperationMessage {
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg := graphqlws.OperationMessage{}
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("could not read message: %v", err)
+	}
+	return msg
+}
+
+func TestTransport_ConnectionsRunOnGobwas(t *testing.T) {
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildSchema(t)),
+		Transport:           gobwas.NewTransport(gobwas.Config{}),
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	}))
+	defer srv.Close()
+
+	ws, _, err := dial(t, srv, nil)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer ws.Close()
+
+	// Subprotocols are negotiated in the server's order of preference
+	if ws.Subprotocol() != graphqlws.SubprotocolGraphQLTransportWS {
+		t.Errorf("unexpected subprotocol: %s", ws.Subprotocol())
+	}
+
+	ws.WriteJSON(map[string]interface{}{"type": "connection_init"})
+	if msg := read(t, ws); msg.Type != "connection_ack" {
+		t.Fatalf("expected connection_ack, received: %v", msg)
+	}
+
+	ws.WriteJSON(map[string]interface{}{
+		"id":      "1",
+		"type":    "subscribe",
+		"payload": map[string]interface{}{"query": "subscription { ticks }"},
+	})
+	var s *graphqlws.Subscription
+	select {
+	case s = <-subscriptions:
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription was not started")
+	}
+
+	s.SendData(&graphqlws.DataMessagePayload{Data: map[string]interface{}{"ticks": 1}})
+	if msg := read(t, ws); msg.Type != "next" || msg.ID != "1" {
+		t.Errorf("unexpected data message: %v", msg)
+	}
+
+	// Pings are answered with pongs carrying their payload
+	pongs := make(chan string, 1)
+	ws.SetPongHandler(func(data string) error {
+		pongs <- data
+		return nil
+	})
+	ws.WriteControl(websocket.PingMessage, []byte("hello"), time.Now().Add(time.Second))
+	go ws.ReadMessage()
+	select {
+	case data := <-pongs:
+		if data != "hello" {
+			t.Errorf("unexpected pong payload: %q", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("ping was not answered")
+	}
+}
+
+func TestTransport_ConnectionsAreClosedWithCloseCodes(t *testing.T) {
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildSchema(t)),
+		Transport:           gobwas.NewTransport(gobwas.Config{}),
+		MaxMessageSize:      64,
+	}))
+	defer srv.Close()
+
+	ws, _, err := dial(t, srv, nil)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer ws.Close()
+
+	ws.WriteJSON(map[string]interface{}{
+		"type":    "connection_init",
+		"payload": map[string]interface{}{"padding": strings.Repeat("a", 100)},
+	})
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("expected close code 1009, received: %v", err)
+	}
+}
+
+func TestTransport_OriginsAreChecked(t *testing.T) {
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildSchema(t)),
+		Transport:           gobwas.NewTransport(gobwas.Config{}),
+		AllowedOrigins:      []string{"https://example.com"},
+	}))
+	defer srv.Close()
+
+	_, resp, err := dial(t, srv, http.Header{"Origin": []string{"https://evil.example.com"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("connection from a disallowed origin is not rejected: %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+// Package gqlgen bridges gqlgen executable schemas to graphqlws, so that
+// gqlgen servers can serve subscriptions over graphqlws connections.
+package gqlgen
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/executor"
+	"github.com/meandrewdev/graphqlws"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// operation is a subscription being executed by gqlgen.
+type operation struct {
+	subscription *graphqlws.Subscription
+	cancel       context.CancelFunc
+}
+
+/**
+ * A SubscriptionManager that executes subscriptions with gqlgen.
+ */
+
+type subscriptionManager struct {
+	exec       graphql.GraphExecutor
+	operations map[graphqlws.Connection]map[string]*operation
+	logger     graphqlws.Logger
+	mutex      *sync.Mutex
+}
+
+// NewSubscriptionManager creates a subscription manager that executes
+// subscriptions against a gqlgen executable schema. Each subscription
+// runs until its resolvers close their channels, after which it is
+// completed, or until it is stopped.
+func NewSubscriptionManager(es graphql.ExecutableSchema) graphqlws.SubscriptionManager {
+	return NewSubscriptionManagerWithExecutor(executor.New(es))
+}
+
+// NewSubscriptionManagerWithExecutor creates a subscription manager that
+// executes subscriptions with a gqlgen executor, e.g. one configured with
+// extensions or a query cache.
+func NewSubscriptionManagerWithExecutor(exec graphql.GraphExecutor) graphqlws.SubscriptionManager {
+	return &subscriptionManager{
+		exec:       exec,
+		operations: make(map[graphqlws.Connection]map[string]*operation),
+		logger:     graphqlws.NewLogger("gqlgen"),
+		mutex:      &sync.Mutex{},
+	}
+}
+
+func (m *subscriptionManager) Subscriptions() graphqlws.Subscriptions {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	subscriptions := make(graphqlws.Subscriptions, len(m.operations))
+	for conn, operations := range m.operations {
+		subscriptions[conn] = make(graphqlws.ConnectionSubscriptions, len(operations))
+		for opID, op := range operations {
+			subscriptions[conn][opID] = op.subscription
+		}
+	}
+	return subscriptions
+}
+
+func (m *subscriptionManager) AddSubscription(
+	conn graphqlws.Connection,
+	subscription *graphqlws.Subscription,
+) []error {
+	m.logger.WithFields(graphqlws.Fields{
+		"conn":         conn.ID(),
+		"subscription": subscription.ID,
+	}).Info("Add subscription")
+
+	// Resolvers see the values of the connection's upgrade request
+	parent := subscription.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx := graphql.StartOperationTrace(parent)
+	rc, errs := m.exec.CreateOperationContext(ctx, &graphql.RawParams{
+		Query:         subscription.Query,
+		OperationName: subscription.OperationName,
+		Variables:     subscription.Variables,
+		ReadTime: graphql.TraceTiming{
+			Start: graphql.Now(),
+			End:   graphql.Now(),
+		},
+	})
+	if errs != nil {
+		m.logger.WithField("errors", errs).Warn("Failed to create operation")
+		resp := m.exec.DispatchError(graphql.WithOperationContext(ctx, rc), errs)
+		return errorsFromList(resp.Errors)
+	}
+
+	// Extract the top-level fields of the operation
+	subscription.Fields = fieldNames(rc.Operation)
+
+	ctx, cancel := context.WithCancel(graphql.WithOperationContext(ctx, rc))
+	op := &operation{subscription: subscription, cancel: cancel}
+
+	m.mutex.Lock()
+	if m.operations[conn][subscription.ID] != nil {
+		m.mutex.Unlock()
+		cancel()
+		return []error{errors.New("Cannot register subscription twice")}
+	}
+	if m.operations[conn] == nil {
+		m.operations[conn] = make(map[string]*operation)
+	}
+	m.operations[conn][subscription.ID] = op
+	m.mutex.Unlock()
+
+	go m.run(ctx, conn, op, rc)
+
+	return nil
+}
+
+// run sends the responses of an operation to the subscriber until there
+// are no more responses or the operation is stopped.
+func (m *subscriptionManager) run(
+	ctx context.Context,
+	conn graphqlws.Connection,
+	op *operation,
+	rc *graphql.OperationContext,
+) {
+	defer op.cancel()
+
+	responses, ctx := m.exec.DispatchOperation(ctx, rc)
+	for {
+		response := responses(ctx)
+		if response == nil || ctx.Err() != nil {
+			break
+		}
+
+		op.subscription.SendData(&graphqlws.DataMessagePayload{
+			Data:       response.Data,
+			Errors:     errorsFromList(response.Errors),
+			Extensions: response.Extensions,
+		})
+	}
+
+	// Complete operations that ended on their own
+	if m.remove(conn, op) {
+		conn.TrySendComplete(op.subscription.ID)
+	}
+}
+
+// remove unregisters an operation and reports whether it was registered.
+func (m *subscriptionManager) remove(conn graphqlws.Connection, op *operation) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.operations[conn][op.subscription.ID] != op {
+		return false
+	}
+	delete(m.operations[conn], op.subscription.ID)
+	if len(m.operations[conn]) == 0 {
+		delete(m.operations, conn)
+	}
+	return true
+}
+
+func (m *subscriptionManager) RemoveSubscription(
+	conn graphqlws.Connection,
+	subscription *graphqlws.Subscription,
+) {
+	m.logger.WithFields(graphqlws.Fields{
+		"conn":         conn.ID(),
+		"subscription": subscription.ID,
+	}).Info("Remove subscription")
+
+	m.mutex.Lock()
+	op := m.operations[conn][subscription.ID]
+	m.mutex.Unlock()
+
+	if op != nil && m.remove(conn, op) {
+		op.cancel()
+	}
+}
+
+func (m *subscriptionManager) RemoveSubscriptions(conn graphqlws.Connection) {
+	m.logger.WithFields(graphqlws.Fields{
+		"conn": conn.ID(),
+	}).Info("Remove subscriptions")
+
+	m.mutex.Lock()
+	operations := m.operations[conn]
+	delete(m.operations, conn)
+	m.mutex.Unlock()
+
+	for _, op := range operations {
+		op.cancel()
+	}
+}
+
+// errorsFromList converts gqlgen errors to regular errors.
+func errorsFromList(list gqlerror.List) []error {
+	if len(list) == 0 {
+		return nil
+	}
+	errs := make([]error, len(list))
+	for i := range list {
+		errs[i] = list[i]
+	}
+	return errs
+}
+
+// fieldNames returns the names of the top-level fields of an operation.
+func fieldNames(op *ast.OperationDefinition) []string {
+	names := []string{}
+	if op == nil {
+		return names
+	}
+	for _, selection := range op.SelectionSet {
+		if field, ok := selection.(*ast.Field); ok {
+			names = append(names, field.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,123 @@
+package gqlgen_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/gorilla/websocket"
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/gqlgen"
+	log "github.com/sirupsen/logrus"
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	m.Run()
+}
+
+// tickSchema is an executable schema with a subscription that emits
+// a fixed number of ticks.
+type tickSchema struct {
+	ticks int
+}
+
+func (s *tickSchema) Schema() *ast.Schema {
+	return gqlparser.MustLoadSchema(&ast.Source{Input: `
+		type Query { hello: String }
+		type Subscription { ticks: Int }
+	`})
+}
+
+func (s *tickSchema) Complexity(typeName, field string, childComplexity int, args map[string]interface{}) (int, bool) {
+	return 0, false
+}
+
+func (s *tickSchema) Exec(ctx context.Context) graphql.ResponseHandler {
+	tick := 0
+	return func(ctx context.Context) *graphql.Response {
+		if tick == s.ticks {
+			return nil
+		}
+		tick++
+		return &graphql.Response{
+			Data: json.RawMessage(fmt.Sprintf(`{"ticks":%d}`, tick)),
+		}
+	}
+}
+
+func dial(t *testing.T, manager graphqlws.SubscriptionManager) *websocket.Conn {
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: manager,
+	}))
+	t.Cleanup(srv.Close)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{
+		"Sec-WebSocket-Protocol": []string{graphqlws.SubprotocolGraphQLWS},
+	})
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func read(t *testing.T, ws *websocket.Conn) map[string]interface{} {
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg := map[string]interface{}{}
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("could not read message: %v", err)
+	}
+	return msg
+}
+
+func start(t *testing.T, ws *websocket.Conn, query string) {
+	err := ws.WriteJSON(map[string]interface{}{
+		"id":      "1",
+		"type":    "start",
+		"payload": map[string]interface{}{"query": query},
+	})
+	if err != nil {
+		t.Fatalf("could not start subscription: %v", err)
+	}
+}
+
+func TestSubscriptionManager_ResultsAreSentUntilCompletion(t *testing.T) {
+	ws := dial(t, gqlgen.NewSubscriptionManager(&tickSchema{ticks: 2}))
+
+	start(t, ws, "subscription { ticks }")
+
+	for tick := 1; tick <= 2; tick++ {
+		msg := read(t, ws)
+		payload, _ := msg["payload"].(map[string]interface{})
+		data, _ := payload["data"].(map[string]interface{})
+		if msg["type"] != "data" || data["ticks"] != float64(tick) {
+			t.Fatalf("expected tick %d, received: %v", tick, msg)
+		}
+	}
+
+	if msg := read(t, ws); msg["type"] != "complete" || msg["id"] != "1" {
+		t.Fatalf("expected complete, received: %v", msg)
+	}
+}
+
+func TestSubscriptionManager_InvalidOperationsAreRejected(t *testing.T) {
+	ws := dial(t, gqlgen.NewSubscriptionManager(&tickSchema{}))
+
+	start(t, ws, "subscription { unknown }")
+
+	msg := read(t, ws)
+	errs, _ := msg["payload"].([]interface{})
+	if msg["type"] != "error" || len(errs) == 0 {
+		t.Fatalf("expected error, received: %v", msg)
+	}
+}
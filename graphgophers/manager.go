@@ -0,0 +1,224 @@
+// Package graphgophers bridges graph-gophers/graphql-go schemas to
+// graphqlws, so that their subscriptions can be served over graphqlws
+// connections.
+package graphgophers
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	qerrors "github.com/graph-gophers/graphql-go/errors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/meandrewdev/graphqlws"
+)
+
+// operation is a subscription being executed by graph-gophers.
+type operation struct {
+	subscription *graphqlws.Subscription
+	cancel       context.CancelFunc
+}
+
+/**
+ * A SubscriptionManager that executes subscriptions with graph-gophers.
+ */
+
+type subscriptionManager struct {
+	schema     *graphql.Schema
+	operations map[graphqlws.Connection]map[string]*operation
+	logger     graphqlws.Logger
+	mutex      *sync.Mutex
+}
+
+// NewSubscriptionManager creates a subscription manager that executes
+// subscriptions with schema.Subscribe. Each result emitted by a
+// subscription is sent to the subscriber; the subscription is completed
+// once its channel is closed.
+func NewSubscriptionManager(schema *graphql.Schema) graphqlws.SubscriptionManager {
+	return &subscriptionManager{
+		schema:     schema,
+		operations: make(map[graphqlws.Connection]map[string]*operation),
+		logger:     graphqlws.NewLogger("graphgophers"),
+		mutex:      &sync.Mutex{},
+	}
+}
+
+func (m *subscriptionManager) Subscriptions() graphqlws.Subscriptions {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	subscriptions := make(graphqlws.Subscriptions, len(m.operations))
+	for conn, operations := range m.operations {
+		subscriptions[conn] = make(graphqlws.ConnectionSubscriptions, len(operations))
+		for opID, op := range operations {
+			subscriptions[conn][opID] = op.subscription
+		}
+	}
+	return subscriptions
+}
+
+func (m *subscriptionManager) AddSubscription(
+	conn graphqlws.Connection,
+	subscription *graphqlws.Subscription,
+) []error {
+	m.logger.WithFields(graphqlws.Fields{
+		"conn":         conn.ID(),
+		"subscription": subscription.ID,
+	}).Info("Add subscription")
+
+	// Validate the query up front, since Subscribe reports errors
+	// through the results channel
+	if errs := m.schema.ValidateWithVariables(subscription.Query, subscription.Variables); len(errs) > 0 {
+		m.logger.WithField("errors", errs).Warn("Failed to validate subscription query")
+		return errorsFromQueryErrors(errs)
+	}
+
+	// Remember the query document and its fields for later
+	if document, err := parser.Parse(parser.ParseParams{Source: subscription.Query}); err == nil {
+		subscription.Document = document
+		subscription.Fields = fieldNames(document)
+	}
+
+	// Resolvers see the values of the connection's upgrade request
+	parent := subscription.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	results, err := m.schema.Subscribe(ctx, subscription.Query, subscription.OperationName, subscription.Variables)
+	if err != nil {
+		cancel()
+		m.logger.WithField("err", err).Warn("Failed to subscribe")
+		return []error{err}
+	}
+
+	op := &operation{subscription: subscription, cancel: cancel}
+
+	m.mutex.Lock()
+	if m.operations[conn][subscription.ID] != nil {
+		m.mutex.Unlock()
+		cancel()
+		return []error{errors.New("Cannot register subscription twice")}
+	}
+	if m.operations[conn] == nil {
+		m.operations[conn] = make(map[string]*operation)
+	}
+	m.operations[conn][subscription.ID] = op
+	m.mutex.Unlock()
+
+	go m.run(ctx, conn, op, results)
+
+	return nil
+}
+
+// run sends the results of an operation to the subscriber until its
+// channel is closed or the operation is stopped.
+func (m *subscriptionManager) run(
+	ctx context.Context,
+	conn graphqlws.Connection,
+	op *operation,
+	results <-chan interface{},
+) {
+	defer op.cancel()
+
+	for result := range results {
+		if ctx.Err() != nil {
+			break
+		}
+
+		response, ok := result.(*graphql.Response)
+		if !ok {
+			continue
+		}
+		op.subscription.SendData(&graphqlws.DataMessagePayload{
+			Data:       response.Data,
+			Errors:     errorsFromQueryErrors(response.Errors),
+			Extensions: response.Extensions,
+		})
+	}
+
+	// Complete operations that ended on their own
+	if m.remove(conn, op) {
+		conn.TrySendComplete(op.subscription.ID)
+	}
+}
+
+// remove unregisters an operation and reports whether it was registered.
+func (m *subscriptionManager) remove(conn graphqlws.Connection, op *operation) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.operations[conn][op.subscription.ID] != op {
+		return false
+	}
+	delete(m.operations[conn], op.subscription.ID)
+	if len(m.operations[conn]) == 0 {
+		delete(m.operations, conn)
+	}
+	return true
+}
+
+func (m *subscriptionManager) RemoveSubscription(
+	conn graphqlws.Connection,
+	subscription *graphqlws.Subscription,
+) {
+	m.logger.WithFields(graphqlws.Fields{
+		"conn":         conn.ID(),
+		"subscription": subscription.ID,
+	}).Info("Remove subscription")
+
+	m.mutex.Lock()
+	op := m.operations[conn][subscription.ID]
+	m.mutex.Unlock()
+
+	if op != nil && m.remove(conn, op) {
+		op.cancel()
+	}
+}
+
+func (m *subscriptionManager) RemoveSubscriptions(conn graphqlws.Connection) {
+	m.logger.WithFields(graphqlws.Fields{
+		"conn": conn.ID(),
+	}).Info("Remove subscriptions")
+
+	m.mutex.Lock()
+	operations := m.operations[conn]
+	delete(m.operations, conn)
+	m.mutex.Unlock()
+
+	for _, op := range operations {
+		op.cancel()
+	}
+}
+
+// errorsFromQueryErrors converts graph-gophers errors to regular errors.
+func errorsFromQueryErrors(list []*qerrors.QueryError) []error {
+	if len(list) == 0 {
+		return nil
+	}
+	errs := make([]error, len(list))
+	for i := range list {
+		errs[i] = list[i]
+	}
+	return errs
+}
+
+// fieldNames returns the names of the top-level fields of the
+// subscriptions in a document.
+func fieldNames(document *ast.Document) []string {
+	names := []string{}
+	for _, node := range document.Definitions {
+		def, ok := node.(*ast.OperationDefinition)
+		if !ok || def.Operation != ast.OperationTypeSubscription || def.SelectionSet == nil {
+			continue
+		}
+		for _, selection := range def.SelectionSet.Selections {
+			if field, ok := selection.(*ast.Field); ok {
+				names = append(names, field.Name.Value)
+			}
+		}
+	}
+	return names
+}
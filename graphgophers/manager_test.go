@@ -0,0 +1,124 @@
+package graphgophers_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/graphgophers"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	m.Run()
+}
+
+const tickSchema = `
+	schema {
+		query: Query
+		subscription: Subscription
+	}
+	type Query { hello: String! }
+	type Subscription { ticks: Int! }
+`
+
+// tickResolver resolves a subscription that emits a fixed number of ticks.
+type tickResolver struct {
+	ticks int32
+}
+
+func (r *tickResolver) Hello() string {
+	return "world"
+}
+
+func (r *tickResolver) Ticks(ctx context.Context) <-chan int32 {
+	ticks := make(chan int32)
+	go func() {
+		defer close(ticks)
+		for tick := int32(1); tick <= r.ticks; tick++ {
+			select {
+			case ticks <- tick:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ticks
+}
+
+func dial(t *testing.T, manager graphqlws.SubscriptionManager) *websocket.Conn {
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: manager,
+	}))
+	t.Cleanup(srv.Close)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{
+		"Sec-WebSocket-Protocol": []string{graphqlws.SubprotocolGraphQLWS},
+	})
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func read(t *testing.T, ws *websocket.Conn) map[string]interface{} {
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg := map[string]interface{}{}
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("could not read message: %v", err)
+	}
+	return msg
+}
+
+func start(t *testing.T, ws *websocket.Conn, query string) {
+	err := ws.WriteJSON(map[string]interface{}{
+		"id":      "1",
+		"type":    "start",
+		"payload": map[string]interface{}{"query": query},
+	})
+	if err != nil {
+		t.Fatalf("could not start subscription: %v", err)
+	}
+}
+
+func TestSubscriptionManager_ResultsAreSentUntilCompletion(t *testing.T) {
+	schema := graphql.MustParseSchema(tickSchema, &tickResolver{ticks: 2})
+	ws := dial(t, graphgophers.NewSubscriptionManager(schema))
+
+	start(t, ws, "subscription { ticks }")
+
+	for tick := 1; tick <= 2; tick++ {
+		msg := read(t, ws)
+		payload, _ := msg["payload"].(map[string]interface{})
+		data, _ := payload["data"].(map[string]interface{})
+		if msg["type"] != "data" || data["ticks"] != float64(tick) {
+			t.Fatalf("expected tick %d, received: %v", tick, msg)
+		}
+	}
+
+	if msg := read(t, ws); msg["type"] != "complete" || msg["id"] != "1" {
+		t.Fatalf("expected complete, received: %v", msg)
+	}
+}
+
+func TestSubscriptionManager_InvalidOperationsAreRejected(t *testing.T) {
+	schema := graphql.MustParseSchema(tickSchema, &tickResolver{})
+	ws := dial(t, graphgophers.NewSubscriptionManager(schema))
+
+	start(t, ws, "subscription { unknown }")
+
+	msg := read(t, ws)
+	errs, _ := msg["payload"].([]interface{})
+	if msg["type"] != "error" || len(errs) == 0 {
+		t.Fatalf("expected error, received: %v", msg)
+	}
+}
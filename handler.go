@@ -1,74 +1,973 @@
 package graphqlws
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
-	log "github.com/sirupsen/logrus"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/parser"
 )
 
 // CustomEventHandlers define the custom event handlers for a connection
 type CustomEventHandlers struct {
+	// Open is called whenever a connection has been established, with the
+	// HTTP request it was upgraded from, e.g. to read tracing headers.
+	Open func(Connection, *http.Request)
+
 	// Close is called whenever the connection is closed and before standart handler,
 	// regardless of whether this happens because of an error or a deliberate termination
 	// by the client.
 	Close func(Connection)
 
+	// Init is called whenever a client has successfully initialized its
+	// connection and receives the payload of the connection_init message,
+	// e.g. to read client metadata like versions or tracing headers.
+	Init func(Connection, map[string]interface{})
+
 	// NewSubscription is called whenever the new subscription added
 	NewSubscription func(*Subscription, []error)
 
 	// StopSubscription is called whenever the subscription stopped and pass it's id
 	StopSubscription func(string)
+
+	// UpgradeFailed is called whenever a request can't be upgraded to a
+	// GraphQL WebSocket connection, e.g. because the client doesn't speak
+	// any of the accepted subprotocols.
+	UpgradeFailed func(*http.Request, error)
+
+	// SendFailed is called whenever a message can't be sent to a client;
+	// see ConnectionEventHandlers.SendFailed.
+	SendFailed func(Connection, error)
+
+	// SlowClient is called whenever the connection of a slow client is
+	// about to be closed; see HandlerConfig.SlowClientBacklog.
+	SlowClient func(Connection)
+
+	// Error is called whenever a connection fails to read, decode, encode
+	// or write a message, with the connection and, for messages of
+	// operations, the operation ID; see ConnectionEventHandlers.Error.
+	Error func(*ConnectionError)
 }
 
+// AuthorizeOperationFunc is a function that decides whether a connection
+// may start a subscription, returning the errors to send to the client if
+// it may not.
+type AuthorizeOperationFunc func(Connection, *Subscription) []error
+
+// RequestAuthenticateFunc is a function that resolves the auth token of
+// a connection into a user, with access to the connection and the HTTP
+// request it was upgraded from, e.g. to read the token from its headers.
+// The request is nil when the new token of a connection_refresh message
+// is authenticated, as the headers of the upgrade request may hold a
+// token that has expired or been revoked by then.
+type RequestAuthenticateFunc func(conn Connection, r *http.Request, token string) (interface{}, error)
+
+// IDGeneratorFunc is a function that generates the ID of the connection
+// upgraded from a request, e.g. a ULID, an ID with a region prefix or the
+// request ID assigned by a gateway.
+type IDGeneratorFunc func(r *http.Request) string
+
 // HandlerConfig stores the configuration of a GraphQL WebSocket handler.
 type HandlerConfig struct {
 	SubscriptionManager SubscriptionManager
 	Authenticate        AuthenticateFunc
 	EventHandlers       CustomEventHandlers
+
+	// IDGenerator generates the IDs of connections (optional); IDs need
+	// to be unique to the server. Connections it returns an empty ID for
+	// get a random UUID, which is also the default.
+	IDGenerator IDGeneratorFunc
+
+	// Events receives the lifecycle events of the handler's connections
+	// (optional). Unlike EventHandlers, an event bus can have any number
+	// of listeners for each event.
+	Events EventBus
+
+	// AuthenticateRequest is used instead of Authenticate if set, e.g.
+	// to authenticate clients based on the headers of the upgrade request
+	// or of the requests of the HTTP transports.
+	AuthenticateRequest RequestAuthenticateFunc
+
+	// RefreshAuth authenticates new auth tokens presented by clients over
+	// initialized connections; see ConnectionConfig.
+	RefreshAuth RefreshAuthFunc
+
+	// AckPayload returns the payload of the connection_ack sent to each
+	// client (optional); see ConnectionConfig.
+	AckPayload AckPayloadFunc
+
+	// StrictProtocol enforces the operation rules of the
+	// graphql-transport-ws protocol on connections of other subprotocols
+	// (optional); see ConnectionConfig.
+	StrictProtocol bool
+
+	// AuthorizeOperation is called before each subscription is added to
+	// the subscription manager, with the user available from the
+	// connection (optional). Subscriptions it returns errors for are
+	// rejected.
+	AuthorizeOperation AuthorizeOperationFunc
+
+	// SubscriptionFilter is set as the filter of every subscription
+	// started over the handler's connections (optional), so that events
+	// published through the subscription manager reach only the
+	// subscribers they are meant for; see Subscription.Filter.
+	SubscriptionFilter SubscriptionFilterFunc
+
+	// SubscriptionScope returns the auth scope of every subscription
+	// started over the handler's connections (optional). Identical
+	// subscriptions share the execution of each published event within
+	// their scope; see Subscription.Scope.
+	SubscriptionScope SubscriptionScopeFunc
+
+	// Subprotocols lists the WebSocket subprotocols accepted by the
+	// handler, in order of preference. Each connection uses the message
+	// types of the subprotocol negotiated with its client. Defaults to
+	// SubprotocolGraphQLTransportWS and SubprotocolGraphQLWS.
+	Subprotocols []string
+
+	// ConnectionInitWaitTimeout is the time clients have to initialize
+	// connections before they are closed with code 4408 (optional).
+	ConnectionInitWaitTimeout time.Duration
+
+	// KeepAliveInterval is the interval at which keep-alive messages are
+	// sent to clients; zero (the default) disables them.
+	KeepAliveInterval time.Duration
+
+	// IdleTimeout closes connections without active subscriptions that
+	// haven't received a message for the given time (optional); see
+	// ConnectionConfig.
+	IdleTimeout time.Duration
+
+	// MaxConnectionAge gracefully closes connections after the given time
+	// (optional), which makes clients reconnect; see ConnectionConfig.
+	MaxConnectionAge time.Duration
+
+	// PingInterval, PongWait and MaxMissedPings configure WebSocket ping
+	// frames used to detect and close dead connections; see
+	// ConnectionConfig.
+	PingInterval   time.Duration
+	PongWait       time.Duration
+	MaxMissedPings int
+
+	// CheckOrigin decides whether to accept an upgrade request, or a
+	// request of one of the HTTP transports, based on its Origin header.
+	// If it is nil and AllowedOrigins is empty, all origins are accepted.
+	CheckOrigin func(r *http.Request) bool
+
+	// AllowedOrigins lists the origins (e.g. "https://example.com") that
+	// are accepted if CheckOrigin is nil; "*" accepts all origins.
+	// Requests without an Origin header, which don't come from browsers,
+	// are always accepted.
+	AllowedOrigins []string
+
+	// ReadBufferSize, WriteBufferSize, HandshakeTimeout and
+	// EnableCompression tune the underlying WebSocket upgrader; see
+	// websocket.Upgrader. Zero values keep the upgrader's defaults.
+	ReadBufferSize    int
+	WriteBufferSize   int
+	HandshakeTimeout  time.Duration
+	EnableCompression bool
+
+	// CompressionThreshold is the minimum size of data messages that are
+	// compressed if EnableCompression is set; see ConnectionConfig.
+	CompressionThreshold int
+
+	// MaxMessageSize is the maximum size of messages received from
+	// clients; see ConnectionConfig.
+	MaxMessageSize int64
+
+	// MaxSubscriptionsPerConnection limits the number of subscriptions each
+	// connection may have active (optional); exceeding subscriptions are
+	// rejected with an error or, if CloseOnSubscriptionLimit is set, close
+	// the connection. See ConnectionConfig.MaxOperations.
+	MaxSubscriptionsPerConnection int
+	CloseOnSubscriptionLimit      bool
+
+	// SubscriptionRateLimit and SubscriptionRateBurst limit the rate at
+	// which each connection may start and stop subscriptions (optional);
+	// subscriptions exceeding the rate are rejected with an error or, if
+	// CloseOnSubscriptionRateLimit is set, close the connection. See
+	// ConnectionConfig.OperationRateLimit. Operations served over HTTP are
+	// limited per user, or per IP address for anonymous clients, and
+	// rejected when they exceed the rate.
+	SubscriptionRateLimit        float64
+	SubscriptionRateBurst        int
+	CloseOnSubscriptionRateLimit bool
+
+	// MessageRateLimits limits the rate of incoming messages by type
+	// (optional); see ConnectionConfig. The limits of start and stop
+	// messages apply to operations served over HTTP as well, like
+	// SubscriptionRateLimit.
+	MessageRateLimits map[string]MessageRateLimit
+
+	// MaxConnectionsPerUser and MaxConnectionsPerIP limit the number of
+	// concurrent connections of each authenticated user and from each
+	// client IP address (optional). Users are compared as map keys and
+	// need to be comparable values, e.g. strings or IDs.
+	MaxConnectionsPerUser int
+	MaxConnectionsPerIP   int
+
+	// ClientIP resolves the IP addresses of clients (optional), which
+	// MaxConnectionsPerIP and Connection.ClientIP use. Defaults to the
+	// host of the requests' remote addresses.
+	ClientIP ClientIPFunc
+
+	// ConnectionLimitPolicy decides whether connections exceeding one of
+	// the connection limits are rejected (the default) or make room by
+	// closing the oldest connections. Connections are closed with code
+	// 4429, except for upgrade requests exceeding MaxConnectionsPerIP
+	// under the reject policy, which fail with 429 Too Many Requests.
+	ConnectionLimitPolicy ConnectionLimitPolicy
+
+	// MaxComplexity is the highest complexity score subscription queries
+	// may have (optional); queries scoring higher are rejected with an
+	// error with code COMPLEXITY_LIMIT_EXCEEDED before they are added to
+	// the subscription manager. Complexity scores each field of a query;
+	// by default every field costs one point.
+	MaxComplexity int
+	Complexity    ComplexityFunc
+
+	// MaxQueryDepth is the deepest nesting of fields subscription queries
+	// may have (optional); deeper queries are rejected with an error with
+	// code QUERY_DEPTH_EXCEEDED. Top-level fields have a depth of one.
+	MaxQueryDepth int
+
+	// DisableIntrospection rejects documents selecting the introspection
+	// fields __schema or __type with an error with code
+	// INTROSPECTION_DISABLED, on all transports of the handler.
+	DisableIntrospection bool
+
+	// MaxQueryLength, MaxVariablesSize and MaxOperationNameLength limit
+	// the size in bytes of the fields of start messages independently
+	// of MaxMessageSize (optional); variables are measured as encoded
+	// JSON. Operations exceeding a limit are rejected with an error with
+	// code PAYLOAD_TOO_LARGE naming the field in its extensions.
+	MaxQueryLength         int
+	MaxVariablesSize       int
+	MaxOperationNameLength int
+
+	// Schema is used to validate the variables of operations against
+	// their declared types before they are added to the subscription
+	// manager (optional). Missing variables and values that can't be
+	// coerced are rejected with errors with code BAD_USER_INPUT.
+	Schema *graphql.Schema
+
+	// WriteTimeout is the time writing a message to a client may take
+	// before the connection is closed; see ConnectionConfig.
+	WriteTimeout time.Duration
+
+	// SendQueueSize and SendQueueOverflow configure the queue of messages
+	// waiting to be written to each client, e.g. to drop data messages for
+	// slow clients instead of blocking publishers; see ConnectionConfig.
+	SendQueueSize     int
+	SendQueueOverflow OverflowPolicy
+
+	// SlowClientBacklog and SlowClientTimeout evict clients that can't keep
+	// up with the messages sent to them (optional); see ConnectionConfig.
+	SlowClientBacklog int
+	SlowClientTimeout time.Duration
+
+	// MaxBatchSize and BatchDelay make connections write data messages
+	// waiting to be written in batches (optional), reducing the number of
+	// frames under high event rates; see ConnectionConfig.
+	MaxBatchSize int
+	BatchDelay   time.Duration
+
+	// ValidateStart validates the start messages of every connection,
+	// including the operations served over HTTP, before subscriptions
+	// are started (optional); see ConnectionConfig.
+	ValidateStart ValidateStartFunc
+
+	// TransformData transforms the data messages of every connection
+	// before they are sent (optional); see ConnectionConfig.
+	TransformData TransformDataFunc
+
+	// ErrorFormatter converts the errors sent to clients into GraphQL
+	// errors (optional); see ConnectionConfig.
+	ErrorFormatter ErrorFormatter
+
+	// Codec encodes and decodes the messages of every connection, e.g. to
+	// use a faster JSON implementation; defaults to JSONCodec.
+	Codec Codec
+
+	// Codecs are further codecs by name (optional), which clients can ask
+	// for by appending "+" and the name to the subprotocol, e.g.
+	// "graphql-transport-ws+msgpack". Connections of other clients use
+	// Codec.
+	Codecs map[string]Codec
+
+	// BufferPool provides the buffers connections encode messages into
+	// (optional); defaults to DefaultBufferPool. See NewBufferPool to
+	// tune the sizes of buffers.
+	BufferPool BufferPool
+
+	// IncomingMiddleware and OutgoingMiddleware wrap the handling of the
+	// messages of every connection (optional); see Middleware.
+	IncomingMiddleware []Middleware
+	OutgoingMiddleware []Middleware
+
+	// OperationMiddleware wraps the handling of the start and stop
+	// messages of every connection where operations are started and
+	// stopped, e.g. on Workers (optional); see Middleware.
+	OperationMiddleware []Middleware
+
+	// MessageTypes handles messages of custom types received over
+	// initialized connections (optional); see MessageTypes.
+	MessageTypes MessageTypes
+
+	// Upgrader is an optional upgrader to start from. Its Subprotocols are
+	// always replaced with the accepted subprotocols, and its CheckOrigin
+	// is only kept if neither CheckOrigin nor AllowedOrigins are set.
+	Upgrader *websocket.Upgrader
+
+	// Transport upgrades requests with a WebSocket library other than
+	// gorilla/websocket (optional). Upgrader, the buffer sizes,
+	// HandshakeTimeout and EnableCompression only apply to the default
+	// transport, while origins are checked for all transports.
+	Transport Transport
+
+	// Poller reads from the sockets of connections once they become
+	// readable instead of from a goroutine per connection (optional); see
+	// ConnectionConfig.Poller.
+	Poller Poller
+
+	// Workers handle the start and stop messages of all connections
+	// (optional), e.g. NewWorkerPool(64); see ConnectionConfig.Workers.
+	Workers WorkerPool
+
+	// Connections keeps track of the handler's live connections; a new
+	// registry is created if none is set.
+	Connections ConnectionRegistry
+
+	// Resume enables resuming subscriptions with resume tokens
+	// when clients reconnect (optional).
+	Resume *ResumeConfig
+
+	// Sessions enables resuming all operations of connections that
+	// dropped when their clients reconnect (optional); see SessionConfig.
+	Sessions *SessionConfig
+
+	// Cluster registers connections in a registry shared by all instances
+	// (optional), so that messages can be routed to them from any
+	// instance; see ClusterConfig.
+	Cluster *ClusterConfig
+
+	// Transcript enables recording the most recent protocol messages of
+	// every connection (optional), which Handler.Transcript returns; see
+	// TranscriptConfig.
+	Transcript *TranscriptConfig
+
+	// Acks enables at-least-once delivery of data messages (optional);
+	// see AckConfig.
+	Acks *AckConfig
+
+	// DeduplicationWindow suppresses duplicate data messages of each
+	// subscription within the window (optional); see ConnectionConfig.
+	DeduplicationWindow time.Duration
+
+	// AppSync enables the AWS AppSync realtime protocol for connections
+	// from AppSync clients (optional); see AppSyncConfig.
+	AppSync *AppSyncConfig
+
+	// PersistedQueries enables automatic persisted queries (optional).
+	// Clients may start subscriptions with only the SHA-256 hash of a
+	// query in the persistedQuery extension; unknown hashes are rejected
+	// with an error with code PERSISTED_QUERY_NOT_FOUND, after which
+	// clients send the hash along with the query to register it.
+	PersistedQueries PersistedQueryCache
+
+	// TrustedDocuments restricts the operations clients may start to the
+	// documents of the store (optional). Clients refer to documents by ID
+	// in the documentId field of the start payload or by hash in the
+	// persistedQuery extension; queries sent in full are only started if
+	// they are trusted. Other operations are rejected with an error with
+	// code UNTRUSTED_DOCUMENT, and PersistedQueries is ignored.
+	TrustedDocuments TrustedDocumentStore
+}
+
+// sendDataWithResumeStatus returns a SendData function that adds the resume
+// status to the extensions of the first data message it sends.
+func sendDataWithResumeStatus(conn Connection, opID string, status string) SubscriptionSendDataFunc {
+	var once sync.Once
+	return func(data *DataMessagePayload) {
+		once.Do(func() {
+			extensions := make(map[string]interface{}, len(data.Extensions)+1)
+			for key, value := range data.Extensions {
+				extensions[key] = value
+			}
+			extensions[resumeExtension] = map[string]interface{}{
+				"status": status,
+			}
+			copied := *data
+			copied.Extensions = extensions
+			data = &copied
+		})
+		conn.SendData(opID, data)
+	}
+}
+
+// checkPayloadLimits returns an error for start messages with a field
+// that exceeds its configured size limit.
+func checkPayloadLimits(config HandlerConfig, data *StartMessagePayload) error {
+	if config.MaxQueryLength > 0 && len(data.Query) > config.MaxQueryLength {
+		return payloadTooLarge("query", "Query", len(data.Query), config.MaxQueryLength)
+	}
+	if config.MaxOperationNameLength > 0 && len(data.OperationName) > config.MaxOperationNameLength {
+		return payloadTooLarge("operationName", "Operation name", len(data.OperationName), config.MaxOperationNameLength)
+	}
+	if config.MaxVariablesSize > 0 && len(data.Variables) > 0 {
+		encoded, err := json.Marshal(data.Variables)
+		if err == nil && len(encoded) > config.MaxVariablesSize {
+			return payloadTooLarge("variables", "Variables", len(encoded), config.MaxVariablesSize)
+		}
+	}
+	return nil
+}
+
+func payloadTooLarge(field string, description string, size int, max int) error {
+	return NewError(
+		fmt.Sprintf("%s of %d bytes exceeds the maximum of %d", description, size, max),
+		map[string]interface{}{"code": ErrCodePayloadTooLarge, "field": field},
+	)
+}
+
+// checkQueryLimits returns errors for subscription queries that exceed the
+// configured limits, use introspection while it is disabled or have
+// invalid variables. Queries that can't be parsed are left to the
+// subscription manager to reject.
+func checkQueryLimits(config HandlerConfig, subscription *Subscription) []error {
+	if config.MaxComplexity <= 0 && config.MaxQueryDepth <= 0 && !config.DisableIntrospection && config.Schema == nil {
+		return nil
+	}
+
+	document, err := parser.Parse(parser.ParseParams{
+		Source: subscription.Query,
+	})
+	if err != nil {
+		return nil
+	}
+
+	if config.DisableIntrospection && usesIntrospection(document) {
+		return []error{newOperationError("Introspection is disabled", ErrCodeIntrospectionDisabled)}
+	}
+
+	if config.Schema != nil {
+		errs := checkVariables(config.Schema, document, subscription.OperationName, subscription.Variables)
+		if len(errs) > 0 {
+			return errs
+		}
+	}
+
+	if config.MaxQueryDepth > 0 {
+		depth := queryDepth(document, subscription.OperationName)
+		if depth > config.MaxQueryDepth {
+			return []error{newOperationError(
+				fmt.Sprintf("Query depth of %d exceeds the maximum of %d", depth, config.MaxQueryDepth),
+				ErrCodeQueryDepthLimit,
+			)}
+		}
+	}
+
+	if config.MaxComplexity <= 0 {
+		return nil
+	}
+
+	complexity := queryComplexity(document, subscription.OperationName, config.Complexity)
+	if complexity > config.MaxComplexity {
+		return []error{newOperationError(
+			fmt.Sprintf("Query complexity of %d exceeds the maximum of %d", complexity, config.MaxComplexity),
+			ErrCodeComplexityLimit,
+		)}
+	}
+
+	return nil
+}
+
+func acceptsSubprotocol(subprotocols []string, subprotocol string) bool {
+	for _, accepted := range subprotocols {
+		if accepted == subprotocol {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOriginFunc returns the origin policy of a handler configuration.
+func checkOriginFunc(config HandlerConfig) func(r *http.Request) bool {
+	if config.CheckOrigin != nil {
+		return config.CheckOrigin
+	}
+
+	if len(config.AllowedOrigins) == 0 {
+		return func(r *http.Request) bool { return true }
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, allowed := range config.AllowedOrigins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// newUpgrader creates the WebSocket upgrader of a handler.
+func newUpgrader(config HandlerConfig, subprotocols []string) *websocket.Upgrader {
+	upgrader := &websocket.Upgrader{}
+	if config.Upgrader != nil {
+		*upgrader = *config.Upgrader
+	}
+
+	upgrader.Subprotocols = subprotocols
+
+	if upgrader.CheckOrigin == nil || config.CheckOrigin != nil || len(config.AllowedOrigins) > 0 {
+		upgrader.CheckOrigin = checkOriginFunc(config)
+	}
+	if config.ReadBufferSize > 0 {
+		upgrader.ReadBufferSize = config.ReadBufferSize
+	}
+	if config.WriteBufferSize > 0 {
+		upgrader.WriteBufferSize = config.WriteBufferSize
+	}
+	if config.HandshakeTimeout > 0 {
+		upgrader.HandshakeTimeout = config.HandshakeTimeout
+	}
+	if config.EnableCompression {
+		upgrader.EnableCompression = true
+	}
+
+	return upgrader
+}
+
+// Handler is a WebSocket handler for GraphQL WebSocket connections.
+type Handler struct {
+	handler             http.Handler
+	config              HandlerConfig
+	clientIP            func(*http.Request) string
+	connections         ConnectionRegistry
+	subscriptionManager SubscriptionManager
+	users               *userConnections
+	cluster             *clusterNode
+	logger              Logger
+
+	// The origin policy and connection limits shared by all transports,
+	// and the rate limits of operations served over HTTP by client
+	checkOrigin    func(r *http.Request) bool
+	userLimiter    *connectionLimiter
+	ipLimiter      *connectionLimiter
+	operationRates *clientRateLimiter
+	messageRates   map[string]*clientRateLimiter
+
+	// Upgrades in progress and whether the handler is shutting down,
+	// guarded by mutex
+	upgrades     *sync.WaitGroup
+	shuttingDown bool
+	mutex        *sync.Mutex
+}
+
+// ServeHTTP upgrades the request to a GraphQL WebSocket connection.
+// Requests are rejected with 503 Service Unavailable once the handler
+// is shutting down.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.beginUpgrade(w) {
+		return
+	}
+	defer h.upgrades.Done()
+	h.handler.ServeHTTP(w, r)
+}
+
+// beginUpgrade counts a request as an upgrade in progress until the
+// caller marks it done, or responds with 503 Service Unavailable and
+// returns false once the handler is shutting down.
+func (h *Handler) beginUpgrade(w http.ResponseWriter) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.shuttingDown {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return false
+	}
+	h.upgrades.Add(1)
+	return true
+}
+
+// Shutdown gracefully shuts down the handler. It stops accepting new
+// connections, completes all active operations, sends a close frame to
+// every client once the messages queued for it have been written, and
+// waits until all connections have been closed and their subscriptions
+// removed. If ctx expires first, the remaining connections are closed
+// immediately and the context's error is returned.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	return h.closeConnections(ctx, websocket.CloseGoingAway, "Server is shutting down")
+}
+
+// Drain is like Shutdown, but closes connections with close code 1012
+// (service restart) to advise clients to reconnect, e.g. to another
+// instance during a rolling deploy. Clients receive a complete message
+// for each of their operations before the close frame.
+func (h *Handler) Drain(ctx context.Context) error {
+	return h.closeConnections(ctx, websocket.CloseServiceRestart, "Server is draining, reconnect to another instance")
+}
+
+// closeConnections stops accepting new connections and gracefully closes
+// all live connections with the given close code and reason.
+func (h *Handler) closeConnections(ctx context.Context, code int, reason string) error {
+	h.mutex.Lock()
+	h.shuttingDown = true
+	h.mutex.Unlock()
+
+	// Wait for upgrades in progress so no connection is missed
+	h.upgrades.Wait()
+
+	h.logger.WithField("connections", h.connections.Count()).Info("Shutting down")
+
+	wg := &sync.WaitGroup{}
+	h.connections.Range(func(conn Connection) bool {
+		if c, ok := conn.(*connection); ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.shutdown(ctx, code, reason)
+			}()
+		} else if c, ok := conn.(shutdownConnection); ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.shutdown(ctx)
+			}()
+		}
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Broadcast sends a data message to every subscription of the handler's
+// live connections for which filter returns true, e.g. for system-wide
+// announcements or cache invalidation signals. A nil filter matches all
+// subscriptions. It returns the number of subscriptions the message was
+// sent to.
+func (h *Handler) Broadcast(filter func(*Subscription) bool, payload *DataMessagePayload) int {
+	subscriptions := h.subscriptionManager.Subscriptions()
+
+	sent := 0
+	h.connections.Range(func(conn Connection) bool {
+		for _, subscription := range subscriptions[conn] {
+			if filter == nil || filter(subscription) {
+				subscription.SendData(payload)
+				sent++
+			}
+		}
+		return true
+	})
+
+	h.logger.WithField("subscriptions", sent).Debug("Broadcast message")
+
+	return sent
+}
+
+// SendToUser sends a data message to the subscriptions of all connections
+// of an authenticated user for which match returns true, e.g. to tell all
+// of the user's clients that their session was revoked. A nil match
+// matches all subscriptions. Users are the values returned when
+// connections are initialized and are compared as map keys. It returns
+// the number of subscriptions the message was sent to.
+func (h *Handler) SendToUser(user interface{}, match func(opID string) bool, payload *DataMessagePayload) int {
+	connections := h.users.get(user)
+	if len(connections) == 0 {
+		return 0
+	}
+
+	subscriptions := h.subscriptionManager.Subscriptions()
+
+	sent := 0
+	for _, conn := range connections {
+		for opID, subscription := range subscriptions[conn] {
+			if match == nil || match(opID) {
+				subscription.SendData(payload)
+				sent++
+			}
+		}
+	}
+
+	h.logger.WithFields(Fields{
+		"user":          user,
+		"connections":   len(connections),
+		"subscriptions": sent,
+	}).Debug("Send message to user")
+
+	return sent
 }
 
 // NewHandler creates a WebSocket handler for GraphQL WebSocket connections.
 // This handler takes a SubscriptionManager and adds/removes subscriptions
-// as they are started/stopped by the client.
-func NewHandler(config HandlerConfig) http.Handler {
+// as they are started/stopped by the client. Unset fields get the defaults
+// of HandlerConfig.WithDefaults; see NewValidatedHandler to check the
+// configuration first.
+func NewHandler(config HandlerConfig) *Handler {
+	config = config.WithDefaults()
+	subprotocols := config.Subprotocols
+
 	// Create a WebSocket upgrader that requires clients to implement
-	// the "graphql-ws" protocol
-	var upgrader = websocket.Upgrader{
-		CheckOrigin:  func(r *http.Request) bool { return true },
-		Subprotocols: []string{"graphql-ws"},
+	// one of the accepted protocols, optionally with one of the codecs
+	if len(config.Codecs) > 0 {
+		subprotocols = codecSubprotocols(subprotocols, config.Codecs)
+	}
+	transport := config.Transport
+	if transport == nil {
+		transport = &gorillaTransport{upgrader: newUpgrader(config, subprotocols)}
 	}
+	checkOrigin := checkOriginFunc(config)
 
 	logger := NewLogger("handler")
 	subscriptionManager := config.SubscriptionManager
 
-	// Create a map (used like a set) to manage client connections
-	var connections = make(map[Connection]bool)
+	// Keep track of client connections
+	connections := config.Connections
+	if connections == nil {
+		connections = NewConnectionRegistry()
+	}
+
+	// Index the connections of authenticated users
+	users := newUserConnections()
+
+	// Register connections with the cluster, if any
+	cluster := newClusterNode(config.Cluster, connections, subscriptionManager, logger)
+
+	// Limit the connections per user and per IP address
+	userLimiter := newConnectionLimiter(config.MaxConnectionsPerUser, config.ConnectionLimitPolicy)
+	ipLimiter := newConnectionLimiter(config.MaxConnectionsPerIP, config.ConnectionLimitPolicy)
 
-	return http.HandlerFunc(
+	resolveClientIP := config.ClientIP
+	if resolveClientIP == nil {
+		resolveClientIP = clientIP
+	}
+
+	// The handler is created before its WebSocket handler, which shares
+	// its limits with the transports served over HTTP
+	h := &Handler{
+		config:              config,
+		clientIP:            resolveClientIP,
+		connections:         connections,
+		subscriptionManager: subscriptionManager,
+		users:               users,
+		cluster:             cluster,
+		logger:              logger,
+		checkOrigin:         checkOrigin,
+		userLimiter:         userLimiter,
+		ipLimiter:           ipLimiter,
+		operationRates:      newClientRateLimiter(config.SubscriptionRateLimit, config.SubscriptionRateBurst),
+		messageRates:        make(map[string]*clientRateLimiter),
+		upgrades:            &sync.WaitGroup{},
+		mutex:               &sync.Mutex{},
+	}
+	// Limit the rate of starts and stops of operations served over HTTP
+	for _, messageType := range []string{gqlStart, gqlStop} {
+		if limit, ok := config.MessageRateLimits[messageType]; ok {
+			h.messageRates[messageType] = newClientRateLimiter(limit.Rate, limit.Burst)
+		}
+	}
+
+	// Emit data events once data messages have passed all middleware
+	outgoingMiddleware := config.OutgoingMiddleware
+	if config.Events != nil {
+		outgoingMiddleware = append(append([]Middleware{}, outgoingMiddleware...), dataSentEvents(config.Events))
+	}
+
+	handler := http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
+			// Take a slot for the client's IP address before upgrading
+			ip := resolveClientIP(r)
+			ipSlot, evicted := ipLimiter.acquire(ip, nil)
+			if ipSlot == nil {
+				logger.WithField("ip", ip).Warn("Too many connections from IP address")
+				http.Error(w, "Too many connections", http.StatusTooManyRequests)
+				h.upgradeFailed(r, errors.New("Too many connections from IP address"))
+				return
+			}
+			closeEvictedConnections(evicted)
+
+			// Other transports leave checking origins to the handler
+			if config.Transport != nil && !checkOrigin(r) {
+				logger.WithField("origin", r.Header.Get("Origin")).Warn("Origin not allowed")
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				ipLimiter.release(ip, ipSlot)
+				h.upgradeFailed(r, errors.New("Origin not allowed"))
+				return
+			}
+
 			// Establish a WebSocket connection
-			var ws, err = upgrader.Upgrade(w, r, nil)
+			ws, err := transport.Upgrade(w, r, subprotocols)
 
 			// Bail out if the WebSocket connection could not be established
 			if err != nil {
 				logger.Warn("Failed to establish WebSocket connection", err)
+				ipLimiter.release(ip, ipSlot)
+				h.upgradeFailed(r, err)
 				return
 			}
 
-			// Close the connection early if it doesn't implement the graphql-ws protocol
-			if ws.Subprotocol() != "graphql-ws" {
-				logger.Warn("Connection does not implement the GraphQL WS protocol")
+			// Close the connection early if it doesn't implement any of the
+			// accepted protocols
+			if !acceptsSubprotocol(subprotocols, ws.Subprotocol()) {
+				logger.WithField("subprotocols", subprotocols).Warn("Connection does not implement the GraphQL WS protocol")
 				ws.Close()
+				ipLimiter.release(ip, ipSlot)
+				h.upgradeFailed(r, errors.New("Connection does not implement the GraphQL WS protocol"))
 				return
 			}
 
+			// The user the connection holds a slot for, guarded by
+			// userMutex, as connections may be closed by other goroutines
+			// than their read loops, e.g. workers
+			var userKey interface{}
+			var userSlot *limitedConnection
+			var userReleased bool
+			userMutex := &sync.Mutex{}
+
+			// The contexts of the connection's subscriptions, which are
+			// cancelled when they are stopped
+			operations := newOperationContexts()
+
+			// Give the authentication access to the upgrade request, except
+			// when refreshing, as its headers are stale by then
+			var authenticateConnection ConnectionAuthenticateFunc
+			refreshAuth := config.RefreshAuth
+			if config.AuthenticateRequest != nil {
+				authenticateConnection = func(conn Connection, token string) (interface{}, error) {
+					return config.AuthenticateRequest(conn, r, token)
+				}
+				if refreshAuth == nil {
+					refreshAuth = func(conn Connection, token string) (interface{}, error) {
+						return config.AuthenticateRequest(conn, nil, token)
+					}
+				}
+			}
+
+			var id string
+			if config.IDGenerator != nil {
+				id = config.IDGenerator(r)
+			}
+
+			codec := config.Codec
+			if _, name := splitSubprotocol(ws.Subprotocol()); name != "" {
+				codec = config.Codecs[name]
+			}
+
 			// Establish a GraphQL WebSocket connection
-			conn := NewConnection(ws, ConnectionConfig{
-				Authenticate: config.Authenticate,
+			NewConnection(ws, ConnectionConfig{
+				ID:                        id,
+				Context:                   detachContext(r.Context()),
+				Request:                   r,
+				ClientIP:                  ip,
+				AuthenticateConnection:    authenticateConnection,
+				Authenticate:              config.Authenticate,
+				RefreshAuth:               refreshAuth,
+				AckPayload:                config.AckPayload,
+				ConnectionInitWaitTimeout: config.ConnectionInitWaitTimeout,
+				IdleTimeout:               config.IdleTimeout,
+				MaxConnectionAge:          config.MaxConnectionAge,
+				KeepAliveInterval:         config.KeepAliveInterval,
+				PingInterval:              config.PingInterval,
+				PongWait:                  config.PongWait,
+				MaxMissedPings:            config.MaxMissedPings,
+				CompressionThreshold:      config.CompressionThreshold,
+				MaxMessageSize:            config.MaxMessageSize,
+				WriteTimeout:              config.WriteTimeout,
+				SendQueueSize:             config.SendQueueSize,
+				SendQueueOverflow:         config.SendQueueOverflow,
+				SlowClientBacklog:         config.SlowClientBacklog,
+				SlowClientTimeout:         config.SlowClientTimeout,
+				MaxBatchSize:              config.MaxBatchSize,
+				BatchDelay:                config.BatchDelay,
+				MaxOperations:             config.MaxSubscriptionsPerConnection,
+				CloseOnOperationLimit:     config.CloseOnSubscriptionLimit,
+				OperationRateLimit:        config.SubscriptionRateLimit,
+				OperationRateBurst:        config.SubscriptionRateBurst,
+				CloseOnOperationRateLimit: config.CloseOnSubscriptionRateLimit,
+				MessageRateLimits:         config.MessageRateLimits,
+				StrictProtocol:            config.StrictProtocol,
+				ValidateStart:             config.ValidateStart,
+				TransformData:             config.TransformData,
+				ErrorFormatter:            config.ErrorFormatter,
+				Codec:                     codec,
+				BufferPool:                config.BufferPool,
+				Poller:                    config.Poller,
+				Workers:                   config.Workers,
+				Sessions:                  config.Sessions,
+				Transcript:                config.Transcript,
+				Acks:                      config.Acks,
+				AppSync:                   config.AppSync,
+				DeduplicationWindow:       config.DeduplicationWindow,
+				IncomingMiddleware:        config.IncomingMiddleware,
+				OutgoingMiddleware:        outgoingMiddleware,
+				OperationMiddleware:       config.OperationMiddleware,
+				MessageTypes:              config.MessageTypes,
 				EventHandlers: ConnectionEventHandlers{
+					Open: func(conn Connection) {
+						ipLimiter.bind(ipSlot, conn)
+						connections.Add(conn)
+
+						if config.EventHandlers.Open != nil {
+							config.EventHandlers.Open(conn, r)
+						}
+						emitEvent(config.Events, Event{Type: EventConnectionOpened, Connection: conn, Request: r})
+					},
+					Init: func(conn Connection, payload map[string]interface{}) {
+						// Move the connection to the slots of its (new) user
+						userMutex.Lock()
+						if userReleased {
+							userMutex.Unlock()
+							return
+						}
+						userLimiter.release(userKey, userSlot)
+						users.remove(userKey, conn)
+						userKey = conn.User()
+						var evicted []Connection
+						userSlot, evicted = userLimiter.acquire(userKey, conn)
+						if userSlot == nil {
+							userMutex.Unlock()
+							logger.WithFields(Fields{
+								"conn": conn.ID(),
+								"user": userKey,
+							}).Warn("Too many connections for user")
+							conn.Close(closeTooManyRequests, "Too many connections")
+							return
+						}
+						users.add(userKey, conn)
+						userMutex.Unlock()
+						closeEvictedConnections(evicted)
+						cluster.register(conn)
+
+						if config.EventHandlers.Init != nil {
+							config.EventHandlers.Init(conn, payload)
+						}
+						emitEvent(config.Events, Event{Type: EventAuthenticated, Connection: conn})
+					},
 					Close: func(conn Connection) {
-						logger.WithFields(log.Fields{
+						logger.WithFields(Fields{
 							"conn": conn.ID(),
 							"user": conn.User(),
 						}).Debug("Closing connection")
@@ -76,36 +975,115 @@ func NewHandler(config HandlerConfig) http.Handler {
 						if config.EventHandlers.Close != nil {
 							config.EventHandlers.Close(conn)
 						}
+						emitEvent(config.Events, Event{Type: EventConnectionClosed, Connection: conn})
 
 						subscriptionManager.RemoveSubscriptions(conn)
 
-						delete(connections, conn)
+						connections.Remove(conn)
+						ipLimiter.release(ip, ipSlot)
+						userMutex.Lock()
+						initialized := userSlot != nil
+						userLimiter.release(userKey, userSlot)
+						users.remove(userKey, conn)
+						userReleased = true
+						userMutex.Unlock()
+						if initialized {
+							cluster.unregister(conn)
+						}
 					},
 					StartOperation: func(
 						conn Connection,
 						opID string,
 						data *StartMessagePayload,
 					) []error {
-						logger.WithFields(log.Fields{
+						logger.WithFields(Fields{
 							"conn": conn.ID(),
 							"op":   opID,
 							"user": conn.User(),
 						}).Debug("Start operation")
+
+						if err := checkPayloadLimits(config, data); err != nil {
+							return []error{err}
+						}
+						persistedHash, err := resolveDocument(config, data)
+						if err != nil {
+							return []error{err}
+						}
+
+						ctx, cancel := context.WithCancel(conn.Context())
 						subscription := &Subscription{
 							ID:            opID,
 							Query:         data.Query,
 							Variables:     data.Variables,
 							OperationName: data.OperationName,
 							Connection:    conn,
+							Context:       ctx,
 							SendData: func(data *DataMessagePayload) {
 								conn.SendData(opID, data)
 							},
+							Filter:        config.SubscriptionFilter,
+							ReplayCursors: replayCursors(data),
+							resume:        config.Resume,
+						}
+						if config.SubscriptionScope != nil {
+							subscription.Scope = config.SubscriptionScope(subscription)
+						}
+
+						errs := checkQueryLimits(config, subscription)
+						if len(errs) > 0 {
+							logger.WithFields(Fields{
+								"conn":   conn.ID(),
+								"op":     opID,
+								"errors": errs,
+							}).Debug("Operation exceeds query limits")
+						} else if config.AuthorizeOperation != nil {
+							errs = config.AuthorizeOperation(conn, subscription)
+							if len(errs) > 0 {
+								logger.WithFields(Fields{
+									"conn":   conn.ID(),
+									"op":     opID,
+									"errors": errs,
+								}).Debug("Operation not authorized")
+							}
+						}
+
+						// Resume the subscription if the client presents a resume
+						// token; the outcome is reported in the first data message.
+						// Tokens are only used up by starts that have been accepted.
+						if len(errs) == 0 && data.ResumeToken != "" && config.Resume != nil && config.Resume.Store != nil {
+							status := resumeSubscription(config.Resume, subscription, data.ResumeToken)
+							subscription.SendData = sendDataWithResumeStatus(conn, opID, status)
+						}
+
+						if len(errs) > 0 {
+							cancel()
+						} else if operations.add(opID, cancel) {
+							// The context is registered first so that the
+							// subscription can be stopped as soon as it's added
+							errs = subscriptionManager.AddSubscription(conn, subscription)
+							if len(errs) > 0 {
+								operations.cancel(opID)
+							}
+						} else {
+							// An operation with the same ID is active already,
+							// which the subscription manager is expected to reject
+							errs = subscriptionManager.AddSubscription(conn, subscription)
+							cancel()
+						}
+
+						// Queries are only persisted once they have been accepted
+						if len(errs) == 0 && persistedHash != "" {
+							config.PersistedQueries.Add(persistedHash, data.Query)
 						}
-						errs := subscriptionManager.AddSubscription(conn, subscription)
 
 						if config.EventHandlers.NewSubscription != nil {
 							config.EventHandlers.NewSubscription(subscription, errs)
 						}
+						if len(errs) > 0 {
+							emitEvent(config.Events, Event{Type: EventError, Connection: conn, OperationID: opID, Errors: errs})
+						} else {
+							emitEvent(config.Events, Event{Type: EventOperationStarted, Connection: conn, OperationID: opID, Subscription: subscription})
+						}
 
 						return errs
 					},
@@ -113,14 +1091,45 @@ func NewHandler(config HandlerConfig) http.Handler {
 						subscriptionManager.RemoveSubscription(conn, &Subscription{
 							ID: opID,
 						})
+						operations.cancel(opID)
 
 						if config.EventHandlers.StopSubscription != nil {
 							config.EventHandlers.StopSubscription(opID)
 						}
+						emitEvent(config.Events, Event{Type: EventOperationStopped, Connection: conn, OperationID: opID})
+					},
+					SendFailed: config.EventHandlers.SendFailed,
+					SlowClient: func(conn Connection) {
+						if config.EventHandlers.SlowClient != nil {
+							config.EventHandlers.SlowClient(conn)
+						}
+						emitEvent(config.Events, Event{Type: EventSlowClient, Connection: conn})
+					},
+					Error: func(err *ConnectionError) {
+						if config.EventHandlers.Error != nil {
+							config.EventHandlers.Error(err)
+						}
+						emitEvent(config.Events, Event{
+							Type:        EventError,
+							Connection:  err.Connection,
+							OperationID: err.OperationID,
+							Errors:      []error{err},
+						})
 					},
 				},
 			})
-			connections[conn] = true
 		},
 	)
+
+	h.handler = handler
+	return h
+}
+
+// upgradeFailed notifies event handlers of a request that couldn't be
+// upgraded or served.
+func (h *Handler) upgradeFailed(r *http.Request, err error) {
+	if h.config.EventHandlers.UpgradeFailed != nil {
+		h.config.EventHandlers.UpgradeFailed(r, err)
+	}
+	emitEvent(h.config.Events, Event{Type: EventError, Request: r, Errors: []error{err}})
 }
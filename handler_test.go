@@ -0,0 +1,1049 @@
+package graphqlws_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/meandrewdev/graphqlws"
+)
+
+func dialWithOrigin(srv *httptest.Server, origin string) error {
+	header := http.Header{}
+	header["Sec-WebSocket-Protocol"] = []string{graphqlws.SubprotocolGraphQLWS}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + wsMountPath
+	ws, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err == nil {
+		ws.Close()
+	}
+	return err
+}
+
+func TestHandler_AllOriginsAreAcceptedByDefault(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := startServer(graphqlws.NewSubscriptionManager(schema))
+	defer srv.Close()
+
+	if err := dialWithOrigin(srv, "https://evil.example.com"); err != nil {
+		t.Errorf("origin rejected by default: %v", err)
+	}
+}
+
+func TestHandler_AllowedOriginsAreEnforced(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		AllowedOrigins:      []string{"https://app.example.com"},
+	}))
+	defer srv.Close()
+
+	if err := dialWithOrigin(srv, "https://APP.example.com"); err != nil {
+		t.Errorf("allowed origin rejected: %v", err)
+	}
+	if err := dialWithOrigin(srv, ""); err != nil {
+		t.Errorf("request without origin rejected: %v", err)
+	}
+	if err := dialWithOrigin(srv, "https://evil.example.com"); err == nil {
+		t.Error("disallowed origin accepted")
+	}
+}
+
+func TestHandler_CheckOriginTakesPrecedence(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		AllowedOrigins:      []string{"https://app.example.com"},
+		CheckOrigin: func(r *http.Request) bool {
+			return false
+		},
+	}))
+	defer srv.Close()
+
+	if err := dialWithOrigin(srv, "https://app.example.com"); err == nil {
+		t.Error("origin rejected by CheckOrigin accepted")
+	}
+}
+
+func TestHandler_UpgraderOptionsAreApplied(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		EnableCompression:   true,
+		Upgrader: &websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return r.Header.Get("Origin") == "https://app.example.com"
+			},
+		},
+	}))
+	defer srv.Close()
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	header := http.Header{}
+	header["Sec-WebSocket-Protocol"] = []string{graphqlws.SubprotocolGraphQLWS}
+	header.Set("Origin", "https://app.example.com")
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + wsMountPath
+	ws, resp, err := dialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("could not connect to websocket server: %v", err)
+	}
+	defer ws.Close()
+
+	if !strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		t.Error("compression was not negotiated")
+	}
+	if ws.Subprotocol() != graphqlws.SubprotocolGraphQLWS {
+		t.Errorf("unexpected subprotocol: %s", ws.Subprotocol())
+	}
+
+	// The CheckOrigin of the supplied upgrader is kept
+	if err := dialWithOrigin(srv, "https://evil.example.com"); err == nil {
+		t.Error("origin rejected by the upgrader accepted")
+	}
+}
+
+func TestHandler_ShutdownClosesConnectionsGracefully(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	waitForConnection(t, sm)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdown <- handler.Shutdown(ctx)
+	}()
+
+	if msg := readOperationMessage(t, ws); msg.Type != "complete" || msg.ID != "1" {
+		t.Fatalf("expected complete, received: %v", msg)
+	}
+	expectClose(t, ws, websocket.CloseGoingAway)
+
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown fails: %v", err)
+	}
+	if len(sm.Subscriptions()) != 0 {
+		t.Error("Shutdown doesn't remove subscriptions")
+	}
+
+	// New connections are rejected
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + wsMountPath
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("connection accepted after shutdown: %v", err)
+	}
+}
+
+func TestHandler_DrainCompletesOperationsBeforeClosing(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	startSubscription(t, ws, "2")
+	conn := waitForConnection(t, sm)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(sm.Subscriptions()[conn]) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	drained := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		drained <- handler.Drain(ctx)
+	}()
+
+	completed := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		msg := readOperationMessage(t, ws)
+		if msg.Type != "complete" {
+			t.Fatalf("expected complete, received: %v", msg)
+		}
+		completed[msg.ID] = true
+	}
+	if !completed["1"] || !completed["2"] {
+		t.Errorf("not all operations were completed: %v", completed)
+	}
+	expectClose(t, ws, websocket.CloseServiceRestart)
+
+	if err := <-drained; err != nil {
+		t.Fatalf("Drain fails: %v", err)
+	}
+	if len(sm.Subscriptions()) != 0 {
+		t.Error("Drain doesn't remove subscriptions")
+	}
+}
+
+func TestHandler_UnauthorizedOperationsAreRejected(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		AuthorizeOperation: func(conn graphqlws.Connection, s *graphqlws.Subscription) []error {
+			if s.Variables["room"] != "public" {
+				return []error{errors.New("Not a member of this room")}
+			}
+			return nil
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	start := func(opID string, room string) {
+		writeMessage(t, ws, map[string]interface{}{
+			"id":   opID,
+			"type": "start",
+			"payload": map[string]interface{}{
+				"query":     "subscription { " + subscriptionName + " { payload } }",
+				"variables": map[string]interface{}{"room": room},
+			},
+		})
+	}
+
+	start("1", "private")
+	if msg := readOperationMessage(t, ws); msg.Type != "error" || msg.ID != "1" {
+		t.Fatalf("expected error, received: %v", msg)
+	}
+
+	start("2", "public")
+	conn := waitForConnection(t, sm)
+	if len(sm.Subscriptions()[conn]) != 1 || sm.Subscriptions()[conn]["2"] == nil {
+		t.Error("only the authorized subscription should be added")
+	}
+}
+
+func TestHandler_SubscriptionsPerConnectionAreLimited(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager:           sm,
+		MaxSubscriptionsPerConnection: 2,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	startSubscription(t, ws, "2")
+	startSubscription(t, ws, "3")
+
+	msg := readOperationMessage(t, ws)
+	errs, _ := msg.Payload.([]interface{})
+	if msg.Type != "error" || msg.ID != "3" || len(errs) != 1 {
+		t.Fatalf("expected error for third subscription, received: %v", msg)
+	}
+	err, _ := errs[0].(map[string]interface{})
+	if extensions, _ := err["extensions"].(map[string]interface{}); extensions["code"] != graphqlws.ErrCodeSubscriptionLimit {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Stopping a subscription makes room for another one; the error for
+	// the fourth subscription confirms the third has been processed
+	writeMessage(t, ws, map[string]interface{}{"id": "1", "type": "stop"})
+	startSubscription(t, ws, "3")
+	startSubscription(t, ws, "4")
+	if msg := readOperationMessage(t, ws); msg.Type != "error" || msg.ID != "4" {
+		t.Fatalf("expected error for fourth subscription, received: %v", msg)
+	}
+
+	conn := waitForConnection(t, sm)
+	if len(sm.Subscriptions()[conn]) != 2 || sm.Subscriptions()[conn]["3"] == nil {
+		t.Fatal("subscription not added after stopping another one")
+	}
+}
+
+func TestHandler_SubscriptionLimitCanCloseConnections(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager:           graphqlws.NewSubscriptionManager(schema),
+		MaxSubscriptionsPerConnection: 1,
+		CloseOnSubscriptionLimit:      true,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	startSubscription(t, ws, "2")
+	expectClose(t, ws, 4429)
+}
+
+func TestHandler_ConnectionsPerIPAreLimited(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		MaxConnectionsPerIP: 1,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + wsMountPath
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{
+		"Sec-WebSocket-Protocol": []string{graphqlws.SubprotocolGraphQLWS},
+	})
+	if err == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("connection exceeding the limit accepted: %v", err)
+	}
+
+	// Closing the first connection makes room for a new one
+	ws.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for dialWithOrigin(srv, "") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("connection rejected after closing the previous one")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandler_OldestConnectionsCanBeEvicted(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+		MaxConnectionsPerUser: 1,
+		ConnectionLimitPolicy: graphqlws.EvictOldestConnections,
+	}))
+	defer srv.Close()
+
+	init := func(ws *websocket.Conn, token string) {
+		writeMessage(t, ws, map[string]interface{}{
+			"type":    "connection_init",
+			"payload": map[string]interface{}{"authToken": token},
+		})
+		if msg := readOperationMessage(t, ws); msg.Type != "connection_ack" {
+			t.Fatalf("expected connection_ack, received: %v", msg)
+		}
+	}
+
+	oldest := dialServer(t, srv)
+	defer oldest.Close()
+	init(oldest, "alice")
+
+	other := dialServer(t, srv)
+	defer other.Close()
+	init(other, "bob")
+
+	newest := dialServer(t, srv)
+	defer newest.Close()
+	init(newest, "alice")
+
+	expectClose(t, oldest, 4429)
+
+	// Connections of other users are kept open
+	writeMessage(t, other, map[string]interface{}{"type": "ping"})
+	if msg := readOperationMessage(t, other); msg.Type != "pong" {
+		t.Fatalf("expected pong, received: %v", msg)
+	}
+}
+
+func TestHandler_ConnectionsPerUserAreLimited(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+		MaxConnectionsPerUser: 1,
+	}))
+	defer srv.Close()
+
+	first := dialServer(t, srv)
+	defer first.Close()
+	writeMessage(t, first, map[string]interface{}{
+		"type":    "connection_init",
+		"payload": map[string]interface{}{"authToken": "alice"},
+	})
+	readOperationMessage(t, first)
+
+	second := dialServer(t, srv)
+	defer second.Close()
+	writeMessage(t, second, map[string]interface{}{
+		"type":    "connection_init",
+		"payload": map[string]interface{}{"authToken": "alice"},
+	})
+	expectClose(t, second, 4429)
+}
+
+func TestHandler_SubscriptionsAreRateLimited(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager:   graphqlws.NewSubscriptionManager(schema),
+		SubscriptionRateLimit: 0.1,
+		SubscriptionRateBurst: 2,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	startSubscription(t, ws, "2")
+	startSubscription(t, ws, "3")
+
+	msg := readOperationMessage(t, ws)
+	errs, _ := msg.Payload.([]interface{})
+	if msg.Type != "error" || msg.ID != "3" || len(errs) != 1 {
+		t.Fatalf("expected error for third subscription, received: %v", msg)
+	}
+	extensions, _ := errs[0].(map[string]interface{})["extensions"].(map[string]interface{})
+	if extensions["code"] != graphqlws.ErrCodeRateLimit {
+		t.Errorf("unexpected error: %v", errs[0])
+	}
+}
+
+func TestHandler_SubscriptionRateLimitCanCloseConnections(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager:          graphqlws.NewSubscriptionManager(schema),
+		SubscriptionRateLimit:        0.1,
+		CloseOnSubscriptionRateLimit: true,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	writeMessage(t, ws, map[string]interface{}{"id": "1", "type": "stop"})
+	expectClose(t, ws, 4429)
+}
+
+func TestHandler_MessagesAreCountedAndLimitedByType(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		MessageRateLimits: map[string]graphqlws.MessageRateLimit{
+			graphqlws.MessageTypeUnknown: {Rate: 0.1, Burst: 2, Close: true},
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	conn := waitForConnection(t, sm)
+
+	// Unknown messages are tolerated up to the burst
+	for i := 0; i < 3; i++ {
+		writeMessage(t, ws, map[string]interface{}{"id": "1", "type": "garbage"})
+	}
+	expectClose(t, ws, 4429)
+
+	counts := conn.Stats().MessagesByType
+	if counts["start"] != 1 || counts[graphqlws.MessageTypeUnknown] != 3 || len(counts) != 2 {
+		t.Errorf("unexpected message counts: %v", counts)
+	}
+}
+
+func TestHandler_ComplexSubscriptionsAreRejected(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		MaxComplexity:       1,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+
+	msg := readOperationMessage(t, ws)
+	errs, _ := msg.Payload.([]interface{})
+	if msg.Type != "error" || msg.ID != "1" || len(errs) != 1 {
+		t.Fatalf("expected error, received: %v", msg)
+	}
+	extensions, _ := errs[0].(map[string]interface{})["extensions"].(map[string]interface{})
+	if extensions["code"] != graphqlws.ErrCodeComplexityLimit {
+		t.Errorf("unexpected error: %v", errs[0])
+	}
+	if len(sm.Subscriptions()) != 0 {
+		t.Error("complex subscription added to the subscription manager")
+	}
+}
+
+// doublingFragmentsQuery returns a subscription query of n fragments,
+// each spreading the next one twice.
+func doublingFragmentsQuery(n int) string {
+	query := "subscription { ...F0 }"
+	for i := 0; i < n; i++ {
+		next := "...F" + strconv.Itoa(i+1)
+		query += " fragment F" + strconv.Itoa(i) + " on RootSubscription { " + next + " " + next + " }"
+	}
+	return query + " fragment F" + strconv.Itoa(n) + " on RootSubscription { " +
+		subscriptionName + " { payload } }"
+}
+
+func TestHandler_FragmentsSpreadManyTimesAreScoredQuickly(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		MaxComplexity:       100,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	started := time.Now()
+	writeMessage(t, ws, map[string]interface{}{
+		"id":      "1",
+		"type":    "start",
+		"payload": map[string]interface{}{"query": doublingFragmentsQuery(40)},
+	})
+
+	msg := readOperationMessage(t, ws)
+	errs, _ := msg.Payload.([]interface{})
+	if msg.Type != "error" || len(errs) != 1 {
+		t.Fatalf("expected error, received: %v", msg)
+	}
+	extensions, _ := errs[0].(map[string]interface{})["extensions"].(map[string]interface{})
+	if extensions["code"] != graphqlws.ErrCodeComplexityLimit {
+		t.Errorf("unexpected error: %v", errs[0])
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("scoring took %v", elapsed)
+	}
+}
+
+func TestHandler_ComplexityCanBeCustomized(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		MaxComplexity:       1,
+		Complexity: func(field *ast.Field, childComplexity int) int {
+			if field.Name.Value == "payload" {
+				return 0
+			}
+			return 1 + childComplexity
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	waitForConnection(t, sm)
+}
+
+func TestHandler_DeepSubscriptionsAreRejected(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		MaxQueryDepth:       1,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	// Fields selected through fragments count towards the depth
+	writeMessage(t, ws, map[string]interface{}{
+		"id":   "1",
+		"type": "start",
+		"payload": map[string]interface{}{
+			"query": "subscription { ...Root } fragment Root on RootSubscription { " +
+				subscriptionName + " { payload } }",
+		},
+	})
+
+	msg := readOperationMessage(t, ws)
+	errs, _ := msg.Payload.([]interface{})
+	if msg.Type != "error" || msg.ID != "1" || len(errs) != 1 {
+		t.Fatalf("expected error, received: %v", msg)
+	}
+	extensions, _ := errs[0].(map[string]interface{})["extensions"].(map[string]interface{})
+	if extensions["code"] != graphqlws.ErrCodeQueryDepthLimit {
+		t.Errorf("unexpected error: %v", errs[0])
+	}
+	if len(sm.Subscriptions()) != 0 {
+		t.Error("deep subscription added to the subscription manager")
+	}
+}
+
+func TestHandler_FragmentsSpreadManyTimesAreMeasuredQuickly(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		MaxQueryDepth:       10,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	// The doubling spreads don't nest fields, so the subscription is
+	// accepted once its depth has been measured
+	started := time.Now()
+	writeMessage(t, ws, map[string]interface{}{
+		"id":      "1",
+		"type":    "start",
+		"payload": map[string]interface{}{"query": doublingFragmentsQuery(40)},
+	})
+	waitForConnection(t, sm)
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("measuring the depth took %v", elapsed)
+	}
+}
+func TestHandler_IntrospectionCanBeDisabled(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager:  sm,
+		DisableIntrospection: true,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	// Introspection fields in fragments are found as well
+	writeMessage(t, ws, map[string]interface{}{
+		"id":   "1",
+		"type": "start",
+		"payload": map[string]interface{}{
+			"query": "subscription { __typename ...Types } fragment Types on RootSubscription { " +
+				"__schema { types { name } } }",
+		},
+	})
+
+	msg := readOperationMessage(t, ws)
+	errs, _ := msg.Payload.([]interface{})
+	if msg.Type != "error" || msg.ID != "1" || len(errs) != 1 {
+		t.Fatalf("expected error, received: %v", msg)
+	}
+	extensions, _ := errs[0].(map[string]interface{})["extensions"].(map[string]interface{})
+	if extensions["code"] != graphqlws.ErrCodeIntrospectionDisabled {
+		t.Errorf("unexpected error: %v", errs[0])
+	}
+	if len(sm.Subscriptions()) != 0 {
+		t.Error("introspection subscription added to the subscription manager")
+	}
+}
+
+func TestHandler_VariablesAreValidatedAgainstTheSchema(t *testing.T) {
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: graphql.Fields{
+			"hello": &graphql.Field{Type: graphql.String},
+		}}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{Name: "Subscription", Fields: graphql.Fields{
+			"counter": &graphql.Field{
+				Type: graphql.Int,
+				Args: graphql.FieldConfigArgument{
+					"limit": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+					"names": &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+				},
+			},
+		}}),
+	})
+	sm := graphqlws.NewSubscriptionManager(&schema)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		Schema:              &schema,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	query := "subscription ($limit: Int!, $names: [String!]) { counter(limit: $limit, names: $names) }"
+	for i, tc := range []struct {
+		variables map[string]interface{}
+		expected  string
+	}{
+		{map[string]interface{}{}, `Variable "$limit" of required type "Int!" was not provided.`},
+		{map[string]interface{}{"limit": "ten"}, `Variable "$limit" got invalid value "ten"; expected type "Int".`},
+		{
+			map[string]interface{}{"limit": 10, "names": []interface{}{"a", nil}},
+			`Variable "$names" got invalid value ["a",null]; expected non-nullable type "String!" not to be null at "[1]".`,
+		},
+	} {
+		id := strconv.Itoa(i)
+		writeMessage(t, ws, map[string]interface{}{
+			"id":      id,
+			"type":    "start",
+			"payload": map[string]interface{}{"query": query, "variables": tc.variables},
+		})
+
+		msg := readOperationMessage(t, ws)
+		errs, _ := msg.Payload.([]interface{})
+		if msg.Type != "error" || msg.ID != id || len(errs) != 1 {
+			t.Fatalf("expected error, received: %v", msg)
+		}
+		err, _ := errs[0].(map[string]interface{})
+		extensions, _ := err["extensions"].(map[string]interface{})
+		if err["message"] != tc.expected || extensions["code"] != graphqlws.ErrCodeInvalidVariables {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if len(sm.Subscriptions()) != 0 {
+		t.Error("subscription with invalid variables added to the subscription manager")
+	}
+}
+
+func TestHandler_StartMessageFieldsAreLimited(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager:    sm,
+		MaxQueryLength:         64,
+		MaxVariablesSize:       16,
+		MaxOperationNameLength: 8,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	query := "subscription { " + subscriptionName + " { payload } }"
+	for i, tc := range []struct {
+		payload map[string]interface{}
+		field   string
+	}{
+		{map[string]interface{}{"query": query + strings.Repeat(" ", 64)}, "query"},
+		{map[string]interface{}{"query": query, "variables": map[string]interface{}{"text": "a long value"}}, "variables"},
+		{map[string]interface{}{"query": query, "operationName": "LongOperationName"}, "operationName"},
+	} {
+		id := strconv.Itoa(i)
+		writeMessage(t, ws, map[string]interface{}{"id": id, "type": "start", "payload": tc.payload})
+
+		msg := readOperationMessage(t, ws)
+		errs, _ := msg.Payload.([]interface{})
+		if msg.Type != "error" || msg.ID != id || len(errs) != 1 {
+			t.Fatalf("expected error, received: %v", msg)
+		}
+		extensions, _ := errs[0].(map[string]interface{})["extensions"].(map[string]interface{})
+		if extensions["code"] != graphqlws.ErrCodePayloadTooLarge || extensions["field"] != tc.field {
+			t.Errorf("unexpected error for %s: %v", tc.field, errs[0])
+		}
+	}
+	if len(sm.Subscriptions()) != 0 {
+		t.Error("oversized operation added to the subscription manager")
+	}
+}
+
+func TestHandler_BroadcastSendsToMatchingSubscriptions(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	first := dialServer(t, srv)
+	defer first.Close()
+	startSubscription(t, first, "1")
+	startSubscription(t, first, "2")
+
+	second := dialServer(t, srv)
+	defer second.Close()
+	startSubscription(t, second, "1")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(sm.Subscriptions()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sent := handler.Broadcast(func(s *graphqlws.Subscription) bool {
+		return s.ID == "1"
+	}, &graphqlws.DataMessagePayload{Data: "maintenance"})
+	if sent != 2 {
+		t.Fatalf("Broadcast sends to %d subscriptions", sent)
+	}
+
+	for _, ws := range []*websocket.Conn{first, second} {
+		if msg := readOperationMessage(t, ws); msg.Type != "data" || msg.ID != "1" {
+			t.Errorf("expected data for 1, received: %v", msg)
+		}
+	}
+}
+
+func TestHandler_SendToUserSendsToAllConnectionsOfUser(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	connect := func(user string) *websocket.Conn {
+		ws := dialServer(t, srv)
+		writeMessage(t, ws, map[string]interface{}{
+			"type":    "connection_init",
+			"payload": map[string]interface{}{"authToken": user},
+		})
+		readOperationMessage(t, ws)
+		startSubscription(t, ws, "1")
+		return ws
+	}
+
+	alice := []*websocket.Conn{connect("alice"), connect("alice")}
+	bob := connect("bob")
+	defer bob.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(sm.Subscriptions()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sent := handler.SendToUser("alice", nil, &graphqlws.DataMessagePayload{Data: "revoked"})
+	if sent != 2 {
+		t.Fatalf("SendToUser sends to %d subscriptions", sent)
+	}
+	for _, ws := range alice {
+		defer ws.Close()
+		if msg := readOperationMessage(t, ws); msg.Type != "data" || msg.ID != "1" {
+			t.Errorf("expected data for 1, received: %v", msg)
+		}
+	}
+
+	if sent := handler.SendToUser("alice", func(opID string) bool {
+		return opID == "2"
+	}, &graphqlws.DataMessagePayload{}); sent != 0 {
+		t.Errorf("SendToUser sends to %d unmatched subscriptions", sent)
+	}
+}
+
+type contextKey string
+
+func TestHandler_RequestContextIsPropagated(t *testing.T) {
+	schema, _ := buildSchema()
+	contexts := make(chan context.Context, 2)
+	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		AuthenticateRequest: func(conn graphqlws.Connection, r *http.Request, token string) (interface{}, error) {
+			contexts <- conn.Context()
+			return token, nil
+		},
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				contexts <- s.Context
+			},
+		},
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), contextKey("tenant"), "acme")
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	writeMessage(t, ws, map[string]interface{}{
+		"type":    "connection_init",
+		"payload": map[string]interface{}{"authToken": "alice"},
+	})
+	readOperationMessage(t, ws)
+	startSubscription(t, ws, "1")
+
+	connCtx, subscriptionCtx := <-contexts, <-contexts
+	for _, ctx := range []context.Context{connCtx, subscriptionCtx} {
+		if ctx.Value(contextKey("tenant")) != "acme" {
+			t.Errorf("context doesn't carry request values")
+		}
+	}
+	if connCtx.Err() != nil {
+		t.Fatal("context is cancelled before the connection is closed")
+	}
+
+	ws.Close()
+	select {
+	case <-connCtx.Done():
+	case <-time.After(2 * time.Second):
+		t.Error("context isn't cancelled when the connection is closed")
+	}
+}
+
+func TestHandler_SubscriptionContextsAreCancelled(t *testing.T) {
+	schema, _ := buildSchema()
+	contexts := make(chan context.Context, 2)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				contexts <- s.Context
+			},
+		},
+	}))
+	defer srv.Close()
+
+	done := func(ctx context.Context) bool {
+		select {
+		case <-ctx.Done():
+			return true
+		case <-time.After(2 * time.Second):
+			return false
+		}
+	}
+
+	ws := dialServer(t, srv)
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	readOperationMessage(t, ws)
+
+	startSubscription(t, ws, "1")
+	startSubscription(t, ws, "2")
+	first, second := <-contexts, <-contexts
+
+	writeMessage(t, ws, map[string]interface{}{"id": "1", "type": "stop"})
+	if !done(first) {
+		t.Error("context isn't cancelled when the subscription is stopped")
+	}
+	if second.Err() != nil {
+		t.Error("contexts of other subscriptions are cancelled")
+	}
+
+	ws.Close()
+	if !done(second) {
+		t.Error("context isn't cancelled when the connection is closed")
+	}
+}
+
+func TestHandler_UpgradeRequestIsExposed(t *testing.T) {
+	schema, _ := buildSchema()
+	requests := make(chan *http.Request, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		AuthenticateRequest: func(conn graphqlws.Connection, r *http.Request, token string) (interface{}, error) {
+			requests <- conn.Request()
+			return token, nil
+		},
+	}))
+	defer srv.Close()
+
+	header := http.Header{}
+	header.Set("Sec-WebSocket-Protocol", graphqlws.SubprotocolGraphQLWS)
+	header.Set("Cookie", "session=abc")
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "?tenant=acme"
+	ws, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{
+		"type":    "connection_init",
+		"payload": map[string]interface{}{"authToken": "alice"},
+	})
+
+	r := <-requests
+	if r == nil {
+		t.Fatal("connection has no request")
+	}
+	if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "abc" {
+		t.Errorf("request has no cookies: %v", r.Header)
+	}
+	if r.URL.Query().Get("tenant") != "acme" {
+		t.Errorf("request has no query parameters: %v", r.URL)
+	}
+}
+
+func TestHandler_ClientIPsAreResolved(t *testing.T) {
+	schema, _ := buildSchema()
+	conns := make(chan graphqlws.Connection, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		ClientIP: func(r *http.Request) string {
+			return r.Header.Get("X-Forwarded-For")
+		},
+		EventHandlers: graphqlws.CustomEventHandlers{
+			Open: func(conn graphqlws.Connection, r *http.Request) {
+				conns <- conn
+			},
+		},
+	}))
+	defer srv.Close()
+
+	header := http.Header{}
+	header.Set("Sec-WebSocket-Protocol", graphqlws.SubprotocolGraphQLWS)
+	header.Set("X-Forwarded-For", "203.0.113.7")
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer ws.Close()
+
+	conn := <-conns
+	if conn.ClientIP() != "203.0.113.7" {
+		t.Errorf("unexpected client IP: %q", conn.ClientIP())
+	}
+	if conn.RemoteAddr() == nil || !strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.1:") {
+		t.Errorf("unexpected remote address: %v", conn.RemoteAddr())
+	}
+}
+
+func TestHandler_ConnectionIDsCanBeGenerated(t *testing.T) {
+	schema, _ := buildSchema()
+	registry := graphqlws.NewConnectionRegistry()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Connections:         registry,
+		IDGenerator: func(r *http.Request) string {
+			return "eu-" + r.Header.Get("X-Request-ID")
+		},
+	}))
+	defer srv.Close()
+
+	header := http.Header{}
+	header.Set("Sec-WebSocket-Protocol", graphqlws.SubprotocolGraphQLWS)
+	header.Set("X-Request-ID", "42")
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer ws.Close()
+
+	waitForCount(t, registry, 1)
+	if _, ok := registry.Get("eu-42"); !ok {
+		t.Error("connection doesn't have the generated ID")
+	}
+}
@@ -0,0 +1,502 @@
+package graphqlws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// shutdownConnection is implemented by connections served over plain
+// HTTP, which complete their operations when the handler shuts down.
+type shutdownConnection interface {
+	shutdown(ctx context.Context)
+}
+
+// readHTTPOperation reads the operation of an HTTP request, as JSON in a
+// POST body or from the parameters of a GET request.
+func readHTTPOperation(r *http.Request) (*StartMessagePayload, error) {
+	data := &StartMessagePayload{}
+	switch r.Method {
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(data); err != nil {
+			return nil, fmt.Errorf("Invalid request body: %v", err)
+		}
+	case http.MethodGet:
+		query := r.URL.Query()
+		data.Query = query.Get("query")
+		data.OperationName = query.Get("operationName")
+		data.DocumentID = query.Get("documentId")
+		for name, target := range map[string]interface{}{
+			"variables":  &data.Variables,
+			"extensions": &data.Extensions,
+		} {
+			if value := query.Get(name); value != "" {
+				if err := json.Unmarshal([]byte(value), target); err != nil {
+					return nil, fmt.Errorf("Invalid %s: %v", name, err)
+				}
+			}
+		}
+	default:
+		return nil, errors.New("Method not allowed")
+	}
+	if data.Query == "" && data.DocumentID == "" && data.Extensions[persistedQueryExtension] == nil {
+		return nil, errors.New("Missing query")
+	}
+	return data, nil
+}
+
+// authenticateHTTP resolves the auth token in the Authorization header of
+// a request, if authentication is configured.
+func authenticateHTTP(config HandlerConfig, conn Connection, r *http.Request) (interface{}, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if config.AuthenticateRequest != nil {
+		return config.AuthenticateRequest(conn, r, token)
+	}
+	if config.Authenticate != nil {
+		return config.Authenticate(token)
+	}
+	return nil, nil
+}
+
+// errorsBody encodes errors an operation was rejected with as the body
+// of a response.
+func errorsBody(errs []error, format ErrorFormatter) []byte {
+	if format == nil {
+		format = DefaultErrorFormatter
+	}
+	body, _ := json.Marshal(map[string]interface{}{"errors": formatErrors(errs, format)})
+	return body
+}
+
+// acceptHTTPConnection checks the origin of a request served over HTTP,
+// authenticates it and takes slots for the IP address and user of its
+// connection, as for WebSocket connections. It responds with an error
+// and returns false if the connection is rejected.
+func (h *Handler) acceptHTTPConnection(w http.ResponseWriter, r *http.Request, conn Connection, base *httpConnection) bool {
+	if !h.checkOrigin(r) {
+		h.logger.WithField("origin", r.Header.Get("Origin")).Warn("Origin not allowed")
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		h.upgradeFailed(r, errors.New("Origin not allowed"))
+		return false
+	}
+
+	ipSlot, evicted := h.ipLimiter.acquire(base.clientIP, conn)
+	if ipSlot == nil {
+		h.logger.WithField("ip", base.clientIP).Warn("Too many connections from IP address")
+		http.Error(w, "Too many connections", http.StatusTooManyRequests)
+		h.upgradeFailed(r, errors.New("Too many connections from IP address"))
+		return false
+	}
+	closeEvictedConnections(evicted)
+
+	user, err := authenticateHTTP(h.config, conn, r)
+	if err != nil {
+		h.ipLimiter.release(base.clientIP, ipSlot)
+		h.logger.WithFields(Fields{
+			"conn": conn.ID(),
+			"err":  err,
+		}).Debug("Failed to authenticate HTTP connection")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	userSlot, evicted := h.userLimiter.acquire(user, conn)
+	if userSlot == nil {
+		h.ipLimiter.release(base.clientIP, ipSlot)
+		h.logger.WithFields(Fields{
+			"conn": conn.ID(),
+			"user": user,
+		}).Warn("Too many connections for user")
+		http.Error(w, "Too many connections", http.StatusTooManyRequests)
+		return false
+	}
+	closeEvictedConnections(evicted)
+
+	base.user = user
+	base.ipSlot = ipSlot
+	base.userSlot = userSlot
+	return true
+}
+
+// openHTTPConnection registers a connection served over HTTP with the
+// handler, once it has been accepted.
+func (h *Handler) openHTTPConnection(conn Connection, r *http.Request) {
+	h.connections.Add(conn)
+	h.users.add(conn.User(), conn)
+	h.cluster.register(conn)
+	if h.config.EventHandlers.Open != nil {
+		h.config.EventHandlers.Open(conn, r)
+	}
+	emitEvent(h.config.Events, Event{Type: EventConnectionOpened, Connection: conn, Request: r})
+}
+
+// closeHTTPConnection unregisters a connection served over HTTP,
+// removes its subscriptions and gives up its slots.
+func (h *Handler) closeHTTPConnection(conn Connection, base *httpConnection) {
+	if h.config.EventHandlers.Close != nil {
+		h.config.EventHandlers.Close(conn)
+	}
+	emitEvent(h.config.Events, Event{Type: EventConnectionClosed, Connection: conn})
+
+	h.subscriptionManager.RemoveSubscriptions(conn)
+	h.connections.Remove(conn)
+	h.users.remove(conn.User(), conn)
+	h.cluster.unregister(conn)
+	h.ipLimiter.release(base.clientIP, base.ipSlot)
+	h.userLimiter.release(base.user, base.userSlot)
+}
+
+// allowHTTPOperation reports whether the client of a connection served
+// over HTTP may start or stop an operation under the rate limits, which
+// apply to each user, or each IP address for anonymous clients. The
+// rate limits of messages are checked first, as for WebSocket
+// connections.
+func (h *Handler) allowHTTPOperation(conn Connection, messageType string) bool {
+	key := rateLimitKey(conn)
+	if h.messageRates[messageType].allow(key) && h.operationRates.allow(key) {
+		return true
+	}
+	h.logger.WithFields(Fields{
+		"conn": conn.ID(),
+		"type": messageType,
+	}).Warn("Operation rate limit exceeded")
+	return false
+}
+
+// startHTTPOperation starts the operation of a connection served over
+// HTTP, as StartOperation does for WebSocket connections.
+func (h *Handler) startHTTPOperation(conn Connection, base *httpConnection, data *StartMessagePayload) []error {
+	config := h.config
+	if !h.allowHTTPOperation(conn, gqlStart) {
+		return []error{newOperationError(
+			"Too many subscriptions started, try again later",
+			ErrCodeRateLimit,
+		)}
+	}
+	if config.ValidateStart != nil {
+		if errs := config.ValidateStart(conn, data); len(errs) > 0 {
+			return errs
+		}
+	}
+	if err := checkPayloadLimits(config, data); err != nil {
+		return []error{err}
+	}
+	persistedHash, err := resolveDocument(config, data)
+	if err != nil {
+		return []error{err}
+	}
+
+	ctx, cancel := context.WithCancel(conn.Context())
+	subscription := &Subscription{
+		ID:            base.opID,
+		Query:         data.Query,
+		Variables:     data.Variables,
+		OperationName: data.OperationName,
+		Connection:    conn,
+		Context:       ctx,
+		SendData: func(data *DataMessagePayload) {
+			conn.SendData(base.opID, data)
+		},
+		Filter: config.SubscriptionFilter,
+	}
+	if config.SubscriptionScope != nil {
+		subscription.Scope = config.SubscriptionScope(subscription)
+	}
+	base.mutex.Lock()
+	base.cancelOperation = cancel
+	base.mutex.Unlock()
+
+	errs := checkQueryLimits(config, subscription)
+	if len(errs) == 0 && config.AuthorizeOperation != nil {
+		errs = config.AuthorizeOperation(conn, subscription)
+	}
+	if len(errs) == 0 {
+		errs = h.subscriptionManager.AddSubscription(conn, subscription)
+	}
+	if len(errs) > 0 {
+		cancel()
+	} else if persistedHash != "" {
+		config.PersistedQueries.Add(persistedHash, data.Query)
+	}
+
+	if config.EventHandlers.NewSubscription != nil {
+		config.EventHandlers.NewSubscription(subscription, errs)
+	}
+	if len(errs) > 0 {
+		emitEvent(config.Events, Event{Type: EventError, Connection: conn, OperationID: base.opID, Errors: errs})
+	} else {
+		emitEvent(config.Events, Event{Type: EventOperationStarted, Connection: conn, OperationID: base.opID, Subscription: subscription})
+	}
+	return errs
+}
+
+// streamConnection is implemented by connections that stream the results
+// of their operation in the response to the request starting it.
+type streamConnection interface {
+	Connection
+
+	// base returns the state of the connection.
+	base() *httpConnection
+
+	// start starts the response stream, unless it has started already.
+	start()
+
+	// reject responds with the errors the operation was rejected with.
+	reject(errs []error, format ErrorFormatter)
+
+	// keepAlive sends a keep-alive message.
+	keepAlive()
+}
+
+// serveStream authenticates and registers a streaming connection, starts
+// its operation and serves it until the stream ends.
+func (h *Handler) serveStream(w http.ResponseWriter, r *http.Request, data *StartMessagePayload, conn streamConnection) {
+	base := conn.base()
+	defer base.finish(ErrClosedByClient)
+
+	// Count the request as an upgrade until its connection is registered,
+	// so that shutting down doesn't miss it
+	if !h.beginUpgrade(w) {
+		return
+	}
+	if !h.acceptHTTPConnection(w, r, conn, base) {
+		h.upgrades.Done()
+		return
+	}
+
+	h.openHTTPConnection(conn, r)
+	h.upgrades.Done()
+	defer func() {
+		base.finish(ErrClosedByClient)
+		h.closeHTTPConnection(conn, base)
+		close(base.closed)
+	}()
+
+	if errs := h.startHTTPOperation(conn, base, data); len(errs) > 0 {
+		conn.reject(errs, h.config.ErrorFormatter)
+		return
+	}
+	conn.start()
+
+	// Wait until the stream ends, sending keep-alive messages at the
+	// configured interval
+	if h.config.KeepAliveInterval <= 0 {
+		<-base.ctx.Done()
+		return
+	}
+	ticker := time.NewTicker(h.config.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-base.ctx.Done():
+			return
+		case <-ticker.C:
+			conn.keepAlive()
+		}
+	}
+}
+
+/**
+ * The state shared by connections served over plain HTTP, which carry a
+ * single operation.
+ */
+
+type httpConnection struct {
+	id          string
+	opID        string
+	config      HandlerConfig
+	logger      Logger
+	request     *http.Request
+	clientIP    string
+	user        interface{}
+	ipSlot      *limitedConnection
+	userSlot    *limitedConnection
+	ctx         context.Context
+	cancel      context.CancelFunc
+	connectedAt time.Time
+
+	// Whether the connection has ended, the error it ended with, the
+	// cancellation of its operation and statistics, guarded by mutex
+	done            bool
+	closeErr        error
+	cancelOperation context.CancelFunc
+	lastActivity    time.Time
+	messagesSent    uint64
+	bytesSent       uint64
+	mutex           *sync.Mutex
+
+	// Closed once the connection has been unregistered
+	closed chan struct{}
+
+	values      map[string]interface{}
+	valuesMutex *sync.RWMutex
+}
+
+func newHTTPConnection(ctx context.Context, config HandlerConfig, logger Logger, r *http.Request, clientIP string) httpConnection {
+	var id string
+	if config.IDGenerator != nil {
+		id = config.IDGenerator(r)
+	}
+	if id == "" {
+		id = uuid.New().String()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return httpConnection{
+		id:          id,
+		opID:        id,
+		config:      config,
+		logger:      logger,
+		request:     r,
+		clientIP:    clientIP,
+		ctx:         ctx,
+		cancel:      cancel,
+		connectedAt: time.Now(),
+		mutex:       &sync.Mutex{},
+		closed:      make(chan struct{}),
+		values:      make(map[string]interface{}),
+		valuesMutex: &sync.RWMutex{},
+	}
+}
+
+func (c *httpConnection) base() *httpConnection {
+	return c
+}
+
+// encodeData transforms the data message of conn as WebSocket
+// connections do and encodes it; it returns nil for messages that
+// aren't sent.
+func (c *httpConnection) encodeData(conn Connection, data *DataMessagePayload) []byte {
+	config := c.config
+	if config.TransformData != nil {
+		data = config.TransformData(conn, c.opID, data)
+		if data == nil {
+			return nil
+		}
+	}
+	if config.ErrorFormatter != nil && (len(data.Errors) > 0 || len(data.Incremental) > 0) {
+		data = formatDataErrors(data, config.ErrorFormatter)
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		c.logger.WithFields(Fields{
+			"conn": c.id,
+			"err":  err,
+		}).Warn("Failed to encode data message")
+		return nil
+	}
+	return body
+}
+
+// sent records a message sent to the client; mutex must be held by the
+// caller.
+func (c *httpConnection) sent(bytes int) {
+	c.messagesSent++
+	c.bytesSent += uint64(bytes)
+	c.lastActivity = time.Now()
+}
+
+// finish ends the connection with the given error, unless it has ended
+// already.
+func (c *httpConnection) finish(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.finishLocked(err)
+}
+
+// finishLocked is like finish; mutex must be held by the caller.
+func (c *httpConnection) finishLocked(err error) {
+	if c.done {
+		return
+	}
+	c.done = true
+	c.closeErr = err
+	if c.cancelOperation != nil {
+		c.cancelOperation()
+	}
+	c.cancel()
+}
+
+// stats returns the statistics of the connection for a subprotocol.
+func (c *httpConnection) stats(subprotocol string) ConnectionStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := ConnectionStats{
+		ID:           c.id,
+		Subprotocol:  subprotocol,
+		ConnectedAt:  c.connectedAt,
+		LastActivity: c.connectedAt,
+		MessagesSent: c.messagesSent,
+		BytesSent:    c.bytesSent,
+	}
+	if !c.lastActivity.IsZero() {
+		stats.LastActivity = c.lastActivity
+	}
+	if !c.done {
+		stats.Subscriptions = 1
+	}
+	return stats
+}
+
+func (c *httpConnection) ID() string {
+	return c.id
+}
+
+func (c *httpConnection) User() interface{} {
+	return c.user
+}
+
+func (c *httpConnection) Set(key string, value interface{}) {
+	c.valuesMutex.Lock()
+	c.values[key] = value
+	c.valuesMutex.Unlock()
+}
+
+func (c *httpConnection) Get(key string) (interface{}, bool) {
+	c.valuesMutex.RLock()
+	value, ok := c.values[key]
+	c.valuesMutex.RUnlock()
+	return value, ok
+}
+
+func (c *httpConnection) InitPayload() map[string]interface{} {
+	return nil
+}
+
+func (c *httpConnection) Context() context.Context {
+	return c.ctx
+}
+
+func (c *httpConnection) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.done {
+		return nil
+	}
+	return c.closeErr
+}
+
+func (c *httpConnection) Request() *http.Request {
+	return c.request
+}
+
+func (c *httpConnection) RemoteAddr() net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", c.request.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return addr
+}
+
+func (c *httpConnection) ClientIP() string {
+	return c.clientIP
+}
@@ -0,0 +1,64 @@
+package graphqlws
+
+import (
+	"encoding/json"
+)
+
+// IncrementalPayload is a partial result of an operation delivered
+// incrementally, for a fragment marked with @defer or for items of a list
+// marked with @stream.
+type IncrementalPayload struct {
+	// Data holds the fields of a deferred fragment and Items the
+	// streamed list items; only one of them is set.
+	Data  interface{}   `json:"data,omitempty"`
+	Items []interface{} `json:"items,omitempty"`
+
+	// Path is the path of the deferred fragment's object, or of the list,
+	// in the result, e.g. []interface{}{"user", "friends", 0}.
+	Path []interface{} `json:"path"`
+
+	// Label is the label argument of the @defer or @stream directive, if
+	// it has one.
+	Label string `json:"label,omitempty"`
+
+	Errors     []error                `json:"errors,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// NewInitialPayload returns the first data message payload of a result
+// delivered incrementally, which is followed by subsequent payloads.
+func NewInitialPayload(data interface{}, errs []error) *DataMessagePayload {
+	hasNext := true
+	return &DataMessagePayload{Data: data, Errors: errs, HasNext: &hasNext}
+}
+
+// NewSubsequentPayload returns a data message payload delivering partial
+// results of a result delivered incrementally; hasNext is false for its
+// last payload.
+func NewSubsequentPayload(hasNext bool, incremental ...IncrementalPayload) *DataMessagePayload {
+	return &DataMessagePayload{HasNext: &hasNext, Incremental: incremental}
+}
+
+// subsequentPayload is the encoding of data message payloads with
+// partial results, which have no data.
+type subsequentPayload struct {
+	Incremental []IncrementalPayload   `json:"incremental,omitempty"`
+	HasNext     *bool                  `json:"hasNext"`
+	Errors      []error                `json:"errors,omitempty"`
+	Extensions  map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// MarshalJSON encodes the payload, leaving out the data of subsequent
+// payloads of results delivered incrementally.
+func (p DataMessagePayload) MarshalJSON() ([]byte, error) {
+	if p.Incremental == nil || p.Data != nil {
+		type payload DataMessagePayload
+		return json.Marshal(payload(p))
+	}
+	return json.Marshal(subsequentPayload{
+		Incremental: p.Incremental,
+		HasNext:     p.HasNext,
+		Errors:      p.Errors,
+		Extensions:  p.Extensions,
+	})
+}
@@ -0,0 +1,85 @@
+package graphqlws_test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+func TestDataMessagePayload_MarshalsIncrementalPayloads(t *testing.T) {
+	for _, tc := range []struct {
+		payload  *graphqlws.DataMessagePayload
+		expected string
+	}{
+		{
+			&graphqlws.DataMessagePayload{Data: map[string]interface{}{"user": "ada"}},
+			`{"data":{"user":"ada"},"errors":null}`,
+		},
+		{
+			graphqlws.NewInitialPayload(map[string]interface{}{"user": "ada"}, nil),
+			`{"data":{"user":"ada"},"errors":null,"hasNext":true}`,
+		},
+		{
+			graphqlws.NewSubsequentPayload(false, graphqlws.IncrementalPayload{
+				Items: []interface{}{"bob"},
+				Path:  []interface{}{"user", "friends", 0},
+				Label: "friends",
+			}),
+			`{"incremental":[{"items":["bob"],"path":["user","friends",0],"label":"friends"}],"hasNext":false}`,
+		},
+	} {
+		encoded, err := json.Marshal(tc.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(encoded) != tc.expected {
+			t.Errorf("expected %s, received %s", tc.expected, encoded)
+		}
+	}
+}
+
+func TestConnection_SendsIncrementalPayloads(t *testing.T) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	readOperationMessage(t, ws)
+	startSubscription(t, ws, "1")
+	s := receiveSubscription(t, subscriptions)
+
+	s.SendData(graphqlws.NewInitialPayload(map[string]interface{}{"user": map[string]interface{}{"name": "ada"}}, nil))
+	s.SendData(graphqlws.NewSubsequentPayload(false, graphqlws.IncrementalPayload{
+		Data: map[string]interface{}{"email": "ada@example.com"},
+		Path: []interface{}{"user"},
+	}))
+
+	initial, _ := readOperationMessage(t, ws).Payload.(map[string]interface{})
+	if initial["hasNext"] != true || initial["data"] == nil {
+		t.Errorf("unexpected initial payload: %v", initial)
+	}
+	subsequent, _ := readOperationMessage(t, ws).Payload.(map[string]interface{})
+	expected := []interface{}{map[string]interface{}{
+		"data": map[string]interface{}{"email": "ada@example.com"},
+		"path": []interface{}{"user"},
+	}}
+	if subsequent["hasNext"] != false || !reflect.DeepEqual(subsequent["incremental"], expected) {
+		t.Errorf("unexpected subsequent payload: %v", subsequent)
+	}
+	if _, ok := subsequent["data"]; ok {
+		t.Errorf("subsequent payload has data: %v", subsequent)
+	}
+}
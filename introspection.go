@@ -0,0 +1,46 @@
+package graphqlws
+
+import (
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// usesIntrospection reports whether any operation or fragment of a
+// document selects the introspection fields __schema or __type;
+// __typename is allowed.
+func usesIntrospection(doc *ast.Document) bool {
+	for _, node := range doc.Definitions {
+		switch def := node.(type) {
+		case *ast.OperationDefinition:
+			if selectionSetUsesIntrospection(def.SelectionSet) {
+				return true
+			}
+		case *ast.FragmentDefinition:
+			if selectionSetUsesIntrospection(def.SelectionSet) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func selectionSetUsesIntrospection(set *ast.SelectionSet) bool {
+	if set == nil {
+		return false
+	}
+	for _, selection := range set.Selections {
+		switch s := selection.(type) {
+		case *ast.Field:
+			if s.Name != nil && (s.Name.Value == "__schema" || s.Name.Value == "__type") {
+				return true
+			}
+			if selectionSetUsesIntrospection(s.SelectionSet) {
+				return true
+			}
+		case *ast.InlineFragment:
+			if selectionSetUsesIntrospection(s.SelectionSet) {
+				return true
+			}
+		}
+	}
+	return false
+}
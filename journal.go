@@ -0,0 +1,168 @@
+package graphqlws
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	// Default number of events kept per topic by memory journals
+	defaultJournalSize = 1000
+
+	// Keys of the journal extensions of start and data messages
+	replayExtension  = "replay"
+	journalExtension = "journal"
+)
+
+// JournalEntry is an event persisted in a journal.
+type JournalEntry struct {
+	// Topic is the topic the event was published to.
+	Topic string
+
+	// Sequence is the position of the event in its topic; the first event
+	// of a topic has sequence number 1.
+	Sequence uint64
+
+	// Payload is the event's payload, encoded as JSON.
+	Payload json.RawMessage
+
+	// Time is the time the event was appended to the journal.
+	Time time.Time
+}
+
+// Journal persists the events published to each topic with sequence
+// numbers, so that subscribers that reconnect can replay the events they
+// missed; see PubSubConfig.Journal. Journals only keep recent events.
+type Journal interface {
+	// Append appends an event to a topic and returns its sequence number.
+	Append(ctx context.Context, topic string, payload json.RawMessage) (uint64, error)
+
+	// Read returns the events of a topic that are still kept and have
+	// sequence numbers greater than after, oldest first.
+	Read(ctx context.Context, topic string, after uint64) ([]JournalEntry, error)
+}
+
+/**
+ * The in-memory implementation of the Journal interface.
+ */
+
+// MemoryJournalConfig configures an in-memory journal.
+type MemoryJournalConfig struct {
+	// Size is the number of events kept per topic; defaults to 1000.
+	Size int
+}
+
+type memoryJournal struct {
+	size int
+
+	// The kept events and the last sequence number by topic, guarded by
+	// mutex
+	entries   map[string][]JournalEntry
+	sequences map[string]uint64
+	mutex     *sync.RWMutex
+}
+
+// NewMemoryJournal creates a journal that keeps the most recent events of
+// each topic in memory, e.g. for single instances or tests.
+func NewMemoryJournal(config MemoryJournalConfig) Journal {
+	size := config.Size
+	if size <= 0 {
+		size = defaultJournalSize
+	}
+	return &memoryJournal{
+		size:      size,
+		entries:   make(map[string][]JournalEntry),
+		sequences: make(map[string]uint64),
+		mutex:     &sync.RWMutex{},
+	}
+}
+
+func (j *memoryJournal) Append(ctx context.Context, topic string, payload json.RawMessage) (uint64, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.sequences[topic]++
+	entries := append(j.entries[topic], JournalEntry{
+		Topic:    topic,
+		Sequence: j.sequences[topic],
+		Payload:  append(json.RawMessage(nil), payload...),
+		Time:     time.Now(),
+	})
+	if len(entries) > j.size {
+		entries = append([]JournalEntry(nil), entries[len(entries)-j.size:]...)
+	}
+	j.entries[topic] = entries
+	return j.sequences[topic], nil
+}
+
+func (j *memoryJournal) Read(ctx context.Context, topic string, after uint64) ([]JournalEntry, error) {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+
+	entries := j.entries[topic]
+	for i, entry := range entries {
+		if entry.Sequence > after {
+			return append([]JournalEntry(nil), entries[i:]...), nil
+		}
+	}
+	return nil, nil
+}
+
+/**
+ * Replaying journaled events to subscriptions.
+ */
+
+// replayCursors returns the cursors requested in the replay extension of
+// a start message: the last sequence number the client has seen by topic.
+func replayCursors(data *StartMessagePayload) map[string]uint64 {
+	extension, ok := data.Extensions[replayExtension].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	cursors := make(map[string]uint64, len(extension))
+	for topic, value := range extension {
+		if sequence, ok := value.(float64); ok && sequence >= 0 {
+			cursors[topic] = uint64(sequence)
+		}
+	}
+	return cursors
+}
+
+// journalCursor tracks the last journaled event replayed to a
+// subscription by topic. Its mutex is held while events are replayed, so
+// that live events are delivered after the replayed ones, and only if
+// they haven't been replayed.
+type journalCursor struct {
+	replayed map[string]uint64
+	mutex    *sync.Mutex
+}
+
+func newJournalCursor() *journalCursor {
+	return &journalCursor{
+		replayed: make(map[string]uint64),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// sendJournaled sends the result of a journaled event to a subscription,
+// with the topic and sequence number of the event in the journal
+// extension; gap is set on the first replayed event if some of the events
+// the client missed are no longer kept.
+func sendJournaled(s *Subscription, topic string, sequence uint64, gap bool, data *DataMessagePayload) {
+	extension := map[string]interface{}{"topic": topic, "sequence": sequence}
+	if gap {
+		extension["gap"] = true
+	}
+	extensions := make(map[string]interface{}, len(data.Extensions)+1)
+	for key, value := range data.Extensions {
+		extensions[key] = value
+	}
+	extensions[journalExtension] = extension
+
+	copied := *data
+	copied.Extensions = extensions
+	s.SendData(&copied)
+}
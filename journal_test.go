@@ -0,0 +1,111 @@
+package graphqlws_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+// journaledEvent is a data message of a journaled event.
+type journaledEvent struct {
+	message  interface{}
+	sequence uint64
+	gap      bool
+}
+
+func addJournaledSubscription(
+	t *testing.T,
+	ps graphqlws.PubSub,
+	cursors map[string]uint64,
+	received *[]journaledEvent,
+) {
+	conn := &mockWebSocketConnection{id: "1"}
+	subscription := &graphqlws.Subscription{
+		ID:            "1",
+		Connection:    conn,
+		Query:         `subscription { message(room: "general") }`,
+		ReplayCursors: cursors,
+		SendData: func(msg *graphqlws.DataMessagePayload) {
+			data, _ := msg.Data.(map[string]interface{})
+			journal, _ := msg.Extensions["journal"].(map[string]interface{})
+			sequence, _ := journal["sequence"].(uint64)
+			gap, _ := journal["gap"].(bool)
+			*received = append(*received, journaledEvent{data["message"], sequence, gap})
+		},
+	}
+	if errs := ps.AddSubscription(conn, subscription); len(errs) > 0 {
+		t.Fatalf("AddSubscription fails: %v", errs)
+	}
+}
+
+func TestPubSub_JournaledEventsAreReplayedFromCursors(t *testing.T) {
+	ps := graphqlws.NewPubSub(graphqlws.PubSubConfig{
+		Schema:  buildPubSubSchema(),
+		Journal: graphqlws.NewMemoryJournal(graphqlws.MemoryJournalConfig{Size: 3}),
+		Topics: func(s *graphqlws.Subscription) []string {
+			return []string{"rooms.general"}
+		},
+	})
+	for _, message := range []string{"one", "two", "three", "four"} {
+		ps.Publish(context.Background(), "rooms.general", message)
+	}
+	ps.Publish(context.Background(), "rooms.secret", "hidden")
+
+	// Topics the subscription isn't subscribed to aren't replayed
+	received := []journaledEvent{}
+	addJournaledSubscription(t, ps, map[string]uint64{"rooms.general": 2, "rooms.secret": 0}, &received)
+	ps.Publish(context.Background(), "rooms.general", "five")
+
+	expected := []journaledEvent{{"three", 3, false}, {"four", 4, false}, {"five", 5, false}}
+	if len(received) != len(expected) {
+		t.Fatalf("unexpected events: %v", received)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Errorf("expected event %v, received %v", expected[i], received[i])
+		}
+	}
+
+	// The first event the journal has kept reports the events it hasn't
+	received = received[:0]
+	ps.RemoveSubscriptions(&mockWebSocketConnection{id: "1"})
+	addJournaledSubscription(t, ps, map[string]uint64{"rooms.general": 0}, &received)
+	if len(received) != 3 || received[0] != (journaledEvent{"three", 3, true}) || received[1].gap {
+		t.Errorf("unexpected events: %v", received)
+	}
+}
+
+func TestHandler_StartMessagesRequestReplays(t *testing.T) {
+	ps := graphqlws.NewPubSub(graphqlws.PubSubConfig{
+		Schema:  buildPubSubSchema(),
+		Journal: graphqlws.NewMemoryJournal(graphqlws.MemoryJournalConfig{}),
+	})
+	ps.Publish(context.Background(), "message", "missed")
+
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{SubscriptionManager: ps}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	readOperationMessage(t, ws)
+	writeMessage(t, ws, map[string]interface{}{
+		"id":   "1",
+		"type": "start",
+		"payload": map[string]interface{}{
+			"query":      "subscription { message }",
+			"extensions": map[string]interface{}{"replay": map[string]interface{}{"message": 0}},
+		},
+	})
+
+	msg := readOperationMessage(t, ws)
+	payload, _ := msg.Payload.(map[string]interface{})
+	extensions, _ := payload["extensions"].(map[string]interface{})
+	journal, _ := extensions["journal"].(map[string]interface{})
+	data, _ := payload["data"].(map[string]interface{})
+	if msg.Type != "data" || data["message"] != "missed" || journal["sequence"] != float64(1) || journal["topic"] != "message" {
+		t.Errorf("unexpected replayed message: %v", msg)
+	}
+}
@@ -0,0 +1,86 @@
+// Package jwtauth authenticates graphqlws connections with JSON Web
+// Tokens:
+//
+//	graphqlws.HandlerConfig{
+//		AuthenticateRequest: jwtauth.NewAuthenticator(keyFunc, nil),
+//	}
+package jwtauth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/meandrewdev/graphqlws"
+)
+
+// ClaimsKey is the connection value key under which the authenticator
+// returned by NewAuthenticator stores the claims of a validated token.
+const ClaimsKey = "graphqlws/jwt-claims"
+
+// NewAuthenticator creates an authentication function for
+// HandlerConfig.AuthenticateRequest that validates JSON Web Tokens with
+// the given key function. The token is taken from the authToken of the
+// connection_init payload or, if that is empty, from the "Authorization:
+// Bearer" header of the request. Refreshes need to carry a new token, as
+// there is no request to fall back to then.
+//
+// newClaims returns the claims value each token is parsed into; if it is
+// nil, tokens are parsed into jwt.MapClaims. The claims of a valid token are
+// stored on the connection under ClaimsKey, while the token's subject
+// becomes the user of the connection. Custom claims types need to implement
+// GetSubject() string for the subject to be found.
+func NewAuthenticator(
+	keyFunc jwt.Keyfunc,
+	newClaims func() jwt.Claims,
+) graphqlws.RequestAuthenticateFunc {
+	return func(conn graphqlws.Connection, r *http.Request, token string) (interface{}, error) {
+		if token == "" && r != nil {
+			token = bearerToken(r)
+		}
+		if token == "" {
+			return nil, errors.New("No auth token provided")
+		}
+
+		var claims jwt.Claims = jwt.MapClaims{}
+		if newClaims != nil {
+			claims = newClaims()
+		}
+
+		if _, err := jwt.ParseWithClaims(token, claims, keyFunc); err != nil {
+			return nil, err
+		}
+
+		subject := subjectOf(claims)
+		if subject == "" {
+			return nil, errors.New("Auth token has no subject")
+		}
+
+		conn.Set(ClaimsKey, claims)
+		return subject, nil
+	}
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+func subjectOf(claims jwt.Claims) string {
+	switch c := claims.(type) {
+	case jwt.MapClaims:
+		subject, _ := c["sub"].(string)
+		return subject
+	case *jwt.RegisteredClaims:
+		return c.Subject
+	case *jwt.StandardClaims:
+		return c.Subject
+	case interface{ GetSubject() string }:
+		return c.GetSubject()
+	}
+	return ""
+}
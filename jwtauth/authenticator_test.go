@@ -0,0 +1,79 @@
+package jwtauth_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/meandrewdev/graphqlws/jwtauth"
+	"github.com/meandrewdev/graphqlws/testutil"
+)
+
+var secret = []byte("secret")
+
+func signToken(t *testing.T, subject string, secret []byte) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":  subject,
+		"role": "admin",
+	})
+	signed, err := token.SignedString(secret)
+	if err != nil {
+		t.Fatalf("could not sign token: %v", err)
+	}
+	return signed
+}
+
+func newAuthenticator() func(*testutil.Connection, string) (interface{}, error) {
+	authenticate := jwtauth.NewAuthenticator(
+		func(token *jwt.Token) (interface{}, error) {
+			return secret, nil
+		},
+		nil,
+	)
+	return func(conn *testutil.Connection, token string) (interface{}, error) {
+		return authenticate(conn, conn.Request(), token)
+	}
+}
+
+func TestAuthenticator_ValidTokensAuthenticateConnections(t *testing.T) {
+	conn := testutil.NewConnection(testutil.ConnectionConfig{
+		Request: httptest.NewRequest("GET", "/", nil),
+	})
+
+	user, err := newAuthenticator()(conn, signToken(t, "joe", secret))
+	if err != nil || user != "joe" {
+		t.Fatalf("unexpected user: %v, %v", user, err)
+	}
+	claims, _ := conn.Get(jwtauth.ClaimsKey)
+	if mapClaims, _ := claims.(jwt.MapClaims); mapClaims["role"] != "admin" {
+		t.Errorf("claims not stored on connection: %v", claims)
+	}
+}
+
+func TestAuthenticator_TokensAreReadFromTheAuthorizationHeader(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+signToken(t, "jane", secret))
+	conn := testutil.NewConnection(testutil.ConnectionConfig{Request: r})
+
+	user, err := newAuthenticator()(conn, "")
+	if err != nil || user != "jane" {
+		t.Fatalf("unexpected user: %v, %v", user, err)
+	}
+
+	// Refreshes have no request and don't fall back to the header
+	refreshed := testutil.NewConnection(testutil.ConnectionConfig{})
+	if user, err := newAuthenticator()(refreshed, ""); err == nil {
+		t.Errorf("refresh without a token authenticated %v", user)
+	}
+}
+
+func TestAuthenticator_InvalidTokensAreRejected(t *testing.T) {
+	for _, token := range []string{"", "garbage", signToken(t, "joe", []byte("wrong"))} {
+		conn := testutil.NewConnection(testutil.ConnectionConfig{
+			Request: httptest.NewRequest("GET", "/", nil),
+		})
+		if user, err := newAuthenticator()(conn, token); err == nil {
+			t.Errorf("token %q authenticated %v", token, user)
+		}
+	}
+}
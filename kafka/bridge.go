@@ -0,0 +1,179 @@
+// Package kafka feeds messages consumed from Kafka topics into a
+// publishing subscription manager, so that subscription events can
+// originate from an event log.
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/meandrewdev/graphqlws"
+	"github.com/segmentio/kafka-go"
+)
+
+// Reader consumes the messages of a Kafka topic; *kafka.Reader
+// implements it.
+type Reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Topic defines how the messages of a Kafka topic are consumed.
+type Topic struct {
+	// Name is the name of the topic.
+	Name string
+
+	// Field is the subscription field that the topic's messages are
+	// published for; defaults to the name of the topic.
+	Field string
+
+	// StartOffset is where the consumer group starts reading partitions
+	// it hasn't committed offsets for yet: kafka.FirstOffset or
+	// kafka.LastOffset, the default.
+	StartOffset int64
+}
+
+// Config defines the configuration of a Kafka bridge.
+type Config struct {
+	// Brokers and GroupID define the Kafka cluster and the consumer group
+	// the bridge joins. Partitions of each topic are balanced across the
+	// members of the group; messages of a partition are published in order.
+	Brokers []string
+	GroupID string
+
+	// Topics lists the consumed topics.
+	Topics []Topic
+
+	// Manager executes the subscriptions for each message.
+	Manager graphqlws.PublishingSubscriptionManager
+
+	// Decode returns the source value of the subscription field's resolver
+	// for a message; by default, message values are decoded as JSON.
+	Decode func(kafka.Message) (interface{}, error)
+
+	// ReaderConfig holds further options for the readers of the topics,
+	// e.g. a dialer or group balancers. Its brokers, group, topic and start
+	// offset are replaced with those of the bridge.
+	ReaderConfig kafka.ReaderConfig
+
+	// NewReader creates the reader of a topic; defaults to kafka.NewReader.
+	NewReader func(kafka.ReaderConfig) Reader
+}
+
+// Bridge consumes Kafka topics and publishes their messages to the
+// subscriptions of a subscription manager.
+type Bridge interface {
+	// Run consumes the topics until ctx is done, which returns nil, or
+	// reading a topic fails. Offsets are committed once messages have been
+	// published, so messages are published at least once.
+	Run(ctx context.Context) error
+}
+
+/**
+ * The default implementation of the Bridge interface.
+ */
+
+type bridge struct {
+	config Config
+	logger graphqlws.Logger
+}
+
+// NewBridge creates a Kafka bridge.
+func NewBridge(config Config) Bridge {
+	if config.Decode == nil {
+		config.Decode = decodeJSON
+	}
+	if config.NewReader == nil {
+		config.NewReader = func(c kafka.ReaderConfig) Reader {
+			return kafka.NewReader(c)
+		}
+	}
+	return &bridge{
+		config: config,
+		logger: graphqlws.NewLogger("kafka"),
+	}
+}
+
+func (b *bridge) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(b.config.Topics))
+	wg := &sync.WaitGroup{}
+	for _, topic := range b.config.Topics {
+		readerConfig := b.config.ReaderConfig
+		readerConfig.Brokers = b.config.Brokers
+		readerConfig.GroupID = b.config.GroupID
+		readerConfig.Topic = topic.Name
+		readerConfig.StartOffset = topic.StartOffset
+		if readerConfig.StartOffset == 0 {
+			readerConfig.StartOffset = kafka.LastOffset
+		}
+
+		field := topic.Field
+		if field == "" {
+			field = topic.Name
+		}
+
+		reader := b.config.NewReader(readerConfig)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer reader.Close()
+			if err := b.consume(ctx, reader, field); err != nil {
+				errs <- err
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// consume publishes the messages of a reader until ctx is done.
+func (b *bridge) consume(ctx context.Context, reader Reader, field string) error {
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		// Skip messages that can't be decoded rather than retrying
+		// them forever
+		payload, err := b.config.Decode(msg)
+		if err != nil {
+			b.logger.WithFields(graphqlws.Fields{
+				"topic":     msg.Topic,
+				"partition": msg.Partition,
+				"offset":    msg.Offset,
+				"err":       err,
+			}).Warn("Failed to decode message")
+		} else {
+			b.config.Manager.Publish(ctx, field, payload)
+		}
+
+		if err := reader.CommitMessages(ctx, msg); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func decodeJSON(msg kafka.Message) (interface{}, error) {
+	var payload interface{}
+	err := json.Unmarshal(msg.Value, &payload)
+	return payload, err
+}
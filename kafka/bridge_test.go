@@ -0,0 +1,184 @@
+package kafka_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/meandrewdev/graphqlws"
+	graphqlwskafka "github.com/meandrewdev/graphqlws/kafka"
+	"github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	m.Run()
+}
+
+// connection is a minimal graphqlws.Connection for subscriptions.
+type connection struct {
+	id string
+}
+
+func (c *connection) ID() string                                     { return c.id }
+func (c *connection) User() interface{}                              { return nil }
+func (c *connection) SendData(string, *graphqlws.DataMessagePayload) {}
+func (c *connection) SendError(error)                                {}
+func (c *connection) TrySendComplete(string) bool                    { return false }
+func (c *connection) Close(int, string)                              {}
+func (c *connection) Set(string, interface{})                        {}
+func (c *connection) Get(string) (interface{}, bool)                 { return nil, false }
+func (c *connection) InitPayload() map[string]interface{}            { return nil }
+func (c *connection) Stats() graphqlws.ConnectionStats               { return graphqlws.ConnectionStats{ID: c.id} }
+func (c *connection) Context() context.Context                       { return context.Background() }
+func (c *connection) Err() error                                     { return nil }
+func (c *connection) Request() *http.Request                         { return nil }
+func (c *connection) RemoteAddr() net.Addr                           { return nil }
+func (c *connection) ClientIP() string                               { return "" }
+
+// reader returns a fixed set of messages, then blocks until the
+// context is done.
+type reader struct {
+	messages  []kafka.Message
+	committed []kafka.Message
+	mutex     *sync.Mutex
+}
+
+func (r *reader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	r.mutex.Lock()
+	if len(r.messages) > 0 {
+		msg := r.messages[0]
+		r.messages = r.messages[1:]
+		r.mutex.Unlock()
+		return msg, nil
+	}
+	r.mutex.Unlock()
+
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+func (r *reader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.mutex.Lock()
+	r.committed = append(r.committed, msgs...)
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *reader) Close() error {
+	return nil
+}
+
+func buildSchema(t *testing.T) *graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Query",
+			Fields: graphql.Fields{"hello": &graphql.Field{Type: graphql.String}},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"orderCreated": &graphql.Field{
+					Type: graphql.NewObject(graphql.ObjectConfig{
+						Name: "Order",
+						Fields: graphql.Fields{
+							"id": &graphql.Field{Type: graphql.String},
+						},
+					}),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source, nil
+					},
+				},
+			},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("could not build schema: %v", err)
+	}
+	return &schema
+}
+
+func TestBridge_MessagesArePublishedAndCommitted(t *testing.T) {
+	sm := graphqlws.NewPublishingSubscriptionManager(buildSchema(t))
+
+	received := make(chan *graphqlws.DataMessagePayload, 2)
+	conn := &connection{id: "1"}
+	sm.AddSubscription(conn, &graphqlws.Subscription{
+		ID:         "1",
+		Connection: conn,
+		Query:      "subscription { orderCreated { id } }",
+		SendData: func(data *graphqlws.DataMessagePayload) {
+			received <- data
+		},
+	})
+
+	orders := &reader{
+		messages: []kafka.Message{
+			{Topic: "orders", Value: []byte(`{"id":"1"}`)},
+			{Topic: "orders", Value: []byte(`invalid`)},
+		},
+		mutex: &sync.Mutex{},
+	}
+	configs := make(chan kafka.ReaderConfig, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- graphqlwskafka.NewBridge(graphqlwskafka.Config{
+			Brokers: []string{"localhost:9092"},
+			GroupID: "graphqlws",
+			Topics: []graphqlwskafka.Topic{
+				{Name: "orders", Field: "orderCreated", StartOffset: kafka.FirstOffset},
+			},
+			Manager: sm,
+			NewReader: func(config kafka.ReaderConfig) graphqlwskafka.Reader {
+				configs <- config
+				return orders
+			},
+		}).Run(ctx)
+	}()
+
+	select {
+	case data := <-received:
+		result, _ := data.Data.(map[string]interface{})
+		order, _ := result["orderCreated"].(map[string]interface{})
+		if order["id"] != "1" {
+			t.Errorf("unexpected data: %v", data.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not published")
+	}
+
+	config := <-configs
+	if config.Topic != "orders" || config.GroupID != "graphqlws" || config.StartOffset != kafka.FirstOffset {
+		t.Errorf("unexpected reader config: %+v", config)
+	}
+
+	// Wait for the invalid message to be skipped
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		orders.mutex.Lock()
+		committed := len(orders.committed)
+		orders.mutex.Unlock()
+		if committed == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("messages not committed: %d", committed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run fails after cancellation: %v", err)
+	}
+	if len(received) != 0 {
+		t.Error("invalid message published")
+	}
+}
@@ -0,0 +1,293 @@
+package graphqlws
+
+import (
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ConnectionLimitPolicy decides what happens when a new connection would
+// exceed a connection limit.
+type ConnectionLimitPolicy int
+
+const (
+	// RejectNewConnections rejects connections that exceed a limit.
+	RejectNewConnections ConnectionLimitPolicy = iota
+
+	// EvictOldestConnections closes the oldest connections sharing the
+	// limit to make room for new ones.
+	EvictOldestConnections
+)
+
+// ClientIPFunc is a function that resolves the IP address of the client
+// that sent an upgrade request, e.g. from the X-Forwarded-For header set
+// by a trusted proxy.
+type ClientIPFunc func(r *http.Request) string
+
+// clientIP returns the IP address of the client that sent a request.
+func clientIP(r *http.Request) string {
+	return hostOf(r.RemoteAddr)
+}
+
+// hostOf returns the host of a network address.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+/**
+ * Tracking of connections that share a limit, e.g. the connections
+ * of a user or from an IP address.
+ */
+
+// limitedConnection is a slot held by a connection. Slots may be acquired
+// before the connection they belong to has been established.
+type limitedConnection struct {
+	conn Connection
+}
+
+type connectionLimiter struct {
+	max         int
+	policy      ConnectionLimitPolicy
+	connections map[interface{}][]*limitedConnection
+	mutex       *sync.Mutex
+}
+
+// newConnectionLimiter creates a limiter that allows at most max
+// connections per key; it returns nil if max is not positive.
+func newConnectionLimiter(max int, policy ConnectionLimitPolicy) *connectionLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connectionLimiter{
+		max:         max,
+		policy:      policy,
+		connections: make(map[interface{}][]*limitedConnection),
+		mutex:       &sync.Mutex{},
+	}
+}
+
+// acquire takes a slot for a connection with the given key. It returns
+// nil if the connection is rejected, along with the connections that
+// need to be closed to make room for it. Keys that can't be compared
+// are not limited.
+func (l *connectionLimiter) acquire(
+	key interface{},
+	conn Connection,
+) (*limitedConnection, []Connection) {
+	slot := &limitedConnection{conn: conn}
+	if l == nil || key == nil || !reflect.TypeOf(key).Comparable() {
+		return slot, nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	slots := l.connections[key]
+	if len(slots) >= l.max && l.policy == RejectNewConnections {
+		return nil, nil
+	}
+
+	// Evict the oldest established connections; slots of connections
+	// that are still being established are skipped
+	var evicted []Connection
+	for i := 0; len(slots) >= l.max && i < len(slots); {
+		if slots[i].conn == nil {
+			i++
+			continue
+		}
+		evicted = append(evicted, slots[i].conn)
+		slots = append(slots[:i], slots[i+1:]...)
+	}
+
+	l.connections[key] = append(slots, slot)
+	return slot, evicted
+}
+
+// bind assigns the connection a slot has been acquired for.
+func (l *connectionLimiter) bind(slot *limitedConnection, conn Connection) {
+	if l == nil {
+		slot.conn = conn
+		return
+	}
+	l.mutex.Lock()
+	slot.conn = conn
+	l.mutex.Unlock()
+}
+
+// release gives up a slot acquired for the given key.
+func (l *connectionLimiter) release(key interface{}, slot *limitedConnection) {
+	if l == nil || slot == nil || key == nil || !reflect.TypeOf(key).Comparable() {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	slots := l.connections[key]
+	for i, s := range slots {
+		if s == slot {
+			slots = append(slots[:i], slots[i+1:]...)
+			break
+		}
+	}
+	if len(slots) == 0 {
+		delete(l.connections, key)
+	} else {
+		l.connections[key] = slots
+	}
+}
+
+// closeEvictedConnections closes connections evicted to make room
+// for new ones.
+func closeEvictedConnections(conns []Connection) {
+	for _, conn := range conns {
+		go conn.Close(closeTooManyRequests, "Too many connections")
+	}
+}
+
+/**
+ * Rate limiting of client messages.
+ */
+
+// tokenBucket is a token bucket rate limiter; it is not safe for
+// concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full bucket that refills at rate tokens per
+// second up to burst tokens, which default to one; it returns nil if
+// rate is not positive.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token from the bucket and reports whether one
+// was available.
+func (b *tokenBucket) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket has refilled completely by now, in
+// which case it's no different from a new one.
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+/**
+ * Rate limiting of operations served over HTTP by client, as their
+ * connections only carry a single operation each.
+ */
+
+// clientIPKey is the key of the rate limits of anonymous clients, which
+// share those of their IP address.
+type clientIPKey string
+
+// rateLimitKey returns the key of the rate limits of a connection's
+// client: its user if it has a comparable one, or its IP address.
+func rateLimitKey(conn Connection) interface{} {
+	if user := conn.User(); user != nil && reflect.TypeOf(user).Comparable() {
+		return user
+	}
+	return clientIPKey(conn.ClientIP())
+}
+
+// clientRateLimiter keeps a token bucket for each client. Buckets that
+// have refilled are forgotten as more clients are added.
+type clientRateLimiter struct {
+	rate    float64
+	burst   int
+	buckets map[interface{}]*tokenBucket
+	sweepAt int
+	mutex   *sync.Mutex
+}
+
+// Number of buckets from which on refilled buckets are forgotten
+const minRateLimiterSweep = 64
+
+// newClientRateLimiter creates a limiter of rate messages per second
+// with bursts of burst messages for each client; it returns nil if rate
+// is not positive.
+func newClientRateLimiter(rate float64, burst int) *clientRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &clientRateLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[interface{}]*tokenBucket),
+		sweepAt: minRateLimiterSweep,
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// allow takes a token from the bucket of a client and reports whether
+// one was available.
+func (l *clientRateLimiter) allow(key interface{}) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucket := l.buckets[key]
+	if bucket == nil {
+		if len(l.buckets) >= l.sweepAt {
+			l.sweep()
+		}
+		bucket = newTokenBucket(l.rate, l.burst)
+		l.buckets[key] = bucket
+	}
+	return bucket.allow()
+}
+
+// sweep forgets the buckets that have refilled; mutex must be held by
+// the caller.
+func (l *clientRateLimiter) sweep() {
+	now := time.Now()
+	for key, bucket := range l.buckets {
+		if bucket.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+	l.sweepAt = 2 * len(l.buckets)
+	if l.sweepAt < minRateLimiterSweep {
+		l.sweepAt = minRateLimiterSweep
+	}
+}
@@ -0,0 +1,92 @@
+package graphqlws
+
+import (
+	"context"
+
+	"github.com/graphql-go/graphql"
+)
+
+// LiveQueryManager is a subscription manager for live queries: operations,
+// typically queries, whose results are sent when they are added and sent
+// again whenever data they depend on changes. Each live query depends on
+// the keys returned by the configured Dependencies function when it is
+// added, and may depend on further keys at any time, e.g. by resolvers
+// recording the entities they read. Keys may be hierarchical patterns, as
+// the topics of a PubSub.
+type LiveQueryManager interface {
+	SubscriptionManager
+
+	// Depend declares that a live query depends on a key or key pattern.
+	Depend(key string, s *Subscription)
+
+	// Invalidate executes all live queries depending on a key again and
+	// sends their results to the subscribers. It returns the number of
+	// live queries that data was sent to.
+	Invalidate(ctx context.Context, key string) int
+}
+
+// LiveQueryConfig defines the configuration of a LiveQueryManager.
+type LiveQueryConfig struct {
+	// Schema validates and executes live queries.
+	Schema *graphql.Schema
+
+	// Dependencies returns the keys a live query depends on when it is
+	// added; defaults to the names of its top-level fields.
+	Dependencies func(*Subscription) []string
+
+	// Root is the source value of the top-level resolvers (optional).
+	Root interface{}
+}
+
+/**
+ * The default implementation of the LiveQueryManager interface.
+ */
+
+type liveQueryManager struct {
+	*pubSub
+
+	root interface{}
+}
+
+// NewLiveQueryManager creates a new live query manager.
+func NewLiveQueryManager(config LiveQueryConfig) LiveQueryManager {
+	return &liveQueryManager{
+		pubSub: newPubSub(PubSubConfig{
+			Schema: config.Schema,
+			Topics: config.Dependencies,
+		}, NewLogger("livequeries")),
+		root: config.Root,
+	}
+}
+
+func (m *liveQueryManager) AddSubscription(conn Connection, subscription *Subscription) []error {
+	if errs := m.pubSub.AddSubscription(conn, subscription); len(errs) > 0 {
+		return errs
+	}
+
+	// Send the initial result
+	ctx := subscription.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	subscription.SendData(ExecuteSubscription(ctx, m.schema, subscription, m.root))
+	return nil
+}
+
+func (m *liveQueryManager) Depend(key string, s *Subscription) {
+	m.Subscribe(key, s)
+}
+
+func (m *liveQueryManager) Invalidate(ctx context.Context, key string) int {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	subscriptions := m.matchingSubscriptions(key)
+	m.logger.WithFields(Fields{
+		"key":         key,
+		"livequeries": len(subscriptions),
+	}).Debug("Invalidate live queries")
+
+	return executeSubscriptions(ctx, m.schema, subscriptions, m.root, nil)
+}
@@ -0,0 +1,64 @@
+package graphqlws_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+	"github.com/meandrewdev/graphqlws"
+)
+
+func TestLiveQueryManager_LiveQueriesAreSentAgainWhenInvalidated(t *testing.T) {
+	stock := map[string]int{"apples": 3, "pears": 5}
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"stock": &graphql.Field{
+					Type: graphql.Int,
+					Args: graphql.FieldConfigArgument{
+						"item": &graphql.ArgumentConfig{Type: graphql.String},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return stock[p.Args["item"].(string)], nil
+					},
+				},
+			},
+		}),
+	})
+	live := graphqlws.NewLiveQueryManager(graphqlws.LiveQueryConfig{
+		Schema: &schema,
+		Dependencies: func(s *graphqlws.Subscription) []string {
+			return []string{"stock." + s.Variables["item"].(string)}
+		},
+	})
+
+	received := map[string][]interface{}{}
+	for _, item := range []string{"apples", "pears"} {
+		conn := &mockWebSocketConnection{id: item}
+		errs := live.AddSubscription(conn, &graphqlws.Subscription{
+			ID:         "1",
+			Connection: conn,
+			Query:      "query($item: String) { stock(item: $item) }",
+			Variables:  map[string]interface{}{"item": item},
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				data, _ := msg.Data.(map[string]interface{})
+				received[conn.ID()] = append(received[conn.ID()], data["stock"])
+			},
+		})
+		if len(errs) > 0 {
+			t.Fatalf("AddSubscription fails: %v", errs)
+		}
+	}
+
+	stock["apples"] = 2
+	if sent := live.Invalidate(context.Background(), "stock.apples"); sent != 1 {
+		t.Errorf("Invalidate sends data to %d live queries", sent)
+	}
+	if len(received["apples"]) != 2 || received["apples"][0] != 3 || received["apples"][1] != 2 {
+		t.Errorf("unexpected results: %v", received["apples"])
+	}
+	if len(received["pears"]) != 1 || received["pears"][0] != 5 {
+		t.Errorf("unexpected results: %v", received["pears"])
+	}
+}
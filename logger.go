@@ -2,16 +2,218 @@ package graphqlws
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 )
 
+// Fields are structured fields attached to log messages.
+type Fields map[string]interface{}
+
+// Logger is the interface of the loggers used by graphqlws components.
+// Adapters for logrus are part of this package; adapters for other
+// logging libraries can be found in the zaplogger and sloglogger packages.
+type Logger interface {
+	// WithField and WithFields return a logger that attaches the given
+	// fields to all messages.
+	WithField(key string, value interface{}) Logger
+	WithFields(fields Fields) Logger
+
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+}
+
+// LogLevel is the severity of log messages.
+type LogLevel int
+
+// Log levels, from the most to the least verbose.
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+	LogLevelOff
+)
+
+// LogConfig defines the logging configuration of a component.
+type LogConfig struct {
+	// Level is the lowest level of messages that are logged; messages
+	// also need to pass the level of the underlying logger. Defaults to
+	// LogLevelDebug.
+	Level LogLevel
+
+	// DebugSampling logs only every Nth occurrence of each debug message
+	// (optional), e.g. of the messages logged for every data message.
+	DebugSampling int
+}
+
+var (
+	// The logger that component loggers are derived from and the logging
+	// configurations by component, guarded by baseLoggerMutex; a nil
+	// logger uses logrus
+	baseLogger      Logger
+	logConfigs      = map[string]*componentLogging{}
+	baseLoggerMutex = &sync.RWMutex{}
+)
+
+// componentLogging holds the logging configuration of a component and
+// the sampler shared by all of its loggers.
+type componentLogging struct {
+	config  LogConfig
+	sampler *debugSampler
+}
+
+// ConfigureLogging sets the logging configuration of a component, e.g.
+// "handler", "connection" or "subscriptions", which applies to the
+// loggers of the component created from now on.
+func ConfigureLogging(component string, config LogConfig) {
+	baseLoggerMutex.Lock()
+	logConfigs[component] = &componentLogging{
+		config:  config,
+		sampler: &debugSampler{counts: map[string]int{}, mutex: &sync.Mutex{}},
+	}
+	baseLoggerMutex.Unlock()
+}
+
+// SetLogger sets the logger that the loggers of all components created
+// from now on are derived from; each of them adds a "prefix" field with
+// the name of its component. Setting nil restores the default, which
+// logs with logrus.
+func SetLogger(logger Logger) {
+	baseLoggerMutex.Lock()
+	baseLogger = logger
+	baseLoggerMutex.Unlock()
+}
+
 // NewLogger returns a beautiful logger that logs messages with a
 // given prefix (typically the name of a system component / subsystem).
-func NewLogger(prefix string) *log.Entry {
-	logger := log.New()
-	logger.Formatter = new(prefixed.TextFormatter)
-	logger.Level = log.GetLevel()
-	return logger.WithField("prefix", fmt.Sprintf("graphqlws/%s", prefix))
+func NewLogger(prefix string) Logger {
+	// Components are named after the first part of their prefix, e.g.
+	// "connection" for "connection/<id>"
+	component := strings.SplitN(prefix, "/", 2)[0]
+
+	baseLoggerMutex.RLock()
+	logger := baseLogger
+	logging := logConfigs[component]
+	baseLoggerMutex.RUnlock()
+
+	if logger == nil {
+		logrusLogger := log.New()
+		logrusLogger.Formatter = new(prefixed.TextFormatter)
+		logrusLogger.Level = log.GetLevel()
+		logger = NewLogrusLogger(log.NewEntry(logrusLogger))
+	}
+
+	logger = logger.WithField("prefix", fmt.Sprintf("graphqlws/%s", prefix))
+	if logging != nil {
+		logger = &filteredLogger{
+			logger:  logger,
+			config:  logging.config,
+			sampler: logging.sampler,
+		}
+	}
+	return logger
+}
+
+/**
+ * A logger that filters messages by level and samples debug messages.
+ */
+
+type filteredLogger struct {
+	logger  Logger
+	config  LogConfig
+	sampler *debugSampler
+}
+
+// debugSampler counts the occurrences of debug messages of a component.
+type debugSampler struct {
+	counts map[string]int
+	mutex  *sync.Mutex
+}
+
+// sample reports whether an occurrence of a message is to be logged.
+func (s *debugSampler) sample(message string, n int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	count := s.counts[message]
+	s.counts[message] = (count + 1) % n
+	return count == 0
+}
+
+func (l *filteredLogger) WithField(key string, value interface{}) Logger {
+	return &filteredLogger{logger: l.logger.WithField(key, value), config: l.config, sampler: l.sampler}
+}
+
+func (l *filteredLogger) WithFields(fields Fields) Logger {
+	return &filteredLogger{logger: l.logger.WithFields(fields), config: l.config, sampler: l.sampler}
+}
+
+func (l *filteredLogger) Debug(args ...interface{}) {
+	if l.config.Level > LogLevelDebug {
+		return
+	}
+	if l.config.DebugSampling > 1 && !l.sampler.sample(fmt.Sprint(args...), l.config.DebugSampling) {
+		return
+	}
+	l.logger.Debug(args...)
+}
+
+func (l *filteredLogger) Info(args ...interface{}) {
+	if l.config.Level <= LogLevelInfo {
+		l.logger.Info(args...)
+	}
+}
+
+func (l *filteredLogger) Warn(args ...interface{}) {
+	if l.config.Level <= LogLevelWarn {
+		l.logger.Warn(args...)
+	}
+}
+
+func (l *filteredLogger) Error(args ...interface{}) {
+	if l.config.Level <= LogLevelError {
+		l.logger.Error(args...)
+	}
+}
+
+/**
+ * An adapter of logrus entries to the Logger interface.
+ */
+
+type logrusLogger struct {
+	entry *log.Entry
+}
+
+// NewLogrusLogger creates a logger that logs with a logrus entry.
+func NewLogrusLogger(entry *log.Entry) Logger {
+	return &logrusLogger{entry: entry}
+}
+
+func (l *logrusLogger) WithField(key string, value interface{}) Logger {
+	return &logrusLogger{entry: l.entry.WithField(key, value)}
+}
+
+func (l *logrusLogger) WithFields(fields Fields) Logger {
+	return &logrusLogger{entry: l.entry.WithFields(log.Fields(fields))}
+}
+
+func (l *logrusLogger) Debug(args ...interface{}) {
+	l.entry.Debug(args...)
+}
+
+func (l *logrusLogger) Info(args ...interface{}) {
+	l.entry.Info(args...)
+}
+
+func (l *logrusLogger) Warn(args ...interface{}) {
+	l.entry.Warn(args...)
+}
+
+func (l *logrusLogger) Error(args ...interface{}) {
+	l.entry.Error(args...)
 }
@@ -0,0 +1,58 @@
+package graphqlws_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+// recordingLogger records the messages it logs by level.
+type recordingLogger struct {
+	messages *[]string
+	mutex    *sync.Mutex
+}
+
+func (l *recordingLogger) WithField(key string, value interface{}) graphqlws.Logger {
+	return l
+}
+
+func (l *recordingLogger) WithFields(fields graphqlws.Fields) graphqlws.Logger {
+	return l
+}
+
+func (l *recordingLogger) record(level string, args []interface{}) {
+	l.mutex.Lock()
+	*l.messages = append(*l.messages, level+": "+fmt.Sprint(args...))
+	l.mutex.Unlock()
+}
+
+func (l *recordingLogger) Debug(args ...interface{}) { l.record("debug", args) }
+func (l *recordingLogger) Info(args ...interface{})  { l.record("info", args) }
+func (l *recordingLogger) Warn(args ...interface{})  { l.record("warn", args) }
+func (l *recordingLogger) Error(args ...interface{}) { l.record("error", args) }
+
+func TestLogger_ComponentsCanBeConfigured(t *testing.T) {
+	messages := []string{}
+	graphqlws.SetLogger(&recordingLogger{messages: &messages, mutex: &sync.Mutex{}})
+	defer graphqlws.SetLogger(nil)
+
+	graphqlws.ConfigureLogging("quiet", graphqlws.LogConfig{Level: graphqlws.LogLevelWarn})
+	graphqlws.ConfigureLogging("sampled", graphqlws.LogConfig{DebugSampling: 3})
+
+	quiet := graphqlws.NewLogger("quiet/1")
+	quiet.Info("Dropped")
+	quiet.WithField("key", "value").Warn("Kept")
+
+	// Samples are shared by all loggers of a component
+	for i := 0; i < 4; i++ {
+		graphqlws.NewLogger(fmt.Sprintf("sampled/%d", i)).Debug("Send message")
+	}
+	graphqlws.NewLogger("sampled").Info("Not sampled")
+
+	expected := []string{"warn: Kept", "debug: Send message", "debug: Send message", "info: Not sampled"}
+	if fmt.Sprint(messages) != fmt.Sprint(expected) {
+		t.Errorf("unexpected messages: %v", messages)
+	}
+}
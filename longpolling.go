@@ -0,0 +1,409 @@
+package graphqlws
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SubprotocolLongPolling is reported as the subprotocol of connections
+// served by long polling.
+const SubprotocolLongPolling = "graphql-long-polling"
+
+// LongPollingConfig defines the configuration of a long-polling handler.
+type LongPollingConfig struct {
+	// PollTimeout is how long polls wait for events before they return
+	// without any; defaults to 30 seconds.
+	PollTimeout time.Duration
+
+	// OperationTimeout is how long operations are kept without being
+	// polled; defaults to one minute.
+	OperationTimeout time.Duration
+
+	// MaxEvents is the number of events kept for an operation until they
+	// are polled; the oldest events are dropped once there are more.
+	// Defaults to 1000.
+	MaxEvents int
+}
+
+// pollingEvent is an event queued for an operation served by long
+// polling, e.g. {"cursor": 3, "type": "next", "payload": {"data": ...}}.
+type pollingEvent struct {
+	Cursor  uint64          `json:"cursor"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// pollingResponse is the response to a poll.
+type pollingResponse struct {
+	Events []pollingEvent `json:"events"`
+	Cursor uint64         `json:"cursor"`
+}
+
+// LongPollingHandler returns an HTTP handler that serves operations by
+// long polling, for networks where neither WebSockets nor Server-Sent
+// Events get through. A POST request with an operation, as JSON like the
+// payload of a start message, starts it and returns its handle, e.g.
+// {"id": "..."}. GET requests with the id and a cursor then wait for the
+// events queued after the cursor and return them with the cursor of the
+// last one, e.g. {"events": [{"cursor": 1, "type": "next", "payload":
+// {...}}], "cursor": 1}. Polling with a cursor discards the events up to
+// it. Operations end once a poll returns their "complete" event, after
+// a DELETE request with the id, or when they haven't been polled for the
+// operation timeout.
+//
+// Operations are started with the same subscription manager, auth,
+// limits and hooks as those of WebSocket connections, as by SSEHandler;
+// polls and stops are subject to the origin policy as well. Handles are
+// random and unrelated to connection IDs, and polls and stops are
+// authenticated again and only accepted from the user who started the
+// operation, who needs to be a comparable value for that, as for
+// MaxConnectionsPerUser.
+func (h *Handler) LongPollingHandler(config LongPollingConfig) http.Handler {
+	if config.PollTimeout <= 0 {
+		config.PollTimeout = 30 * time.Second
+	}
+	if config.OperationTimeout <= 0 {
+		config.OperationTimeout = time.Minute
+	}
+	if config.MaxEvents <= 0 {
+		config.MaxEvents = 1000
+	}
+	return &longPollingHandler{
+		handler:    h,
+		config:     config,
+		operations: make(map[string]*pollingConnection),
+		mutex:      &sync.Mutex{},
+	}
+}
+
+type longPollingHandler struct {
+	handler *Handler
+	config  LongPollingConfig
+
+	// Operations by handle, guarded by mutex
+	operations map[string]*pollingConnection
+	mutex      *sync.Mutex
+}
+
+func (p *longPollingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		p.start(w, r)
+	case http.MethodGet:
+		p.poll(w, r)
+	case http.MethodDelete:
+		p.stop(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *longPollingHandler) start(w http.ResponseWriter, r *http.Request) {
+	h := p.handler
+	data, err := readHTTPOperation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	handle, err := newPollingHandle()
+	if err != nil {
+		http.Error(w, "Could not start operation", http.StatusInternalServerError)
+		return
+	}
+
+	// Count the request as an upgrade until its connection is registered,
+	// so that shutting down doesn't miss it
+	if !h.beginUpgrade(w) {
+		return
+	}
+
+	conn := &pollingConnection{
+		httpConnection: newHTTPConnection(detachContext(r.Context()), h.config, NewLogger("longpolling"), r, h.clientIP(r)),
+		maxEvents:      p.config.MaxEvents,
+		handle:         handle,
+		notify:         make(chan struct{}),
+		lastPoll:       time.Now(),
+	}
+
+	if !h.acceptHTTPConnection(w, r, conn, &conn.httpConnection) {
+		h.upgrades.Done()
+		conn.finish(ErrClosedByClient)
+		return
+	}
+
+	h.openHTTPConnection(conn, r)
+	p.mutex.Lock()
+	p.operations[conn.handle] = conn
+	p.mutex.Unlock()
+	h.upgrades.Done()
+	go p.run(conn)
+
+	if errs := h.startHTTPOperation(conn, &conn.httpConnection, data); len(errs) > 0 {
+		conn.finish(ErrClosedByServer)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(errorsBody(errs, h.config.ErrorFormatter))
+		return
+	}
+	writeJSON(w, map[string]string{"id": conn.handle})
+}
+
+// run unregisters a connection once it has ended, ending it when it
+// hasn't been polled for the operation timeout.
+func (p *longPollingHandler) run(conn *pollingConnection) {
+	ticker := time.NewTicker(p.config.OperationTimeout / 4)
+	defer ticker.Stop()
+
+	for done := false; !done; {
+		select {
+		case <-conn.ctx.Done():
+			done = true
+		case <-ticker.C:
+			conn.expire(p.config.OperationTimeout)
+		}
+	}
+
+	p.mutex.Lock()
+	delete(p.operations, conn.handle)
+	p.mutex.Unlock()
+	p.handler.closeHTTPConnection(conn, &conn.httpConnection)
+	close(conn.closed)
+}
+
+// operation returns the operation of a request by its handle once the
+// request has been authenticated as coming from the operation's user.
+// Otherwise it responds with 404 Not Found for unknown handles, 401
+// Unauthorized or 403 Forbidden and returns nil.
+func (p *longPollingHandler) operation(w http.ResponseWriter, r *http.Request) *pollingConnection {
+	h := p.handler
+	if !h.checkOrigin(r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return nil
+	}
+
+	p.mutex.Lock()
+	conn := p.operations[r.URL.Query().Get("id")]
+	p.mutex.Unlock()
+	if conn == nil {
+		http.Error(w, "Unknown operation", http.StatusNotFound)
+		return nil
+	}
+
+	user, err := authenticateHTTP(h.config, conn, r)
+	if err != nil {
+		h.logger.WithFields(Fields{
+			"conn": conn.ID(),
+			"err":  err,
+		}).Debug("Failed to authenticate long-polling request")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+	if !sameUser(user, conn.User()) {
+		h.logger.WithFields(Fields{
+			"conn": conn.ID(),
+			"user": user,
+		}).Warn("Long-polling request of another user")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil
+	}
+	return conn
+}
+
+// newPollingHandle returns a random handle of an operation served by
+// long polling.
+func newPollingHandle() (string, error) {
+	handle := make([]byte, 32)
+	if _, err := rand.Read(handle); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(handle), nil
+}
+
+func (p *longPollingHandler) poll(w http.ResponseWriter, r *http.Request) {
+	var cursor uint64
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		var err error
+		if cursor, err = strconv.ParseUint(value, 10, 64); err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	conn := p.operation(w, r)
+	if conn == nil {
+		return
+	}
+
+	events, last := conn.poll(r.Context(), cursor, p.config.PollTimeout)
+	writeJSON(w, pollingResponse{Events: events, Cursor: last})
+}
+
+func (p *longPollingHandler) stop(w http.ResponseWriter, r *http.Request) {
+	conn := p.operation(w, r)
+	if conn == nil {
+		return
+	}
+
+	// Stops count toward the rate limits, but are always processed so
+	// that no operation is left running
+	p.handler.allowHTTPOperation(conn, gqlStop)
+	conn.finish(ErrClosedByClient)
+
+	config := p.handler.config
+	if config.EventHandlers.StopSubscription != nil {
+		config.EventHandlers.StopSubscription(conn.opID)
+	}
+	emitEvent(config.Events, Event{Type: EventOperationStopped, Connection: conn, OperationID: conn.opID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSON responds with a value encoded as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+/**
+ * Connections served by long polling.
+ */
+
+type pollingConnection struct {
+	httpConnection
+	maxEvents int
+
+	// The handle clients poll and stop the operation with
+	handle string
+
+	// The queued events, the cursor of the last one, whether the
+	// operation has completed, the channel closed when events are queued,
+	// the number of polls waiting and when the last one ended, guarded by
+	// mutex
+	events    []pollingEvent
+	cursor    uint64
+	completed bool
+	notify    chan struct{}
+	polls     int
+	lastPoll  time.Time
+}
+
+// queue queues an event for the client; it returns false if the
+// operation has ended or completed already.
+func (c *pollingConnection) queue(event string, payload []byte) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.done || c.completed {
+		return false
+	}
+
+	c.cursor++
+	c.events = append(c.events, pollingEvent{Cursor: c.cursor, Type: event, Payload: payload})
+	if len(c.events) > c.maxEvents {
+		c.logger.WithField("conn", c.id).Warn("Dropped event that wasn't polled")
+		c.events = c.events[1:]
+	}
+	c.completed = event == "complete"
+	c.sent(len(payload))
+
+	close(c.notify)
+	c.notify = make(chan struct{})
+	return true
+}
+
+// poll discards the events up to a cursor and returns those after it,
+// with the cursor of the last one, waiting up to timeout for events to
+// be queued. The connection ends once its complete event is returned.
+func (c *pollingConnection) poll(ctx context.Context, cursor uint64, timeout time.Duration) ([]pollingEvent, uint64) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.polls++
+	defer func() {
+		c.polls--
+		c.lastPoll = time.Now()
+	}()
+
+	for {
+		discarded := 0
+		for discarded < len(c.events) && c.events[discarded].Cursor <= cursor {
+			discarded++
+		}
+		c.events = c.events[discarded:]
+		if len(c.events) > 0 || c.done {
+			break
+		}
+
+		notify := c.notify
+		c.mutex.Unlock()
+		select {
+		case <-notify:
+			c.mutex.Lock()
+			continue
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		c.mutex.Lock()
+		break
+	}
+
+	events := append([]pollingEvent{}, c.events...)
+	if len(events) == 0 {
+		return events, cursor
+	}
+	if events[len(events)-1].Type == "complete" {
+		c.finishLocked(ErrClosedByServer)
+	}
+	return events, events[len(events)-1].Cursor
+}
+
+// expire ends the connection if it hasn't been polled for the given
+// time.
+func (c *pollingConnection) expire(timeout time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.polls == 0 && time.Since(c.lastPoll) >= timeout {
+		c.finishLocked(ErrHeartbeatTimeout)
+	}
+}
+
+// shutdown completes the operation of the connection and waits until
+// it has been unregistered or ctx expires.
+func (c *pollingConnection) shutdown(ctx context.Context) {
+	c.TrySendComplete(c.opID)
+	select {
+	case <-c.closed:
+	case <-ctx.Done():
+	}
+}
+
+func (c *pollingConnection) SendData(opID string, data *DataMessagePayload) {
+	if opID != c.opID {
+		return
+	}
+	if body := c.encodeData(c, data); body != nil {
+		c.queue("next", body)
+	}
+}
+
+func (c *pollingConnection) SendError(err error) {
+	c.queue("next", errorsBody([]error{err}, DefaultErrorFormatter))
+}
+
+func (c *pollingConnection) TrySendComplete(opID string) bool {
+	return opID == c.opID && c.queue("complete", nil)
+}
+
+func (c *pollingConnection) Close(code int, reason string) {
+	c.queue("complete", nil)
+}
+
+func (c *pollingConnection) Stats() ConnectionStats {
+	return c.stats(SubprotocolLongPolling)
+}
@@ -0,0 +1,144 @@
+package graphqlws_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+type pollResult struct {
+	Events []struct {
+		Cursor  uint64                 `json:"cursor"`
+		Type    string                 `json:"type"`
+		Payload map[string]interface{} `json:"payload"`
+	} `json:"events"`
+	Cursor uint64 `json:"cursor"`
+}
+
+func pollOperation(t *testing.T, srv *httptest.Server, id string, cursor string) pollResult {
+	res, err := http.Get(srv.URL + "?id=" + id + "&cursor=" + cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var result pollResult
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Fatalf("could not decode poll response: %v", err)
+	}
+	return result
+}
+
+func TestLongPollingHandler_PollsReturnEventsAfterTheirCursor(t *testing.T) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	})
+	srv := httptest.NewServer(handler.LongPollingHandler(graphqlws.LongPollingConfig{PollTimeout: time.Second}))
+	defer srv.Close()
+
+	query := `{"query": "subscription { ` + subscriptionName + ` { payload } }"}`
+	res, err := http.Post(srv.URL, "application/json", strings.NewReader(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var started struct{ ID string }
+	json.NewDecoder(res.Body).Decode(&started)
+	res.Body.Close()
+	s := receiveSubscription(t, subscriptions)
+	if started.ID == "" || started.ID == s.Connection.ID() {
+		t.Fatalf("expected a handle unrelated to the connection ID: %q", started.ID)
+	}
+
+	// Polls wait for events
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.SendData(&graphqlws.DataMessagePayload{Data: "one"})
+	}()
+	result := pollOperation(t, srv, started.ID, "0")
+	if len(result.Events) != 1 || result.Events[0].Payload["data"] != "one" || result.Cursor != 1 {
+		t.Fatalf("unexpected poll result: %+v", result)
+	}
+
+	// Events are kept until a poll passes their cursor
+	s.SendData(&graphqlws.DataMessagePayload{Data: "two"})
+	if result = pollOperation(t, srv, started.ID, "0"); len(result.Events) != 2 {
+		t.Errorf("expected 2 events, received: %+v", result)
+	}
+	s.Connection.TrySendComplete(s.ID)
+	result = pollOperation(t, srv, started.ID, "1")
+	if len(result.Events) != 2 || result.Events[1].Type != "complete" || result.Cursor != 3 {
+		t.Errorf("unexpected poll result: %+v", result)
+	}
+}
+
+func TestLongPollingHandler_OnlyAcceptsPollsAndStopsOfTheSameUser(t *testing.T) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Authenticate: func(token string) (interface{}, error) {
+			if token == "" {
+				return nil, errors.New("missing token")
+			}
+			return token, nil
+		},
+		IDGenerator: func(r *http.Request) string { return "request-1" },
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	})
+	srv := httptest.NewServer(handler.LongPollingHandler(graphqlws.LongPollingConfig{PollTimeout: 10 * time.Millisecond}))
+	defer srv.Close()
+
+	request := func(method string, url string, body string, token string) *http.Response {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := request(http.MethodPost, srv.URL, `{"query": "subscription { `+subscriptionName+` { payload } }"}`, "ada")
+	var started struct{ ID string }
+	json.NewDecoder(res.Body).Decode(&started)
+	res.Body.Close()
+	receiveSubscription(t, subscriptions)
+
+	for _, tc := range []struct {
+		method   string
+		id       string
+		token    string
+		expected int
+	}{
+		{http.MethodGet, "request-1", "ada", http.StatusNotFound},
+		{http.MethodGet, started.ID, "", http.StatusUnauthorized},
+		{http.MethodGet, started.ID, "mallory", http.StatusForbidden},
+		{http.MethodDelete, started.ID, "mallory", http.StatusForbidden},
+		{http.MethodGet, started.ID, "ada", http.StatusOK},
+		{http.MethodDelete, started.ID, "ada", http.StatusNoContent},
+	} {
+		res := request(tc.method, srv.URL+"?id="+tc.id, "", tc.token)
+		res.Body.Close()
+		if res.StatusCode != tc.expected {
+			t.Errorf("expected status %d for %s by %q, received %d", tc.expected, tc.method, tc.token, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+// Package metrics instruments graphqlws handlers with Prometheus metrics
+// for connections, subscriptions, messages and failures.
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/meandrewdev/graphqlws"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Config defines the configuration of the metrics.
+type Config struct {
+	// Namespace and Subsystem prefix the names of all metrics; Namespace
+	// defaults to "graphqlws".
+	Namespace string
+	Subsystem string
+
+	// Buckets are the buckets of the latency histograms; defaults to
+	// prometheus.DefBuckets.
+	Buckets []float64
+
+	// Registerer is where the metrics are registered (optional). Metrics
+	// are collectors themselves and may also be registered later on.
+	Registerer prometheus.Registerer
+}
+
+// Metrics collects the metrics of instrumented handlers.
+type Metrics interface {
+	prometheus.Collector
+
+	// Instrument returns a copy of a handler configuration that records
+	// metrics for the handler's connections. A connection registry is
+	// created if the configuration has none, and the metrics' middleware
+	// wraps any middleware that is configured already.
+	Instrument(config graphqlws.HandlerConfig) graphqlws.HandlerConfig
+}
+
+/**
+ * The default implementation of the Metrics interface.
+ */
+
+type metrics struct {
+	connections      prometheus.Gauge
+	subscriptions    prometheus.GaugeFunc
+	messagesReceived *prometheus.CounterVec
+	messagesSent     *prometheus.CounterVec
+	upgradeFailures  prometheus.Counter
+	authFailures     prometheus.Counter
+	sendErrors       prometheus.Counter
+	handlingDuration *prometheus.HistogramVec
+	connectionLength prometheus.Histogram
+
+	// Subscription managers of the instrumented handlers, guarded by
+	// mutex
+	managers []graphqlws.SubscriptionManager
+	mutex    *sync.Mutex
+}
+
+// New creates the metrics for graphqlws handlers and registers them with
+// the configured registerer, if any.
+func New(config Config) (Metrics, error) {
+	namespace := config.Namespace
+	if namespace == "" {
+		namespace = "graphqlws"
+	}
+	buckets := config.Buckets
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+
+	m := &metrics{mutex: &sync.Mutex{}}
+
+	m.connections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: config.Subsystem,
+		Name:      "connections_active",
+		Help:      "Number of open GraphQL WebSocket connections.",
+	})
+	m.subscriptions = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: config.Subsystem,
+		Name:      "subscriptions_active",
+		Help:      "Number of active subscriptions.",
+	}, m.countSubscriptions)
+	m.messagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: config.Subsystem,
+		Name:      "messages_received_total",
+		Help:      "Number of messages received from clients, by type.",
+	}, []string{"type"})
+	m.messagesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: config.Subsystem,
+		Name:      "messages_sent_total",
+		Help:      "Number of messages queued to be sent to clients, by type.",
+	}, []string{"type"})
+	m.upgradeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: config.Subsystem,
+		Name:      "upgrade_failures_total",
+		Help:      "Number of requests that couldn't be upgraded to connections.",
+	})
+	m.authFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: config.Subsystem,
+		Name:      "auth_failures_total",
+		Help:      "Number of failed authentications and refreshes.",
+	})
+	m.sendErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: config.Subsystem,
+		Name:      "send_errors_total",
+		Help:      "Number of messages that couldn't be sent to clients.",
+	})
+	m.handlingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: config.Subsystem,
+		Name:      "message_handling_duration_seconds",
+		Help:      "Time taken to handle messages received from clients, by type.",
+		Buckets:   buckets,
+	}, []string{"type"})
+	m.connectionLength = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: config.Subsystem,
+		Name:      "connection_duration_seconds",
+		Help:      "Time connections stayed open.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	})
+
+	if config.Registerer != nil {
+		if err := config.Registerer.Register(m); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (m *metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.connections,
+		m.subscriptions,
+		m.messagesReceived,
+		m.messagesSent,
+		m.upgradeFailures,
+		m.authFailures,
+		m.sendErrors,
+		m.handlingDuration,
+		m.connectionLength,
+	}
+}
+
+func (m *metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range m.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+func (m *metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range m.collectors() {
+		collector.Collect(ch)
+	}
+}
+
+// countSubscriptions returns the number of subscriptions of all
+// instrumented handlers.
+func (m *metrics) countSubscriptions() float64 {
+	m.mutex.Lock()
+	managers := m.managers
+	m.mutex.Unlock()
+
+	count := 0
+	for _, manager := range managers {
+		for _, subscriptions := range manager.Subscriptions() {
+			count += len(subscriptions)
+		}
+	}
+	return float64(count)
+}
+
+func (m *metrics) Instrument(config graphqlws.HandlerConfig) graphqlws.HandlerConfig {
+	if config.SubscriptionManager != nil {
+		m.mutex.Lock()
+		m.managers = append(m.managers, config.SubscriptionManager)
+		m.mutex.Unlock()
+	}
+
+	// Count connections as the handler registers them
+	connections := config.Connections
+	if connections == nil {
+		connections = graphqlws.NewConnectionRegistry()
+	}
+	config.Connections = &registry{
+		ConnectionRegistry: connections,
+		metrics:            m,
+		opened:             make(map[graphqlws.Connection]time.Time),
+		mutex:              &sync.Mutex{},
+	}
+
+	// Count failed authentications
+	if authenticate := config.Authenticate; authenticate != nil {
+		config.Authenticate = func(token string) (interface{}, error) {
+			user, err := authenticate(token)
+			if err != nil {
+				m.authFailures.Inc()
+			}
+			return user, err
+		}
+	}
+	if authenticate := config.AuthenticateRequest; authenticate != nil {
+		config.AuthenticateRequest = func(
+			conn graphqlws.Connection,
+			r *http.Request,
+			token string,
+		) (interface{}, error) {
+			user, err := authenticate(conn, r, token)
+			if err != nil {
+				m.authFailures.Inc()
+			}
+			return user, err
+		}
+	}
+	if refresh := config.RefreshAuth; refresh != nil {
+		config.RefreshAuth = func(conn graphqlws.Connection, token string) (interface{}, error) {
+			user, err := refresh(conn, token)
+			if err != nil {
+				m.authFailures.Inc()
+			}
+			return user, err
+		}
+	}
+
+	// Count failures
+	upgradeFailed := config.EventHandlers.UpgradeFailed
+	config.EventHandlers.UpgradeFailed = func(r *http.Request, err error) {
+		m.upgradeFailures.Inc()
+		if upgradeFailed != nil {
+			upgradeFailed(r, err)
+		}
+	}
+	sendFailed := config.EventHandlers.SendFailed
+	config.EventHandlers.SendFailed = func(conn graphqlws.Connection, err error) {
+		m.sendErrors.Inc()
+		if sendFailed != nil {
+			sendFailed(conn, err)
+		}
+	}
+
+	// Count and time all messages received, and count the messages
+	// handed to connections to be sent, which may still be dropped if
+	// their send queue overflows or they are closed. Start and stop
+	// messages are only queued for workers as they are received, so
+	// they are timed as the workers handle them.
+	types := messageTypes(config.MessageTypes)
+	onWorkers := config.Workers != nil
+	config.IncomingMiddleware = append([]graphqlws.Middleware{m.incoming(types, onWorkers)}, config.IncomingMiddleware...)
+	config.OutgoingMiddleware = append(append([]graphqlws.Middleware{}, config.OutgoingMiddleware...), m.outgoing(types))
+	if onWorkers {
+		config.OperationMiddleware = append([]graphqlws.Middleware{m.operation(types)}, config.OperationMiddleware...)
+	}
+
+	return config
+}
+
+// Types of the messages of all subprotocols, which are the only types
+// besides custom ones that messages are labelled with
+var protocolMessageTypes = []string{
+	"connection_init", "connection_ack", "connection_error", "connection_terminate",
+	"connection_refresh", "connection_refresh_ack", "ka", "ping", "pong",
+	"start", "start_ack", "subscribe", "data", "next", "error", "complete",
+	"stop", "ack",
+}
+
+// Types of the start and stop messages of all subprotocols
+var operationMessageTypes = map[string]bool{
+	"start": true, "subscribe": true, "stop": true, "complete": true,
+}
+
+// messageTypes returns the set of types messages are labelled with.
+func messageTypes(custom graphqlws.MessageTypes) map[string]bool {
+	types := make(map[string]bool, len(protocolMessageTypes)+len(custom))
+	for _, messageType := range protocolMessageTypes {
+		types[messageType] = true
+	}
+	for messageType := range custom {
+		types[messageType] = true
+	}
+	return types
+}
+
+// messageType returns the label of a message's type. Clients choose the
+// types of the messages they send, so types that are unknown share one
+// label rather than each creating time series.
+func messageType(types map[string]bool, msg graphqlws.OperationMessage) string {
+	if types[msg.Type] {
+		return msg.Type
+	}
+	return graphqlws.MessageTypeUnknown
+}
+
+func (m *metrics) incoming(types map[string]bool, onWorkers bool) graphqlws.Middleware {
+	return func(next graphqlws.MessageHandler) graphqlws.MessageHandler {
+		return func(conn graphqlws.Connection, msg graphqlws.OperationMessage) {
+			label := messageType(types, msg)
+			m.messagesReceived.WithLabelValues(label).Inc()
+			if onWorkers && operationMessageTypes[msg.Type] {
+				next(conn, msg)
+				return
+			}
+			start := time.Now()
+			next(conn, msg)
+			m.handlingDuration.WithLabelValues(label).Observe(time.Since(start).Seconds())
+		}
+	}
+}
+
+// operation times the start and stop messages handled by workers.
+func (m *metrics) operation(types map[string]bool) graphqlws.Middleware {
+	return func(next graphqlws.MessageHandler) graphqlws.MessageHandler {
+		return func(conn graphqlws.Connection, msg graphqlws.OperationMessage) {
+			start := time.Now()
+			next(conn, msg)
+			m.handlingDuration.WithLabelValues(messageType(types, msg)).Observe(time.Since(start).Seconds())
+		}
+	}
+}
+
+func (m *metrics) outgoing(types map[string]bool) graphqlws.Middleware {
+	return func(next graphqlws.MessageHandler) graphqlws.MessageHandler {
+		return func(conn graphqlws.Connection, msg graphqlws.OperationMessage) {
+			next(conn, msg)
+			m.messagesSent.WithLabelValues(messageType(types, msg)).Inc()
+		}
+	}
+}
+
+/**
+ * A connection registry that counts connections and measures how long
+ * they stay open.
+ */
+
+type registry struct {
+	graphqlws.ConnectionRegistry
+
+	metrics *metrics
+	opened  map[graphqlws.Connection]time.Time
+	mutex   *sync.Mutex
+}
+
+func (r *registry) Add(conn graphqlws.Connection) {
+	r.mutex.Lock()
+	if _, ok := r.opened[conn]; !ok {
+		r.opened[conn] = time.Now()
+		r.metrics.connections.Inc()
+	}
+	r.mutex.Unlock()
+
+	r.ConnectionRegistry.Add(conn)
+}
+
+func (r *registry) Remove(conn graphqlws.Connection) {
+	r.mutex.Lock()
+	if opened, ok := r.opened[conn]; ok {
+		delete(r.opened, conn)
+		r.metrics.connections.Dec()
+		r.metrics.connectionLength.Observe(time.Since(opened).Seconds())
+	}
+	r.mutex.Unlock()
+
+	r.ConnectionRegistry.Remove(conn)
+}
@@ -0,0 +1,252 @@
+package metrics_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	m.Run()
+}
+
+func buildSchema(t *testing.T) *graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"hello": &graphql.Field{Type: graphql.String},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"ticks": &graphql.Field{Type: graphql.Int},
+			},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("could not build schema: %v", err)
+	}
+	return &schema
+}
+
+// value returns the sum of the values of a metric with the given labels.
+func value(t *testing.T, registry *prometheus.Registry, name string, labels map[string]string) float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("could not gather metrics: %v", err)
+	}
+
+	sum := 0.0
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if expected, ok := labels[label.GetName()]; ok && expected != label.GetValue() {
+					continue metrics
+				}
+			}
+			switch {
+			case metric.Gauge != nil:
+				sum += metric.GetGauge().GetValue()
+			case metric.Counter != nil:
+				sum += metric.GetCounter().GetValue()
+			case metric.Histogram != nil:
+				sum += float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return sum
+}
+
+func eventually(t *testing.T, check func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetrics_HandlersAreInstrumented(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m, err := metrics.New(metrics.Config{Registerer: registry})
+	if err != nil {
+		t.Fatalf("New fails: %v", err)
+	}
+
+	srv := httptest.NewServer(graphqlws.NewHandler(m.Instrument(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildSchema(t)),
+		Authenticate: func(token string) (interface{}, error) {
+			if token != "secret" {
+				return nil, errors.New("invalid token")
+			}
+			return "alice", nil
+		},
+	})))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{
+		"Sec-WebSocket-Protocol": []string{graphqlws.SubprotocolGraphQLWS},
+	})
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer ws.Close()
+
+	for _, token := range []string{"wrong", "secret"} {
+		ws.WriteJSON(map[string]interface{}{
+			"type":    "connection_init",
+			"payload": map[string]interface{}{"authToken": token},
+		})
+	}
+	ws.WriteJSON(map[string]interface{}{
+		"id":      "1",
+		"type":    "start",
+		"payload": map[string]interface{}{"query": "subscription { ticks }"},
+	})
+
+	eventually(t, func() bool {
+		return value(t, registry, "graphqlws_subscriptions_active", nil) == 1 &&
+			value(t, registry, "graphqlws_message_handling_duration_seconds", map[string]string{"type": "start"}) == 1
+	})
+
+	if v := value(t, registry, "graphqlws_connections_active", nil); v != 1 {
+		t.Errorf("unexpected active connections: %v", v)
+	}
+	if v := value(t, registry, "graphqlws_messages_received_total", map[string]string{"type": "connection_init"}); v != 2 {
+		t.Errorf("unexpected received init messages: %v", v)
+	}
+	if v := value(t, registry, "graphqlws_messages_sent_total", map[string]string{"type": "connection_ack"}); v != 1 {
+		t.Errorf("unexpected sent acks: %v", v)
+	}
+	if v := value(t, registry, "graphqlws_auth_failures_total", nil); v != 1 {
+		t.Errorf("unexpected auth failures: %v", v)
+	}
+
+	// Closing the connection removes it and its subscriptions
+	ws.Close()
+	eventually(t, func() bool {
+		return value(t, registry, "graphqlws_connections_active", nil) == 0 &&
+			value(t, registry, "graphqlws_subscriptions_active", nil) == 0
+	})
+	if v := value(t, registry, "graphqlws_connection_duration_seconds", nil); v != 1 {
+		t.Errorf("unexpected closed connections: %v", v)
+	}
+
+	// Requests that aren't WebSocket upgrades fail
+	http.Get(srv.URL)
+	if v := value(t, registry, "graphqlws_upgrade_failures_total", nil); v != 1 {
+		t.Errorf("unexpected upgrade failures: %v", v)
+	}
+}
+
+func TestMetrics_UnknownMessageTypesShareALabel(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m, err := metrics.New(metrics.Config{Registerer: registry})
+	if err != nil {
+		t.Fatalf("New fails: %v", err)
+	}
+
+	srv := httptest.NewServer(graphqlws.NewHandler(m.Instrument(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildSchema(t)),
+	})))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{
+		"Sec-WebSocket-Protocol": []string{graphqlws.SubprotocolGraphQLWS},
+	})
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer ws.Close()
+
+	ws.WriteJSON(map[string]interface{}{"type": "connection_init"})
+	for _, messageType := range []string{"random-1", "random-2"} {
+		ws.WriteJSON(map[string]interface{}{"type": messageType})
+	}
+
+	eventually(t, func() bool {
+		return value(t, registry, "graphqlws_messages_received_total", map[string]string{"type": graphqlws.MessageTypeUnknown}) == 2
+	})
+	for _, messageType := range []string{"random-1", "random-2"} {
+		if v := value(t, registry, "graphqlws_messages_received_total", map[string]string{"type": messageType}); v != 0 {
+			t.Errorf("unexpected messages labelled %q: %v", messageType, v)
+		}
+	}
+}
+
+func TestMetrics_OperationsHandledByWorkersAreTimed(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m, err := metrics.New(metrics.Config{Registerer: registry})
+	if err != nil {
+		t.Fatalf("New fails: %v", err)
+	}
+
+	srv := httptest.NewServer(graphqlws.NewHandler(m.Instrument(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildSchema(t)),
+		Workers:             graphqlws.NewWorkerPool(4),
+		AuthorizeOperation: func(graphqlws.Connection, *graphqlws.Subscription) []error {
+			time.Sleep(100 * time.Millisecond)
+			return nil
+		},
+	})))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{
+		"Sec-WebSocket-Protocol": []string{graphqlws.SubprotocolGraphQLWS},
+	})
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer ws.Close()
+
+	ws.WriteJSON(map[string]interface{}{"type": "connection_init"})
+	ws.WriteJSON(map[string]interface{}{
+		"id":      "1",
+		"type":    "start",
+		"payload": map[string]interface{}{"query": "subscription { ticks }"},
+	})
+
+	eventually(t, func() bool {
+		return value(t, registry, "graphqlws_message_handling_duration_seconds", map[string]string{"type": "start"}) == 1
+	})
+
+	// The duration covers starting the operation on the worker rather
+	// than queueing the message
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("could not gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "graphqlws_message_handling_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetValue() == "start" && metric.GetHistogram().GetSampleSum() < 0.1 {
+					t.Errorf("unexpected start duration: %v", metric.GetHistogram().GetSampleSum())
+				}
+			}
+		}
+	}
+}
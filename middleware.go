@@ -0,0 +1,53 @@
+package graphqlws
+
+import (
+	"encoding/json"
+)
+
+// MessageHandler handles a protocol message received from or sent to a
+// client. Message types are those of the connection's subprotocol, e.g.
+// "subscribe" and "next" for graphql-transport-ws connections.
+type MessageHandler func(conn Connection, msg OperationMessage)
+
+// Middleware wraps the handling of protocol messages, e.g. for logging,
+// metrics or rewriting payloads. It may pass messages on to next, change
+// them before doing so or drop them by not calling next at all.
+//
+// Incoming middleware is called from the connection's read loop and must
+// call next before returning; the payloads of incoming messages are
+// *json.RawMessage values, but may be replaced with any value that the
+// connection's codec can encode. Outgoing middleware is called from the
+// goroutines that send messages, before they are queued for writing.
+//
+// Operation middleware is called where start and stop messages are
+// handled, after they passed the incoming middleware, which is on a
+// worker for connections with workers.
+type Middleware func(next MessageHandler) MessageHandler
+
+// chainMiddleware wraps a handler in middleware, with the first middleware
+// being the outermost one.
+func chainMiddleware(handler MessageHandler, middleware []Middleware) MessageHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// rawMessagePayload returns the payload of an incoming message as raw JSON,
+// encoding payloads that have been replaced by middleware with a codec.
+func rawMessagePayload(msg OperationMessage, codec Codec) json.RawMessage {
+	switch payload := msg.Payload.(type) {
+	case *json.RawMessage:
+		if payload == nil {
+			return nil
+		}
+		return *payload
+	case json.RawMessage:
+		return payload
+	case nil:
+		return nil
+	default:
+		data, _ := codec.Marshal(payload)
+		return data
+	}
+}
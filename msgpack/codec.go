@@ -0,0 +1,201 @@
+// Package msgpack implements a MessagePack codec for graphqlws, which
+// cuts the size of messages and the cost of encoding them, e.g. for
+// subscriptions pushing numeric telemetry at high rates to clients that
+// can decode MessagePack:
+//
+//	graphqlws.NewHandler(graphqlws.HandlerConfig{
+//		SubscriptionManager: subscriptionManager,
+//		Codecs:              map[string]graphqlws.Codec{msgpack.Name: msgpack.Codec},
+//	})
+//
+// Clients ask for the codec by appending "+msgpack" to the subprotocol,
+// e.g. "graphql-transport-ws+msgpack", and exchange messages in binary
+// frames. Values are encoded with github.com/vmihailenco/msgpack, except
+// that structs become maps keyed by their JSON field names, the way
+// encoding/json encodes them, and byte slices become binary data. To do
+// so, the package registers encoders for json.RawMessage, json.Number,
+// []error and graphqlws.DataMessagePayload values with that library.
+package msgpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/meandrewdev/graphqlws"
+	mp "github.com/vmihailenco/msgpack/v5"
+)
+
+// Name is the name clients append to subprotocols to use the codec.
+const Name = "msgpack"
+
+// Codec is the MessagePack codec; it implements graphqlws.BufferCodec.
+var Codec graphqlws.BinaryCodec = codec{}
+
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	return Marshal(v)
+}
+
+func (codec) MarshalTo(buf *bytes.Buffer, v interface{}) error {
+	return MarshalTo(buf, v)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	return Unmarshal(data, v)
+}
+
+func (codec) Binary() bool {
+	return true
+}
+
+func init() {
+	mp.Register(json.RawMessage(nil), encodeRawMessage, decodeRawMessage)
+	mp.Register((*json.RawMessage)(nil), nil, decodeRawMessagePointer)
+	mp.Register(json.Number(""), encodeNumber, nil)
+	mp.Register([]error(nil), encodeErrors, nil)
+	mp.Register(graphqlws.DataMessagePayload{}, encodeDataMessagePayload, nil)
+}
+
+// Marshal returns the MessagePack encoding of v. The contents of
+// json.RawMessage values are expected to be MessagePack already and are
+// written as they are.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := MarshalTo(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalTo appends the MessagePack encoding of v to buf; buf is left as
+// it was if encoding fails.
+func MarshalTo(buf *bytes.Buffer, v interface{}) error {
+	e := mp.GetEncoder()
+	defer mp.PutEncoder(e)
+	e.Reset(buf)
+	e.SetCustomStructTag("json")
+	e.UseCompactInts(true)
+
+	n := buf.Len()
+	if err := e.Encode(v); err != nil {
+		buf.Truncate(n)
+		return err
+	}
+	return nil
+}
+
+// Unmarshal decodes MessagePack data into the value v points to, the way
+// encoding/json decodes JSON: maps are decoded into structs by their JSON
+// field names and into interface values as map[string]interface{}.
+// Integers are decoded into interface values as int64, or as uint64 if
+// they were encoded unsigned, and floats as float64. json.RawMessage
+// values receive the MessagePack encoding of their value.
+func Unmarshal(data []byte, v interface{}) error {
+	r := bytes.NewReader(data)
+	d := mp.GetDecoder()
+	defer mp.PutDecoder(d)
+	d.Reset(r)
+	d.SetCustomStructTag("json")
+	d.UseLooseInterfaceDecoding(true)
+
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	if r.Len() > 0 {
+		return errors.New("msgpack: unexpected data after top-level value")
+	}
+	return nil
+}
+
+// encodeRawMessage writes json.RawMessage values, which hold MessagePack
+// encoded by this codec, as they are.
+func encodeRawMessage(e *mp.Encoder, v reflect.Value) error {
+	if v.Len() == 0 {
+		return e.EncodeNil()
+	}
+	return e.Encode(mp.RawMessage(v.Bytes()))
+}
+
+func decodeRawMessage(d *mp.Decoder, v reflect.Value) error {
+	raw, err := d.DecodeRaw()
+	if err != nil {
+		return err
+	}
+	v.SetBytes(append([]byte(nil), raw...))
+	return nil
+}
+
+// decodeRawMessagePointer decodes into the json.RawMessage a pointer
+// points to, which receives the encoding of nil values too, the way
+// encoding/json fills it with null.
+func decodeRawMessagePointer(d *mp.Decoder, v reflect.Value) error {
+	if v.IsNil() {
+		if !v.CanSet() {
+			return errors.New("msgpack: decoding into a nil *json.RawMessage")
+		}
+		v.Set(reflect.New(v.Type().Elem()))
+	}
+	return decodeRawMessage(d, v.Elem())
+}
+
+// encodeNumber encodes json.Number values as integers or floats.
+func encodeNumber(e *mp.Encoder, v reflect.Value) error {
+	number := json.Number(v.String())
+	if !strings.ContainsAny(string(number), ".eE") {
+		if i, err := number.Int64(); err == nil {
+			return e.EncodeInt(i)
+		}
+	}
+	f, err := number.Float64()
+	if err != nil {
+		return fmt.Errorf("msgpack: invalid number %q", number)
+	}
+	return e.EncodeFloat64(f)
+}
+
+// encodeErrors encodes errors from their values, the way encoding/json
+// does, rather than as their messages.
+func encodeErrors(e *mp.Encoder, v reflect.Value) error {
+	if v.IsNil() {
+		return e.EncodeNil()
+	}
+	if err := e.EncodeArrayLen(v.Len()); err != nil {
+		return err
+	}
+	for _, err := range v.Interface().([]error) {
+		if err := e.Encode(err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subsequentPayload is the encoding of data message payloads with partial
+// results, which have no data; see DataMessagePayload.MarshalJSON.
+type subsequentPayload struct {
+	Incremental []graphqlws.IncrementalPayload `json:"incremental,omitempty"`
+	HasNext     *bool                          `json:"hasNext"`
+	Errors      []error                        `json:"errors,omitempty"`
+	Extensions  map[string]interface{}         `json:"extensions,omitempty"`
+}
+
+// encodeDataMessagePayload encodes data message payloads the way their
+// MarshalJSON method does.
+func encodeDataMessagePayload(e *mp.Encoder, v reflect.Value) error {
+	p := v.Interface().(graphqlws.DataMessagePayload)
+	if p.Incremental == nil || p.Data != nil {
+		type payload graphqlws.DataMessagePayload
+		return e.Encode(payload(p))
+	}
+	return e.Encode(subsequentPayload{
+		Incremental: p.Incremental,
+		HasNext:     p.HasNext,
+		Errors:      p.Errors,
+		Extensions:  p.Extensions,
+	})
+}
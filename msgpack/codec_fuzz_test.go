@@ -0,0 +1,35 @@
+//go:build go1.18
+// +build go1.18
+
+package msgpack_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/msgpack"
+)
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, msg := range []interface{}{
+		map[string]interface{}{"id": "1", "type": "subscribe", "payload": map[string]interface{}{
+			"query":     "subscription { ticks }",
+			"variables": map[string]interface{}{"limit": 10, "ratio": 0.5},
+		}},
+		map[string]interface{}{"type": "connection_init", "payload": nil},
+	} {
+		data, _ := msgpack.Marshal(msg)
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		raw := json.RawMessage{}
+		msg := graphqlws.OperationMessage{Payload: &raw}
+		if msgpack.Unmarshal(data, &msg) != nil {
+			return
+		}
+		payload := graphqlws.StartMessagePayload{}
+		msgpack.Unmarshal(raw, &payload)
+	})
+}
@@ -0,0 +1,332 @@
+package msgpack_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/msgpack"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	m.Run()
+}
+
+func buildSchema(t *testing.T) *graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"hello": &graphql.Field{Type: graphql.String},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"ticks": &graphql.Field{Type: graphql.Int},
+			},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("could not build schema: %v", err)
+	}
+	return &schema
+}
+
+func TestCodec_MessagesAreEncodedLikeJSON(t *testing.T) {
+	data, err := msgpack.Marshal(graphqlws.OperationMessage{
+		ID:   "1",
+		Type: "next",
+		Payload: &graphqlws.DataMessagePayload{
+			Data:   map[string]interface{}{"ticks": 42, "ratio": 0.5, "tags": []string{"a"}},
+			Errors: []error{graphqlws.NewError("Slow down", map[string]interface{}{"code": "RATE_LIMITED"})},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Marshal fails: %v", err)
+	}
+
+	var decoded map[string]interface{}
+	if err := msgpack.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal fails: %v", err)
+	}
+	expected := map[string]interface{}{
+		"id":   "1",
+		"type": "next",
+		"payload": map[string]interface{}{
+			"data": map[string]interface{}{
+				"ticks": int64(42),
+				"ratio": 0.5,
+				"tags":  []interface{}{"a"},
+			},
+			"errors": []interface{}{
+				map[string]interface{}{
+					"message":    "Slow down",
+					"locations":  []interface{}{},
+					"extensions": map[string]interface{}{"code": "RATE_LIMITED"},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("unexpected message: %#v", decoded)
+	}
+}
+
+func TestCodec_RawPayloadsCanBeDecodedLater(t *testing.T) {
+	data, err := msgpack.Marshal(map[string]interface{}{
+		"id":   "1",
+		"type": "subscribe",
+		"payload": map[string]interface{}{
+			"query":     "subscription { ticks }",
+			"variables": map[string]interface{}{"limit": 10},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Marshal fails: %v", err)
+	}
+
+	raw := json.RawMessage{}
+	msg := graphqlws.OperationMessage{Payload: &raw}
+	if err := msgpack.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("Unmarshal fails: %v", err)
+	}
+	if msg.ID != "1" || msg.Type != "subscribe" {
+		t.Errorf("unexpected message: %v", msg)
+	}
+
+	payload := graphqlws.StartMessagePayload{}
+	if err := msgpack.Unmarshal(raw, &payload); err != nil {
+		t.Fatalf("Unmarshal of raw payload fails: %v", err)
+	}
+	if payload.Query != "subscription { ticks }" || payload.Variables["limit"] != int64(10) {
+		t.Errorf("unexpected payload: %v", payload)
+	}
+}
+
+func TestCodec_MismatchedTypesAreRejected(t *testing.T) {
+	data, _ := msgpack.Marshal(map[string]interface{}{"id": 1})
+
+	msg := graphqlws.OperationMessage{}
+	if err := msgpack.Unmarshal(data, &msg); err == nil {
+		t.Error("decoding a number into a string succeeds")
+	}
+	if err := msgpack.Unmarshal(data[:len(data)-1], &msg); err == nil {
+		t.Error("decoding truncated data succeeds")
+	}
+	if _, err := msgpack.Marshal(make(chan int)); err == nil {
+		t.Error("encoding a channel succeeds")
+	}
+}
+
+func TestCodec_IsNegotiatedBySubprotocol(t *testing.T) {
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildSchema(t)),
+		Codecs:              map[string]graphqlws.Codec{msgpack.Name: msgpack.Codec},
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	}))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{
+		"Sec-WebSocket-Protocol": []string{graphqlws.SubprotocolGraphQLTransportWS + "+" + msgpack.Name},
+	})
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer ws.Close()
+
+	if ws.Subprotocol() != "graphql-transport-ws+msgpack" {
+		t.Fatalf("unexpected subprotocol: %s", ws.Subprotocol())
+	}
+
+	write := func(msg map[string]interface{}) {
+		data, err := msgpack.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Marshal fails: %v", err)
+		}
+		if err := ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			t.Fatalf("could not send message: %v", err)
+		}
+	}
+	read := func() map[string]interface{} {
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		frameType, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("could not read message: %v", err)
+		}
+		if frameType != websocket.BinaryMessage {
+			t.Fatalf("unexpected frame type: %d", frameType)
+		}
+		var msg map[string]interface{}
+		if err := msgpack.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("Unmarshal fails: %v", err)
+		}
+		return msg
+	}
+
+	write(map[string]interface{}{"type": "connection_init"})
+	if msg := read(); msg["type"] != "connection_ack" {
+		t.Fatalf("expected connection_ack, received: %v", msg)
+	}
+
+	write(map[string]interface{}{
+		"id":      "1",
+		"type":    "subscribe",
+		"payload": map[string]interface{}{"query": "subscription { ticks }"},
+	})
+	var s *graphqlws.Subscription
+	select {
+	case s = <-subscriptions:
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription was not started")
+	}
+
+	s.SendData(&graphqlws.DataMessagePayload{Data: map[string]interface{}{"ticks": 42}})
+	msg := read()
+	payload, _ := msg["payload"].(map[string]interface{})
+	data, _ := payload["data"].(map[string]interface{})
+	if msg["type"] != "next" || msg["id"] != "1" || data["ticks"] != int64(42) {
+		t.Errorf("unexpected data message: %v", msg)
+	}
+}
+
+func TestCodec_ClientsWithoutTheSuffixUseJSON(t *testing.T) {
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildSchema(t)),
+		Codecs:              map[string]graphqlws.Codec{msgpack.Name: msgpack.Codec},
+	}))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{
+		"Sec-WebSocket-Protocol": []string{graphqlws.SubprotocolGraphQLTransportWS},
+	})
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer ws.Close()
+
+	ws.WriteJSON(map[string]interface{}{"type": "connection_init"})
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	frameType, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("could not read message: %v", err)
+	}
+	var msg graphqlws.OperationMessage
+	if frameType != websocket.TextMessage || json.Unmarshal(data, &msg) != nil || msg.Type != "connection_ack" {
+		t.Errorf("unexpected message: %s", data)
+	}
+}
+
+func TestCodec_SubsequentPayloadsLeaveOutData(t *testing.T) {
+	data, err := msgpack.Marshal(graphqlws.NewSubsequentPayload(false, graphqlws.IncrementalPayload{
+		Data: map[string]interface{}{"name": "joe"},
+		Path: []interface{}{"user"},
+	}))
+	if err != nil {
+		t.Fatalf("Marshal fails: %v", err)
+	}
+
+	var decoded map[string]interface{}
+	if err := msgpack.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal fails: %v", err)
+	}
+	expected := map[string]interface{}{
+		"hasNext": false,
+		"incremental": []interface{}{
+			map[string]interface{}{
+				"data": map[string]interface{}{"name": "joe"},
+				"path": []interface{}{"user"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("unexpected payload: %#v", decoded)
+	}
+}
+
+func TestCodec_PersistedQueriesHaveIntegerVersions(t *testing.T) {
+	subscriptions := make(chan *graphqlws.Subscription, 2)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildSchema(t)),
+		Codecs:              map[string]graphqlws.Codec{msgpack.Name: msgpack.Codec},
+		PersistedQueries:    graphqlws.NewMemoryPersistedQueryCache(0),
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				if len(errs) > 0 {
+					t.Errorf("subscription %s failed: %v", s.ID, errs)
+				}
+				subscriptions <- s
+			},
+		},
+	}))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{
+		"Sec-WebSocket-Protocol": []string{graphqlws.SubprotocolGraphQLTransportWS + "+" + msgpack.Name},
+	})
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer ws.Close()
+
+	write := func(msg map[string]interface{}) {
+		data, err := msgpack.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Marshal fails: %v", err)
+		}
+		if err := ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			t.Fatalf("could not send message: %v", err)
+		}
+	}
+	write(map[string]interface{}{"type": "connection_init"})
+
+	// MessagePack encodes the version as an integer rather than a float
+	query := "subscription { ticks }"
+	sum := sha256.Sum256([]byte(query))
+	extensions := map[string]interface{}{
+		"persistedQuery": map[string]interface{}{
+			"version":    1,
+			"sha256Hash": hex.EncodeToString(sum[:]),
+		},
+	}
+	write(map[string]interface{}{
+		"id":      "1",
+		"type":    "subscribe",
+		"payload": map[string]interface{}{"query": query, "extensions": extensions},
+	})
+	write(map[string]interface{}{
+		"id":      "2",
+		"type":    "subscribe",
+		"payload": map[string]interface{}{"extensions": extensions},
+	})
+
+	for _, id := range []string{"1", "2"} {
+		select {
+		case s := <-subscriptions:
+			if s.ID != id || s.Query != query {
+				t.Errorf("unexpected subscription: %s %q", s.ID, s.Query)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("subscription %s was not started", id)
+		}
+	}
+}
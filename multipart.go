@@ -0,0 +1,193 @@
+package graphqlws
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// SubprotocolGraphQLMultipart is reported as the subprotocol of
+// connections streaming multipart responses.
+const SubprotocolGraphQLMultipart = "graphql-multipart"
+
+// Boundary of the parts of multipart responses
+const multipartBoundary = "graphql"
+
+// MultipartHandler returns an HTTP handler that streams the results of
+// operations as the parts of a chunked multipart/mixed response, for
+// environments where WebSockets are unavailable. Each request carries one
+// operation, as for SSEHandler.
+//
+// Clients asking for Apollo's multipart subscription protocol, with
+// subscriptionSpec in the Accept header, receive each result in the
+// payload field of a part and heartbeats as empty parts at the
+// KeepAliveInterval. Other clients receive the results themselves, as in
+// the incremental delivery transport used for @defer and @stream by
+// Relay and Apollo. The response ends with the closing boundary once the
+// operation completes. Operations are started with the same subscription
+// manager, auth and hooks as by SSEHandler.
+func (h *Handler) MultipartHandler() http.Handler {
+	return http.HandlerFunc(h.serveMultipart)
+}
+
+func (h *Handler) serveMultipart(w http.ResponseWriter, r *http.Request) {
+	data, err := readHTTPOperation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	h.serveStream(w, r, data, &multipartConnection{
+		httpConnection: newHTTPConnection(r.Context(), h.config, NewLogger("multipart"), r, h.clientIP(r)),
+		w:              w,
+		flusher:        flusher,
+		apollo:         strings.Contains(r.Header.Get("Accept"), "subscriptionSpec"),
+	})
+}
+
+/**
+ * Connections streaming multipart responses.
+ */
+
+type multipartConnection struct {
+	httpConnection
+
+	// Whether parts follow Apollo's multipart subscription protocol
+	apollo bool
+
+	// The response stream and whether it has started, guarded by mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	started bool
+}
+
+func (c *multipartConnection) start() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.startLocked()
+}
+
+// startLocked is like start; mutex must be held by the caller.
+func (c *multipartConnection) startLocked() {
+	if c.started || c.done {
+		return
+	}
+	c.started = true
+	contentType := fmt.Sprintf(`multipart/mixed; boundary="%s"`, multipartBoundary)
+	if c.apollo {
+		contentType += `; subscriptionSpec="1.0"`
+	}
+	c.w.Header().Set("Content-Type", contentType)
+	c.w.WriteHeader(http.StatusOK)
+	c.flusher.Flush()
+}
+
+// writePart sends a part to the client, or the closing boundary if last
+// is true; it returns false if the stream has ended.
+func (c *multipartConnection) writePart(body []byte, last bool) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.done {
+		return false
+	}
+	c.startLocked()
+
+	var n int
+	var err error
+	if last {
+		n, err = fmt.Fprintf(c.w, "\r\n--%s--\r\n", multipartBoundary)
+	} else {
+		n, err = fmt.Fprintf(c.w, "\r\n--%s\r\nContent-Type: application/json; charset=utf-8\r\n\r\n%s", multipartBoundary, body)
+	}
+	if err != nil {
+		c.finishLocked(err)
+		return false
+	}
+	c.flusher.Flush()
+	c.sent(n)
+	return true
+}
+
+// errorsPart returns the part sending errors to the client.
+func (c *multipartConnection) errorsPart(errs []error, format ErrorFormatter) []byte {
+	body := errorsBody(errs, format)
+	if c.apollo {
+		// Transport errors have no payload
+		body = append([]byte(`{"payload":null,`), body[1:]...)
+	}
+	return body
+}
+
+func (c *multipartConnection) reject(errs []error, format ErrorFormatter) {
+	body := errorsBody(errs, format)
+
+	c.mutex.Lock()
+	started := c.started
+	if !started && !c.done {
+		c.w.Header().Set("Content-Type", "application/json")
+		c.w.WriteHeader(http.StatusBadRequest)
+		c.w.Write(body)
+	}
+	c.mutex.Unlock()
+
+	if started {
+		c.writePart(c.errorsPart(errs, format), false)
+		c.writePart(nil, true)
+	}
+}
+
+func (c *multipartConnection) keepAlive() {
+	if c.apollo {
+		c.writePart([]byte("{}"), false)
+	}
+}
+
+// shutdown completes the operation of the connection and waits until
+// it has been unregistered or ctx expires.
+func (c *multipartConnection) shutdown(ctx context.Context) {
+	c.TrySendComplete(c.opID)
+	select {
+	case <-c.closed:
+	case <-ctx.Done():
+	}
+}
+
+func (c *multipartConnection) SendData(opID string, data *DataMessagePayload) {
+	if opID != c.opID {
+		return
+	}
+	body := c.encodeData(c, data)
+	if body == nil {
+		return
+	}
+	if c.apollo {
+		body = append(append([]byte(`{"payload":`), body...), '}')
+	}
+	c.writePart(body, false)
+}
+
+func (c *multipartConnection) SendError(err error) {
+	c.writePart(c.errorsPart([]error{err}, DefaultErrorFormatter), false)
+}
+
+func (c *multipartConnection) TrySendComplete(opID string) bool {
+	if opID != c.opID || !c.writePart(nil, true) {
+		return false
+	}
+	c.finish(ErrClosedByServer)
+	return true
+}
+
+func (c *multipartConnection) Close(code int, reason string) {
+	c.TrySendComplete(c.opID)
+}
+
+func (c *multipartConnection) Stats() ConnectionStats {
+	return c.stats(SubprotocolGraphQLMultipart)
+}
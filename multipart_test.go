@@ -0,0 +1,72 @@
+package graphqlws_test
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+func TestMultipartHandler_StreamsResultsAsParts(t *testing.T) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 2)
+	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	})
+	srv := httptest.NewServer(handler.MultipartHandler())
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		accept   string
+		expected string
+	}{
+		{`multipart/mixed;boundary="graphql";subscriptionSpec=1.0, application/json`, `{"payload":{"data":"hello","errors":null}}`},
+		{`multipart/mixed;deferSpec=20220824, application/json`, `{"data":"hello","errors":null}`},
+	} {
+		query := `{"query": "subscription { ` + subscriptionName + ` { payload } }"}`
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(query))
+		req.Header.Set("Accept", tc.accept)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := receiveSubscription(t, subscriptions)
+		s.SendData(&graphqlws.DataMessagePayload{Data: "hello"})
+		s.Connection.TrySendComplete(s.ID)
+
+		_, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		if err != nil || params["boundary"] != "graphql" {
+			t.Fatalf("unexpected content type: %q", res.Header.Get("Content-Type"))
+		}
+		reader := multipart.NewReader(res.Body, params["boundary"])
+		var parts []string
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("could not read part: %v", err)
+			}
+			body, _ := ioutil.ReadAll(part)
+			parts = append(parts, string(body))
+		}
+		res.Body.Close()
+
+		if len(parts) != 1 || parts[0] != tc.expected {
+			t.Errorf("expected part %s, received: %q", tc.expected, parts)
+		}
+	}
+}
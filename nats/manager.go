@@ -0,0 +1,193 @@
+// Package nats attaches subscriptions to NATS subjects, so that events
+// published on a subject are delivered to the subscriptions of every
+// server instance.
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	"github.com/meandrewdev/graphqlws"
+	"github.com/nats-io/nats.go"
+)
+
+// SubscriptionManager is a subscription manager that subscribes to a NATS
+// subject for each subscription and executes the subscription for every
+// message received on it.
+type SubscriptionManager interface {
+	graphqlws.SubscriptionManager
+
+	// Publish publishes an event on a subject. The payload is encoded as
+	// JSON and becomes the source value of the top-level resolvers of the
+	// subscriptions attached to the subject.
+	Publish(ctx context.Context, subject string, payload interface{}) error
+}
+
+// Config defines the configuration of a NATS subscription manager.
+type Config struct {
+	// Schema validates and executes subscriptions.
+	Schema *graphql.Schema
+
+	// Conn is the NATS connection, which reconnects and resubscribes to
+	// subjects after connection losses on its own.
+	Conn *nats.Conn
+
+	// JetStream, if set, is used to subscribe and publish instead of core
+	// NATS, with SubscribeOptions applied to each JetStream subscription
+	// (e.g. nats.DeliverNew()).
+	JetStream        nats.JetStreamContext
+	SubscribeOptions []nats.SubOpt
+
+	// Subjects returns the subjects a subscription is attached to;
+	// defaults to the names of its top-level fields.
+	Subjects func(*graphqlws.Subscription) []string
+}
+
+/**
+ * The NATS implementation of the SubscriptionManager interface.
+ */
+
+type subscriptionManager struct {
+	config        Config
+	subscriptions graphqlws.SubscriptionManager
+	subs          map[graphqlws.Connection]map[string][]*nats.Subscription
+	logger        graphqlws.Logger
+	mutex         *sync.Mutex
+}
+
+// NewSubscriptionManager creates a NATS subscription manager.
+func NewSubscriptionManager(config Config) SubscriptionManager {
+	if config.Subjects == nil {
+		config.Subjects = func(s *graphqlws.Subscription) []string {
+			return s.Fields
+		}
+	}
+
+	return &subscriptionManager{
+		config:        config,
+		subscriptions: graphqlws.NewSubscriptionManager(config.Schema),
+		subs:          make(map[graphqlws.Connection]map[string][]*nats.Subscription),
+		logger:        graphqlws.NewLogger("nats"),
+		mutex:         &sync.Mutex{},
+	}
+}
+
+func (m *subscriptionManager) Subscriptions() graphqlws.Subscriptions {
+	return m.subscriptions.Subscriptions()
+}
+
+func (m *subscriptionManager) AddSubscription(
+	conn graphqlws.Connection,
+	subscription *graphqlws.Subscription,
+) []error {
+	if errs := m.subscriptions.AddSubscription(conn, subscription); len(errs) > 0 {
+		return errs
+	}
+
+	// Attach the subscription to its subjects
+	handler := func(msg *nats.Msg) {
+		m.deliver(subscription, msg)
+	}
+	subs := []*nats.Subscription{}
+	for _, subject := range m.config.Subjects(subscription) {
+		sub, err := m.subscribe(subject, handler)
+		if err != nil {
+			m.logger.WithFields(graphqlws.Fields{
+				"subject": subject,
+				"err":     err,
+			}).Warn("Failed to subscribe to subject")
+			unsubscribe(subs)
+			m.subscriptions.RemoveSubscription(conn, subscription)
+			return []error{errors.New("Failed to subscribe to events")}
+		}
+		subs = append(subs, sub)
+	}
+
+	m.mutex.Lock()
+	if m.subs[conn] == nil {
+		m.subs[conn] = make(map[string][]*nats.Subscription)
+	}
+	m.subs[conn][subscription.ID] = subs
+	m.mutex.Unlock()
+
+	return nil
+}
+
+func (m *subscriptionManager) subscribe(subject string, handler nats.MsgHandler) (*nats.Subscription, error) {
+	if m.config.JetStream != nil {
+		return m.config.JetStream.Subscribe(subject, handler, m.config.SubscribeOptions...)
+	}
+	return m.config.Conn.Subscribe(subject, handler)
+}
+
+// deliver executes a subscription for a message and sends the result.
+func (m *subscriptionManager) deliver(subscription *graphqlws.Subscription, msg *nats.Msg) {
+	var payload interface{}
+	if err := json.Unmarshal(msg.Data, &payload); err != nil {
+		m.logger.WithFields(graphqlws.Fields{
+			"subject": msg.Subject,
+			"err":     err,
+		}).Warn("Failed to decode event")
+		return
+	}
+	if !subscription.Accepts(payload) {
+		return
+	}
+
+	subscription.SendData(graphqlws.ExecuteSubscription(
+		context.Background(),
+		m.config.Schema,
+		subscription,
+		payload,
+	))
+}
+
+func (m *subscriptionManager) RemoveSubscription(
+	conn graphqlws.Connection,
+	subscription *graphqlws.Subscription,
+) {
+	m.mutex.Lock()
+	subs := m.subs[conn][subscription.ID]
+	delete(m.subs[conn], subscription.ID)
+	if len(m.subs[conn]) == 0 {
+		delete(m.subs, conn)
+	}
+	m.mutex.Unlock()
+
+	unsubscribe(subs)
+	m.subscriptions.RemoveSubscription(conn, subscription)
+}
+
+func (m *subscriptionManager) RemoveSubscriptions(conn graphqlws.Connection) {
+	m.mutex.Lock()
+	subs := m.subs[conn]
+	delete(m.subs, conn)
+	m.mutex.Unlock()
+
+	for _, s := range subs {
+		unsubscribe(s)
+	}
+	m.subscriptions.RemoveSubscriptions(conn)
+}
+
+func (m *subscriptionManager) Publish(ctx context.Context, subject string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if m.config.JetStream != nil {
+		_, err = m.config.JetStream.Publish(subject, data, nats.Context(ctx))
+		return err
+	}
+	return m.config.Conn.Publish(subject, data)
+}
+
+// unsubscribe detaches NATS subscriptions from their subjects.
+func unsubscribe(subs []*nats.Subscription) {
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+}
@@ -0,0 +1,182 @@
+package nats_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/meandrewdev/graphqlws"
+	graphqlwsnats "github.com/meandrewdev/graphqlws/nats"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	m.Run()
+}
+
+// connection is a minimal graphqlws.Connection for subscriptions.
+type connection struct {
+	id string
+}
+
+func (c *connection) ID() string                                     { return c.id }
+func (c *connection) User() interface{}                              { return nil }
+func (c *connection) SendData(string, *graphqlws.DataMessagePayload) {}
+func (c *connection) SendError(error)                                {}
+func (c *connection) TrySendComplete(string) bool                    { return false }
+func (c *connection) Close(int, string)                              {}
+func (c *connection) Set(string, interface{})                        {}
+func (c *connection) Get(string) (interface{}, bool)                 { return nil, false }
+func (c *connection) InitPayload() map[string]interface{}            { return nil }
+func (c *connection) Stats() graphqlws.ConnectionStats               { return graphqlws.ConnectionStats{ID: c.id} }
+func (c *connection) Context() context.Context                       { return context.Background() }
+func (c *connection) Err() error                                     { return nil }
+func (c *connection) Request() *http.Request                         { return nil }
+func (c *connection) RemoteAddr() net.Addr                           { return nil }
+func (c *connection) ClientIP() string                               { return "" }
+
+func buildSchema(t *testing.T) *graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Query",
+			Fields: graphql.Fields{"hello": &graphql.Field{Type: graphql.String}},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"message": &graphql.Field{
+					Type: graphql.NewObject(graphql.ObjectConfig{
+						Name: "Message",
+						Fields: graphql.Fields{
+							"text": &graphql.Field{Type: graphql.String},
+						},
+					}),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source, nil
+					},
+				},
+			},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("could not build schema: %v", err)
+	}
+	return &schema
+}
+
+func connect(t *testing.T) *nats.Conn {
+	srv, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1})
+	if err != nil {
+		t.Fatalf("could not create NATS server: %v", err)
+	}
+	go srv.Start()
+	t.Cleanup(srv.Shutdown)
+	if !srv.ReadyForConnections(2 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatalf("could not connect to NATS: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func TestSubscriptionManager_SubscriptionsReceiveEventsOfTheirSubjects(t *testing.T) {
+	nc := connect(t)
+	sm := graphqlwsnats.NewSubscriptionManager(graphqlwsnats.Config{
+		Schema: buildSchema(t),
+		Conn:   nc,
+	})
+
+	received := make(chan *graphqlws.DataMessagePayload, 1)
+	conn := &connection{id: "1"}
+	subscription := &graphqlws.Subscription{
+		ID:         "1",
+		Connection: conn,
+		Query:      "subscription { message { text } }",
+		SendData: func(data *graphqlws.DataMessagePayload) {
+			received <- data
+		},
+	}
+	if errs := sm.AddSubscription(conn, subscription); len(errs) > 0 {
+		t.Fatalf("could not add subscription: %v", errs)
+	}
+	nc.Flush()
+
+	err := sm.Publish(context.Background(), "message", map[string]interface{}{"text": "hello"})
+	if err != nil {
+		t.Fatalf("could not publish event: %v", err)
+	}
+
+	select {
+	case data := <-received:
+		result, _ := data.Data.(map[string]interface{})
+		message, _ := result["message"].(map[string]interface{})
+		if message["text"] != "hello" {
+			t.Errorf("unexpected data: %v", data.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event not received")
+	}
+
+	// Removed subscriptions are detached from their subjects
+	sm.RemoveSubscription(conn, subscription)
+	nc.Flush()
+	sm.Publish(context.Background(), "message", map[string]interface{}{"text": "bye"})
+	nc.Flush()
+
+	select {
+	case data := <-received:
+		t.Errorf("removed subscription received data: %v", data.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSubscriptionManager_SubjectsCanBeCustomized(t *testing.T) {
+	nc := connect(t)
+	sm := graphqlwsnats.NewSubscriptionManager(graphqlwsnats.Config{
+		Schema: buildSchema(t),
+		Conn:   nc,
+		Subjects: func(s *graphqlws.Subscription) []string {
+			return []string{"rooms." + s.Variables["room"].(string)}
+		},
+	})
+
+	received := make(chan *graphqlws.DataMessagePayload, 1)
+	conn := &connection{id: "1"}
+	errs := sm.AddSubscription(conn, &graphqlws.Subscription{
+		ID:         "1",
+		Connection: conn,
+		Query:      "subscription { message { text } }",
+		Variables:  map[string]interface{}{"room": "general"},
+		SendData: func(data *graphqlws.DataMessagePayload) {
+			received <- data
+		},
+	})
+	if len(errs) > 0 {
+		t.Fatalf("could not add subscription: %v", errs)
+	}
+	nc.Flush()
+
+	sm.Publish(context.Background(), "rooms.random", map[string]interface{}{"text": "nope"})
+	sm.Publish(context.Background(), "rooms.general", map[string]interface{}{"text": "hello"})
+
+	select {
+	case data := <-received:
+		result, _ := data.Data.(map[string]interface{})
+		message, _ := result["message"].(map[string]interface{})
+		if message["text"] != "hello" {
+			t.Errorf("unexpected data: %v", data.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event not received")
+	}
+}
@@ -0,0 +1,48 @@
+// Package netpoll provides pollers for graphqlws connections, which
+// multiplex the reading of many mostly idle connections onto a few
+// goroutines: sockets are watched with epoll on Linux and kqueue on macOS
+// and the BSDs, and connections only start goroutines to read messages
+// once they have arrived.
+//
+//	poller, err := netpoll.New()
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	graphqlws.NewHandler(graphqlws.HandlerConfig{
+//		SubscriptionManager: subscriptionManager,
+//		Transport:           gobwas.NewTransport(gobwas.Config{}),
+//		Poller:              poller,
+//	})
+//
+// Only sockets implementing graphqlws.PollableSocket on network
+// connections with file descriptors are polled, e.g. those of the gobwas
+// transport on TCP connections; other connections are read from a
+// goroutine each as usual.
+package netpoll
+
+import (
+	"errors"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+// ErrUnsupported is returned by New on platforms without epoll or kqueue.
+var ErrUnsupported = errors.New("netpoll: polling is not supported on this platform")
+
+// ErrClosed is returned when watching connections with a closed poller.
+var ErrClosed = errors.New("netpoll: poller closed")
+
+// Poller is a graphqlws.Poller that can be closed.
+type Poller interface {
+	graphqlws.Poller
+
+	// Close stops the poller; connections that are still watched are no
+	// longer notified when they become readable.
+	Close() error
+}
+
+// New creates a poller, which watches connections with a goroutine of
+// its own until it's closed.
+func New() (Poller, error) {
+	return newPoller()
+}
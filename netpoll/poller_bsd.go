@@ -0,0 +1,62 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"syscall"
+)
+
+// backend watches file descriptors with kqueue.
+type backend struct {
+	fd     int
+	events []syscall.Kevent_t
+}
+
+func newBackend() (*backend, error) {
+	fd, err := syscall.Kqueue()
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(fd)
+	return &backend{fd: fd, events: make([]syscall.Kevent_t, maxEvents)}, nil
+}
+
+// watch reports fd as readable once; one-shot events are deleted once
+// they are reported, so registered file descriptors are simply added
+// again.
+func (b *backend) watch(fd int, registered bool) error {
+	return b.change(fd, syscall.EV_ADD|syscall.EV_ONESHOT)
+}
+
+func (b *backend) unwatch(fd int) error {
+	// The event has been deleted already if it has been reported
+	if err := b.change(fd, syscall.EV_DELETE); err != nil && err != syscall.ENOENT {
+		return err
+	}
+	return nil
+}
+
+func (b *backend) change(fd int, flags int) error {
+	changes := make([]syscall.Kevent_t, 1)
+	syscall.SetKevent(&changes[0], fd, syscall.EVFILT_READ, flags)
+	_, err := syscall.Kevent(b.fd, changes, nil, nil)
+	return err
+}
+
+// wait waits for file descriptors to become readable and stores them in
+// fds.
+func (b *backend) wait(fds []int) (int, error) {
+	n, err := syscall.Kevent(b.fd, nil, b.events[:len(fds)], nil)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		fds[i] = int(b.events[i].Ident)
+	}
+	return n, nil
+}
+
+func (b *backend) close() error {
+	return syscall.Close(b.fd)
+}
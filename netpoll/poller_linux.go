@@ -0,0 +1,57 @@
+package netpoll
+
+import (
+	"syscall"
+)
+
+// Reported for readable sockets and those closed by the peer; the socket
+// is disabled after each event until it's watched again
+const epollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// backend watches file descriptors with epoll.
+type backend struct {
+	fd     int
+	events []syscall.EpollEvent
+}
+
+func newBackend() (*backend, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &backend{fd: fd, events: make([]syscall.EpollEvent, maxEvents)}, nil
+}
+
+// watch reports fd as readable once; registered file descriptors are
+// enabled again.
+func (b *backend) watch(fd int, registered bool) error {
+	op := syscall.EPOLL_CTL_ADD
+	if registered {
+		op = syscall.EPOLL_CTL_MOD
+	}
+	return syscall.EpollCtl(b.fd, op, fd, &syscall.EpollEvent{
+		Events: epollEvents,
+		Fd:     int32(fd),
+	})
+}
+
+func (b *backend) unwatch(fd int) error {
+	return syscall.EpollCtl(b.fd, syscall.EPOLL_CTL_DEL, fd, &syscall.EpollEvent{})
+}
+
+// wait waits for file descriptors to become readable and stores them in
+// fds.
+func (b *backend) wait(fds []int) (int, error) {
+	n, err := syscall.EpollWait(b.fd, b.events[:len(fds)], -1)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		fds[i] = int(b.events[i].Fd)
+	}
+	return n, nil
+}
+
+func (b *backend) close() error {
+	return syscall.Close(b.fd)
+}
@@ -0,0 +1,212 @@
+package netpoll_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/gobwas"
+	"github.com/meandrewdev/graphqlws/netpoll"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	m.Run()
+}
+
+func buildSchema(t *testing.T) *graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"hello": &graphql.Field{Type: graphql.String},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"ticks": &graphql.Field{Type: graphql.Int},
+			},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("could not build schema: %v", err)
+	}
+	return &schema
+}
+
+func newPoller(t *testing.T) netpoll.Poller {
+	poller, err := netpoll.New()
+	if err == netpoll.ErrUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("could not create poller: %v", err)
+	}
+	return poller
+}
+
+func dial(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{
+		"Sec-WebSocket-Protocol": []string{graphqlws.SubprotocolGraphQLTransportWS},
+	})
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	return ws
+}
+
+func read(t *testing.T, ws *websocket.Conn) graphqlws.OperationMessage {
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg := graphqlws.OperationMessage{}
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("could not read message: %v", err)
+	}
+	return msg
+}
+
+func TestPoller_ConnectionsAreReadWhenReadable(t *testing.T) {
+	poller := newPoller(t)
+	defer poller.Close()
+
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	closed := make(chan struct{}, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildSchema(t)),
+		Transport:           gobwas.NewTransport(gobwas.Config{}),
+		Poller:              poller,
+		PingInterval:        20 * time.Millisecond,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+			Close: func(conn graphqlws.Connection) {
+				closed <- struct{}{}
+			},
+		},
+	}))
+	defer srv.Close()
+
+	ws := dial(t, srv)
+	defer ws.Close()
+
+	// Read continuously, so that the pings of the server are answered
+	messages := make(chan graphqlws.OperationMessage, 1)
+	go func() {
+		for {
+			msg := graphqlws.OperationMessage{}
+			if err := ws.ReadJSON(&msg); err != nil {
+				close(messages)
+				return
+			}
+			messages <- msg
+		}
+	}()
+	next := func() graphqlws.OperationMessage {
+		select {
+		case msg := <-messages:
+			return msg
+		case <-time.After(2 * time.Second):
+			t.Fatal("no message received")
+		}
+		return graphqlws.OperationMessage{}
+	}
+
+	// Messages sent in one go are all read
+	ws.WriteJSON(map[string]interface{}{"type": "connection_init"})
+	ws.WriteJSON(map[string]interface{}{
+		"id":      "1",
+		"type":    "subscribe",
+		"payload": map[string]interface{}{"query": "subscription { ticks }"},
+	})
+	if msg := next(); msg.Type != "connection_ack" {
+		t.Fatalf("expected connection_ack, received: %v", msg)
+	}
+	var s *graphqlws.Subscription
+	select {
+	case s = <-subscriptions:
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription was not started")
+	}
+
+	// Pongs keep the connection open across several pings
+	time.Sleep(100 * time.Millisecond)
+	s.SendData(&graphqlws.DataMessagePayload{Data: map[string]interface{}{"ticks": 1}})
+	if msg := next(); msg.Type != "next" || msg.ID != "1" {
+		t.Errorf("unexpected data message: %v", msg)
+	}
+
+	// Connections closed by the client are noticed by the poller
+	ws.Close()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Error("connection was not closed")
+	}
+}
+
+func TestPoller_IdleConnectionsDontHoldGoroutines(t *testing.T) {
+	poller := newPoller(t)
+	defer poller.Close()
+
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildSchema(t)),
+		Transport:           gobwas.NewTransport(gobwas.Config{}),
+		Poller:              poller,
+	}))
+	defer srv.Close()
+
+	const clients = 50
+	connect := func() []*websocket.Conn {
+		conns := make([]*websocket.Conn, clients)
+		for i := range conns {
+			conns[i] = dial(t, srv)
+			conns[i].WriteJSON(map[string]interface{}{"type": "connection_init"})
+			read(t, conns[i])
+		}
+		return conns
+	}
+
+	// Each client takes a reading goroutine and those of the HTTP server,
+	// which are counted by connecting without reading from the clients
+	before := runtime.NumGoroutine()
+	conns := connect()
+	defer func() {
+		for _, ws := range conns {
+			ws.Close()
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	perClient := float64(runtime.NumGoroutine()-before) / clients
+	if perClient > 1.5 {
+		t.Errorf("idle connections hold %.1f goroutines each", perClient)
+	}
+}
+
+func TestPoller_ClosedPollersRejectConnections(t *testing.T) {
+	poller := newPoller(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	if err := poller.Close(); err != nil {
+		t.Fatalf("Close fails: %v", err)
+	}
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer conn.Close()
+	if err := poller.Watch(conn, func() {}); err != netpoll.ErrClosed {
+		t.Errorf("expected ErrClosed, received: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// Maximum number of events handled per wait
+const maxEvents = 128
+
+var errNoFileDescriptor = errors.New("netpoll: connection has no file descriptor")
+
+type poller struct {
+	backend *backend
+
+	// A pipe that is written to in order to stop the poller
+	wake [2]int
+
+	// Watched file descriptors, guarded by mutex
+	watches map[int]*watch
+	closed  bool
+	mutex   *sync.Mutex
+}
+
+// watch is a watched file descriptor; armed is set from a call of Watch
+// until onReadable has been called for it, so that it's called at most
+// once per call, even if events of closed connections whose file
+// descriptors have been reused are still being handled.
+type watch struct {
+	onReadable func()
+	armed      bool
+}
+
+func newPoller() (Poller, error) {
+	b, err := newBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &poller{
+		backend: b,
+		watches: make(map[int]*watch),
+		mutex:   &sync.Mutex{},
+	}
+	if err := syscall.Pipe(p.wake[:]); err != nil {
+		b.close()
+		return nil, err
+	}
+	syscall.CloseOnExec(p.wake[0])
+	syscall.CloseOnExec(p.wake[1])
+	if err := b.watch(p.wake[0], false); err != nil {
+		p.shutdown()
+		return nil, err
+	}
+
+	go p.run()
+	return p, nil
+}
+
+func (p *poller) Watch(conn net.Conn, onReadable func()) error {
+	return control(conn, func(fd int) error {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		if p.closed {
+			return ErrClosed
+		}
+		w, registered := p.watches[fd]
+		if err := p.backend.watch(fd, registered); err != nil {
+			return err
+		}
+		if !registered {
+			w = &watch{}
+			p.watches[fd] = w
+		}
+		w.onReadable = onReadable
+		w.armed = true
+		return nil
+	})
+}
+
+func (p *poller) Unwatch(conn net.Conn) error {
+	return control(conn, func(fd int) error {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		if _, ok := p.watches[fd]; !ok {
+			return nil
+		}
+		delete(p.watches, fd)
+		if p.closed {
+			return nil
+		}
+		return p.backend.unwatch(fd)
+	})
+}
+
+func (p *poller) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	_, err := syscall.Write(p.wake[1], []byte{0})
+	return err
+}
+
+func (p *poller) run() {
+	fds := make([]int, maxEvents)
+	for {
+		n, err := p.backend.wait(fds)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			p.shutdown()
+			return
+		}
+
+		for _, fd := range fds[:n] {
+			if fd == p.wake[0] {
+				p.shutdown()
+				return
+			}
+			if onReadable := p.fire(fd); onReadable != nil {
+				onReadable()
+			}
+		}
+	}
+}
+
+// fire returns the callback of an armed file descriptor and disarms it.
+func (p *poller) fire(fd int) func() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	w, ok := p.watches[fd]
+	if !ok || !w.armed {
+		return nil
+	}
+	w.armed = false
+	return w.onReadable
+}
+
+// shutdown releases the file descriptors of the poller.
+func (p *poller) shutdown() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closed = true
+	p.watches = make(map[int]*watch)
+	p.backend.close()
+	syscall.Close(p.wake[0])
+	syscall.Close(p.wake[1])
+}
+
+// control calls f with the file descriptor of conn, which is kept open
+// while f runs.
+func control(conn net.Conn, f func(fd int) error) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errNoFileDescriptor
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ferr error
+	err = raw.Control(func(fd uintptr) {
+		ferr = f(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return ferr
+}
@@ -0,0 +1,185 @@
+package graphqlws
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Option configures handlers created with NewHandlerWithOptions and
+// connections created with NewConnectionWithOptions, as an alternative to
+// filling in a HandlerConfig or ConnectionConfig. Options that only apply
+// to handlers, e.g. WithUpgrader, are ignored by connections.
+type Option interface {
+	applyHandler(config *HandlerConfig)
+	applyConnection(config *ConnectionConfig)
+}
+
+type option struct {
+	handler    func(config *HandlerConfig)
+	connection func(config *ConnectionConfig)
+}
+
+func (o option) applyHandler(config *HandlerConfig) {
+	if o.handler != nil {
+		o.handler(config)
+	}
+}
+
+func (o option) applyConnection(config *ConnectionConfig) {
+	if o.connection != nil {
+		o.connection(config)
+	}
+}
+
+// NewHandlerWithOptions creates a handler for the subscription manager,
+// configured by the given options. Options are applied in order, and the
+// defaults of NewHandler apply to everything they leave unset.
+func NewHandlerWithOptions(subscriptionManager SubscriptionManager, opts ...Option) *Handler {
+	config := HandlerConfig{SubscriptionManager: subscriptionManager}
+	for _, opt := range opts {
+		opt.applyHandler(&config)
+	}
+	return NewHandler(config)
+}
+
+// NewConnectionWithOptions establishes a GraphQL WebSocket connection over
+// the socket, configured by the given options; see NewConnection.
+func NewConnectionWithOptions(ws Socket, opts ...Option) Connection {
+	config := ConnectionConfig{}
+	for _, opt := range opts {
+		opt.applyConnection(&config)
+	}
+	return NewConnection(ws, config)
+}
+
+// WithHandlerConfig applies a function to the configuration of handlers,
+// for settings that have no option of their own.
+func WithHandlerConfig(f func(config *HandlerConfig)) Option {
+	return option{handler: f}
+}
+
+// WithConnectionConfig applies a function to the configuration of
+// connections, for settings that have no option of their own.
+func WithConnectionConfig(f func(config *ConnectionConfig)) Option {
+	return option{connection: f}
+}
+
+// WithAuthenticate sets the function resolving the auth tokens of
+// clients into users.
+func WithAuthenticate(f AuthenticateFunc) Option {
+	return option{
+		handler:    func(config *HandlerConfig) { config.Authenticate = f },
+		connection: func(config *ConnectionConfig) { config.Authenticate = f },
+	}
+}
+
+// WithKeepAlive sets the interval at which keep-alive messages are sent.
+func WithKeepAlive(interval time.Duration) Option {
+	return option{
+		handler:    func(config *HandlerConfig) { config.KeepAliveInterval = interval },
+		connection: func(config *ConnectionConfig) { config.KeepAliveInterval = interval },
+	}
+}
+
+// WithInitTimeout sets the time clients have to initialize connections.
+func WithInitTimeout(timeout time.Duration) Option {
+	return option{
+		handler:    func(config *HandlerConfig) { config.ConnectionInitWaitTimeout = timeout },
+		connection: func(config *ConnectionConfig) { config.ConnectionInitWaitTimeout = timeout },
+	}
+}
+
+// WithPingInterval sets the interval at which WebSocket pings are sent.
+func WithPingInterval(interval time.Duration) Option {
+	return option{
+		handler:    func(config *HandlerConfig) { config.PingInterval = interval },
+		connection: func(config *ConnectionConfig) { config.PingInterval = interval },
+	}
+}
+
+// WithIdleTimeout sets the time after which connections without
+// operations are closed.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return option{
+		handler:    func(config *HandlerConfig) { config.IdleTimeout = timeout },
+		connection: func(config *ConnectionConfig) { config.IdleTimeout = timeout },
+	}
+}
+
+// WithMaxMessageSize sets the maximum size of messages read from clients.
+func WithMaxMessageSize(size int64) Option {
+	return option{
+		handler:    func(config *HandlerConfig) { config.MaxMessageSize = size },
+		connection: func(config *ConnectionConfig) { config.MaxMessageSize = size },
+	}
+}
+
+// WithErrorFormatter sets the formatter of the errors sent to clients.
+func WithErrorFormatter(format ErrorFormatter) Option {
+	return option{
+		handler:    func(config *HandlerConfig) { config.ErrorFormatter = format },
+		connection: func(config *ConnectionConfig) { config.ErrorFormatter = format },
+	}
+}
+
+// WithCodec sets the codec messages are encoded with.
+func WithCodec(codec Codec) Option {
+	return option{
+		handler:    func(config *HandlerConfig) { config.Codec = codec },
+		connection: func(config *ConnectionConfig) { config.Codec = codec },
+	}
+}
+
+// WithMiddleware appends middleware wrapping the handling of incoming
+// and outgoing messages; either may be nil.
+func WithMiddleware(incoming, outgoing Middleware) Option {
+	return option{
+		handler: func(config *HandlerConfig) {
+			config.IncomingMiddleware = appendMiddleware(config.IncomingMiddleware, incoming)
+			config.OutgoingMiddleware = appendMiddleware(config.OutgoingMiddleware, outgoing)
+		},
+		connection: func(config *ConnectionConfig) {
+			config.IncomingMiddleware = appendMiddleware(config.IncomingMiddleware, incoming)
+			config.OutgoingMiddleware = appendMiddleware(config.OutgoingMiddleware, outgoing)
+		},
+	}
+}
+
+func appendMiddleware(middleware []Middleware, m Middleware) []Middleware {
+	if m == nil {
+		return middleware
+	}
+	return append(middleware, m)
+}
+
+// WithMessageType adds a handler for messages of a custom type; see
+// MessageTypes.
+func WithMessageType(messageType string, handler MessageHandler) Option {
+	add := func(types MessageTypes) MessageTypes {
+		if types == nil {
+			types = MessageTypes{}
+		}
+		types[messageType] = handler
+		return types
+	}
+	return option{
+		handler:    func(config *HandlerConfig) { config.MessageTypes = add(config.MessageTypes) },
+		connection: func(config *ConnectionConfig) { config.MessageTypes = add(config.MessageTypes) },
+	}
+}
+
+// WithEventHandlers sets the lifecycle hooks of handlers.
+func WithEventHandlers(handlers CustomEventHandlers) Option {
+	return option{handler: func(config *HandlerConfig) { config.EventHandlers = handlers }}
+}
+
+// WithUpgrader sets the upgrader handlers start from.
+func WithUpgrader(upgrader *websocket.Upgrader) Option {
+	return option{handler: func(config *HandlerConfig) { config.Upgrader = upgrader }}
+}
+
+// WithSubprotocols restricts the subprotocols handlers accept.
+func WithSubprotocols(subprotocols ...string) Option {
+	return option{handler: func(config *HandlerConfig) { config.Subprotocols = subprotocols }}
+}
@@ -0,0 +1,40 @@
+package graphqlws_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+func TestOptions_ConfigureHandlers(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandlerWithOptions(
+		graphqlws.NewSubscriptionManager(schema),
+		graphqlws.WithAuthenticate(func(token string) (interface{}, error) {
+			return "user:" + token, nil
+		}),
+		graphqlws.WithSubprotocols(graphqlws.SubprotocolGraphQLTransportWS),
+		graphqlws.WithMessageType("whoami", func(conn graphqlws.Connection, msg graphqlws.OperationMessage) {
+			graphqlws.SendMessage(conn, graphqlws.OperationMessage{Type: "whoami", Payload: conn.User()})
+		}),
+	))
+	defer srv.Close()
+
+	ws := dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLTransportWS)
+	defer ws.Close()
+	if ws.Subprotocol() != graphqlws.SubprotocolGraphQLTransportWS {
+		t.Fatalf("unexpected subprotocol: %q", ws.Subprotocol())
+	}
+
+	writeMessage(t, ws, map[string]interface{}{
+		"type":    "connection_init",
+		"payload": map[string]interface{}{"authToken": "ada"},
+	})
+	readOperationMessage(t, ws)
+
+	writeMessage(t, ws, map[string]interface{}{"type": "whoami"})
+	if msg := readOperationMessage(t, ws); msg.Type != "whoami" || msg.Payload != "user:ada" {
+		t.Errorf("unexpected message: %v", msg)
+	}
+}
@@ -0,0 +1,163 @@
+package graphqlws
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+// Codes of errors for automatic persisted queries, which match those
+// expected by Apollo clients.
+const (
+	ErrCodePersistedQueryNotFound     = "PERSISTED_QUERY_NOT_FOUND"
+	ErrCodePersistedQueryNotSupported = "PERSISTED_QUERY_NOT_SUPPORTED"
+	ErrCodePersistedQueryHashMismatch = "PERSISTED_QUERY_HASH_MISMATCH"
+)
+
+// DefaultPersistedQueryCacheSize is the maximum number of queries that
+// in-memory persisted query caches hold by default.
+const DefaultPersistedQueryCacheSize = 1000
+
+// persistedQueryExtension is the key of automatic persisted queries in
+// the extensions of start messages.
+const persistedQueryExtension = "persistedQuery"
+
+// PersistedQueryCache stores the queries of automatic persisted queries
+// by their SHA-256 hashes. Implementations need to be safe for concurrent
+// use and may be backed by shared stores such as Redis, so that queries
+// registered on one server are found on the others.
+type PersistedQueryCache interface {
+	// Get returns the query with the given hash.
+	Get(hash string) (string, bool)
+
+	// Add stores a query under its hash.
+	Add(hash string, query string)
+}
+
+/**
+ * The default, in-memory implementation of the PersistedQueryCache
+ * interface.
+ */
+
+type memoryPersistedQueryCache struct {
+	size int
+
+	// Elements of the queries, ordered from the most to the least
+	// recently used, guarded by mutex
+	queries map[string]*list.Element
+	order   *list.List
+	mutex   *sync.Mutex
+}
+
+// A query in an in-memory persisted query cache
+type persistedQuery struct {
+	hash  string
+	query string
+}
+
+// NewMemoryPersistedQueryCache creates an in-memory persisted query cache
+// that holds up to size queries, or DefaultPersistedQueryCacheSize if
+// size isn't positive. The least recently used queries are evicted first.
+func NewMemoryPersistedQueryCache(size int) PersistedQueryCache {
+	if size <= 0 {
+		size = DefaultPersistedQueryCacheSize
+	}
+	return &memoryPersistedQueryCache{
+		size:    size,
+		queries: make(map[string]*list.Element),
+		order:   list.New(),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+func (c *memoryPersistedQueryCache) Get(hash string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.queries[hash]
+	if !ok {
+		return "", false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*persistedQuery).query, true
+}
+
+func (c *memoryPersistedQueryCache) Add(hash string, query string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.queries[hash]; ok {
+		element.Value.(*persistedQuery).query = query
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.queries[hash] = c.order.PushFront(&persistedQuery{hash: hash, query: query})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.queries, oldest.Value.(*persistedQuery).hash)
+	}
+}
+
+// persistedQueryVersion returns the version of a persisted query
+// extension, which codecs decode as different numeric types, e.g.
+// MessagePack decodes integers as int64.
+func persistedQueryVersion(version interface{}) float64 {
+	switch version := version.(type) {
+	case float64:
+		return version
+	case int64:
+		return float64(version)
+	case uint64:
+		return float64(version)
+	case json.Number:
+		f, _ := version.Float64()
+		return f
+	default:
+		return 0
+	}
+}
+
+// resolvePersistedQuery fills in the query of a start message that refers
+// to a persisted query. It returns the hash of the query the message comes
+// with, which is only registered once the operation has been accepted, so
+// that invalid queries don't fill up the cache. Messages without a
+// persisted query are left untouched.
+func resolvePersistedQuery(cache PersistedQueryCache, data *StartMessagePayload) (string, error) {
+	extension, ok := data.Extensions[persistedQueryExtension].(map[string]interface{})
+	if !ok {
+		return "", nil
+	}
+
+	// Servers without a cache still run queries sent in full
+	if cache == nil && data.Query != "" {
+		return "", nil
+	}
+
+	hash, _ := extension["sha256Hash"].(string)
+	hash = strings.ToLower(hash)
+	if cache == nil || persistedQueryVersion(extension["version"]) != 1 || hash == "" {
+		return "", newOperationError("PersistedQueryNotSupported", ErrCodePersistedQueryNotSupported)
+	}
+
+	// Look up the query if the client only sent its hash
+	if data.Query == "" {
+		query, found := cache.Get(hash)
+		if !found {
+			return "", newOperationError("PersistedQueryNotFound", ErrCodePersistedQueryNotFound)
+		}
+		data.Query = query
+		return "", nil
+	}
+
+	// Check the hash of the query to register
+	sum := sha256.Sum256([]byte(data.Query))
+	if hex.EncodeToString(sum[:]) != hash {
+		return "", newOperationError("Provided sha256Hash does not match query", ErrCodePersistedQueryHashMismatch)
+	}
+	return hash, nil
+}
@@ -0,0 +1,152 @@
+package graphqlws_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/meandrewdev/graphqlws"
+)
+
+func startPersistedQuery(t *testing.T, ws *websocket.Conn, opID string, query string, hash string) {
+	payload := map[string]interface{}{
+		"extensions": map[string]interface{}{
+			"persistedQuery": map[string]interface{}{
+				"version":    1,
+				"sha256Hash": hash,
+			},
+		},
+	}
+	if query != "" {
+		payload["query"] = query
+	}
+	writeMessage(t, ws, map[string]interface{}{
+		"id":      opID,
+		"type":    "start",
+		"payload": payload,
+	})
+}
+
+func errorCode(t *testing.T, msg graphqlws.OperationMessage) string {
+	errs, _ := msg.Payload.([]interface{})
+	if msg.Type != "error" || len(errs) != 1 {
+		t.Fatalf("expected error, received: %v", msg)
+	}
+	extensions, _ := errs[0].(map[string]interface{})["extensions"].(map[string]interface{})
+	code, _ := extensions["code"].(string)
+	return code
+}
+
+func TestPersistedQueries_QueriesAreRegisteredAndLookedUp(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		PersistedQueries:    graphqlws.NewMemoryPersistedQueryCache(0),
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	query := "subscription { " + subscriptionName + " { payload } }"
+	sum := sha256.Sum256([]byte(query))
+	hash := hex.EncodeToString(sum[:])
+
+	// Unknown hashes are rejected
+	startPersistedQuery(t, ws, "1", "", hash)
+	if code := errorCode(t, readOperationMessage(t, ws)); code != graphqlws.ErrCodePersistedQueryNotFound {
+		t.Fatalf("unexpected error code: %s", code)
+	}
+
+	// Queries are registered with their hash
+	startPersistedQuery(t, ws, "2", query, hash)
+	conn := waitForConnection(t, sm)
+
+	// Registered queries can be referred to by their hash
+	startPersistedQuery(t, ws, "3", "", hash)
+	startPersistedQuery(t, ws, "4", "", "0000")
+	if code := errorCode(t, readOperationMessage(t, ws)); code != graphqlws.ErrCodePersistedQueryNotFound {
+		t.Fatalf("unexpected error code: %s", code)
+	}
+	if s := sm.Subscriptions()[conn]["3"]; s == nil || s.Query != query {
+		t.Errorf("persisted query not looked up: %v", s)
+	}
+}
+
+func TestPersistedQueries_HashesMustMatchQueries(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		PersistedQueries:    graphqlws.NewMemoryPersistedQueryCache(0),
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startPersistedQuery(t, ws, "1", "subscription { "+subscriptionName+" { payload } }", "0000")
+	if code := errorCode(t, readOperationMessage(t, ws)); code != graphqlws.ErrCodePersistedQueryHashMismatch {
+		t.Fatalf("unexpected error code: %s", code)
+	}
+}
+
+func TestPersistedQueries_AreNotSupportedWithoutCache(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := startServer(graphqlws.NewSubscriptionManager(schema))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startPersistedQuery(t, ws, "1", "", "0000")
+	if code := errorCode(t, readOperationMessage(t, ws)); code != graphqlws.ErrCodePersistedQueryNotSupported {
+		t.Fatalf("unexpected error code: %s", code)
+	}
+}
+
+func TestPersistedQueries_InvalidQueriesAreNotRegistered(t *testing.T) {
+	schema, _ := buildSchema()
+	cache := graphqlws.NewMemoryPersistedQueryCache(0)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		PersistedQueries:    cache,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	query := "subscription { unknown }"
+	sum := sha256.Sum256([]byte(query))
+	hash := hex.EncodeToString(sum[:])
+
+	startPersistedQuery(t, ws, "1", query, hash)
+	if msg := readOperationMessage(t, ws); msg.Type != "error" {
+		t.Fatalf("expected error, received: %v", msg)
+	}
+	if query, ok := cache.Get(hash); ok {
+		t.Errorf("invalid query was registered: %s", query)
+	}
+}
+
+func TestMemoryPersistedQueryCache_EvictsTheLeastRecentlyUsedQueries(t *testing.T) {
+	cache := graphqlws.NewMemoryPersistedQueryCache(2)
+	cache.Add("a", "query a")
+	cache.Add("b", "query b")
+
+	// Looking up a query keeps it in the cache
+	cache.Get("a")
+	cache.Add("c", "query c")
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("least recently used query wasn't evicted")
+	}
+	for _, hash := range []string{"a", "c"} {
+		if _, ok := cache.Get(hash); !ok {
+			t.Errorf("query %s was evicted", hash)
+		}
+	}
+}
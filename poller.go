@@ -0,0 +1,41 @@
+package graphqlws
+
+import (
+	"net"
+)
+
+// Poller notifies connections when their network connections become
+// readable, e.g. with epoll or kqueue, so that idle connections don't need
+// goroutines blocked on reading; see the netpoll package.
+//
+// Only connections on sockets implementing PollableSocket are polled;
+// other connections keep reading in goroutines of their own.
+type Poller interface {
+	// Watch calls onReadable once conn has become readable or has been
+	// closed by the peer. The watch only fires once; Watch is called
+	// again to be notified of further data. onReadable must not block.
+	Watch(conn net.Conn, onReadable func()) error
+
+	// Unwatch stops watching conn; it's called before conn is closed.
+	Unwatch(conn net.Conn) error
+}
+
+// PollableSocket is a Socket that can be read from when a Poller reports
+// its network connection as readable. This requires that it doesn't read
+// ahead of the frames it returns, other than the bytes it reports as
+// buffered; *websocket.Conn doesn't qualify.
+type PollableSocket interface {
+	Socket
+
+	// NetConn returns the network connection frames are read from.
+	NetConn() net.Conn
+
+	// Buffered returns the number of bytes that have been read from the
+	// network connection but not yet returned in frames.
+	Buffered() int
+
+	// ReadFrame is like ReadMessage, but returns after handling a control
+	// frame, with the type of the frame and no data, so that it doesn't
+	// block waiting for a message after pings and pongs.
+	ReadFrame() (messageType int, data []byte, err error)
+}
@@ -0,0 +1,85 @@
+package graphqlws
+
+import (
+	"bytes"
+	"sync"
+)
+
+const (
+	// Default initial capacity of pooled buffers
+	bufferSize = 1024
+
+	// Default size above which buffers aren't returned to their pool
+	maxBufferSize = 64 * 1024
+)
+
+// BufferPool provides the buffers that connections encode messages into,
+// so that they don't allocate memory for every message they send.
+// Buffer pools must be safe for concurrent use.
+type BufferPool interface {
+	// Get returns an empty buffer.
+	Get() *bytes.Buffer
+
+	// Put returns a buffer to the pool once its contents have been
+	// written.
+	Put(buf *bytes.Buffer)
+}
+
+// BufferPoolConfig configures a buffer pool.
+type BufferPoolConfig struct {
+	// BufferSize is the initial capacity of new buffers; defaults to
+	// 1 KiB. Buffers grow as needed and keep their capacity when they are
+	// reused.
+	BufferSize int
+
+	// MaxBufferSize is the capacity above which buffers are dropped rather
+	// than returned to the pool, so that the occasional large message
+	// doesn't keep its memory in use; defaults to 64 KiB.
+	MaxBufferSize int
+}
+
+// DefaultBufferPool is the buffer pool of connections that don't
+// configure one.
+var DefaultBufferPool = NewBufferPool(BufferPoolConfig{})
+
+/**
+ * The default implementation of the BufferPool interface.
+ */
+
+type bufferPool struct {
+	pool          *sync.Pool
+	maxBufferSize int
+}
+
+// NewBufferPool creates a buffer pool backed by a sync.Pool.
+func NewBufferPool(config BufferPoolConfig) BufferPool {
+	size := config.BufferSize
+	if size <= 0 {
+		size = bufferSize
+	}
+	maxSize := config.MaxBufferSize
+	if maxSize <= 0 {
+		maxSize = maxBufferSize
+	}
+
+	return &bufferPool{
+		pool: &sync.Pool{
+			New: func() interface{} {
+				return bytes.NewBuffer(make([]byte, 0, size))
+			},
+		},
+		maxBufferSize: maxSize,
+	}
+}
+
+func (p *bufferPool) Get() *bytes.Buffer {
+	return p.pool.Get().(*bytes.Buffer)
+}
+
+func (p *bufferPool) Put(buf *bytes.Buffer) {
+	if buf.Cap() > p.maxBufferSize {
+		return
+	}
+	buf.Reset()
+	p.pool.Put(buf)
+}
@@ -0,0 +1,110 @@
+package graphqlws_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+func TestBufferPool_LargeBuffersAreDropped(t *testing.T) {
+	pool := graphqlws.NewBufferPool(graphqlws.BufferPoolConfig{
+		BufferSize:    16,
+		MaxBufferSize: 64,
+	})
+
+	buf := pool.Get()
+	if buf.Len() != 0 || buf.Cap() < 16 {
+		t.Errorf("unexpected new buffer: len %d, cap %d", buf.Len(), buf.Cap())
+	}
+
+	buf.Write(make([]byte, 1000))
+	pool.Put(buf)
+	if buf := pool.Get(); buf.Cap() >= 1000 {
+		t.Errorf("buffer above the maximum size was reused")
+	}
+
+	small := pool.Get()
+	small.WriteString("hello")
+	pool.Put(small)
+	if buf := pool.Get(); buf.Len() != 0 {
+		t.Errorf("reused buffer is not empty: %q", buf.String())
+	}
+}
+
+func TestJSONCodec_MarshalToMatchesMarshal(t *testing.T) {
+	msg := graphqlws.OperationMessage{
+		ID:      "1",
+		Type:    "next",
+		Payload: &graphqlws.DataMessagePayload{Data: map[string]interface{}{"html": "<b>"}},
+	}
+	expected, _ := json.Marshal(msg)
+
+	buf := bytes.NewBufferString("prefix")
+	if err := graphqlws.JSONCodec.(graphqlws.BufferCodec).MarshalTo(buf, msg); err != nil {
+		t.Fatalf("MarshalTo fails: %v", err)
+	}
+	if buf.String() != "prefix"+string(expected) {
+		t.Errorf("unexpected encoding: %s", buf.String())
+	}
+
+	if err := graphqlws.JSONCodec.(graphqlws.BufferCodec).MarshalTo(buf, make(chan int)); err == nil {
+		t.Error("encoding a channel succeeds")
+	}
+	if buf.String() != "prefix"+string(expected) {
+		t.Errorf("failed encoding changed the buffer: %s", buf.String())
+	}
+}
+
+// countingPool counts the buffers taken from and returned to a pool.
+type countingPool struct {
+	graphqlws.BufferPool
+	gets int32
+	puts int32
+}
+
+func (p *countingPool) Get() *bytes.Buffer {
+	atomic.AddInt32(&p.gets, 1)
+	return p.BufferPool.Get()
+}
+
+func (p *countingPool) Put(buf *bytes.Buffer) {
+	atomic.AddInt32(&p.puts, 1)
+	p.BufferPool.Put(buf)
+}
+
+func TestHandler_MessagesAreEncodedIntoPooledBuffers(t *testing.T) {
+	schema, _ := buildSchema()
+	pool := &countingPool{BufferPool: graphqlws.NewBufferPool(graphqlws.BufferPoolConfig{})}
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		BufferPool:          pool,
+		KeepAliveInterval:   10 * time.Millisecond,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	if msg := readOperationMessage(t, ws); msg.Type != "connection_ack" {
+		t.Fatalf("expected connection_ack, received: %v", msg)
+	}
+	readOperationMessage(t, ws)
+	readOperationMessage(t, ws)
+
+	// Buffers are returned once their messages have been written, which
+	// may be just after the client has read them
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&pool.puts) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	gets, puts := atomic.LoadInt32(&pool.gets), atomic.LoadInt32(&pool.puts)
+	if gets < 3 || puts < 3 || gets-puts > 1 {
+		t.Errorf("buffers are not taken from and returned to the pool: %d gets, %d puts", gets, puts)
+	}
+}
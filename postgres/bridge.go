@@ -0,0 +1,199 @@
+// Package postgres executes subscriptions when Postgres sends
+// notifications on the channels it LISTENs on, so that small deployments
+// can distribute subscription events without additional infrastructure.
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/meandrewdev/graphqlws"
+)
+
+// Default intervals of the listener
+const (
+	minReconnectInterval = 10 * time.Second
+	maxReconnectInterval = time.Minute
+	pingInterval         = 90 * time.Second
+)
+
+// Listener listens for notifications on Postgres channels; *pq.Listener
+// implements it. Listeners are expected to reconnect and LISTEN on their
+// channels again after losing their connection.
+type Listener interface {
+	Listen(channel string) error
+	NotificationChannel() <-chan *pq.Notification
+	Ping() error
+	Close() error
+}
+
+// Channel defines a Postgres notification channel.
+type Channel struct {
+	// Name is the name of the channel.
+	Name string
+
+	// Field is the subscription field that the channel's notifications
+	// are published for; defaults to the name of the channel.
+	Field string
+}
+
+// Config defines the configuration of a Postgres bridge.
+type Config struct {
+	// ConnInfo is the connection string of the database, see pq.
+	ConnInfo string
+
+	// Channels lists the channels to LISTEN on.
+	Channels []Channel
+
+	// Manager executes the subscriptions for each notification.
+	Manager graphqlws.PublishingSubscriptionManager
+
+	// Decode returns the source value of the subscription field's resolver
+	// for a notification. By default, payloads are decoded as JSON, or used
+	// as strings if they aren't valid JSON.
+	Decode func(*pq.Notification) (interface{}, error)
+
+	// MinReconnectInterval and MaxReconnectInterval bound the time between
+	// attempts to reconnect to the database; they default to 10 seconds
+	// and one minute. PingInterval is the interval at which the connection
+	// is checked while no notifications arrive; it defaults to 90 seconds.
+	MinReconnectInterval time.Duration
+	MaxReconnectInterval time.Duration
+	PingInterval         time.Duration
+
+	// NewListener creates the listener; defaults to pq.NewListener.
+	NewListener func(config Config, callback pq.EventCallbackType) Listener
+}
+
+// Bridge listens on Postgres channels and publishes their notifications
+// to the subscriptions of a subscription manager.
+type Bridge interface {
+	// Run listens on the channels until ctx is done, which returns nil,
+	// or listening on one of them fails.
+	Run(ctx context.Context) error
+}
+
+/**
+ * The default implementation of the Bridge interface.
+ */
+
+type bridge struct {
+	config Config
+	fields map[string]string
+	logger graphqlws.Logger
+}
+
+// NewBridge creates a Postgres bridge.
+func NewBridge(config Config) Bridge {
+	if config.Decode == nil {
+		config.Decode = decodeJSON
+	}
+	if config.MinReconnectInterval <= 0 {
+		config.MinReconnectInterval = minReconnectInterval
+	}
+	if config.MaxReconnectInterval <= 0 {
+		config.MaxReconnectInterval = maxReconnectInterval
+	}
+	if config.PingInterval <= 0 {
+		config.PingInterval = pingInterval
+	}
+	if config.NewListener == nil {
+		config.NewListener = func(config Config, callback pq.EventCallbackType) Listener {
+			return pq.NewListener(
+				config.ConnInfo,
+				config.MinReconnectInterval,
+				config.MaxReconnectInterval,
+				callback,
+			)
+		}
+	}
+
+	fields := make(map[string]string, len(config.Channels))
+	for _, channel := range config.Channels {
+		fields[channel.Name] = channel.Field
+		if channel.Field == "" {
+			fields[channel.Name] = channel.Name
+		}
+	}
+
+	return &bridge{
+		config: config,
+		fields: fields,
+		logger: graphqlws.NewLogger("postgres"),
+	}
+}
+
+func (b *bridge) Run(ctx context.Context) error {
+	listener := b.config.NewListener(b.config, b.logEvent)
+	defer listener.Close()
+
+	for _, channel := range b.config.Channels {
+		if err := listener.Listen(channel.Name); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(b.config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case notification := <-listener.NotificationChannel():
+			// The listener sends nil after reconnecting, when notifications
+			// may have been missed
+			if notification != nil {
+				b.publish(ctx, notification)
+			}
+
+		// Check the connection now and then, so that dead connections are
+		// detected and reconnected
+		case <-ticker.C:
+			go listener.Ping()
+		}
+	}
+}
+
+// publish executes the subscriptions for a notification.
+func (b *bridge) publish(ctx context.Context, notification *pq.Notification) {
+	field, ok := b.fields[notification.Channel]
+	if !ok {
+		return
+	}
+
+	payload, err := b.config.Decode(notification)
+	if err != nil {
+		b.logger.WithFields(graphqlws.Fields{
+			"channel": notification.Channel,
+			"err":     err,
+		}).Warn("Failed to decode notification")
+		return
+	}
+
+	b.config.Manager.Publish(ctx, field, payload)
+}
+
+func (b *bridge) logEvent(event pq.ListenerEventType, err error) {
+	if err != nil {
+		b.logger.WithFields(graphqlws.Fields{
+			"event": event,
+			"err":   err,
+		}).Warn("Listener connection problem")
+	}
+}
+
+func decodeJSON(notification *pq.Notification) (interface{}, error) {
+	if notification.Extra == "" {
+		return nil, nil
+	}
+
+	var payload interface{}
+	if err := json.Unmarshal([]byte(notification.Extra), &payload); err != nil {
+		return notification.Extra, nil
+	}
+	return payload, nil
+}
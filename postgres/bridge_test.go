@@ -0,0 +1,150 @@
+package postgres_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/lib/pq"
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/postgres"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	m.Run()
+}
+
+// connection is a minimal graphqlws.Connection for subscriptions.
+type connection struct {
+	id string
+}
+
+func (c *connection) ID() string                                     { return c.id }
+func (c *connection) User() interface{}                              { return nil }
+func (c *connection) SendData(string, *graphqlws.DataMessagePayload) {}
+func (c *connection) SendError(error)                                {}
+func (c *connection) TrySendComplete(string) bool                    { return false }
+func (c *connection) Close(int, string)                              {}
+func (c *connection) Set(string, interface{})                        {}
+func (c *connection) Get(string) (interface{}, bool)                 { return nil, false }
+func (c *connection) InitPayload() map[string]interface{}            { return nil }
+func (c *connection) Stats() graphqlws.ConnectionStats               { return graphqlws.ConnectionStats{ID: c.id} }
+func (c *connection) Context() context.Context                       { return context.Background() }
+func (c *connection) Err() error                                     { return nil }
+func (c *connection) Request() *http.Request                         { return nil }
+func (c *connection) RemoteAddr() net.Addr                           { return nil }
+func (c *connection) ClientIP() string                               { return "" }
+
+// listener delivers notifications sent by the test.
+type listener struct {
+	channels      chan string
+	notifications chan *pq.Notification
+}
+
+func (l *listener) Listen(channel string) error {
+	l.channels <- channel
+	return nil
+}
+
+func (l *listener) NotificationChannel() <-chan *pq.Notification {
+	return l.notifications
+}
+
+func (l *listener) Ping() error {
+	return nil
+}
+
+func (l *listener) Close() error {
+	return nil
+}
+
+func buildSchema(t *testing.T) *graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Query",
+			Fields: graphql.Fields{"hello": &graphql.Field{Type: graphql.String}},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"userUpdated": &graphql.Field{
+					Type: graphql.String,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if user, ok := p.Source.(map[string]interface{}); ok {
+							return user["name"], nil
+						}
+						return p.Source, nil
+					},
+				},
+			},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("could not build schema: %v", err)
+	}
+	return &schema
+}
+
+func TestBridge_NotificationsArePublished(t *testing.T) {
+	sm := graphqlws.NewPublishingSubscriptionManager(buildSchema(t))
+
+	received := make(chan *graphqlws.DataMessagePayload, 2)
+	conn := &connection{id: "1"}
+	sm.AddSubscription(conn, &graphqlws.Subscription{
+		ID:         "1",
+		Connection: conn,
+		Query:      "subscription { userUpdated }",
+		SendData: func(data *graphqlws.DataMessagePayload) {
+			received <- data
+		},
+	})
+
+	l := &listener{
+		channels:      make(chan string, 1),
+		notifications: make(chan *pq.Notification),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- postgres.NewBridge(postgres.Config{
+			Channels: []postgres.Channel{{Name: "users", Field: "userUpdated"}},
+			Manager:  sm,
+			NewListener: func(postgres.Config, pq.EventCallbackType) postgres.Listener {
+				return l
+			},
+		}).Run(ctx)
+	}()
+
+	if channel := <-l.channels; channel != "users" {
+		t.Fatalf("listening on unexpected channel: %s", channel)
+	}
+
+	// Reconnects, notifications of other channels, JSON and plain payloads
+	l.notifications <- nil
+	l.notifications <- &pq.Notification{Channel: "orders", Extra: `{"name":"nope"}`}
+	l.notifications <- &pq.Notification{Channel: "users", Extra: `{"name":"alice"}`}
+	l.notifications <- &pq.Notification{Channel: "users", Extra: "bob"}
+
+	for _, name := range []string{"alice", "bob"} {
+		select {
+		case data := <-received:
+			result, _ := data.Data.(map[string]interface{})
+			if result["userUpdated"] != name {
+				t.Errorf("unexpected data: %v", data.Data)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("notification not published")
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run fails after cancellation: %v", err)
+	}
+}
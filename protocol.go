@@ -0,0 +1,123 @@
+package graphqlws
+
+const (
+	// SubprotocolGraphQLWS is the legacy subprotocol implemented by
+	// subscriptions-transport-ws.
+	SubprotocolGraphQLWS = "graphql-ws"
+
+	// SubprotocolGraphQLTransportWS is the subprotocol implemented by the
+	// graphql-ws library and Apollo Client 3.5+.
+	SubprotocolGraphQLTransportWS = "graphql-transport-ws"
+)
+
+const (
+	// Close codes defined by the graphql-transport-ws protocol
+	closeInternalServerError = 4500
+	closeBadRequest          = 4400
+	closeUnauthorized        = 4401
+	closeForbidden           = 4403
+	closeInitTimeout         = 4408
+	closeSubscriberExists    = 4409
+	closeTooManyInitRequests = 4429
+	closeTooManyRequests     = 4429
+
+	// Maximum length of close reasons allowed by the WebSocket protocol
+	maxCloseReasonLength = 123
+)
+
+// protocol describes how the messages of a subprotocol map onto the
+// message types used internally, which are those of the legacy
+// "graphql-ws" protocol.
+type protocol struct {
+	subprotocol string
+
+	// Maps incoming message types to internal message types
+	incoming map[string]string
+
+	// Maps internal message types to outgoing message types
+	outgoing map[string]string
+
+	// Whether protocol violations close the connection with one of
+	// the close codes of the graphql-transport-ws protocol
+	strict bool
+
+	// Whether this is the AWS AppSync realtime protocol, whose starts
+	// are acknowledged and whose error payloads are objects
+	appSync bool
+}
+
+var graphqlWSProtocol = &protocol{
+	subprotocol: SubprotocolGraphQLWS,
+}
+
+var graphqlTransportWSProtocol = &protocol{
+	subprotocol: SubprotocolGraphQLTransportWS,
+	incoming: map[string]string{
+		"connection_init":    gqlConnectionInit,
+		"connection_refresh": gqlConnectionRefresh,
+		"subscribe":          gqlStart,
+		"complete":           gqlStop,
+		"ping":               gqlPing,
+		"pong":               gqlPong,
+		"ack":                gqlAck,
+	},
+	outgoing: map[string]string{
+		gqlConnectionAck:        "connection_ack",
+		gqlConnectionRefreshAck: "connection_refresh_ack",
+		gqlConnectionKeepAlive:  "ping",
+		gqlData:                 "next",
+		gqlError:                "error",
+		gqlComplete:             "complete",
+		gqlPing:                 "ping",
+		gqlPong:                 "pong",
+	},
+	strict: true,
+}
+
+// protocolForSubprotocol returns the protocol for a negotiated
+// subprotocol, falling back to the legacy protocol.
+func protocolForSubprotocol(subprotocol string) *protocol {
+	if subprotocol == SubprotocolGraphQLTransportWS {
+		return graphqlTransportWSProtocol
+	}
+	return graphqlWSProtocol
+}
+
+// incomingType translates the type of a message received from the client.
+// Unknown message types are translated into an empty string.
+func (p *protocol) incomingType(messageType string) string {
+	if p.incoming == nil {
+		return messageType
+	}
+	return p.incoming[messageType]
+}
+
+// outgoingType translates an internal message type into the type of
+// the message sent to the client.
+func (p *protocol) outgoingType(messageType string) string {
+	if p.outgoing == nil {
+		return messageType
+	}
+	return p.outgoing[messageType]
+}
+
+// operationErrors converts operation errors into the payload of an
+// error message. The graphql-transport-ws protocol requires errors to be
+// GraphQL errors with at least a message, so they are always formatted;
+// errors sent over other protocols are only formatted if a formatter is
+// set. AppSync error payloads hold the errors in an errors field.
+func (p *protocol) operationErrors(errs []error, format ErrorFormatter) interface{} {
+	if p.appSync {
+		if format == nil {
+			format = DefaultErrorFormatter
+		}
+		return map[string]interface{}{"errors": formatErrors(errs, format)}
+	}
+	if format == nil {
+		if !p.strict {
+			return errs
+		}
+		format = DefaultErrorFormatter
+	}
+	return formatErrors(errs, format)
+}
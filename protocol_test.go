@@ -0,0 +1,257 @@
+package graphqlws_test
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/meandrewdev/graphqlws"
+)
+
+func startTransportWSServer(
+	manager graphqlws.SubscriptionManager,
+) *httptest.Server {
+	return httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: manager,
+		Subprotocols:        []string{graphqlws.SubprotocolGraphQLTransportWS},
+	}))
+}
+
+func writeMessage(t *testing.T, ws *websocket.Conn, msg map[string]interface{}) {
+	if err := ws.WriteJSON(msg); err != nil {
+		t.Fatalf("could not send message: %v", err)
+	}
+}
+
+func expectClose(t *testing.T, ws *websocket.Conn, code int) {
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := ws.ReadMessage()
+	if !websocket.IsCloseError(err, code) {
+		t.Fatalf("connection not closed with code %d: %v", code, err)
+	}
+}
+
+func TestProtocol_TransportWSSubscriptionLifecycle(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := startTransportWSServer(sm)
+	defer srv.Close()
+
+	ws := dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLTransportWS)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	if msg := readOperationMessage(t, ws); msg.Type != "connection_ack" {
+		t.Fatalf("expected connection_ack, received: %v", msg)
+	}
+
+	writeMessage(t, ws, map[string]interface{}{"type": "ping"})
+	if msg := readOperationMessage(t, ws); msg.Type != "pong" {
+		t.Fatalf("expected pong, received: %v", msg)
+	}
+
+	writeMessage(t, ws, map[string]interface{}{
+		"id":   "1",
+		"type": "subscribe",
+		"payload": map[string]interface{}{
+			"query": "subscription { " + subscriptionName + " { payload } }",
+		},
+	})
+	conn := waitForConnection(t, sm)
+
+	triggerSubscription(map[string]interface{}{"payload": "foo"}, schema, sm)
+	if msg := readOperationMessage(t, ws); msg.Type != "next" || msg.ID != "1" {
+		t.Fatalf("expected next, received: %v", msg)
+	}
+
+	conn.TrySendComplete("1")
+	if msg := readOperationMessage(t, ws); msg.Type != "complete" || msg.ID != "1" {
+		t.Fatalf("expected complete, received: %v", msg)
+	}
+}
+
+func TestProtocol_TransportWSClientCompleteStopsSubscriptions(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	srv := startTransportWSServer(sm)
+	defer srv.Close()
+
+	ws := dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLTransportWS)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	readOperationMessage(t, ws)
+
+	writeMessage(t, ws, map[string]interface{}{
+		"id":   "1",
+		"type": "subscribe",
+		"payload": map[string]interface{}{
+			"query": "subscription { " + subscriptionName + " { payload } }",
+		},
+	})
+	conn := waitForConnection(t, sm)
+
+	writeMessage(t, ws, map[string]interface{}{"id": "1", "type": "complete"})
+
+	// Ping to make sure the complete message has been processed
+	writeMessage(t, ws, map[string]interface{}{"type": "ping"})
+	readOperationMessage(t, ws)
+
+	if len(sm.Subscriptions()) != 0 {
+		t.Error("complete from the client doesn't remove the subscription")
+	}
+	if conn.TrySendComplete("1") {
+		t.Error("operation completed by the client is still active")
+	}
+}
+
+func TestProtocol_TransportWSOperationErrorsAreGraphQLErrors(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := startTransportWSServer(graphqlws.NewSubscriptionManager(schema))
+	defer srv.Close()
+
+	ws := dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLTransportWS)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	readOperationMessage(t, ws)
+
+	writeMessage(t, ws, map[string]interface{}{
+		"id":      "1",
+		"type":    "subscribe",
+		"payload": map[string]interface{}{"query": "subscription { unknown }"},
+	})
+
+	msg := readOperationMessage(t, ws)
+	errs, _ := msg.Payload.([]interface{})
+	if msg.Type != "error" || msg.ID != "1" || len(errs) == 0 {
+		t.Fatalf("expected error, received: %v", msg)
+	}
+	if err, _ := errs[0].(map[string]interface{}); err["message"] == "" {
+		t.Errorf("error has no message: %v", err)
+	}
+}
+
+func TestProtocol_TransportWSRejectsSubscribeBeforeInit(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := startTransportWSServer(graphqlws.NewSubscriptionManager(schema))
+	defer srv.Close()
+
+	ws := dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLTransportWS)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{
+		"id":      "1",
+		"type":    "subscribe",
+		"payload": map[string]interface{}{"query": "subscription { foo }"},
+	})
+	expectClose(t, ws, 4401)
+}
+
+func TestProtocol_TransportWSRejectsCompleteBeforeInit(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := startTransportWSServer(graphqlws.NewSubscriptionManager(schema))
+	defer srv.Close()
+
+	ws := dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLTransportWS)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{"id": "1", "type": "complete"})
+	expectClose(t, ws, 4401)
+}
+
+func TestProtocol_TransportWSRejectsRepeatedInit(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := startTransportWSServer(graphqlws.NewSubscriptionManager(schema))
+	defer srv.Close()
+
+	ws := dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLTransportWS)
+	defer ws.Close()
+
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	readOperationMessage(t, ws)
+
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	expectClose(t, ws, 4429)
+}
+
+func TestProtocol_HandlerNegotiatesSubprotocolsPerConnection(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := startServer(graphqlws.NewSubscriptionManager(schema))
+	defer srv.Close()
+
+	legacy := dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLWS)
+	defer legacy.Close()
+	modern := dialServerWithSubprotocol(t, srv, graphqlws.SubprotocolGraphQLTransportWS)
+	defer modern.Close()
+
+	if legacy.Subprotocol() != graphqlws.SubprotocolGraphQLWS ||
+		modern.Subprotocol() != graphqlws.SubprotocolGraphQLTransportWS {
+		t.Fatalf("unexpected subprotocols: %s, %s", legacy.Subprotocol(), modern.Subprotocol())
+	}
+
+	// Each connection uses the start message type of its protocol
+	startTypes := map[*websocket.Conn]string{
+		legacy: "start",
+		modern: "subscribe",
+	}
+
+	for ws, startType := range startTypes {
+		writeMessage(t, ws, map[string]interface{}{
+			"type":    "connection_init",
+			"payload": map[string]interface{}{},
+		})
+		if msg := readOperationMessage(t, ws); msg.Type != "connection_ack" {
+			t.Fatalf("expected connection_ack, received: %v", msg)
+		}
+		writeMessage(t, ws, map[string]interface{}{
+			"id":      "1",
+			"type":    startType,
+			"payload": map[string]interface{}{"query": "subscription { unknown }"},
+		})
+		if msg := readOperationMessage(t, ws); msg.Type != "error" || msg.ID != "1" {
+			t.Fatalf("expected error, received: %v", msg)
+		}
+	}
+
+	// Only the legacy protocol supports connection_terminate
+	writeMessage(t, modern, map[string]interface{}{"type": "connection_terminate"})
+	expectClose(t, modern, 4400)
+}
+
+func TestProtocol_HandlerRejectsUnknownSubprotocols(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := startServer(graphqlws.NewSubscriptionManager(schema))
+	defer srv.Close()
+
+	ws := dialServerWithSubprotocol(t, srv, "foo")
+	defer ws.Close()
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Fatal("connection with an unknown subprotocol is not closed")
+	}
+}
+
+func TestProtocol_StrictProtocolRejectsLegacyOperationsBeforeAckAndDuplicates(t *testing.T) {
+	schema, _ := buildSchema()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		StrictProtocol:      true,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+	startSubscription(t, ws, "1")
+	expectClose(t, ws, 4401)
+
+	ws = dialServer(t, srv)
+	defer ws.Close()
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	readOperationMessage(t, ws)
+	startSubscription(t, ws, "1")
+	startSubscription(t, ws, "1")
+	expectClose(t, ws, 4409)
+}
@@ -0,0 +1,398 @@
+package graphqlws
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+)
+
+// PubSub is a subscription manager that delivers events by topic. Each
+// subscription is subscribed to the topics returned by the configured
+// Topics function when it is added, and may be subscribed to further
+// topics at any time, e.g. by resolvers or event handlers. Subscriptions
+// are unsubscribed from all topics when they are removed.
+//
+// Topics may be hierarchical, with segments separated by dots. Subscriptions
+// may subscribe to patterns, in which "*" matches exactly one segment and
+// "#" matches any number of segments, e.g. "orders.*" matches
+// "orders.created" and "chat.room.#" matches "chat.room.1.messages".
+type PubSub interface {
+	SubscriptionManager
+
+	// Subscribe subscribes a subscription to a topic or topic pattern.
+	Subscribe(topic string, s *Subscription)
+
+	// Unsubscribe unsubscribes a subscription from a topic or topic
+	// pattern.
+	Unsubscribe(topic string, s *Subscription)
+
+	// Publish executes all subscriptions to a topic or to patterns matching
+	// it, with payload as the source value of their top-level resolvers,
+	// and sends the results to the subscribers. Subscriptions matching
+	// several times receive the event once. It returns the number of
+	// subscriptions that data was sent to.
+	Publish(ctx context.Context, topic string, payload interface{}) int
+}
+
+// PubSubConfig defines the configuration of a PubSub.
+type PubSubConfig struct {
+	// Schema validates and executes subscriptions.
+	Schema *graphql.Schema
+
+	// Topics returns the topics a subscription is subscribed to when it is
+	// added; defaults to the names of its top-level fields.
+	Topics func(*Subscription) []string
+
+	// Journal persists the events published to each topic (optional), so
+	// that subscribers can replay the events they missed while they were
+	// disconnected. Data messages of journaled events have the topic and
+	// sequence number of the event in the journal extension, e.g.
+	// {"journal": {"topic": "orders.1", "sequence": 42}}. Clients that
+	// subscribe again pass the last sequence number they received by
+	// topic in the replay extension of the start message, e.g.
+	// {"replay": {"orders.1": 42}}, and receive the events after it, which
+	// are still kept, before any new events; the first replayed event has
+	// "gap": true if some weren't. Only topics the subscription is
+	// subscribed to when it is added are replayed, with the payloads of
+	// their events decoded from JSON into generic values such as
+	// map[string]interface{}.
+	Journal Journal
+}
+
+// subscriptionKey identifies a subscription of a connection.
+type subscriptionKey struct {
+	conn Connection
+	id   string
+}
+
+/**
+ * The default implementation of the PubSub interface.
+ */
+
+type pubSub struct {
+	*subscriptionManager
+
+	topicsFunc func(*Subscription) []string
+	journal    Journal
+
+	// Subscribers by topic, topics by subscriber, the patterns among the
+	// subscribed topics and the journal cursors of subscribers, guarded by
+	// topicsMutex
+	subscribers map[string]map[subscriptionKey]*Subscription
+	topics      map[subscriptionKey]map[string]bool
+	patterns    map[string]bool
+	cursors     map[subscriptionKey]*journalCursor
+	topicsMutex *sync.RWMutex
+}
+
+// NewPubSub creates a new topic-based subscription manager.
+func NewPubSub(config PubSubConfig) PubSub {
+	return newPubSub(config, NewLogger("pubsub"))
+}
+
+func newPubSub(config PubSubConfig, logger Logger) *pubSub {
+	topics := config.Topics
+	if topics == nil {
+		topics = func(s *Subscription) []string {
+			return s.Fields
+		}
+	}
+
+	return &pubSub{
+		subscriptionManager: newSubscriptionManager(config.Schema, logger),
+		topicsFunc:          topics,
+		journal:             config.Journal,
+		subscribers:         make(map[string]map[subscriptionKey]*Subscription),
+		topics:              make(map[subscriptionKey]map[string]bool),
+		patterns:            make(map[string]bool),
+		cursors:             make(map[subscriptionKey]*journalCursor),
+		topicsMutex:         &sync.RWMutex{},
+	}
+}
+
+func (p *pubSub) AddSubscription(conn Connection, subscription *Subscription) []error {
+	if errs := p.subscriptionManager.AddSubscription(conn, subscription); len(errs) > 0 {
+		return errs
+	}
+	if p.journal == nil {
+		for _, topic := range p.topicsFunc(subscription) {
+			p.Subscribe(topic, subscription)
+		}
+		return nil
+	}
+
+	// Live events wait for the cursor until the missed events have been
+	// replayed
+	cursor := newJournalCursor()
+	cursor.mutex.Lock()
+	defer cursor.mutex.Unlock()
+
+	p.topicsMutex.Lock()
+	p.cursors[subscriptionKey{conn, subscription.ID}] = cursor
+	p.topicsMutex.Unlock()
+
+	for _, topic := range p.topicsFunc(subscription) {
+		p.Subscribe(topic, subscription)
+	}
+	p.replay(subscription, cursor)
+	return nil
+}
+
+func (p *pubSub) RemoveSubscription(conn Connection, subscription *Subscription) {
+	p.unsubscribeAll(subscriptionKey{conn, subscription.ID})
+	p.subscriptionManager.RemoveSubscription(conn, subscription)
+}
+
+func (p *pubSub) RemoveSubscriptions(conn Connection) {
+	for opID := range p.subscriptionManager.connectionSubscriptions(conn) {
+		p.unsubscribeAll(subscriptionKey{conn, opID})
+	}
+	p.subscriptionManager.RemoveSubscriptions(conn)
+}
+
+func (p *pubSub) Subscribe(topic string, s *Subscription) {
+	key := subscriptionKey{s.Connection, s.ID}
+
+	p.topicsMutex.Lock()
+	defer p.topicsMutex.Unlock()
+
+	if p.subscribers[topic] == nil {
+		p.subscribers[topic] = make(map[subscriptionKey]*Subscription)
+		if isTopicPattern(topic) {
+			p.patterns[topic] = true
+		}
+	}
+	p.subscribers[topic][key] = s
+
+	if p.topics[key] == nil {
+		p.topics[key] = make(map[string]bool)
+	}
+	p.topics[key][topic] = true
+}
+
+func (p *pubSub) Unsubscribe(topic string, s *Subscription) {
+	key := subscriptionKey{s.Connection, s.ID}
+
+	p.topicsMutex.Lock()
+	defer p.topicsMutex.Unlock()
+
+	p.unsubscribe(topic, key)
+}
+
+// unsubscribe removes a subscription from a topic; topicsMutex must be
+// held by the caller.
+func (p *pubSub) unsubscribe(topic string, key subscriptionKey) {
+	delete(p.subscribers[topic], key)
+	if len(p.subscribers[topic]) == 0 {
+		delete(p.subscribers, topic)
+		delete(p.patterns, topic)
+	}
+
+	delete(p.topics[key], topic)
+	if len(p.topics[key]) == 0 {
+		delete(p.topics, key)
+	}
+}
+
+// unsubscribeAll removes a subscription from all of its topics.
+func (p *pubSub) unsubscribeAll(key subscriptionKey) {
+	p.topicsMutex.Lock()
+	defer p.topicsMutex.Unlock()
+
+	for topic := range p.topics[key] {
+		p.unsubscribe(topic, key)
+	}
+	delete(p.cursors, key)
+}
+
+func (p *pubSub) Publish(ctx context.Context, topic string, payload interface{}) int {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	subscriptions := p.matchingSubscriptions(topic)
+	p.logger.WithFields(Fields{
+		"topic":         topic,
+		"subscriptions": len(subscriptions),
+	}).Debug("Publish event")
+
+	return executeSubscriptions(ctx, p.schema, subscriptions, payload, p.journalEvent(ctx, topic, payload))
+}
+
+// matchingSubscriptions returns the subscriptions to a topic or to
+// patterns matching it, each of them once.
+func (p *pubSub) matchingSubscriptions(topic string) []*Subscription {
+	p.topicsMutex.RLock()
+	matches := make(map[subscriptionKey]*Subscription, len(p.subscribers[topic]))
+	for key, subscription := range p.subscribers[topic] {
+		matches[key] = subscription
+	}
+	for pattern := range p.patterns {
+		if matchTopic(pattern, topic) {
+			for key, subscription := range p.subscribers[pattern] {
+				matches[key] = subscription
+			}
+		}
+	}
+	p.topicsMutex.RUnlock()
+
+	subscriptions := make([]*Subscription, 0, len(matches))
+	for _, subscription := range matches {
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions
+}
+
+/**
+ * Journaling events.
+ */
+
+// journalEvent appends an event to the journal, if there is one, and
+// returns the function sending its results. Events that can't be
+// journaled are sent without a sequence number.
+func (p *pubSub) journalEvent(ctx context.Context, topic string, payload interface{}) func(*Subscription, *DataMessagePayload) bool {
+	if p.journal == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(payload)
+	var sequence uint64
+	if err == nil {
+		sequence, err = p.journal.Append(ctx, topic, data)
+	}
+	if err != nil {
+		p.logger.WithFields(Fields{
+			"topic": topic,
+			"err":   err,
+		}).Warn("Failed to journal event")
+		return nil
+	}
+
+	return func(s *Subscription, data *DataMessagePayload) bool {
+		p.topicsMutex.RLock()
+		cursor := p.cursors[subscriptionKey{s.Connection, s.ID}]
+		p.topicsMutex.RUnlock()
+
+		if cursor != nil {
+			cursor.mutex.Lock()
+			defer cursor.mutex.Unlock()
+			if sequence <= cursor.replayed[topic] {
+				return false
+			}
+		}
+		sendJournaled(s, topic, sequence, false, data)
+		return true
+	}
+}
+
+// replay sends the journaled events after the replay cursors of a
+// subscription; the caller holds the subscription's journal cursor.
+func (p *pubSub) replay(s *Subscription, cursor *journalCursor) {
+	ctx := s.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	topics := make([]string, 0, len(s.ReplayCursors))
+	for topic := range s.ReplayCursors {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	for _, topic := range topics {
+		after := s.ReplayCursors[topic]
+		if !p.subscribed(s, topic) {
+			p.logger.WithFields(Fields{
+				"topic": topic,
+				"op":    s.ID,
+			}).Debug("Not replaying events of topic that isn't subscribed to")
+			continue
+		}
+
+		entries, err := p.journal.Read(ctx, topic, after)
+		if err != nil {
+			p.logger.WithFields(Fields{
+				"topic": topic,
+				"err":   err,
+			}).Warn("Failed to read journal")
+			continue
+		}
+
+		p.logger.WithFields(Fields{
+			"topic":  topic,
+			"op":     s.ID,
+			"events": len(entries),
+		}).Debug("Replay events")
+
+		gap := len(entries) > 0 && entries[0].Sequence > after+1
+		for _, entry := range entries {
+			cursor.replayed[topic] = entry.Sequence
+
+			var payload interface{}
+			if err := json.Unmarshal(entry.Payload, &payload); err != nil || !s.Accepts(payload) {
+				continue
+			}
+			sendJournaled(s, topic, entry.Sequence, gap, ExecuteSubscription(ctx, p.schema, s, payload))
+			gap = false
+		}
+	}
+}
+
+// subscribed reports whether a subscription is subscribed to a topic or
+// to a pattern matching it.
+func (p *pubSub) subscribed(s *Subscription, topic string) bool {
+	p.topicsMutex.RLock()
+	defer p.topicsMutex.RUnlock()
+
+	for subscribed := range p.topics[subscriptionKey{s.Connection, s.ID}] {
+		if subscribed == topic || (isTopicPattern(subscribed) && matchTopic(subscribed, topic)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTopicPattern reports whether a topic contains wildcard segments.
+func isTopicPattern(topic string) bool {
+	for _, segment := range strings.Split(topic, ".") {
+		if segment == "*" || segment == "#" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTopic reports whether a topic matches a topic pattern.
+func matchTopic(pattern string, topic string) bool {
+	return matchTopicSegments(strings.Split(pattern, "."), strings.Split(topic, "."))
+}
+
+func matchTopicSegments(pattern []string, topic []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case "#":
+			// Try to match the rest of the pattern after skipping any
+			// number of segments
+			for i := 0; i <= len(topic); i++ {
+				if matchTopicSegments(pattern[1:], topic[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(topic) == 0 {
+				return false
+			}
+		default:
+			if len(topic) == 0 || pattern[0] != topic[0] {
+				return false
+			}
+		}
+		pattern, topic = pattern[1:], topic[1:]
+	}
+	return len(topic) == 0
+}
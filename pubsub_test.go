@@ -0,0 +1,130 @@
+package graphqlws_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+	"github.com/meandrewdev/graphqlws"
+)
+
+func buildPubSubSchema() *graphql.Schema {
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"hello": &graphql.Field{Type: graphql.String},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"message": &graphql.Field{
+					Type: graphql.String,
+					Args: graphql.FieldConfigArgument{
+						"room": &graphql.ArgumentConfig{Type: graphql.String},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source, nil
+					},
+				},
+			},
+		})})
+	return &schema
+}
+
+func addMessageSubscription(
+	t *testing.T,
+	ps graphqlws.PubSub,
+	conn graphqlws.Connection,
+	room string,
+	received map[string][]interface{},
+) *graphqlws.Subscription {
+	subscription := &graphqlws.Subscription{
+		ID:         "1",
+		Connection: conn,
+		Query:      "subscription($room: String) { message(room: $room) }",
+		Variables:  map[string]interface{}{"room": room},
+		SendData: func(msg *graphqlws.DataMessagePayload) {
+			data, _ := msg.Data.(map[string]interface{})
+			received[conn.ID()] = append(received[conn.ID()], data["message"])
+		},
+	}
+	if errs := ps.AddSubscription(conn, subscription); len(errs) > 0 {
+		t.Fatalf("AddSubscription fails: %v", errs)
+	}
+	return subscription
+}
+
+func TestPubSub_SubscriptionsReceiveEventsOfTheirTopics(t *testing.T) {
+	ps := graphqlws.NewPubSub(graphqlws.PubSubConfig{
+		Schema: buildPubSubSchema(),
+		Topics: func(s *graphqlws.Subscription) []string {
+			return []string{"rooms." + s.Variables["room"].(string)}
+		},
+	})
+
+	received := map[string][]interface{}{}
+	addMessageSubscription(t, ps, &mockWebSocketConnection{id: "1"}, "general", received)
+	addMessageSubscription(t, ps, &mockWebSocketConnection{id: "2"}, "random", received)
+
+	if sent := ps.Publish(context.Background(), "rooms.general", "hello"); sent != 1 {
+		t.Errorf("Publish sends data to %d subscriptions", sent)
+	}
+	if len(received) != 1 || len(received["1"]) != 1 || received["1"][0] != "hello" {
+		t.Errorf("Publish doesn't deliver events by topic: %v", received)
+	}
+}
+
+func TestPubSub_SubscriptionsCanBeSubscribedToTopics(t *testing.T) {
+	ps := graphqlws.NewPubSub(graphqlws.PubSubConfig{Schema: buildPubSubSchema()})
+
+	conn := &mockWebSocketConnection{id: "1"}
+	received := map[string][]interface{}{}
+	subscription := addMessageSubscription(t, ps, conn, "general", received)
+
+	// Subscriptions are subscribed to their fields by default
+	ps.Subscribe("announcements", subscription)
+	ps.Publish(context.Background(), "message", "hello")
+	ps.Publish(context.Background(), "announcements", "maintenance")
+
+	ps.Unsubscribe("announcements", subscription)
+	ps.Publish(context.Background(), "announcements", "ignored")
+
+	if len(received["1"]) != 2 || received["1"][0] != "hello" || received["1"][1] != "maintenance" {
+		t.Errorf("unexpected events: %v", received)
+	}
+
+	// Removed subscriptions are unsubscribed from all topics
+	ps.Subscribe("announcements", subscription)
+	ps.RemoveSubscription(conn, &graphqlws.Subscription{ID: "1"})
+	if sent := ps.Publish(context.Background(), "announcements", "bye"); sent != 0 {
+		t.Errorf("removed subscription still receives events")
+	}
+}
+
+func TestPubSub_SubscriptionsCanBeSubscribedToPatterns(t *testing.T) {
+	ps := graphqlws.NewPubSub(graphqlws.PubSubConfig{
+		Schema: buildPubSubSchema(),
+		Topics: func(s *graphqlws.Subscription) []string {
+			return []string{"orders.*", "orders.created", "chat.room.#"}
+		},
+	})
+
+	received := map[string][]interface{}{}
+	addMessageSubscription(t, ps, &mockWebSocketConnection{id: "1"}, "general", received)
+
+	for topic, expected := range map[string]int{
+		"orders.created":       1,
+		"orders.shipped":       1,
+		"orders.created.eu":    0,
+		"orders":               0,
+		"chat.room":            1,
+		"chat.room.1.messages": 1,
+		"chat.rooms":           0,
+	} {
+		if sent := ps.Publish(context.Background(), topic, topic); sent != expected {
+			t.Errorf("Publish to %q sends data to %d subscriptions, expected %d", topic, sent, expected)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package graphqlws
+
+import (
+	"sync"
+	"time"
+)
+
+// OverflowPolicy decides what happens to data messages sent to a client
+// whose send queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes senders wait until there is room in the queue.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropOldest drops the oldest queued data message to make
+	// room for the new one.
+	OverflowDropOldest
+
+	// OverflowDropNewest drops the new data message.
+	OverflowDropNewest
+
+	// OverflowClose closes the connection with close code 1008 (policy
+	// violation).
+	OverflowClose
+)
+
+// Default size of the send queues of connections
+const sendQueueSize = 16
+
+/**
+ * The queue of the messages waiting to be written to a client.
+ */
+
+type sendQueue struct {
+	messages []queuedMessage
+	size     int
+	dataType string
+	closed   bool
+	mutex    *sync.Mutex
+
+	// The times since which the queue has been non-empty and has held
+	// more than slowBacklog messages, or zero
+	backlogSince time.Time
+	slowBacklog  int
+	slowSince    time.Time
+
+	// Signalled when messages have been queued or the queue was closed,
+	// and when messages have been taken from the queue
+	ready chan struct{}
+	space chan struct{}
+}
+
+// queuedMessage is a message or, if frame is set, a close frame.
+type queuedMessage struct {
+	msg   OperationMessage
+	frame *closeFrame
+}
+
+// newSendQueue creates a queue of up to size messages; dataType is the
+// outgoing type of data messages, the only ones that may be dropped.
+// Queues with more than slowBacklog messages (if positive) belong to
+// slow clients.
+func newSendQueue(size int, dataType string, slowBacklog int) *sendQueue {
+	if size <= 0 {
+		size = sendQueueSize
+	}
+	return &sendQueue{
+		size:        size,
+		dataType:    dataType,
+		slowBacklog: slowBacklog,
+		mutex:       &sync.Mutex{},
+		ready:       make(chan struct{}, 1),
+		space:       make(chan struct{}, 1),
+	}
+}
+
+// updateBacklog updates the times since which the queue has had a
+// backlog; q.mutex must be held by the caller.
+func (q *sendQueue) updateBacklog() {
+	n := len(q.messages)
+	if n == 0 {
+		q.backlogSince = time.Time{}
+	} else if q.backlogSince.IsZero() {
+		q.backlogSince = time.Now()
+	}
+	if q.slowBacklog <= 0 || n <= q.slowBacklog {
+		q.slowSince = time.Time{}
+	} else if q.slowSince.IsZero() {
+		q.slowSince = time.Now()
+	}
+}
+
+// backlog returns the number of queued messages and the time since which
+// the queue hasn't been empty.
+func (q *sendQueue) backlog() (int, time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.messages), q.backlogSince
+}
+
+// slowFor returns how long the queue has held more than the slow backlog.
+func (q *sendQueue) slowFor() time.Duration {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.slowSince.IsZero() {
+		return 0
+	}
+	return time.Since(q.slowSince)
+}
+
+// pushResult is the outcome of queueing a message.
+type pushResult int
+
+const (
+	pushQueued pushResult = iota
+	pushDropped
+	pushFull
+	pushOverflow
+	pushClosed
+)
+
+// push queues a message according to an overflow policy. Under
+// OverflowBlock, messages that don't fit are left to the caller to push
+// again once there is room.
+func (q *sendQueue) push(msg OperationMessage, policy OverflowPolicy) pushResult {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return pushClosed
+	}
+
+	// Messages other than data messages are never dropped and never close
+	// the connection; they may exceed the size of the queue unless senders
+	// wait for room
+	if len(q.messages) >= q.size {
+		switch {
+		case policy == OverflowBlock:
+			return pushFull
+		case msg.Type != q.dataType:
+		case policy == OverflowClose:
+			return pushOverflow
+		case policy == OverflowDropNewest:
+			return pushDropped
+		case policy == OverflowDropOldest:
+			if !q.dropOldestData() {
+				return pushDropped
+			}
+		}
+	}
+
+	q.messages = append(q.messages, queuedMessage{msg: msg})
+	q.updateBacklog()
+	signal(q.ready)
+	return pushQueued
+}
+
+// pushClose queues a close frame, which is never dropped.
+func (q *sendQueue) pushClose(frame closeFrame) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if !q.closed {
+		q.messages = append(q.messages, queuedMessage{frame: &frame})
+		q.updateBacklog()
+		signal(q.ready)
+	}
+}
+
+// dropOldestData removes the oldest queued data message, if any.
+func (q *sendQueue) dropOldestData() bool {
+	for i, queued := range q.messages {
+		if q.isData(queued) {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// pop takes the oldest message from the queue; ok is false if the queue
+// is empty or closed.
+func (q *sendQueue) pop() (queued queuedMessage, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed || len(q.messages) == 0 {
+		return queuedMessage{}, false
+	}
+	queued = q.messages[0]
+	q.messages[0] = queuedMessage{}
+	q.messages = q.messages[1:]
+	q.updateBacklog()
+	signal(q.space)
+	return queued, true
+}
+
+// popData takes up to max consecutive data messages from the front of
+// the queue.
+func (q *sendQueue) popData(max int) []OperationMessage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	n := 0
+	for n < max && n < len(q.messages) && q.isData(q.messages[n]) {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	batch := make([]OperationMessage, n)
+	for i := range batch {
+		batch[i] = q.messages[i].msg
+		q.messages[i] = queuedMessage{}
+	}
+	q.messages = q.messages[n:]
+	q.updateBacklog()
+	signal(q.space)
+	return batch
+}
+
+// nextIsData reports whether the oldest queued message is a data message.
+func (q *sendQueue) nextIsData() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.messages) > 0 && q.isData(q.messages[0])
+}
+
+func (q *sendQueue) isData(queued queuedMessage) bool {
+	return queued.frame == nil && queued.msg.Type == q.dataType
+}
+
+// close discards the queued messages and makes the queue reject new ones.
+func (q *sendQueue) close() {
+	q.mutex.Lock()
+	q.closed = true
+	q.messages = nil
+	q.updateBacklog()
+	q.mutex.Unlock()
+	signal(q.ready)
+}
+
+// pending reports whether messages are queued or the queue was closed.
+func (q *sendQueue) pending() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.closed || len(q.messages) > 0
+}
+
+func (q *sendQueue) isClosed() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.closed
+}
+
+// signal notifies the receiver of a channel with a buffer of one without
+// blocking.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,201 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/meandrewdev/graphqlws"
+)
+
+// Default prefix of the keys and channels of cluster registries
+const defaultClusterPrefix = "graphqlws:cluster:"
+
+// ClusterRegistryConfig configures a Redis cluster registry.
+type ClusterRegistryConfig struct {
+	// Prefix is prepended to the keys mapping connections and users to
+	// instances and to the channels of instances; defaults to
+	// "graphqlws:cluster:".
+	Prefix string
+}
+
+// ClusterRegistry is a cluster registry kept in Redis, which routes
+// messages to instances over Redis Pub/Sub.
+type ClusterRegistry interface {
+	graphqlws.ClusterRegistry
+
+	// Close unsubscribes from the channels of instances.
+	Close() error
+}
+
+// routedEvent is the message format of routed messages on the channels of
+// instances.
+type routedEvent struct {
+	ConnectionIDs []string                   `json:"connectionIds"`
+	Data          interface{}                `json:"data"`
+	Errors        []gqlerrors.FormattedError `json:"errors,omitempty"`
+	Extensions    map[string]interface{}     `json:"extensions,omitempty"`
+}
+
+/**
+ * The Redis implementation of the graphqlws.ClusterRegistry interface.
+ */
+
+type clusterRegistry struct {
+	client goredis.UniversalClient
+	prefix string
+	logger graphqlws.Logger
+
+	// Subscriptions to the channels of instances, guarded by mutex
+	pubsubs []*goredis.PubSub
+	mutex   *sync.Mutex
+}
+
+// NewClusterRegistry creates a cluster registry that maps connections and
+// users to instances in Redis keys, e.g. for HandlerConfig.Cluster. The
+// registrations of instances that crash aren't removed; messages routed
+// to them are dropped.
+func NewClusterRegistry(client goredis.UniversalClient, config ClusterRegistryConfig) ClusterRegistry {
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = defaultClusterPrefix
+	}
+	return &clusterRegistry{
+		client: client,
+		prefix: prefix,
+		logger: graphqlws.NewLogger("redis"),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+func (r *clusterRegistry) connectionKey(id string) string {
+	return r.prefix + "conn:" + id
+}
+
+func (r *clusterRegistry) userKey(user string) string {
+	return r.prefix + "user:" + user
+}
+
+func (r *clusterRegistry) nodeChannel(node string) string {
+	return r.prefix + "node:" + node
+}
+
+func (r *clusterRegistry) Register(ctx context.Context, conn graphqlws.ClusterConnection) error {
+	pipe := r.client.TxPipeline()
+	pipe.Set(ctx, r.connectionKey(conn.ID), conn.Node, 0)
+	if conn.User != "" {
+		pipe.HSet(ctx, r.userKey(conn.User), conn.ID, conn.Node)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *clusterRegistry) Unregister(ctx context.Context, conn graphqlws.ClusterConnection) error {
+	pipe := r.client.TxPipeline()
+	pipe.Del(ctx, r.connectionKey(conn.ID))
+	if conn.User != "" {
+		pipe.HDel(ctx, r.userKey(conn.User), conn.ID)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *clusterRegistry) Route(ctx context.Context, msg graphqlws.RoutedMessage) error {
+	// Group the connections of the message by instance
+	nodes := make(map[string][]string)
+	if msg.User != "" {
+		connections, err := r.client.HGetAll(ctx, r.userKey(msg.User)).Result()
+		if err != nil {
+			return err
+		}
+		for id, node := range connections {
+			nodes[node] = append(nodes[node], id)
+		}
+	}
+	if len(msg.ConnectionIDs) > 0 {
+		keys := make([]string, len(msg.ConnectionIDs))
+		for i, id := range msg.ConnectionIDs {
+			keys[i] = r.connectionKey(id)
+		}
+		values, err := r.client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, value := range values {
+			if node, ok := value.(string); ok {
+				nodes[node] = append(nodes[node], msg.ConnectionIDs[i])
+			}
+		}
+	}
+
+	e := routedEvent{}
+	if msg.Payload != nil {
+		e.Data = msg.Payload.Data
+		e.Extensions = msg.Payload.Extensions
+		for _, err := range msg.Payload.Errors {
+			e.Errors = append(e.Errors, graphqlws.DefaultErrorFormatter(err))
+		}
+	}
+	for node, ids := range nodes {
+		e.ConnectionIDs = ids
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err := r.client.Publish(ctx, r.nodeChannel(node), data).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Receive subscribes to the channel of an instance and returns once it has
+// been subscribed to; the Redis client resubscribes automatically after
+// reconnecting.
+func (r *clusterRegistry) Receive(node string, deliver func(graphqlws.RoutedMessage)) {
+	ctx := context.Background()
+	pubsub := r.client.Subscribe(ctx, r.nodeChannel(node))
+	if _, err := pubsub.Receive(ctx); err != nil {
+		r.logger.WithFields(graphqlws.Fields{
+			"node": node,
+			"err":  err,
+		}).Warn("Failed to subscribe to instance channel")
+	}
+	r.mutex.Lock()
+	r.pubsubs = append(r.pubsubs, pubsub)
+	r.mutex.Unlock()
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			var e routedEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+				r.logger.WithFields(graphqlws.Fields{
+					"channel": msg.Channel,
+					"err":     err,
+				}).Warn("Failed to decode routed message")
+				continue
+			}
+
+			payload := &graphqlws.DataMessagePayload{Data: e.Data, Extensions: e.Extensions}
+			for _, err := range e.Errors {
+				payload.Errors = append(payload.Errors, err)
+			}
+			deliver(graphqlws.RoutedMessage{ConnectionIDs: e.ConnectionIDs, Payload: payload})
+		}
+	}()
+}
+
+func (r *clusterRegistry) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var err error
+	for _, pubsub := range r.pubsubs {
+		if closeErr := pubsub.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package redis_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/redis"
+)
+
+func newClusterHandler(t *testing.T, addr string, node string) *graphqlws.Handler {
+	client := goredis.NewClient(&goredis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+
+	registry := redis.NewClusterRegistry(client, redis.ClusterRegistryConfig{})
+	t.Cleanup(func() { registry.Close() })
+
+	return graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildSchema(t)),
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+		Cluster: &graphqlws.ClusterConfig{Registry: registry, Node: node},
+	})
+}
+
+func TestClusterRegistry_MessagesAreRoutedToTheInstancesOfUsers(t *testing.T) {
+	server := miniredis.RunT(t)
+	sender := newClusterHandler(t, server.Addr(), "sender")
+	holder := newClusterHandler(t, server.Addr(), "holder")
+
+	srv := httptest.NewServer(holder)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Sec-WebSocket-Protocol": {graphqlws.SubprotocolGraphQLWS}})
+	if err != nil {
+		t.Fatalf("could not connect to websocket server: %v", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	ws.WriteJSON(map[string]interface{}{"type": "connection_init", "payload": map[string]interface{}{"authToken": "ada"}})
+	ws.WriteJSON(map[string]interface{}{
+		"id":      "1",
+		"type":    "start",
+		"payload": map[string]interface{}{"query": "subscription { message { text } }"},
+	})
+	msg := graphqlws.OperationMessage{}
+	if err := ws.ReadJSON(&msg); err != nil || msg.Type != "connection_ack" {
+		t.Fatalf("expected connection_ack, received: %v (%v)", msg, err)
+	}
+
+	// Routing races with starting the subscription
+	deadline := time.Now().Add(2 * time.Second)
+	received := make(chan graphqlws.OperationMessage, 1)
+	go func() {
+		msg := graphqlws.OperationMessage{}
+		if err := ws.ReadJSON(&msg); err == nil {
+			received <- msg
+		}
+	}()
+	for {
+		err := sender.RouteToUser(context.Background(), "ada", &graphqlws.DataMessagePayload{Data: "hello"})
+		if err != nil {
+			t.Fatalf("could not route message: %v", err)
+		}
+		select {
+		case msg := <-received:
+			if msg.Type != "data" || msg.ID != "1" {
+				t.Errorf("unexpected message: %v", msg)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("routed message not received")
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/meandrewdev/graphqlws"
+)
+
+const (
+	// Default prefix of the keys of journal streams
+	defaultJournalPrefix = "graphqlws:journal:"
+
+	// Default number of events kept per topic
+	defaultJournalMaxLen = 1000
+)
+
+// appendScript increments the sequence number of a topic and adds the
+// event to the topic's stream with the ID 0-<sequence>, atomically so
+// that stream IDs are added in order.
+var appendScript = goredis.NewScript(`
+local sequence = redis.call("INCR", KEYS[2])
+redis.call("XADD", KEYS[1], "MAXLEN", "~", ARGV[3], "0-" .. sequence, "payload", ARGV[1], "time", ARGV[2])
+return sequence
+`)
+
+// JournalConfig configures a Redis Streams journal.
+type JournalConfig struct {
+	// Prefix is prepended to the topics to form the keys of their streams
+	// and sequence counters; defaults to "graphqlws:journal:".
+	Prefix string
+
+	// MaxLen is the approximate number of events kept per topic; defaults
+	// to 1000.
+	MaxLen int64
+}
+
+/**
+ * The Redis Streams implementation of the graphqlws.Journal interface.
+ */
+
+type journal struct {
+	client goredis.UniversalClient
+	prefix string
+	maxLen int64
+}
+
+// NewJournal creates a journal that persists the events of each topic in
+// a Redis stream, so that all server instances replay the same events.
+// The sequence numbers of events are the sequence parts of their stream
+// IDs, 0-1, 0-2 and so on.
+func NewJournal(client goredis.UniversalClient, config JournalConfig) graphqlws.Journal {
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = defaultJournalPrefix
+	}
+	maxLen := config.MaxLen
+	if maxLen <= 0 {
+		maxLen = defaultJournalMaxLen
+	}
+	return &journal{client: client, prefix: prefix, maxLen: maxLen}
+}
+
+func (j *journal) Append(ctx context.Context, topic string, payload json.RawMessage) (uint64, error) {
+	keys := []string{j.prefix + topic, j.prefix + topic + ":sequence"}
+	now := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	sequence, err := appendScript.Run(ctx, j.client, keys, string(payload), now, j.maxLen).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(sequence), nil
+}
+
+func (j *journal) Read(ctx context.Context, topic string, after uint64) ([]graphqlws.JournalEntry, error) {
+	start := "0-" + strconv.FormatUint(after+1, 10)
+	messages, err := j.client.XRange(ctx, j.prefix+topic, start, "+").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]graphqlws.JournalEntry, 0, len(messages))
+	for _, msg := range messages {
+		sequence, err := strconv.ParseUint(strings.TrimPrefix(msg.ID, "0-"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		payload, _ := msg.Values["payload"].(string)
+		timestamp, _ := msg.Values["time"].(string)
+		millis, _ := strconv.ParseInt(timestamp, 10, 64)
+		entries = append(entries, graphqlws.JournalEntry{
+			Topic:    topic,
+			Sequence: sequence,
+			Payload:  json.RawMessage(payload),
+			Time:     time.Unix(0, millis*int64(time.Millisecond)),
+		})
+	}
+	return entries, nil
+}
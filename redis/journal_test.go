@@ -0,0 +1,48 @@
+package redis_test
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/meandrewdev/graphqlws/redis"
+)
+
+func TestJournal_EventsAreReadAfterCursors(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := goredis.NewClient(&goredis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	journal := redis.NewJournal(client, redis.JournalConfig{})
+	ctx := context.Background()
+	for i := 1; i <= 3; i++ {
+		sequence, err := journal.Append(ctx, "orders", json.RawMessage(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("could not append event: %v", err)
+		}
+		if sequence != uint64(i) {
+			t.Errorf("expected sequence number %d, got %d", i, sequence)
+		}
+	}
+	journal.Append(ctx, "invoices", json.RawMessage(`"other"`))
+
+	entries, err := journal.Read(ctx, "orders", 1)
+	if err != nil {
+		t.Fatalf("could not read journal: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	for i, entry := range entries {
+		if entry.Topic != "orders" || entry.Sequence != uint64(i+2) || string(entry.Payload) != strconv.Itoa(i+2) || entry.Time.IsZero() {
+			t.Errorf("unexpected entry: %+v", entry)
+		}
+	}
+
+	if entries, _ := journal.Read(ctx, "orders", 3); len(entries) != 0 {
+		t.Errorf("unexpected entries after the last event: %v", entries)
+	}
+}
@@ -0,0 +1,115 @@
+// Package redis distributes subscription events through Redis Pub/Sub,
+// so that events published on any server instance reach the subscribers
+// connected to all of them, journals events in Redis Streams for
+// subscribers to replay and keeps a cluster registry routing messages to
+// the instances holding connections.
+package redis
+
+import (
+	"context"
+	"encoding/json"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/graphql-go/graphql"
+	"github.com/meandrewdev/graphqlws"
+)
+
+// SubscriptionManager is a subscription manager whose events are
+// published on a Redis channel. Every instance subscribed to the channel
+// executes the subscriptions of its own connections for each event.
+type SubscriptionManager interface {
+	graphqlws.SubscriptionManager
+
+	// Publish publishes an event for the subscriptions to the given field
+	// on the Redis channel. The payload is encoded as JSON and becomes the
+	// source value of the field's resolver, decoded into generic values
+	// such as map[string]interface{}.
+	Publish(ctx context.Context, field string, payload interface{}) error
+
+	// Close unsubscribes from the Redis channel.
+	Close() error
+}
+
+// event is the message format of events on the Redis channel.
+type event struct {
+	Field   string          `json:"field"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+/**
+ * The Redis Pub/Sub implementation of the SubscriptionManager interface.
+ */
+
+type subscriptionManager struct {
+	graphqlws.PublishingSubscriptionManager
+
+	client  goredis.UniversalClient
+	channel string
+	pubsub  *goredis.PubSub
+	logger  graphqlws.Logger
+}
+
+// NewSubscriptionManager creates a subscription manager that validates
+// and executes subscriptions against schema and receives events from the
+// given Redis channel. It returns once the channel has been subscribed
+// to; the Redis client resubscribes automatically after reconnecting.
+func NewSubscriptionManager(
+	ctx context.Context,
+	schema *graphql.Schema,
+	client goredis.UniversalClient,
+	channel string,
+) (SubscriptionManager, error) {
+	pubsub := client.Subscribe(ctx, channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	m := &subscriptionManager{
+		PublishingSubscriptionManager: graphqlws.NewPublishingSubscriptionManager(schema),
+		client:                        client,
+		channel:                       channel,
+		pubsub:                        pubsub,
+		logger:                        graphqlws.NewLogger("redis"),
+	}
+	go m.receive()
+	return m, nil
+}
+
+func (m *subscriptionManager) Publish(ctx context.Context, field string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(event{Field: field, Payload: data})
+	if err != nil {
+		return err
+	}
+	return m.client.Publish(ctx, m.channel, msg).Err()
+}
+
+func (m *subscriptionManager) Close() error {
+	return m.pubsub.Close()
+}
+
+// receive executes local subscriptions for the events received from the
+// Redis channel until the manager is closed.
+func (m *subscriptionManager) receive() {
+	for msg := range m.pubsub.Channel() {
+		var e event
+		var payload interface{}
+		err := json.Unmarshal([]byte(msg.Payload), &e)
+		if err == nil {
+			err = json.Unmarshal(e.Payload, &payload)
+		}
+		if err != nil {
+			m.logger.WithFields(graphqlws.Fields{
+				"channel": msg.Channel,
+				"err":     err,
+			}).Warn("Failed to decode event")
+			continue
+		}
+
+		m.PublishingSubscriptionManager.Publish(context.Background(), e.Field, payload)
+	}
+}
@@ -0,0 +1,119 @@
+package redis_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/graphql-go/graphql"
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	m.Run()
+}
+
+// connection is a minimal graphqlws.Connection for subscriptions.
+type connection struct {
+	id string
+}
+
+func (c *connection) ID() string                                     { return c.id }
+func (c *connection) User() interface{}                              { return nil }
+func (c *connection) SendData(string, *graphqlws.DataMessagePayload) {}
+func (c *connection) SendError(error)                                {}
+func (c *connection) TrySendComplete(string) bool                    { return false }
+func (c *connection) Close(int, string)                              {}
+func (c *connection) Set(string, interface{})                        {}
+func (c *connection) Get(string) (interface{}, bool)                 { return nil, false }
+func (c *connection) InitPayload() map[string]interface{}            { return nil }
+func (c *connection) Stats() graphqlws.ConnectionStats               { return graphqlws.ConnectionStats{ID: c.id} }
+func (c *connection) Context() context.Context                       { return context.Background() }
+func (c *connection) Err() error                                     { return nil }
+func (c *connection) Request() *http.Request                         { return nil }
+func (c *connection) RemoteAddr() net.Addr                           { return nil }
+func (c *connection) ClientIP() string                               { return "" }
+
+func buildSchema(t *testing.T) *graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Query",
+			Fields: graphql.Fields{"hello": &graphql.Field{Type: graphql.String}},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"message": &graphql.Field{
+					Type: graphql.NewObject(graphql.ObjectConfig{
+						Name: "Message",
+						Fields: graphql.Fields{
+							"text": &graphql.Field{Type: graphql.String},
+						},
+					}),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source, nil
+					},
+				},
+			},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("could not build schema: %v", err)
+	}
+	return &schema
+}
+
+func newManager(t *testing.T, addr string) redis.SubscriptionManager {
+	client := goredis.NewClient(&goredis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+
+	sm, err := redis.NewSubscriptionManager(context.Background(), buildSchema(t), client, "events")
+	if err != nil {
+		t.Fatalf("could not create subscription manager: %v", err)
+	}
+	t.Cleanup(func() { sm.Close() })
+	return sm
+}
+
+func TestSubscriptionManager_EventsReachSubscribersOfAllInstances(t *testing.T) {
+	server := miniredis.RunT(t)
+	publisher := newManager(t, server.Addr())
+	subscriber := newManager(t, server.Addr())
+
+	received := make(chan *graphqlws.DataMessagePayload, 1)
+	conn := &connection{id: "1"}
+	errs := subscriber.AddSubscription(conn, &graphqlws.Subscription{
+		ID:         "1",
+		Connection: conn,
+		Query:      "subscription { message { text } }",
+		SendData: func(data *graphqlws.DataMessagePayload) {
+			received <- data
+		},
+	})
+	if len(errs) > 0 {
+		t.Fatalf("could not add subscription: %v", errs)
+	}
+
+	err := publisher.Publish(context.Background(), "message", map[string]interface{}{"text": "hello"})
+	if err != nil {
+		t.Fatalf("could not publish event: %v", err)
+	}
+
+	select {
+	case data := <-received:
+		result, _ := data.Data.(map[string]interface{})
+		message, _ := result["message"].(map[string]interface{})
+		if message["text"] != "hello" {
+			t.Errorf("unexpected data: %v", data.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event not received by the other instance")
+	}
+}
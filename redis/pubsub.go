@@ -0,0 +1,126 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/meandrewdev/graphqlws"
+)
+
+// PubSub is a topic-based subscription manager whose events are published
+// on a Redis channel, so that publishing on any instance reaches the
+// subscribers connected to all of them. Every instance delivers the
+// events to the subscriptions of its own connections, as a
+// graphqlws.PubSub does, including those subscribed to topic patterns.
+type PubSub interface {
+	graphqlws.SubscriptionManager
+
+	// Subscribe subscribes a local subscription to a topic or topic
+	// pattern.
+	Subscribe(topic string, s *graphqlws.Subscription)
+
+	// Unsubscribe unsubscribes a local subscription from a topic or topic
+	// pattern.
+	Unsubscribe(topic string, s *graphqlws.Subscription)
+
+	// Publish publishes an event for the subscriptions to a topic on the
+	// Redis channel. The payload is encoded as JSON and becomes the source
+	// value of the subscriptions' top-level resolvers, decoded into
+	// generic values such as map[string]interface{}.
+	Publish(ctx context.Context, topic string, payload interface{}) error
+
+	// Close unsubscribes from the Redis channel.
+	Close() error
+}
+
+// topicEvent is the message format of events on the Redis channel of a
+// PubSub.
+type topicEvent struct {
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+/**
+ * The Redis Pub/Sub implementation of the PubSub interface.
+ */
+
+type pubSub struct {
+	graphqlws.PubSub
+
+	client  goredis.UniversalClient
+	channel string
+	pubsub  *goredis.PubSub
+	logger  graphqlws.Logger
+}
+
+// NewPubSub creates a topic-based subscription manager, configured as by
+// graphqlws.NewPubSub, that receives events from the given Redis channel.
+// Journals aren't supported, as every instance would journal each event.
+// It returns once the channel has been subscribed to; the Redis client
+// resubscribes automatically after reconnecting.
+func NewPubSub(
+	ctx context.Context,
+	config graphqlws.PubSubConfig,
+	client goredis.UniversalClient,
+	channel string,
+) (PubSub, error) {
+	if config.Journal != nil {
+		return nil, errors.New("redis: journals aren't supported by PubSub")
+	}
+
+	pubsub := client.Subscribe(ctx, channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	p := &pubSub{
+		PubSub:  graphqlws.NewPubSub(config),
+		client:  client,
+		channel: channel,
+		pubsub:  pubsub,
+		logger:  graphqlws.NewLogger("redis"),
+	}
+	go p.receive()
+	return p, nil
+}
+
+func (p *pubSub) Publish(ctx context.Context, topic string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(topicEvent{Topic: topic, Payload: data})
+	if err != nil {
+		return err
+	}
+	return p.client.Publish(ctx, p.channel, msg).Err()
+}
+
+func (p *pubSub) Close() error {
+	return p.pubsub.Close()
+}
+
+// receive delivers the events received from the Redis channel to local
+// subscriptions until the PubSub is closed.
+func (p *pubSub) receive() {
+	for msg := range p.pubsub.Channel() {
+		var e topicEvent
+		var payload interface{}
+		err := json.Unmarshal([]byte(msg.Payload), &e)
+		if err == nil {
+			err = json.Unmarshal(e.Payload, &payload)
+		}
+		if err != nil {
+			p.logger.WithFields(graphqlws.Fields{
+				"channel": msg.Channel,
+				"err":     err,
+			}).Warn("Failed to decode event")
+			continue
+		}
+
+		p.PubSub.Publish(context.Background(), e.Topic, payload)
+	}
+}
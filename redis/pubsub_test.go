@@ -0,0 +1,65 @@
+package redis_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/redis"
+)
+
+func newPubSub(t *testing.T, addr string) redis.PubSub {
+	client := goredis.NewClient(&goredis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+
+	pubsub, err := redis.NewPubSub(context.Background(), graphqlws.PubSubConfig{
+		Schema: buildSchema(t),
+		Topics: func(s *graphqlws.Subscription) []string {
+			return []string{"rooms.*"}
+		},
+	}, client, "topics")
+	if err != nil {
+		t.Fatalf("could not create pubsub: %v", err)
+	}
+	t.Cleanup(func() { pubsub.Close() })
+	return pubsub
+}
+
+func TestPubSub_EventsReachTopicSubscribersOfAllInstances(t *testing.T) {
+	server := miniredis.RunT(t)
+	publisher := newPubSub(t, server.Addr())
+	subscriber := newPubSub(t, server.Addr())
+
+	received := make(chan *graphqlws.DataMessagePayload, 1)
+	conn := &connection{id: "1"}
+	errs := subscriber.AddSubscription(conn, &graphqlws.Subscription{
+		ID:         "1",
+		Connection: conn,
+		Query:      "subscription { message { text } }",
+		SendData: func(data *graphqlws.DataMessagePayload) {
+			received <- data
+		},
+	})
+	if len(errs) > 0 {
+		t.Fatalf("could not add subscription: %v", errs)
+	}
+
+	err := publisher.Publish(context.Background(), "rooms.general", map[string]interface{}{"text": "hello"})
+	if err != nil {
+		t.Fatalf("could not publish event: %v", err)
+	}
+
+	select {
+	case data := <-received:
+		result, _ := data.Data.(map[string]interface{})
+		message, _ := result["message"].(map[string]interface{})
+		if message["text"] != "hello" {
+			t.Errorf("unexpected data: %v", data.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event not received by the other instance")
+	}
+}
@@ -0,0 +1,203 @@
+package graphqlws
+
+import (
+	"reflect"
+	"sync"
+)
+
+// ConnectionRegistry keeps track of live GraphQL WS connections. It is
+// safe for concurrent use; handlers add connections as they are
+// established and remove them when they are closed.
+type ConnectionRegistry interface {
+	// Add registers a connection.
+	Add(Connection)
+
+	// Remove unregisters a connection.
+	Remove(Connection)
+
+	// Get returns the connection with the given ID.
+	Get(id string) (Connection, bool)
+
+	// Count returns the number of registered connections.
+	Count() int
+
+	// Range calls f for each registered connection until f returns false.
+	// Connections added or removed while ranging may or may not be visited.
+	Range(f func(Connection) bool)
+
+	// Stats returns a snapshot of the statistics of all registered
+	// connections.
+	Stats() RegistryStats
+}
+
+/**
+ * The default implementation of the ConnectionRegistry interface.
+ */
+
+type connectionRegistry struct {
+	shards []*registryShard
+}
+
+// registryShard holds the connections whose IDs hash to it.
+type registryShard struct {
+	connections map[string]Connection
+	mutex       *sync.RWMutex
+}
+
+// NewConnectionRegistry creates a new, empty connection registry.
+func NewConnectionRegistry() ConnectionRegistry {
+	r := &connectionRegistry{
+		shards: make([]*registryShard, shardCount),
+	}
+	for i := range r.shards {
+		r.shards[i] = &registryShard{
+			connections: make(map[string]Connection),
+			mutex:       &sync.RWMutex{},
+		}
+	}
+	return r
+}
+
+func (r *connectionRegistry) shard(id string) *registryShard {
+	return r.shards[shardIndex(id)]
+}
+
+func (r *connectionRegistry) Add(conn Connection) {
+	shard := r.shard(conn.ID())
+	shard.mutex.Lock()
+	shard.connections[conn.ID()] = conn
+	shard.mutex.Unlock()
+}
+
+func (r *connectionRegistry) Remove(conn Connection) {
+	shard := r.shard(conn.ID())
+	shard.mutex.Lock()
+	if shard.connections[conn.ID()] == conn {
+		delete(shard.connections, conn.ID())
+	}
+	shard.mutex.Unlock()
+}
+
+func (r *connectionRegistry) Get(id string) (Connection, bool) {
+	shard := r.shard(id)
+	shard.mutex.RLock()
+	conn, ok := shard.connections[id]
+	shard.mutex.RUnlock()
+	return conn, ok
+}
+
+func (r *connectionRegistry) Count() int {
+	count := 0
+	for _, shard := range r.shards {
+		shard.mutex.RLock()
+		count += len(shard.connections)
+		shard.mutex.RUnlock()
+	}
+	return count
+}
+
+func (r *connectionRegistry) Range(f func(Connection) bool) {
+	// Take a snapshot of each shard so that f may add or remove
+	// connections
+	for _, shard := range r.shards {
+		shard.mutex.RLock()
+		connections := make([]Connection, 0, len(shard.connections))
+		for _, conn := range shard.connections {
+			connections = append(connections, conn)
+		}
+		shard.mutex.RUnlock()
+
+		for _, conn := range connections {
+			if !f(conn) {
+				return
+			}
+		}
+	}
+}
+
+func (r *connectionRegistry) Stats() RegistryStats {
+	stats := RegistryStats{}
+	r.Range(func(conn Connection) bool {
+		connStats := conn.Stats()
+		stats.Connections = append(stats.Connections, connStats)
+		stats.MessagesReceived += connStats.MessagesReceived
+		stats.MessagesSent += connStats.MessagesSent
+		stats.BytesReceived += connStats.BytesReceived
+		stats.BytesSent += connStats.BytesSent
+		for messageType, count := range connStats.MessagesByType {
+			if stats.MessagesByType == nil {
+				stats.MessagesByType = make(map[string]uint64)
+			}
+			stats.MessagesByType[messageType] += count
+		}
+		stats.Subscriptions += connStats.Subscriptions
+		return true
+	})
+	return stats
+}
+
+/**
+ * An index of the connections of authenticated users.
+ */
+
+type userConnections struct {
+	connections map[interface{}]map[Connection]bool
+	mutex       *sync.RWMutex
+}
+
+func newUserConnections() *userConnections {
+	return &userConnections{
+		connections: make(map[interface{}]map[Connection]bool),
+		mutex:       &sync.RWMutex{},
+	}
+}
+
+// indexable reports whether connections can be indexed by a user, which
+// requires users to be comparable.
+func indexable(user interface{}) bool {
+	return user != nil && reflect.TypeOf(user).Comparable()
+}
+
+func (u *userConnections) add(user interface{}, conn Connection) {
+	if !indexable(user) {
+		return
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.connections[user] == nil {
+		u.connections[user] = make(map[Connection]bool)
+	}
+	u.connections[user][conn] = true
+}
+
+func (u *userConnections) remove(user interface{}, conn Connection) {
+	if !indexable(user) {
+		return
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	delete(u.connections[user], conn)
+	if len(u.connections[user]) == 0 {
+		delete(u.connections, user)
+	}
+}
+
+// get returns the connections of a user.
+func (u *userConnections) get(user interface{}) []Connection {
+	if !indexable(user) {
+		return nil
+	}
+
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	connections := make([]Connection, 0, len(u.connections[user]))
+	for conn := range u.connections[user] {
+		connections = append(connections, conn)
+	}
+	return connections
+}
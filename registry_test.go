@@ -0,0 +1,162 @@
+package graphqlws_test
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+func TestRegistry_ConnectionsCanBeAddedAndRemoved(t *testing.T) {
+	registry := graphqlws.NewConnectionRegistry()
+	conn1 := mockWebSocketConnection{id: "1"}
+	conn2 := mockWebSocketConnection{id: "2"}
+
+	registry.Add(&conn1)
+	registry.Add(&conn2)
+
+	if registry.Count() != 2 {
+		t.Fatalf("expected 2 connections, found %d", registry.Count())
+	}
+	if conn, ok := registry.Get("2"); !ok || conn != &conn2 {
+		t.Error("Get doesn't return registered connections")
+	}
+
+	registry.Remove(&conn2)
+
+	if registry.Count() != 1 {
+		t.Fatalf("expected 1 connection, found %d", registry.Count())
+	}
+	if _, ok := registry.Get("2"); ok {
+		t.Error("Get returns removed connections")
+	}
+}
+
+func TestRegistry_RangeVisitsAllConnections(t *testing.T) {
+	registry := graphqlws.NewConnectionRegistry()
+	registry.Add(&mockWebSocketConnection{id: "1"})
+	registry.Add(&mockWebSocketConnection{id: "2"})
+	registry.Add(&mockWebSocketConnection{id: "3"})
+
+	visited := map[string]bool{}
+	registry.Range(func(conn graphqlws.Connection) bool {
+		visited[conn.ID()] = true
+		registry.Remove(conn)
+		return true
+	})
+	if len(visited) != 3 || registry.Count() != 0 {
+		t.Errorf("Range doesn't visit all connections: %v", visited)
+	}
+
+	registry.Add(&mockWebSocketConnection{id: "1"})
+	registry.Add(&mockWebSocketConnection{id: "2"})
+
+	count := 0
+	registry.Range(func(conn graphqlws.Connection) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Errorf("Range doesn't stop when asked to, visited %d connections", count)
+	}
+}
+
+func TestRegistry_ConnectionsCanBeAddedConcurrently(t *testing.T) {
+	registry := graphqlws.NewConnectionRegistry()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			conn := &mockWebSocketConnection{id: id}
+			registry.Add(conn)
+			if found, ok := registry.Get(id); !ok || found != conn {
+				t.Errorf("connection %s is not found", id)
+			}
+			registry.Count()
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	if registry.Count() != 100 {
+		t.Errorf("expected 100 connections, found %d", registry.Count())
+	}
+	visited := map[string]bool{}
+	registry.Range(func(conn graphqlws.Connection) bool {
+		visited[conn.ID()] = true
+		return true
+	})
+	if len(visited) != 100 {
+		t.Errorf("Range visits %d connections", len(visited))
+	}
+}
+
+func TestRegistry_HandlerTracksLiveConnections(t *testing.T) {
+	schema, _ := buildSchema()
+	registry := graphqlws.NewConnectionRegistry()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Connections:         registry,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	waitForCount(t, registry, 1)
+
+	ws.Close()
+	waitForCount(t, registry, 0)
+}
+
+func waitForCount(t *testing.T, registry graphqlws.ConnectionRegistry, count int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for registry.Count() != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d connections, found %d", count, registry.Count())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegistry_StatsAggregateConnectionStats(t *testing.T) {
+	schema, _ := buildSchema()
+	registry := graphqlws.NewConnectionRegistry()
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Connections:         registry,
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	readOperationMessage(t, ws)
+	startSubscription(t, ws, "1")
+	waitForCount(t, registry, 1)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for registry.Stats().Subscriptions != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := registry.Stats()
+	if len(stats.Connections) != 1 || stats.Subscriptions != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	conn := stats.Connections[0]
+	if conn.Subprotocol != graphqlws.SubprotocolGraphQLWS {
+		t.Errorf("unexpected subprotocol: %q", conn.Subprotocol)
+	}
+	if conn.MessagesReceived != 2 || conn.MessagesSent != 1 || conn.BytesReceived == 0 || conn.BytesSent == 0 {
+		t.Errorf("unexpected traffic: %+v", conn)
+	}
+	if conn.ConnectedAt.IsZero() || conn.LastActivity.Before(conn.ConnectedAt) {
+		t.Errorf("unexpected times: %+v", conn)
+	}
+	if stats.MessagesReceived != conn.MessagesReceived || stats.BytesSent != conn.BytesSent {
+		t.Errorf("totals don't match the connection: %+v", stats)
+	}
+}
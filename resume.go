@@ -0,0 +1,211 @@
+package graphqlws
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Prefix (and format version) of all resume tokens
+	resumeTokenPrefix = "rt1."
+
+	// Default lifetime of resume tokens
+	defaultResumeTokenTTL = 5 * time.Minute
+
+	// Interval at which in-memory resume stores discard expired tokens
+	resumeTokenSweepInterval = time.Minute
+
+	// Key of the resume status in data message extensions
+	resumeExtension = "resume"
+)
+
+// Resume statuses reported to the client in the "resume" extension of the
+// first data message of an operation that was started with a resume token.
+const (
+	ResumeStatusResumed = "resumed"
+	ResumeStatusExpired = "expired"
+	ResumeStatusInvalid = "invalid"
+)
+
+// ResumeToken is the server-side record of a resume token.
+//
+// Clients only ever see tokens as opaque strings of the form "rt1.<id>",
+// where <id> is a random UUID. The stream position a token refers to is
+// kept in the ResumeStore, so clients cannot forge positions.
+type ResumeToken struct {
+	// ID is the random part of the token string.
+	ID string
+
+	// Stream binds the token to the query, operation name and variables
+	// of the subscription it was issued for.
+	Stream string
+
+	// Position is the last position in the ordered stream that was
+	// delivered to the client.
+	Position uint64
+
+	// User is the user of the connection the token was issued over;
+	// tokens can only be used by the same user.
+	User interface{}
+
+	// ExpiresAt is the time after which the token can no longer be used.
+	ExpiresAt time.Time
+}
+
+// String returns the token string handed out to clients.
+func (t *ResumeToken) String() string {
+	return resumeTokenPrefix + t.ID
+}
+
+// Expired returns true if the token can no longer be used at the given time.
+func (t *ResumeToken) Expired(now time.Time) bool {
+	return !t.ExpiresAt.After(now)
+}
+
+// ResumeStore persists resume tokens so they can be validated when a
+// reconnecting client replays its subscriptions.
+type ResumeStore interface {
+	// Save stores a token, replacing any token with the same ID.
+	Save(*ResumeToken) error
+
+	// Take returns and removes the token with the given ID, or nil if
+	// the token is unknown, so that it is only used once.
+	Take(id string) (*ResumeToken, error)
+}
+
+// ResumeConfig enables subscription resumption.
+type ResumeConfig struct {
+	// Store holds the issued resume tokens.
+	Store ResumeStore
+
+	// TTL is the lifetime of issued tokens; defaults to five minutes.
+	TTL time.Duration
+}
+
+func (c *ResumeConfig) ttl() time.Duration {
+	if c.TTL > 0 {
+		return c.TTL
+	}
+	return defaultResumeTokenTTL
+}
+
+/**
+ * The default, in-memory implementation of the ResumeStore interface.
+ */
+
+type memoryResumeStore struct {
+	tokens map[string]*ResumeToken
+	swept  time.Time
+	mutex  *sync.Mutex
+}
+
+// NewMemoryResumeStore creates a resume store that keeps tokens in memory.
+// Expired tokens are discarded when they are taken, and the tokens that
+// are never taken are swept at most once a minute as tokens are saved.
+func NewMemoryResumeStore() ResumeStore {
+	return &memoryResumeStore{
+		tokens: make(map[string]*ResumeToken),
+		swept:  time.Now(),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+func (s *memoryResumeStore) Save(token *ResumeToken) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if now := time.Now(); now.Sub(s.swept) >= resumeTokenSweepInterval {
+		for id, t := range s.tokens {
+			if t.Expired(now) {
+				delete(s.tokens, id)
+			}
+		}
+		s.swept = now
+	}
+
+	stored := *token
+	s.tokens[token.ID] = &stored
+	return nil
+}
+
+func (s *memoryResumeStore) Take(id string) (*ResumeToken, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.tokens, id)
+	return token, nil
+}
+
+// IssueResumeToken records the given stream position of the subscription
+// and returns a token the client can present to resume from it after
+// reconnecting. Servers typically send the token to the client in the
+// extensions of each data message.
+func (s *Subscription) IssueResumeToken(position uint64) (string, error) {
+	if s.resume == nil || s.resume.Store == nil {
+		return "", errors.New("Subscription resumption is not enabled")
+	}
+
+	token := &ResumeToken{
+		ID:        uuid.New().String(),
+		Stream:    subscriptionStream(s),
+		Position:  position,
+		User:      s.Connection.User(),
+		ExpiresAt: time.Now().Add(s.resume.ttl()),
+	}
+	if err := s.resume.Store.Save(token); err != nil {
+		return "", err
+	}
+	return token.String(), nil
+}
+
+// resumeSubscription validates a resume token presented by the client and,
+// if it is valid, marks the subscription as resumed from the token's
+// position. Tokens are used up by the attempt, and only resume
+// subscriptions of the user they were issued to. It returns the resume
+// status to report to the client.
+func resumeSubscription(config *ResumeConfig, s *Subscription, token string) string {
+	if !strings.HasPrefix(token, resumeTokenPrefix) {
+		return ResumeStatusInvalid
+	}
+
+	record, err := config.Store.Take(strings.TrimPrefix(token, resumeTokenPrefix))
+	if err != nil || record == nil || record.Stream != subscriptionStream(s) {
+		return ResumeStatusInvalid
+	}
+	if !sameUser(record.User, s.Connection.User()) {
+		return ResumeStatusInvalid
+	}
+
+	if record.Expired(time.Now()) {
+		return ResumeStatusExpired
+	}
+
+	s.Resumed = true
+	s.ResumePosition = record.Position
+	return ResumeStatusResumed
+}
+
+// subscriptionStream returns a fingerprint of everything that defines the
+// stream a subscription receives.
+func subscriptionStream(s *Subscription) string {
+	variables, _ := json.Marshal(s.Variables)
+
+	hash := sha256.New()
+	hash.Write([]byte(s.Query))
+	hash.Write([]byte{0})
+	hash.Write([]byte(s.OperationName))
+	hash.Write([]byte{0})
+	hash.Write(variables)
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,327 @@
+package graphqlws_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/meandrewdev/graphqlws"
+)
+
+func startResumeServer(
+	ttl time.Duration,
+) (*httptest.Server, chan *graphqlws.Subscription) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Resume: &graphqlws.ResumeConfig{
+			Store: graphqlws.NewMemoryResumeStore(),
+			TTL:   ttl,
+		},
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	})
+	return httptest.NewServer(handler), subscriptions
+}
+
+func startResumedSubscription(
+	t *testing.T,
+	ws *websocket.Conn,
+	opID string,
+	token string,
+) {
+	err := ws.WriteJSON(map[string]interface{}{
+		"id":   opID,
+		"type": "start",
+		"payload": map[string]interface{}{
+			"query":       "subscription { " + subscriptionName + " { payload } }",
+			"resumeToken": token,
+		},
+	})
+	if err != nil {
+		t.Fatalf("could not start subscription: %v", err)
+	}
+}
+
+func receiveSubscription(
+	t *testing.T,
+	subscriptions chan *graphqlws.Subscription,
+) *graphqlws.Subscription {
+	select {
+	case s := <-subscriptions:
+		return s
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription was not started")
+		return nil
+	}
+}
+
+func resumeStatus(msg graphqlws.OperationMessage) interface{} {
+	payload, _ := msg.Payload.(map[string]interface{})
+	extensions, _ := payload["extensions"].(map[string]interface{})
+	resume, _ := extensions["resume"].(map[string]interface{})
+	if resume == nil {
+		return nil
+	}
+	return resume["status"]
+}
+
+func issueResumeToken(
+	t *testing.T,
+	srv *httptest.Server,
+	subscriptions chan *graphqlws.Subscription,
+	position uint64,
+) string {
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	token, err := receiveSubscription(t, subscriptions).IssueResumeToken(position)
+	if err != nil {
+		t.Fatalf("could not issue resume token: %v", err)
+	}
+	return token
+}
+
+func TestResume_ValidTokensResumeSubscriptions(t *testing.T) {
+	srv, subscriptions := startResumeServer(time.Minute)
+	defer srv.Close()
+
+	token := issueResumeToken(t, srv, subscriptions, 42)
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startResumedSubscription(t, ws, "1", token)
+	s := receiveSubscription(t, subscriptions)
+	if !s.Resumed || s.ResumePosition != 42 {
+		t.Fatalf("subscription not resumed from position 42: %v, %d", s.Resumed, s.ResumePosition)
+	}
+
+	s.SendData(&graphqlws.DataMessagePayload{Data: "first"})
+	if status := resumeStatus(readOperationMessage(t, ws)); status != graphqlws.ResumeStatusResumed {
+		t.Errorf("unexpected resume status: %v", status)
+	}
+
+	s.SendData(&graphqlws.DataMessagePayload{Data: "second"})
+	if status := resumeStatus(readOperationMessage(t, ws)); status != nil {
+		t.Errorf("resume status sent more than once: %v", status)
+	}
+}
+
+func TestResume_ExpiredTokensStartFreshSubscriptions(t *testing.T) {
+	srv, subscriptions := startResumeServer(time.Millisecond)
+	defer srv.Close()
+
+	token := issueResumeToken(t, srv, subscriptions, 42)
+	time.Sleep(10 * time.Millisecond)
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startResumedSubscription(t, ws, "1", token)
+	s := receiveSubscription(t, subscriptions)
+	if s.Resumed {
+		t.Fatal("subscription resumed with an expired token")
+	}
+
+	s.SendData(&graphqlws.DataMessagePayload{Data: "first"})
+	if status := resumeStatus(readOperationMessage(t, ws)); status != graphqlws.ResumeStatusExpired {
+		t.Errorf("unexpected resume status: %v", status)
+	}
+}
+
+func TestResume_UnknownTokensStartFreshSubscriptions(t *testing.T) {
+	srv, subscriptions := startResumeServer(time.Minute)
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startResumedSubscription(t, ws, "1", "rt1.unknown")
+	s := receiveSubscription(t, subscriptions)
+	if s.Resumed {
+		t.Fatal("subscription resumed with an unknown token")
+	}
+
+	s.SendData(&graphqlws.DataMessagePayload{Data: "first"})
+	if status := resumeStatus(readOperationMessage(t, ws)); status != graphqlws.ResumeStatusInvalid {
+		t.Errorf("unexpected resume status: %v", status)
+	}
+}
+
+func TestResume_SubscriptionsWithoutTokensReportNoStatus(t *testing.T) {
+	srv, subscriptions := startResumeServer(time.Minute)
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startSubscription(t, ws, "1")
+	s := receiveSubscription(t, subscriptions)
+	if s.Resumed {
+		t.Fatal("subscription resumed without a token")
+	}
+
+	s.SendData(&graphqlws.DataMessagePayload{Data: "first"})
+	if status := resumeStatus(readOperationMessage(t, ws)); status != nil {
+		t.Errorf("unexpected resume status: %v", status)
+	}
+}
+
+func TestResume_FirstMessagesOfResumedSubscriptionsKeepTheirFields(t *testing.T) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Resume:              &graphqlws.ResumeConfig{Store: graphqlws.NewMemoryResumeStore()},
+		Acks:                &graphqlws.AckConfig{},
+		DeduplicationWindow: time.Minute,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	}))
+	defer srv.Close()
+
+	token := issueResumeToken(t, srv, subscriptions, 42)
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	startResumedSubscription(t, ws, "1", token)
+	s := receiveSubscription(t, subscriptions)
+	hasNext := true
+	s.SendData(&graphqlws.DataMessagePayload{Data: "first", MessageID: "a", HasNext: &hasNext})
+	s.SendData(&graphqlws.DataMessagePayload{Data: "first", MessageID: "a", HasNext: &hasNext})
+	s.SendData(&graphqlws.DataMessagePayload{Data: "second", MessageID: "b"})
+
+	msg := readOperationMessage(t, ws)
+	payload, _ := msg.Payload.(map[string]interface{})
+	extensions, _ := payload["extensions"].(map[string]interface{})
+	if resumeStatus(msg) != graphqlws.ResumeStatusResumed || extensions["delivery"] == nil || payload["hasNext"] != true {
+		t.Fatalf("unexpected first message: %v", msg)
+	}
+
+	// The duplicate of the first message is suppressed
+	if data, sequence := readDelivery(t, ws); data != "second" || sequence != 2 {
+		t.Errorf("expected second message (2), received %v (%v)", data, sequence)
+	}
+}
+
+func TestResume_TokensCanOnlyBeUsedOnce(t *testing.T) {
+	srv, subscriptions := startResumeServer(time.Minute)
+	defer srv.Close()
+
+	token := issueResumeToken(t, srv, subscriptions, 42)
+
+	for i, expected := range []bool{true, false} {
+		ws := dialServer(t, srv)
+		startResumedSubscription(t, ws, "1", token)
+		if s := receiveSubscription(t, subscriptions); s.Resumed != expected {
+			t.Errorf("attempt %d: expected resumed to be %v", i+1, expected)
+		}
+		ws.Close()
+	}
+}
+
+func TestResume_TokensOnlyResumeSubscriptionsOfTheSameUser(t *testing.T) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		AuthenticateRequest: func(conn graphqlws.Connection, r *http.Request, token string) (interface{}, error) {
+			return token, nil
+		},
+		Resume: &graphqlws.ResumeConfig{
+			Store: graphqlws.NewMemoryResumeStore(),
+		},
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	}))
+	defer srv.Close()
+
+	dialUser := func(user string) *websocket.Conn {
+		ws := dialServer(t, srv)
+		writeMessage(t, ws, map[string]interface{}{
+			"type":    "connection_init",
+			"payload": map[string]interface{}{"authToken": user},
+		})
+		readOperationMessage(t, ws)
+		return ws
+	}
+
+	alice := dialUser("alice")
+	startSubscription(t, alice, "1")
+	token, err := receiveSubscription(t, subscriptions).IssueResumeToken(42)
+	alice.Close()
+	if err != nil {
+		t.Fatalf("could not issue resume token: %v", err)
+	}
+
+	bob := dialUser("bob")
+	defer bob.Close()
+	startResumedSubscription(t, bob, "1", token)
+	s := receiveSubscription(t, subscriptions)
+	if s.Resumed {
+		t.Fatal("subscription resumed with a token of another user")
+	}
+
+	s.SendData(&graphqlws.DataMessagePayload{Data: "first"})
+	if status := resumeStatus(readOperationMessage(t, bob)); status != graphqlws.ResumeStatusInvalid {
+		t.Errorf("unexpected resume status: %v", status)
+	}
+}
+
+func TestResume_RejectedStartsDontUseUpTokens(t *testing.T) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	var reject int32
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		AuthorizeOperation: func(conn graphqlws.Connection, s *graphqlws.Subscription) []error {
+			if atomic.LoadInt32(&reject) == 1 {
+				return []error{errors.New("not authorized")}
+			}
+			return nil
+		},
+		Resume: &graphqlws.ResumeConfig{
+			Store: graphqlws.NewMemoryResumeStore(),
+		},
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	}))
+	defer srv.Close()
+
+	token := issueResumeToken(t, srv, subscriptions, 42)
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	atomic.StoreInt32(&reject, 1)
+	startResumedSubscription(t, ws, "1", token)
+	if s := receiveSubscription(t, subscriptions); s.Resumed {
+		t.Fatal("rejected subscription was resumed")
+	}
+
+	atomic.StoreInt32(&reject, 0)
+	startResumedSubscription(t, ws, "2", token)
+	if s := receiveSubscription(t, subscriptions); !s.Resumed || s.ResumePosition != 42 {
+		t.Errorf("subscription not resumed from position 42: %v, %d", s.Resumed, s.ResumePosition)
+	}
+}
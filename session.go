@@ -0,0 +1,163 @@
+package graphqlws
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Prefix (and format version) of all session tokens
+	sessionTokenPrefix = "st1."
+
+	// Default time sessions are held for after their connection dropped
+	defaultSessionGracePeriod = 30 * time.Second
+)
+
+// Session is the record of a connection's operations that is kept after
+// the connection dropped, so that the client can resume them once it has
+// reconnected instead of starting each of them again.
+type Session struct {
+	// Token is the token string handed out to the client in the payload
+	// of the connection_ack message.
+	Token string
+
+	// User is the user of the connection the session was recorded for;
+	// sessions can only be resumed by the same user.
+	User interface{}
+
+	// Operations holds the start payloads of the active operations of
+	// the connection by ID.
+	Operations map[string]*StartMessagePayload
+
+	// Sequence is the last sequence number issued to a data message of
+	// the connection and Unacked holds the messages the client hasn't
+	// acknowledged, if acks are enabled; see AckConfig.
+	Sequence uint64
+	Unacked  []UnackedMessage
+
+	// ExpiresAt is the time after which the session can no longer be
+	// resumed.
+	ExpiresAt time.Time
+}
+
+// Expired returns true if the session can no longer be resumed at the
+// given time.
+func (s *Session) Expired(now time.Time) bool {
+	return !s.ExpiresAt.After(now)
+}
+
+// SessionStore holds the sessions of dropped connections for their grace
+// period.
+type SessionStore interface {
+	// Save stores a session, replacing any session with the same token.
+	Save(*Session) error
+
+	// Take returns and removes the session with the given token, or nil
+	// if the session is unknown, so that it is only resumed once.
+	Take(token string) (*Session, error)
+}
+
+// SessionConfig enables resuming the operations of dropped connections.
+// Clients receive a session token in the sessionToken field of the
+// connection_ack payload and present it in the sessionToken field of the
+// connection_init payload of their next connection, whose ack lists the
+// IDs of the resumed operations in resumedOperations.
+//
+// Sessions are only kept for connections that dropped, e.g. because of a
+// network failure, and not for those the client closed deliberately.
+type SessionConfig struct {
+	// Store holds the sessions of dropped connections.
+	Store SessionStore
+
+	// GracePeriod is the time sessions are held for after their
+	// connection dropped; defaults to 30 seconds.
+	GracePeriod time.Duration
+}
+
+func (c *SessionConfig) gracePeriod() time.Duration {
+	if c.GracePeriod > 0 {
+		return c.GracePeriod
+	}
+	return defaultSessionGracePeriod
+}
+
+// newSessionToken returns a new, random session token.
+func newSessionToken() string {
+	return sessionTokenPrefix + uuid.New().String()
+}
+
+// takeSession returns the session with the given token if it can be
+// resumed by the user, or nil otherwise.
+func takeSession(config *SessionConfig, token string, user interface{}) *Session {
+	if !strings.HasPrefix(token, sessionTokenPrefix) {
+		return nil
+	}
+
+	session, err := config.Store.Take(token)
+	if err != nil || session == nil || session.Expired(time.Now()) {
+		return nil
+	}
+	if !sameUser(session.User, user) {
+		return nil
+	}
+	return session
+}
+
+// sameUser reports whether two users are the same; users that can't be
+// compared are only the same if both are nil.
+func sameUser(a interface{}, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return indexable(a) && indexable(b) && a == b
+}
+
+/**
+ * The default, in-memory implementation of the SessionStore interface.
+ */
+
+type memorySessionStore struct {
+	sessions map[string]*Session
+	mutex    *sync.Mutex
+}
+
+// NewMemorySessionStore creates a session store that keeps sessions in
+// memory. Expired sessions are discarded lazily whenever a session is
+// saved.
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{
+		sessions: make(map[string]*Session),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+func (s *memorySessionStore) Save(session *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for token, stored := range s.sessions {
+		if stored.Expired(now) {
+			delete(s.sessions, token)
+		}
+	}
+
+	stored := *session
+	s.sessions[session.Token] = &stored
+	return nil
+}
+
+func (s *memorySessionStore) Take(token string) (*Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	session, ok := s.sessions[token]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.sessions, token)
+	return session, nil
+}
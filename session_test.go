@@ -0,0 +1,154 @@
+package graphqlws_test
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/meandrewdev/graphqlws"
+)
+
+func startSessionServer(
+	gracePeriod time.Duration,
+) (*httptest.Server, chan *graphqlws.Subscription, chan graphqlws.Connection) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 4)
+	closed := make(chan graphqlws.Connection, 1)
+	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Sessions: &graphqlws.SessionConfig{
+			Store:       graphqlws.NewMemorySessionStore(),
+			GracePeriod: gracePeriod,
+		},
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+			Close: func(conn graphqlws.Connection) {
+				closed <- conn
+			},
+		},
+	})
+	return httptest.NewServer(handler), subscriptions, closed
+}
+
+// initSession initializes a connection, presenting the given session
+// token if it isn't empty, and returns the payload of its ack.
+func initSession(t *testing.T, ws *websocket.Conn, token string) map[string]interface{} {
+	payload := map[string]interface{}{}
+	if token != "" {
+		payload["sessionToken"] = token
+	}
+	writeMessage(t, ws, map[string]interface{}{
+		"type":    "connection_init",
+		"payload": payload,
+	})
+
+	msg := readOperationMessage(t, ws)
+	if msg.Type != "connection_ack" {
+		t.Fatalf("expected connection_ack, received: %v", msg)
+	}
+	ack, _ := msg.Payload.(map[string]interface{})
+	if token, _ := ack["sessionToken"].(string); token == "" {
+		t.Fatalf("connection_ack has no session token: %v", msg.Payload)
+	}
+	return ack
+}
+
+// openSession starts two subscriptions on a new connection and closes it
+// with drop; it returns the session token of the connection.
+func openSession(
+	t *testing.T,
+	srv *httptest.Server,
+	subscriptions chan *graphqlws.Subscription,
+	closed chan graphqlws.Connection,
+	drop func(*websocket.Conn),
+) string {
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	token := initSession(t, ws, "")["sessionToken"].(string)
+	startSubscription(t, ws, "1")
+	startSubscription(t, ws, "2")
+	receiveSubscription(t, subscriptions)
+	receiveSubscription(t, subscriptions)
+
+	drop(ws)
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+	return token
+}
+
+// Dropping the network connection closes it without a close frame
+func dropConnection(ws *websocket.Conn) {
+	ws.UnderlyingConn().Close()
+}
+
+func TestSession_OperationsOfDroppedConnectionsAreResumed(t *testing.T) {
+	srv, subscriptions, closed := startSessionServer(time.Minute)
+	defer srv.Close()
+
+	token := openSession(t, srv, subscriptions, closed, dropConnection)
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	ack := initSession(t, ws, token)
+	resumed, _ := ack["resumedOperations"].([]interface{})
+	if len(resumed) != 2 || resumed[0] != "1" || resumed[1] != "2" {
+		t.Fatalf("unexpected resumed operations: %v", ack["resumedOperations"])
+	}
+
+	s := receiveSubscription(t, subscriptions)
+	if s.ID != "1" || s.Query == "" {
+		t.Errorf("unexpected resumed subscription: %v", s)
+	}
+	receiveSubscription(t, subscriptions)
+
+	s.SendData(&graphqlws.DataMessagePayload{Data: "resumed"})
+	if msg := readOperationMessage(t, ws); msg.Type != "data" || msg.ID != "1" {
+		t.Errorf("unexpected data message: %v", msg)
+	}
+
+	// Sessions are only resumed once
+	other := dialServer(t, srv)
+	defer other.Close()
+	if ack := initSession(t, other, token); ack["resumedOperations"] != nil {
+		t.Errorf("session was resumed twice: %v", ack)
+	}
+}
+
+func TestSession_ConnectionsClosedByClientsAreNotResumed(t *testing.T) {
+	srv, subscriptions, closed := startSessionServer(time.Minute)
+	defer srv.Close()
+
+	token := openSession(t, srv, subscriptions, closed, func(ws *websocket.Conn) {
+		writeMessage(t, ws, map[string]interface{}{"type": "connection_terminate"})
+	})
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	if ack := initSession(t, ws, token); ack["resumedOperations"] != nil {
+		t.Errorf("terminated session was resumed: %v", ack)
+	}
+}
+
+func TestSession_ExpiredSessionsAreNotResumed(t *testing.T) {
+	srv, subscriptions, closed := startSessionServer(time.Millisecond)
+	defer srv.Close()
+
+	token := openSession(t, srv, subscriptions, closed, dropConnection)
+	time.Sleep(10 * time.Millisecond)
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	if ack := initSession(t, ws, token); ack["resumedOperations"] != nil {
+		t.Errorf("expired session was resumed: %v", ack)
+	}
+}
@@ -0,0 +1,15 @@
+package graphqlws
+
+// Number of shards that connection and subscription indexes are split
+// into, so that connections don't contend for a single lock
+const shardCount = 32
+
+// shardIndex returns the shard of an ID, hashed with FNV-1a.
+func shardIndex(id string) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		hash ^= uint32(id[i])
+		hash *= 16777619
+	}
+	return int(hash % shardCount)
+}
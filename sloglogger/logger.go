@@ -0,0 +1,60 @@
+//go:build go1.21
+
+// Package sloglogger adapts log/slog loggers to the Logger interface of
+// graphqlws, so that projects using slog can log graphqlws messages with
+// their slog handlers:
+//
+//	graphqlws.SetLogger(sloglogger.New(slog.Default()))
+package sloglogger
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+type logger struct {
+	logger *slog.Logger
+}
+
+// New creates a graphqlws logger that logs with a slog logger.
+func New(l *slog.Logger) graphqlws.Logger {
+	return &logger{logger: l}
+}
+
+func (l *logger) WithField(key string, value interface{}) graphqlws.Logger {
+	return &logger{logger: l.logger.With(key, value)}
+}
+
+func (l *logger) WithFields(fields graphqlws.Fields) graphqlws.Logger {
+	// Add the fields in a stable order
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	args := make([]interface{}, 0, 2*len(fields))
+	for _, key := range keys {
+		args = append(args, key, fields[key])
+	}
+	return &logger{logger: l.logger.With(args...)}
+}
+
+func (l *logger) Debug(args ...interface{}) {
+	l.logger.Debug(fmt.Sprint(args...))
+}
+
+func (l *logger) Info(args ...interface{}) {
+	l.logger.Info(fmt.Sprint(args...))
+}
+
+func (l *logger) Warn(args ...interface{}) {
+	l.logger.Warn(fmt.Sprint(args...))
+}
+
+func (l *logger) Error(args ...interface{}) {
+	l.logger.Error(fmt.Sprint(args...))
+}
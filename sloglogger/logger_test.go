@@ -0,0 +1,31 @@
+//go:build go1.21
+
+package sloglogger_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/sloglogger"
+)
+
+func TestLogger_MessagesAreLoggedWithFields(t *testing.T) {
+	buf := &bytes.Buffer{}
+	graphqlws.SetLogger(sloglogger.New(slog.New(slog.NewJSONHandler(buf, nil))))
+	defer graphqlws.SetLogger(nil)
+
+	logger := graphqlws.NewLogger("handler")
+	logger.WithFields(graphqlws.Fields{"conn": "1"}).Info("Start operation")
+	logger.Debug("Not logged")
+
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("unexpected output: %s", buf)
+	}
+	if entry["msg"] != "Start operation" || entry["prefix"] != "graphqlws/handler" || entry["conn"] != "1" {
+		t.Errorf("unexpected entry: %v", entry)
+	}
+}
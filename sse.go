@@ -0,0 +1,184 @@
+package graphqlws
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// SubprotocolGraphQLSSE is reported as the subprotocol of connections
+// served over Server-Sent Events.
+const SubprotocolGraphQLSSE = "graphql-sse"
+
+// SSEHandler returns an HTTP handler that serves operations over
+// Server-Sent Events, following the distinct connections mode of the
+// GraphQL over SSE protocol, for clients behind proxies that block
+// WebSockets. Each request carries one operation, as JSON in a POST body
+// or in the query, variables, operationName and extensions parameters of
+// a GET request, and receives its results as "next" events followed by a
+// "complete" event.
+//
+// Operations are started with the same subscription manager, auth and
+// hooks as those of WebSocket connections, and their connections are
+// registered with the handler's connections, so that publishing,
+// Broadcast and SendToUser reach them as well. Auth tokens are read from
+// the Authorization header, with or without a "Bearer " prefix.
+//
+// Requests are subject to the same origin policy, connection limits per
+// user and IP address and ValidateStart as WebSocket connections. As
+// each connection carries a single operation, the rates of operations
+// are limited per user, or per IP address for anonymous clients, rather
+// than per connection.
+func (h *Handler) SSEHandler() http.Handler {
+	return http.HandlerFunc(h.serveSSE)
+}
+
+func (h *Handler) serveSSE(w http.ResponseWriter, r *http.Request) {
+	data, err := readHTTPOperation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	h.serveStream(w, r, data, &sseConnection{
+		httpConnection: newHTTPConnection(r.Context(), h.config, NewLogger("sse"), r, h.clientIP(r)),
+		w:              w,
+		flusher:        flusher,
+	})
+}
+
+/**
+ * Connections served over Server-Sent Events.
+ */
+
+type sseConnection struct {
+	httpConnection
+
+	// The response stream and whether it has started, guarded by mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	started bool
+}
+
+// start sends the response headers, unless an event has been sent
+// already.
+func (c *sseConnection) start() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.startLocked()
+}
+
+// startLocked is like start; mutex must be held by the caller.
+func (c *sseConnection) startLocked() {
+	if c.started || c.done {
+		return
+	}
+	c.started = true
+	header := c.w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	c.w.WriteHeader(http.StatusOK)
+	c.flusher.Flush()
+}
+
+// writeEvent sends an event to the client; it returns false if the
+// stream has ended.
+func (c *sseConnection) writeEvent(event string, data []byte) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.done {
+		return false
+	}
+	c.startLocked()
+
+	format := "event: %s\ndata: %s\n\n"
+	if len(data) == 0 {
+		format = "event: %s\ndata:%s\n\n"
+	}
+	n, err := fmt.Fprintf(c.w, format, event, data)
+	if err != nil {
+		c.finishLocked(err)
+		return false
+	}
+	c.flusher.Flush()
+	c.sent(n)
+	return true
+}
+
+// reject responds with the errors an operation was rejected with, or
+// sends them as an event if the stream has started already.
+func (c *sseConnection) reject(errs []error, format ErrorFormatter) {
+	body := errorsBody(errs, format)
+
+	c.mutex.Lock()
+	started := c.started
+	if !started && !c.done {
+		c.w.Header().Set("Content-Type", "application/json")
+		c.w.WriteHeader(http.StatusBadRequest)
+		c.w.Write(body)
+	}
+	c.mutex.Unlock()
+
+	if started {
+		c.writeEvent("next", body)
+		c.writeEvent("complete", nil)
+	}
+}
+
+// keepAlive sends a comment to keep the stream open.
+func (c *sseConnection) keepAlive() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.done {
+		return
+	}
+	if _, err := fmt.Fprint(c.w, ":\n\n"); err != nil {
+		c.finishLocked(err)
+		return
+	}
+	c.flusher.Flush()
+}
+
+// shutdown completes the operation of the connection and waits until
+// it has been unregistered or ctx expires.
+func (c *sseConnection) shutdown(ctx context.Context) {
+	c.TrySendComplete(c.opID)
+	select {
+	case <-c.closed:
+	case <-ctx.Done():
+	}
+}
+
+func (c *sseConnection) SendData(opID string, data *DataMessagePayload) {
+	if opID != c.opID {
+		return
+	}
+	if body := c.encodeData(c, data); body != nil {
+		c.writeEvent("next", body)
+	}
+}
+
+func (c *sseConnection) SendError(err error) {
+	c.writeEvent("next", errorsBody([]error{err}, DefaultErrorFormatter))
+}
+
+func (c *sseConnection) TrySendComplete(opID string) bool {
+	if opID != c.opID || !c.writeEvent("complete", nil) {
+		return false
+	}
+	c.finish(ErrClosedByServer)
+	return true
+}
+
+func (c *sseConnection) Close(code int, reason string) {
+	c.finish(ErrClosedByServer)
+}
+
+func (c *sseConnection) Stats() ConnectionStats {
+	return c.stats(SubprotocolGraphQLSSE)
+}
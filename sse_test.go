@@ -0,0 +1,190 @@
+package graphqlws_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+func startSSEServer() (*httptest.Server, chan *graphqlws.Subscription) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Authenticate: func(token string) (interface{}, error) {
+			if token != "secret" {
+				return nil, errors.New("invalid token")
+			}
+			return "ada", nil
+		},
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				if len(errs) == 0 {
+					subscriptions <- s
+				}
+			},
+		},
+	})
+	return httptest.NewServer(handler.SSEHandler()), subscriptions
+}
+
+func postSSE(t *testing.T, srv *httptest.Server, token string, query string) *http.Response {
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(`{"query": "`+query+`"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestSSEHandler_StreamsResultsUntilComplete(t *testing.T) {
+	srv, subscriptions := startSSEServer()
+	defer srv.Close()
+
+	res := postSSE(t, srv, "secret", "subscription { "+subscriptionName+" { payload } }")
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response: %v %v", res.StatusCode, res.Header)
+	}
+
+	s := receiveSubscription(t, subscriptions)
+	if s.Connection.User() != "ada" {
+		t.Errorf("unexpected user: %v", s.Connection.User())
+	}
+	s.SendData(&graphqlws.DataMessagePayload{Data: "hello"})
+	s.Connection.TrySendComplete(s.ID)
+
+	var lines []string
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	expected := []string{
+		"event: next", `data: {"data":"hello","errors":null}`, "",
+		"event: complete", "data:", "",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected events: %q", lines)
+	}
+}
+
+func TestSSEHandler_RejectsUnauthenticatedAndInvalidOperations(t *testing.T) {
+	srv, _ := startSSEServer()
+	defer srv.Close()
+
+	res := postSSE(t, srv, "wrong", "subscription { "+subscriptionName+" { payload } }")
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401, received %d", res.StatusCode)
+	}
+
+	res = postSSE(t, srv, "secret", "subscription { unknown }")
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest || res.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("expected a JSON response with status 400, received %d", res.StatusCode)
+	}
+}
+
+func TestSSEHandler_AppliesTheOriginPolicyAndConnectionLimits(t *testing.T) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager:   graphqlws.NewSubscriptionManager(schema),
+		Authenticate:          func(token string) (interface{}, error) { return token, nil },
+		AllowedOrigins:        []string{"https://example.com"},
+		MaxConnectionsPerUser: 1,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	})
+	srv := httptest.NewServer(handler.SSEHandler())
+	defer srv.Close()
+
+	post := func(origin string) *http.Response {
+		query := `{"query": "subscription { ` + subscriptionName + ` { payload } }"}`
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(query))
+		req.Header.Set("Authorization", "ada")
+		req.Header.Set("Origin", origin)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := post("https://evil.example")
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status 403 for a foreign origin, received %d", res.StatusCode)
+	}
+
+	first := post("https://example.com")
+	defer first.Body.Close()
+	if first.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, received %d", first.StatusCode)
+	}
+	receiveSubscription(t, subscriptions)
+
+	res = post("https://example.com")
+	res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected status 429 beyond the connections of the user, received %d", res.StatusCode)
+	}
+}
+
+func TestSSEHandler_ValidatesAndRateLimitsOperations(t *testing.T) {
+	schema, _ := buildSchema()
+	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager:   graphqlws.NewSubscriptionManager(schema),
+		SubscriptionRateLimit: 0.001,
+		SubscriptionRateBurst: 2,
+		ValidateStart: func(conn graphqlws.Connection, payload *graphqlws.StartMessagePayload) []error {
+			if payload.OperationName == "Forbidden" {
+				return []error{graphqlws.NewError("Forbidden operation", map[string]interface{}{"code": "FORBIDDEN"})}
+			}
+			return nil
+		},
+	})
+	srv := httptest.NewServer(handler.SSEHandler())
+	defer srv.Close()
+
+	query := "subscription Forbidden { " + subscriptionName + " { payload } }"
+	for _, tc := range []struct {
+		query         string
+		operationName string
+		code          string
+	}{
+		{query, "Forbidden", "FORBIDDEN"},
+		{"subscription { unknown }", "", ""},
+		{query, "Forbidden", graphqlws.ErrCodeRateLimit},
+	} {
+		body, _ := json.Marshal(map[string]string{"query": tc.query, "operationName": tc.operationName})
+		res, err := http.Post(srv.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result struct {
+			Errors []struct {
+				Extensions map[string]interface{} `json:"extensions"`
+			} `json:"errors"`
+		}
+		json.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest || len(result.Errors) == 0 {
+			t.Fatalf("expected errors for %s, received status %d", tc.query, res.StatusCode)
+		}
+		if code, _ := result.Errors[0].Extensions["code"].(string); code != tc.code {
+			t.Errorf("expected code %q for %s, received %q", tc.code, tc.query, code)
+		}
+	}
+}
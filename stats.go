@@ -0,0 +1,110 @@
+package graphqlws
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ConnectionStats is a snapshot of the statistics of a connection.
+type ConnectionStats struct {
+	ID string
+
+	// Subprotocol is the subprotocol negotiated with the client.
+	Subprotocol string
+
+	// ConnectedAt is the time the connection was established;
+	// LastActivity is the time a message was last received from or sent
+	// to the client.
+	ConnectedAt  time.Time
+	LastActivity time.Time
+
+	// The numbers of messages and bytes received from and sent to the
+	// client, excluding WebSocket control frames
+	MessagesReceived uint64
+	MessagesSent     uint64
+	BytesReceived    uint64
+	BytesSent        uint64
+
+	// MessagesByType is the number of messages received by type, keyed
+	// by the graphql-ws type of protocol messages, e.g. start for the
+	// subscribe messages of graphql-transport-ws, the type of custom
+	// messages or MessageTypeUnknown for others.
+	MessagesByType map[string]uint64
+
+	// Subscriptions is the number of active operations.
+	Subscriptions int
+
+	// SendBacklog is the number of messages waiting to be written to the
+	// client; SendBacklogSince is the time since which there have been
+	// messages waiting, which is zero while there are none.
+	SendBacklog      int
+	SendBacklogSince time.Time
+}
+
+// RegistryStats is a snapshot of the statistics of the connections of a
+// registry, with totals across all connections.
+type RegistryStats struct {
+	Connections []ConnectionStats
+
+	MessagesReceived uint64
+	MessagesSent     uint64
+	BytesReceived    uint64
+	BytesSent        uint64
+	MessagesByType   map[string]uint64
+	Subscriptions    int
+}
+
+// connectionCounters counts the traffic of a connection. It is allocated
+// separately so that its 64-bit fields, which are accessed atomically,
+// are aligned on 32-bit platforms.
+type connectionCounters struct {
+	messagesReceived uint64
+	messagesSent     uint64
+	bytesReceived    uint64
+	bytesSent        uint64
+
+	// Unix times in nanoseconds
+	lastActivity int64
+	lastReceived int64
+
+	// Counters of the messages received by type
+	byType map[string]*uint64
+}
+
+func (c *connectionCounters) received(bytes int) {
+	atomic.AddUint64(&c.messagesReceived, 1)
+	atomic.AddUint64(&c.bytesReceived, uint64(bytes))
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&c.lastActivity, now)
+	atomic.StoreInt64(&c.lastReceived, now)
+}
+
+func (c *connectionCounters) sent(messages int, bytes int) {
+	atomic.AddUint64(&c.messagesSent, uint64(messages))
+	atomic.AddUint64(&c.bytesSent, uint64(bytes))
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+func (conn *connection) Stats() ConnectionStats {
+	conn.operationsMutex.Lock()
+	subscriptions := len(conn.operations)
+	conn.operationsMutex.Unlock()
+
+	stats := ConnectionStats{
+		ID:               conn.id,
+		Subprotocol:      conn.ws.Subprotocol(),
+		ConnectedAt:      conn.connectedAt,
+		LastActivity:     conn.connectedAt,
+		MessagesReceived: atomic.LoadUint64(&conn.counters.messagesReceived),
+		MessagesSent:     atomic.LoadUint64(&conn.counters.messagesSent),
+		BytesReceived:    atomic.LoadUint64(&conn.counters.bytesReceived),
+		BytesSent:        atomic.LoadUint64(&conn.counters.bytesSent),
+		MessagesByType:   conn.counters.messagesByType(),
+		Subscriptions:    subscriptions,
+	}
+	stats.SendBacklog, stats.SendBacklogSince = conn.queue.backlog()
+	if lastActivity := atomic.LoadInt64(&conn.counters.lastActivity); lastActivity > 0 {
+		stats.LastActivity = time.Unix(0, lastActivity)
+	}
+	return stats
+}
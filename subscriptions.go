@@ -1,13 +1,15 @@
 package graphqlws
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"sync"
 
 	"github.com/graphql-go/graphql"
 	"github.com/graphql-go/graphql/gqlerrors"
 	"github.com/graphql-go/graphql/language/ast"
 	"github.com/graphql-go/graphql/language/parser"
-	log "github.com/sirupsen/logrus"
 )
 
 // ErrorsFromGraphQLErrors convert from GraphQL errors to regular errors.
@@ -27,6 +29,16 @@ func ErrorsFromGraphQLErrors(errors []gqlerrors.FormattedError) []error {
 // for a specific subscription to the corresponding subscriber.
 type SubscriptionSendDataFunc func(*DataMessagePayload)
 
+// SubscriptionFilterFunc is a function that decides whether an event is
+// delivered to a subscription, e.g. based on its variables or the user of
+// its connection.
+type SubscriptionFilterFunc func(s *Subscription, event interface{}) bool
+
+// SubscriptionScopeFunc is a function that returns the auth scope of a
+// subscription, e.g. the role of the user of its connection; see
+// Subscription.Scope.
+type SubscriptionScopeFunc func(s *Subscription) string
+
 // Subscription holds all information about a GraphQL subscription
 // made by a client, including a function to send data back to the
 // client when there are updates to the subscription query result.
@@ -39,6 +51,39 @@ type Subscription struct {
 	Fields        []string
 	Connection    Connection
 	SendData      SubscriptionSendDataFunc
+
+	// Context is the context of the subscription, which carries the
+	// values of the connection's upgrade request; see Connection.Context.
+	// Subscriptions started by a Handler have contexts that are cancelled
+	// when they are stopped or their connection is closed, so resolvers
+	// and managers can tear down the work done for them.
+	Context context.Context
+
+	// Filter decides which published events are delivered to the
+	// subscription (optional); events it rejects are not executed for
+	// the subscription.
+	Filter SubscriptionFilterFunc
+
+	// Scope is the auth scope of the subscription (optional). Published
+	// events are executed once for all subscriptions with the same query,
+	// variables and scope, with the Context of one of them, and the
+	// result is sent to each of them, so subscriptions whose results
+	// depend on their user need a scope that tells users apart.
+	// Subscriptions without a scope are executed on their own.
+	Scope string
+
+	// Resumed is true if the client resumed the subscription with a
+	// valid resume token; ResumePosition is the stream position recorded
+	// for that token.
+	Resumed        bool
+	ResumePosition uint64
+
+	// ReplayCursors are the last sequence numbers of journaled events by
+	// topic that the client has seen, requested in the replay extension
+	// of the start message; see PubSubConfig.Journal.
+	ReplayCursors map[string]uint64
+
+	resume *ResumeConfig
 }
 
 // MatchesField returns true if the subscription is for data that
@@ -58,6 +103,12 @@ func (s *Subscription) MatchesField(field string) bool {
 	return false
 }
 
+// Accepts returns true if an event passes the subscription's filter.
+// Subscriptions without a filter accept all events.
+func (s *Subscription) Accepts(event interface{}) bool {
+	return s.Filter == nil || s.Filter(s, event)
+}
+
 // ConnectionSubscriptions defines a map of all subscriptions of
 // a connection by their IDs.
 type ConnectionSubscriptions map[string]*Subscription
@@ -83,17 +134,39 @@ type SubscriptionManager interface {
 	RemoveSubscriptions(Connection)
 }
 
+// PublishingSubscriptionManager is a SubscriptionManager that executes
+// subscriptions itself whenever an event is published for them.
+type PublishingSubscriptionManager interface {
+	SubscriptionManager
+
+	// Publish executes all subscriptions to the given field against the
+	// schema, with root as the source value of the field's resolver, and
+	// sends the results to the subscribers whose filters accept root.
+	// Resolvers receive the Context of each subscription, or ctx if it
+	// has none; subscriptions that share a Scope share executions, see
+	// Subscription.Scope. It returns the number of subscriptions that
+	// data was sent to.
+	Publish(ctx context.Context, field string, root interface{}) int
+}
+
 /**
  * The default implementation of the SubscriptionManager interface.
  */
 
 type subscriptionManager struct {
+	shards []*subscriptionShard
+	schema *graphql.Schema
+	logger Logger
+}
+
+// subscriptionShard holds the subscriptions of the connections whose IDs
+// hash to it.
+type subscriptionShard struct {
 	subscriptions Subscriptions
-	schema        *graphql.Schema
-	logger        *log.Entry
+	mutex         *sync.RWMutex
 }
 
-func NewSubscriptionManagerWithLogger(schema *graphql.Schema, logger *log.Entry) SubscriptionManager {
+func NewSubscriptionManagerWithLogger(schema *graphql.Schema, logger Logger) SubscriptionManager {
 	return newSubscriptionManager(schema, logger)
 }
 
@@ -102,23 +175,66 @@ func NewSubscriptionManager(schema *graphql.Schema) SubscriptionManager {
 	return newSubscriptionManager(schema, NewLogger("subscriptions"))
 }
 
-func newSubscriptionManager(schema *graphql.Schema, logger *log.Entry) SubscriptionManager {
+// NewPublishingSubscriptionManager creates a new subscription manager
+// that executes subscriptions when events are published.
+func NewPublishingSubscriptionManager(schema *graphql.Schema) PublishingSubscriptionManager {
+	return newSubscriptionManager(schema, NewLogger("subscriptions"))
+}
+
+func newSubscriptionManager(schema *graphql.Schema, logger Logger) *subscriptionManager {
 	manager := new(subscriptionManager)
-	manager.subscriptions = make(Subscriptions)
+	manager.shards = make([]*subscriptionShard, shardCount)
+	for i := range manager.shards {
+		manager.shards[i] = &subscriptionShard{
+			subscriptions: make(Subscriptions),
+			mutex:         &sync.RWMutex{},
+		}
+	}
 	manager.logger = logger
 	manager.schema = schema
 	return manager
 }
 
+func (m *subscriptionManager) shard(conn Connection) *subscriptionShard {
+	return m.shards[shardIndex(conn.ID())]
+}
+
+// Subscriptions returns a snapshot of the registered subscriptions, which
+// isn't affected by subscriptions being added or removed later on.
 func (m *subscriptionManager) Subscriptions() Subscriptions {
-	return m.subscriptions
+	subscriptions := make(Subscriptions)
+	for _, shard := range m.shards {
+		shard.mutex.RLock()
+		for conn, connSubscriptions := range shard.subscriptions {
+			subscriptions[conn] = make(ConnectionSubscriptions, len(connSubscriptions))
+			for opID, subscription := range connSubscriptions {
+				subscriptions[conn][opID] = subscription
+			}
+		}
+		shard.mutex.RUnlock()
+	}
+	return subscriptions
+}
+
+// connectionSubscriptions returns a snapshot of the subscriptions of a
+// connection.
+func (m *subscriptionManager) connectionSubscriptions(conn Connection) ConnectionSubscriptions {
+	shard := m.shard(conn)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	subscriptions := make(ConnectionSubscriptions, len(shard.subscriptions[conn]))
+	for opID, subscription := range shard.subscriptions[conn] {
+		subscriptions[opID] = subscription
+	}
+	return subscriptions
 }
 
 func (m *subscriptionManager) AddSubscription(
 	conn Connection,
 	subscription *Subscription,
 ) []error {
-	m.logger.WithFields(log.Fields{
+	m.logger.WithFields(Fields{
 		"conn":         conn.ID(),
 		"subscription": subscription.ID,
 	}).Info("Add subscription")
@@ -140,7 +256,7 @@ func (m *subscriptionManager) AddSubscription(
 	// Validate the query document
 	validation := graphql.ValidateDocument(m.schema, document, nil)
 	if !validation.IsValid {
-		m.logger.WithFields(log.Fields{
+		m.logger.WithFields(Fields{
 			"errors": validation.Errors,
 		}).Warn("Failed to validate subscription query")
 		return ErrorsFromGraphQLErrors(validation.Errors)
@@ -152,22 +268,26 @@ func (m *subscriptionManager) AddSubscription(
 	// Extract query names from the document (typically, there should only be one)
 	subscription.Fields = subscriptionFieldNamesFromDocument(document)
 
+	shard := m.shard(conn)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
 	// Allocate the connection's map of subscription IDs to
 	// subscriptions on demand
-	if m.subscriptions[conn] == nil {
-		m.subscriptions[conn] = make(ConnectionSubscriptions)
+	if shard.subscriptions[conn] == nil {
+		shard.subscriptions[conn] = make(ConnectionSubscriptions)
 	}
 
 	// Add the subscription if it hasn't already been added
-	if m.subscriptions[conn][subscription.ID] != nil {
-		m.logger.WithFields(log.Fields{
+	if shard.subscriptions[conn][subscription.ID] != nil {
+		m.logger.WithFields(Fields{
 			"conn":         conn.ID(),
 			"subscription": subscription.ID,
 		}).Warn("Cannot register subscription twice")
 		return []error{errors.New("Cannot register subscription twice")}
 	}
 
-	m.subscriptions[conn][subscription.ID] = subscription
+	shard.subscriptions[conn][subscription.ID] = subscription
 
 	return nil
 }
@@ -176,35 +296,153 @@ func (m *subscriptionManager) RemoveSubscription(
 	conn Connection,
 	subscription *Subscription,
 ) {
-	m.logger.WithFields(log.Fields{
+	m.logger.WithFields(Fields{
 		"conn":         conn.ID(),
 		"subscription": subscription.ID,
 	}).Info("Remove subscription")
 
+	shard := m.shard(conn)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
 	// Remove the subscription from its connections' subscription map
-	delete(m.subscriptions[conn], subscription.ID)
+	delete(shard.subscriptions[conn], subscription.ID)
 
 	// Remove the connection as well if there are no subscriptions left
-	if len(m.subscriptions[conn]) == 0 {
-		delete(m.subscriptions, conn)
+	if len(shard.subscriptions[conn]) == 0 {
+		delete(shard.subscriptions, conn)
 	}
 }
 
 func (m *subscriptionManager) RemoveSubscriptions(conn Connection) {
-	m.logger.WithFields(log.Fields{
+	m.logger.WithFields(Fields{
 		"conn": conn.ID(),
 	}).Info("Remove subscriptions")
 
-	// Only remove subscriptions if we know the connection
-	if m.subscriptions[conn] != nil {
-		// Remove subscriptions one by one
-		for opID := range m.subscriptions[conn] {
-			m.RemoveSubscription(conn, m.subscriptions[conn][opID])
+	// Remove the connection's subscription map altogether
+	shard := m.shard(conn)
+	shard.mutex.Lock()
+	delete(shard.subscriptions, conn)
+	shard.mutex.Unlock()
+}
+
+func (m *subscriptionManager) Publish(ctx context.Context, field string, root interface{}) int {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	subscriptions := []*Subscription{}
+	for _, shard := range m.shards {
+		shard.mutex.RLock()
+		for _, connSubscriptions := range shard.subscriptions {
+			for _, subscription := range connSubscriptions {
+				if subscription.MatchesField(field) {
+					subscriptions = append(subscriptions, subscription)
+				}
+			}
 		}
+		shard.mutex.RUnlock()
+	}
+
+	m.logger.WithFields(Fields{
+		"field":         field,
+		"subscriptions": len(subscriptions),
+	}).Debug("Publish event")
+
+	return executeSubscriptions(ctx, m.schema, subscriptions, root, nil)
+}
 
-		// Remove the connection's subscription map altogether
-		delete(m.subscriptions, conn)
+// executeSubscriptions executes subscriptions for an event and sends the
+// results to the subscribers. Subscriptions whose filters reject the event
+// are skipped, and subscriptions with the same scope, query, operation
+// name and variables are executed only once. Results are sent with send
+// if it isn't nil, which returns false for results it didn't send.
+func executeSubscriptions(
+	ctx context.Context,
+	schema *graphql.Schema,
+	subscriptions []*Subscription,
+	root interface{},
+	send func(*Subscription, *DataMessagePayload) bool,
+) int {
+	groups := [][]*Subscription{}
+	scoped := make(map[string]int)
+	for _, subscription := range subscriptions {
+		if !subscription.Accepts(root) {
+			continue
+		}
+		if subscription.Scope == "" {
+			groups = append(groups, []*Subscription{subscription})
+			continue
+		}
+		key := executionKey(subscription)
+		if i, ok := scoped[key]; ok {
+			groups[i] = append(groups[i], subscription)
+		} else {
+			scoped[key] = len(groups)
+			groups = append(groups, []*Subscription{subscription})
+		}
+	}
+
+	sent := 0
+	for _, group := range groups {
+		data := ExecuteSubscription(ctx, schema, group[0], root)
+		for _, subscription := range group {
+			if send == nil {
+				subscription.SendData(data)
+			} else if !send(subscription, data) {
+				continue
+			}
+			sent++
+		}
 	}
+	return sent
+}
+
+// ExecuteSubscription executes the query of a subscription against a
+// schema, with root as the source value of the top-level resolvers, and
+// returns the result to send to the subscriber. Resolvers receive the
+// subscription's Context, so that they see the values of its connection;
+// ctx is only used if the subscription has no Context.
+func ExecuteSubscription(
+	ctx context.Context,
+	schema *graphql.Schema,
+	s *Subscription,
+	root interface{},
+) *DataMessagePayload {
+	if s.Context != nil {
+		ctx = s.Context
+	}
+
+	document := s.Document
+	if document == nil {
+		var err error
+		document, err = parser.Parse(parser.ParseParams{Source: s.Query})
+		if err != nil {
+			return &DataMessagePayload{Errors: []error{err}}
+		}
+	}
+
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        *schema,
+		Root:          root,
+		AST:           document,
+		OperationName: s.OperationName,
+		Args:          s.Variables,
+		Context:       ctx,
+	})
+
+	return &DataMessagePayload{
+		Data:      result.Data,
+		Errors:    ErrorsFromGraphQLErrors(result.Errors),
+		MessageID: eventMessageID(root),
+	}
+}
+
+// executionKey identifies subscriptions that produce the same results
+// when executed for an event.
+func executionKey(s *Subscription) string {
+	variables, _ := json.Marshal(s.Variables)
+	return s.Scope + "\x00" + s.OperationName + "\x00" + s.Query + "\x00" + string(variables)
 }
 
 func validateSubscription(s *Subscription) []error {
@@ -1,6 +1,10 @@
 package graphqlws_test
 
 import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/graphql-go/graphql"
@@ -34,6 +38,50 @@ func (c *mockWebSocketConnection) SendError(err error) {
 	// Do nothing
 }
 
+func (c *mockWebSocketConnection) TrySendComplete(opID string) bool {
+	return false
+}
+
+func (c *mockWebSocketConnection) Close(code int, reason string) {
+	// Do nothing
+}
+
+func (c *mockWebSocketConnection) Set(key string, value interface{}) {
+	// Do nothing
+}
+
+func (c *mockWebSocketConnection) Get(key string) (interface{}, bool) {
+	return nil, false
+}
+
+func (c *mockWebSocketConnection) InitPayload() map[string]interface{} {
+	return nil
+}
+
+func (c *mockWebSocketConnection) Stats() graphqlws.ConnectionStats {
+	return graphqlws.ConnectionStats{ID: c.id}
+}
+
+func (c *mockWebSocketConnection) Context() context.Context {
+	return context.Background()
+}
+
+func (c *mockWebSocketConnection) Err() error {
+	return nil
+}
+
+func (c *mockWebSocketConnection) Request() *http.Request {
+	return nil
+}
+
+func (c *mockWebSocketConnection) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (c *mockWebSocketConnection) ClientIP() string {
+	return ""
+}
+
 // Tests
 
 func TestMain(m *testing.M) {
@@ -337,3 +385,207 @@ func TestSubscriptions_RemovingSubscriptionsOfAConnectionWorks(t *testing.T) {
 		t.Error("RemoveSubscriptions doesn't remove subscriptions of connections")
 	}
 }
+
+func TestSubscriptions_PublishExecutesMatchingSubscriptions(t *testing.T) {
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"hello": &graphql.Field{Type: graphql.String},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source, nil
+					},
+				},
+				"posts": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		})})
+	sm := graphqlws.NewPublishingSubscriptionManager(&schema)
+
+	conn1 := mockWebSocketConnection{id: "1"}
+	conn2 := mockWebSocketConnection{id: "2"}
+
+	received := map[string]*graphqlws.DataMessagePayload{}
+	subscribe := func(conn *mockWebSocketConnection, query string) {
+		sm.AddSubscription(conn, &graphqlws.Subscription{
+			ID:         "1",
+			Connection: conn,
+			Query:      query,
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				received[conn.id] = msg
+			},
+		})
+	}
+	subscribe(&conn1, "subscription { users }")
+	subscribe(&conn2, "subscription { posts }")
+
+	sent := sm.Publish(context.Background(), "users", []string{"alice", "bob"})
+
+	if sent != 1 || len(received) != 1 || received["1"] == nil {
+		t.Fatalf("Publish doesn't send data to matching subscriptions only: %v", received)
+	}
+	data, _ := received["1"].Data.(map[string]interface{})
+	if users, _ := data["users"].([]interface{}); len(users) != 2 || users[0] != "alice" {
+		t.Errorf("Publish doesn't execute subscriptions with the root value: %v", received["1"].Data)
+	}
+}
+
+func buildGreetingSchema(executions *int) *graphql.Schema {
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"hello": &graphql.Field{Type: graphql.String},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"greeting": &graphql.Field{
+					Type: graphql.String,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if executions != nil {
+							*executions++
+						}
+						user, _ := p.Context.Value(contextKey("user")).(string)
+						return p.Source.(string) + ", " + user, nil
+					},
+				},
+			},
+		})})
+	return &schema
+}
+
+func TestSubscriptions_PublishExecutesSubscriptionsWithTheirContexts(t *testing.T) {
+	sm := graphqlws.NewPublishingSubscriptionManager(buildGreetingSchema(nil))
+
+	var received interface{}
+	conn := &mockWebSocketConnection{id: "1"}
+	sm.AddSubscription(conn, &graphqlws.Subscription{
+		ID:         "1",
+		Connection: conn,
+		Query:      "subscription { greeting }",
+		Context:    context.WithValue(context.Background(), contextKey("user"), "alice"),
+		SendData: func(msg *graphqlws.DataMessagePayload) {
+			received = msg.Data
+		},
+	})
+
+	publisher := context.WithValue(context.Background(), contextKey("user"), "publisher")
+	sm.Publish(publisher, "greeting", "hello")
+
+	data, _ := received.(map[string]interface{})
+	if data["greeting"] != "hello, alice" {
+		t.Errorf("resolvers don't receive the context of the subscription: %v", received)
+	}
+}
+
+func TestSubscriptions_PublishSkipsFilteredSubscriptions(t *testing.T) {
+	sm := graphqlws.NewPublishingSubscriptionManager(buildPubSubSchema())
+
+	received := map[string][]interface{}{}
+	inRoom := func(s *graphqlws.Subscription, event interface{}) bool {
+		return strings.HasPrefix(event.(string), s.Variables["room"].(string)+":")
+	}
+	for _, room := range []string{"general", "random"} {
+		conn := &mockWebSocketConnection{id: room}
+		sm.AddSubscription(conn, &graphqlws.Subscription{
+			ID:         "1",
+			Connection: conn,
+			Query:      "subscription($room: String) { message(room: $room) }",
+			Variables:  map[string]interface{}{"room": room},
+			Filter:     inRoom,
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				data, _ := msg.Data.(map[string]interface{})
+				received[conn.id] = append(received[conn.id], data["message"])
+			},
+		})
+	}
+
+	sent := sm.Publish(context.Background(), "message", "general:hello")
+
+	if sent != 1 || len(received) != 1 || len(received["general"]) != 1 {
+		t.Errorf("Publish doesn't apply subscription filters: %v", received)
+	}
+}
+
+func TestSubscriptions_PublishDoesNotShareExecutionsWithoutScopes(t *testing.T) {
+	executions := 0
+	sm := graphqlws.NewPublishingSubscriptionManager(buildGreetingSchema(&executions))
+
+	received := map[string]interface{}{}
+	for _, user := range []string{"alice", "bob"} {
+		conn := &mockWebSocketConnection{id: user}
+		sm.AddSubscription(conn, &graphqlws.Subscription{
+			ID:         "1",
+			Connection: conn,
+			Query:      "subscription { greeting }",
+			Context:    context.WithValue(context.Background(), contextKey("user"), user),
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				data, _ := msg.Data.(map[string]interface{})
+				received[conn.id] = data["greeting"]
+			},
+		})
+	}
+
+	sm.Publish(context.Background(), "greeting", "hello")
+
+	if executions != 2 || received["alice"] != "hello, alice" || received["bob"] != "hello, bob" {
+		t.Errorf("subscriptions without scopes share executions: %d executions, %v", executions, received)
+	}
+}
+
+func TestSubscriptions_PublishSharesExecutionsWithinScopes(t *testing.T) {
+	executions := 0
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"hello": &graphql.Field{Type: graphql.String},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"dashboard": &graphql.Field{
+					Type: graphql.String,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						executions++
+						return p.Source, nil
+					},
+				},
+			},
+		})})
+	sm := graphqlws.NewPublishingSubscriptionManager(&schema)
+
+	received := 0
+	for i, scope := range []string{"admin", "admin", "viewer"} {
+		conn := &mockWebSocketConnection{id: string(rune('a' + i))}
+		sm.AddSubscription(conn, &graphqlws.Subscription{
+			ID:         "1",
+			Connection: conn,
+			Query:      "subscription { dashboard }",
+			Scope:      scope,
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				received++
+			},
+		})
+	}
+
+	sent := sm.Publish(context.Background(), "dashboard", "update")
+
+	if sent != 3 || received != 3 {
+		t.Errorf("Publish doesn't send data to all subscriptions: %d sent, %d received", sent, received)
+	}
+	if executions != 2 {
+		t.Errorf("expected one execution per scope, got %d", executions)
+	}
+}
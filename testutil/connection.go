@@ -0,0 +1,404 @@
+// Package testutil provides test doubles for unit testing code built on
+// graphqlws, e.g. subscription managers and event handlers, without a
+// real WebSocket connection:
+//
+//	conn := testutil.NewConnection(testutil.ConnectionConfig{})
+//	manager.AddSubscription(conn, &graphqlws.Subscription{
+//		ID:         "1",
+//		Query:      "subscription { ticks }",
+//		Connection: conn,
+//		SendData: func(data *graphqlws.DataMessagePayload) {
+//			conn.SendData("1", data)
+//		},
+//	})
+//	manager.Publish(ctx, "ticks", 1)
+//	msg, ok := conn.WaitForMessage(time.Second)
+//
+// Messages from the client are injected with Connection.Receive, which
+// calls the connection's event handlers.
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/meandrewdev/graphqlws"
+)
+
+// Types of the messages recorded by fake connections, which are those of
+// the graphql-ws protocol.
+const (
+	TypeConnectionInit      = "connection_init"
+	TypeConnectionAck       = "connection_ack"
+	TypeConnectionTerminate = "connection_terminate"
+	TypeStart               = "start"
+	TypeStop                = "stop"
+	TypeData                = "data"
+	TypeError               = "error"
+	TypeComplete            = "complete"
+)
+
+// ConnectionConfig configures a fake connection; all fields are optional.
+type ConnectionConfig struct {
+	// ID is the ID of the connection; a random ID is used if it's empty.
+	ID string
+
+	// User is the user of the connection, as if it had been
+	// authenticated.
+	User interface{}
+
+	// Context is the parent of the connection's context.
+	Context context.Context
+
+	// Request, RemoteAddr and ClientIP are returned by the connection's
+	// methods of the same names.
+	Request    *http.Request
+	RemoteAddr net.Addr
+	ClientIP   string
+
+	// EventHandlers are called for the messages passed to Receive and
+	// once the connection is closed.
+	EventHandlers graphqlws.ConnectionEventHandlers
+}
+
+// Closed is the close code and reason a connection was closed with.
+type Closed struct {
+	Code   int
+	Reason string
+}
+
+// Connection is a fake graphqlws.Connection that records the messages
+// sent to the client instead of writing them to a WebSocket connection.
+// Messages from the client are injected with Receive. It is safe for
+// concurrent use.
+type Connection struct {
+	config      ConnectionConfig
+	ctx         context.Context
+	cancel      context.CancelFunc
+	connectedAt time.Time
+
+	// The recorded messages and the number of them returned by
+	// WaitForMessage, the active operations, the values, the init payload
+	// and how the connection was closed, guarded by mutex
+	messages    []graphqlws.OperationMessage
+	waited      int
+	operations  map[string]bool
+	values      map[string]interface{}
+	initPayload map[string]interface{}
+	closed      *Closed
+	mutex       *sync.Mutex
+
+	// Signalled whenever a message has been recorded
+	sent chan struct{}
+}
+
+// NewConnection creates a fake connection.
+func NewConnection(config ConnectionConfig) *Connection {
+	if config.ID == "" {
+		config.ID = uuid.New().String()
+	}
+	parent := config.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	conn := &Connection{
+		config:      config,
+		connectedAt: time.Now(),
+		operations:  make(map[string]bool),
+		values:      make(map[string]interface{}),
+		mutex:       &sync.Mutex{},
+		sent:        make(chan struct{}, 1),
+	}
+	conn.ctx, conn.cancel = context.WithCancel(parent)
+	return conn
+}
+
+/**
+ * Methods of the graphqlws.Connection interface.
+ */
+
+func (conn *Connection) ID() string {
+	return conn.config.ID
+}
+
+func (conn *Connection) User() interface{} {
+	return conn.config.User
+}
+
+func (conn *Connection) SendData(opID string, data *graphqlws.DataMessagePayload) {
+	conn.record(graphqlws.OperationMessage{ID: opID, Type: TypeData, Payload: data})
+}
+
+func (conn *Connection) SendError(err error) {
+	conn.record(graphqlws.OperationMessage{Type: TypeError, Payload: err.Error()})
+}
+
+func (conn *Connection) TrySendComplete(opID string) bool {
+	conn.mutex.Lock()
+	active := conn.operations[opID]
+	delete(conn.operations, opID)
+	conn.mutex.Unlock()
+
+	if active {
+		conn.record(graphqlws.OperationMessage{ID: opID, Type: TypeComplete})
+	}
+	return active
+}
+
+func (conn *Connection) Close(code int, reason string) {
+	conn.mutex.Lock()
+	if conn.closed != nil {
+		conn.mutex.Unlock()
+		return
+	}
+	conn.closed = &Closed{Code: code, Reason: reason}
+	conn.mutex.Unlock()
+
+	if conn.config.EventHandlers.Close != nil {
+		conn.config.EventHandlers.Close(conn)
+	}
+	conn.cancel()
+}
+
+func (conn *Connection) Set(key string, value interface{}) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.values[key] = value
+}
+
+func (conn *Connection) Get(key string) (interface{}, bool) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	value, ok := conn.values[key]
+	return value, ok
+}
+
+func (conn *Connection) InitPayload() map[string]interface{} {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.initPayload
+}
+
+func (conn *Connection) Stats() graphqlws.ConnectionStats {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return graphqlws.ConnectionStats{
+		ID:            conn.config.ID,
+		Subprotocol:   graphqlws.SubprotocolGraphQLWS,
+		ConnectedAt:   conn.connectedAt,
+		MessagesSent:  uint64(len(conn.messages)),
+		Subscriptions: len(conn.operations),
+	}
+}
+
+func (conn *Connection) Context() context.Context {
+	return conn.ctx
+}
+
+func (conn *Connection) Err() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.closed == nil {
+		return nil
+	}
+	return graphqlws.ErrClosedByServer
+}
+
+func (conn *Connection) Request() *http.Request {
+	return conn.config.Request
+}
+
+func (conn *Connection) RemoteAddr() net.Addr {
+	return conn.config.RemoteAddr
+}
+
+func (conn *Connection) ClientIP() string {
+	return conn.config.ClientIP
+}
+
+/**
+ * Injecting messages from the client.
+ */
+
+// StartMessage returns a start message for an operation.
+func StartMessage(opID string, query string, variables map[string]interface{}) graphqlws.OperationMessage {
+	return graphqlws.OperationMessage{
+		ID:   opID,
+		Type: TypeStart,
+		Payload: &graphqlws.StartMessagePayload{
+			Query:     query,
+			Variables: variables,
+		},
+	}
+}
+
+// StopMessage returns a stop message for an operation.
+func StopMessage(opID string) graphqlws.OperationMessage {
+	return graphqlws.OperationMessage{ID: opID, Type: TypeStop}
+}
+
+// Receive handles a message as if the client had sent it, calling the
+// event handlers of the connection: connection_init messages call Init
+// and are acknowledged, start and stop messages call StartOperation and
+// StopOperation, and connection_terminate messages close the connection.
+// Errors returned by StartOperation are sent to the client and returned.
+// Payloads may be of any type that encodes into the expected JSON.
+func (conn *Connection) Receive(msg graphqlws.OperationMessage) []error {
+	handlers := conn.config.EventHandlers
+
+	switch msg.Type {
+	case TypeConnectionInit:
+		payload := map[string]interface{}{}
+		if err := decodePayload(msg.Payload, &payload); err != nil {
+			return []error{err}
+		}
+		conn.mutex.Lock()
+		conn.initPayload = payload
+		conn.mutex.Unlock()
+
+		if handlers.Init != nil {
+			handlers.Init(conn, payload)
+		}
+		conn.record(graphqlws.OperationMessage{Type: TypeConnectionAck})
+
+	case TypeStart:
+		data := &graphqlws.StartMessagePayload{}
+		if err := decodePayload(msg.Payload, data); err != nil {
+			return []error{err}
+		}
+
+		conn.mutex.Lock()
+		conn.operations[msg.ID] = true
+		conn.mutex.Unlock()
+
+		var errs []error
+		if handlers.StartOperation != nil {
+			errs = handlers.StartOperation(conn, msg.ID, data)
+		}
+		if len(errs) > 0 {
+			conn.mutex.Lock()
+			delete(conn.operations, msg.ID)
+			conn.mutex.Unlock()
+			conn.record(graphqlws.OperationMessage{ID: msg.ID, Type: TypeError, Payload: errs})
+		}
+		return errs
+
+	case TypeStop:
+		conn.mutex.Lock()
+		delete(conn.operations, msg.ID)
+		conn.mutex.Unlock()
+
+		if handlers.StopOperation != nil {
+			handlers.StopOperation(conn, msg.ID)
+		}
+
+	case TypeConnectionTerminate:
+		conn.Close(1000, "")
+
+	default:
+		return []error{errors.New("testutil: unsupported message type " + msg.Type)}
+	}
+	return nil
+}
+
+// decodePayload converts a payload into v by encoding it into JSON.
+func decodePayload(payload interface{}, v interface{}) error {
+	if payload == nil {
+		return nil
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+/**
+ * Inspecting the messages sent to the client.
+ */
+
+func (conn *Connection) record(msg graphqlws.OperationMessage) {
+	conn.mutex.Lock()
+	conn.messages = append(conn.messages, msg)
+	conn.mutex.Unlock()
+
+	select {
+	case conn.sent <- struct{}{}:
+	default:
+	}
+}
+
+// Messages returns all messages sent to the client so far.
+func (conn *Connection) Messages() []graphqlws.OperationMessage {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return append([]graphqlws.OperationMessage(nil), conn.messages...)
+}
+
+// Data returns the payloads of the data messages sent for an operation.
+func (conn *Connection) Data(opID string) []*graphqlws.DataMessagePayload {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	payloads := []*graphqlws.DataMessagePayload{}
+	for _, msg := range conn.messages {
+		if msg.Type == TypeData && msg.ID == opID {
+			payloads = append(payloads, msg.Payload.(*graphqlws.DataMessagePayload))
+		}
+	}
+	return payloads
+}
+
+// Errors returns the errors sent to the client with SendError.
+func (conn *Connection) Errors() []string {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	errs := []string{}
+	for _, msg := range conn.messages {
+		if msg.Type == TypeError && msg.ID == "" {
+			errs = append(errs, msg.Payload.(string))
+		}
+	}
+	return errs
+}
+
+// Closed returns the close code and reason the connection was closed
+// with, or nil if it's open.
+func (conn *Connection) Closed() *Closed {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.closed
+}
+
+// WaitForMessage returns the next message sent to the client that hasn't
+// been returned yet, waiting up to timeout for it to be sent. Messages
+// are returned in the order they were sent.
+func (conn *Connection) WaitForMessage(timeout time.Duration) (graphqlws.OperationMessage, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		conn.mutex.Lock()
+		if conn.waited < len(conn.messages) {
+			msg := conn.messages[conn.waited]
+			conn.waited++
+			conn.mutex.Unlock()
+			return msg, true
+		}
+		conn.mutex.Unlock()
+
+		select {
+		case <-conn.sent:
+		case <-timer.C:
+			return graphqlws.OperationMessage{}, false
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package testutil_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/testutil"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	m.Run()
+}
+
+func buildSchema(t *testing.T) *graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"hello": &graphql.Field{Type: graphql.String},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"ticks": &graphql.Field{
+					Type: graphql.Int,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source, nil
+					},
+				},
+			},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("could not build schema: %v", err)
+	}
+	return &schema
+}
+
+func TestConnection_RecordsDataSentByManagers(t *testing.T) {
+	manager := graphqlws.NewPublishingSubscriptionManager(buildSchema(t))
+	conn := testutil.NewConnection(testutil.ConnectionConfig{ID: "conn"})
+
+	errs := manager.AddSubscription(conn, &graphqlws.Subscription{
+		ID:         "1",
+		Query:      "subscription { ticks }",
+		Connection: conn,
+		SendData: func(data *graphqlws.DataMessagePayload) {
+			conn.SendData("1", data)
+		},
+	})
+	if len(errs) > 0 {
+		t.Fatalf("AddSubscription fails: %v", errs)
+	}
+
+	manager.Publish(context.Background(), "ticks", 1)
+	msg, ok := conn.WaitForMessage(time.Second)
+	if !ok || msg.Type != testutil.TypeData || msg.ID != "1" {
+		t.Fatalf("expected data message, received: %v", msg)
+	}
+	data := conn.Data("1")
+	if len(data) != 1 || data[0].Data.(map[string]interface{})["ticks"] != 1 {
+		t.Errorf("unexpected data: %v", data)
+	}
+	if _, ok := conn.WaitForMessage(10 * time.Millisecond); ok {
+		t.Error("unexpected message")
+	}
+}
+
+func TestConnection_ReceivedMessagesCallEventHandlers(t *testing.T) {
+	started := map[string]*graphqlws.StartMessagePayload{}
+	stopped := []string{}
+	closed := false
+	conn := testutil.NewConnection(testutil.ConnectionConfig{
+		EventHandlers: graphqlws.ConnectionEventHandlers{
+			StartOperation: func(conn graphqlws.Connection, opID string, data *graphqlws.StartMessagePayload) []error {
+				if data.Query == "" {
+					return []error{errors.New("Query is empty")}
+				}
+				started[opID] = data
+				return nil
+			},
+			StopOperation: func(conn graphqlws.Connection, opID string) {
+				stopped = append(stopped, opID)
+			},
+			Close: func(conn graphqlws.Connection) {
+				closed = true
+			},
+		},
+	})
+
+	conn.Receive(graphqlws.OperationMessage{
+		Type:    testutil.TypeConnectionInit,
+		Payload: map[string]interface{}{"authToken": "token"},
+	})
+	if conn.InitPayload()["authToken"] != "token" {
+		t.Errorf("init payload not recorded: %v", conn.InitPayload())
+	}
+
+	conn.Receive(testutil.StartMessage("1", "subscription { ticks }", map[string]interface{}{"n": 1}))
+	if started["1"] == nil || started["1"].Variables["n"] != float64(1) {
+		t.Errorf("operation not started: %v", started)
+	}
+	if errs := conn.Receive(testutil.StartMessage("2", "", nil)); len(errs) != 1 {
+		t.Errorf("expected an error, received: %v", errs)
+	}
+	if conn.Stats().Subscriptions != 1 {
+		t.Errorf("expected 1 active operation, got %d", conn.Stats().Subscriptions)
+	}
+
+	conn.Receive(testutil.StopMessage("1"))
+	if len(stopped) != 1 || stopped[0] != "1" {
+		t.Errorf("operation not stopped: %v", stopped)
+	}
+
+	conn.Receive(graphqlws.OperationMessage{Type: testutil.TypeConnectionTerminate})
+	if !closed || conn.Closed() == nil || conn.Context().Err() == nil {
+		t.Error("connection not closed")
+	}
+
+	types := []string{}
+	for _, msg := range conn.Messages() {
+		types = append(types, msg.Type)
+	}
+	if len(types) != 2 || types[0] != testutil.TypeConnectionAck || types[1] != testutil.TypeError {
+		t.Errorf("unexpected messages: %v", types)
+	}
+}
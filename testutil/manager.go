@@ -0,0 +1,157 @@
+package testutil
+
+import (
+	"sync"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+// Methods of the subscription manager recorded in calls.
+const (
+	MethodAddSubscription     = "AddSubscription"
+	MethodRemoveSubscription  = "RemoveSubscription"
+	MethodRemoveSubscriptions = "RemoveSubscriptions"
+)
+
+// Call is a call recorded by a subscription manager.
+type Call struct {
+	Method     string
+	Connection graphqlws.Connection
+
+	// Subscription is nil for calls of RemoveSubscriptions.
+	Subscription *graphqlws.Subscription
+}
+
+// SubscriptionManagerConfig configures a recording subscription manager.
+type SubscriptionManagerConfig struct {
+	// AddErrors returns the errors AddSubscription rejects a subscription
+	// with (optional); subscriptions are added if it returns none.
+	AddErrors func(graphqlws.Connection, *graphqlws.Subscription) []error
+}
+
+// SubscriptionManager is a graphqlws.SubscriptionManager that records the
+// calls of its methods and keeps subscriptions without executing them, so
+// that handlers can be tested without a GraphQL schema. It is safe for
+// concurrent use.
+type SubscriptionManager struct {
+	config SubscriptionManagerConfig
+
+	// The current subscriptions, the recorded calls and the errors
+	// AddSubscription fails with, guarded by mutex
+	subscriptions graphqlws.Subscriptions
+	calls         []Call
+	addErrors     []error
+	mutex         *sync.Mutex
+}
+
+// NewSubscriptionManager creates a recording subscription manager.
+func NewSubscriptionManager(config SubscriptionManagerConfig) *SubscriptionManager {
+	return &SubscriptionManager{
+		config:        config,
+		subscriptions: make(graphqlws.Subscriptions),
+		mutex:         &sync.Mutex{},
+	}
+}
+
+// FailAdd makes AddSubscription reject all subscriptions with the given
+// errors from now on; calling it without errors makes it add them again.
+func (m *SubscriptionManager) FailAdd(errs ...error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.addErrors = errs
+}
+
+func (m *SubscriptionManager) Subscriptions() graphqlws.Subscriptions {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	subscriptions := make(graphqlws.Subscriptions, len(m.subscriptions))
+	for conn, connSubscriptions := range m.subscriptions {
+		copied := make(graphqlws.ConnectionSubscriptions, len(connSubscriptions))
+		for id, subscription := range connSubscriptions {
+			copied[id] = subscription
+		}
+		subscriptions[conn] = copied
+	}
+	return subscriptions
+}
+
+func (m *SubscriptionManager) AddSubscription(conn graphqlws.Connection, subscription *graphqlws.Subscription) []error {
+	m.mutex.Lock()
+	m.calls = append(m.calls, Call{Method: MethodAddSubscription, Connection: conn, Subscription: subscription})
+	errs := m.addErrors
+	m.mutex.Unlock()
+
+	// The hook is called without holding the mutex, so that it may
+	// inspect the manager
+	if len(errs) == 0 && m.config.AddErrors != nil {
+		errs = m.config.AddErrors(conn, subscription)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.subscriptions[conn] == nil {
+		m.subscriptions[conn] = make(graphqlws.ConnectionSubscriptions)
+	}
+	m.subscriptions[conn][subscription.ID] = subscription
+	return nil
+}
+
+func (m *SubscriptionManager) RemoveSubscription(conn graphqlws.Connection, subscription *graphqlws.Subscription) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.calls = append(m.calls, Call{Method: MethodRemoveSubscription, Connection: conn, Subscription: subscription})
+
+	delete(m.subscriptions[conn], subscription.ID)
+	if len(m.subscriptions[conn]) == 0 {
+		delete(m.subscriptions, conn)
+	}
+}
+
+func (m *SubscriptionManager) RemoveSubscriptions(conn graphqlws.Connection) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.calls = append(m.calls, Call{Method: MethodRemoveSubscriptions, Connection: conn})
+
+	delete(m.subscriptions, conn)
+}
+
+// Calls returns the calls recorded so far, in the order they were made.
+func (m *SubscriptionManager) Calls() []Call {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+// CallsOf returns the recorded calls of one method.
+func (m *SubscriptionManager) CallsOf(method string) []Call {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	calls := []Call{}
+	for _, call := range m.calls {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Subscription returns the current subscription of a connection with the
+// given ID, or nil if there is none.
+func (m *SubscriptionManager) Subscription(conn graphqlws.Connection, id string) *graphqlws.Subscription {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.subscriptions[conn][id]
+}
+
+// Reset forgets all subscriptions and recorded calls.
+func (m *SubscriptionManager) Reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.subscriptions = make(graphqlws.Subscriptions)
+	m.calls = nil
+}
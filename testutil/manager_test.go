@@ -0,0 +1,92 @@
+package testutil_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/testutil"
+)
+
+func TestSubscriptionManager_RecordsCallsOfHandlers(t *testing.T) {
+	manager := testutil.NewSubscriptionManager(testutil.SubscriptionManagerConfig{})
+	closed := make(chan graphqlws.Connection, 1)
+	srv := testutil.NewServer(graphqlws.HandlerConfig{
+		SubscriptionManager: manager,
+		EventHandlers: graphqlws.CustomEventHandlers{
+			Close: func(conn graphqlws.Connection) {
+				closed <- conn
+			},
+		},
+	})
+	defer srv.Close()
+
+	ws := srv.Dial(t, graphqlws.SubprotocolGraphQLWS)
+	defer ws.Close()
+
+	// Queries aren't validated against a schema
+	ws.Start("1", "subscription { anything }", nil)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(manager.Calls()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	calls := manager.CallsOf(testutil.MethodAddSubscription)
+	if len(calls) != 1 || calls[0].Subscription.Query != "subscription { anything }" {
+		t.Fatalf("unexpected calls: %v", calls)
+	}
+	if s := manager.Subscription(calls[0].Connection, "1"); s == nil {
+		t.Error("subscription was not added")
+	}
+
+	manager.FailAdd(errors.New("Not allowed"))
+	ws.Start("2", "subscription { anything }", nil)
+	if errs := ws.ExpectError("2"); len(errs) != 1 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if len(manager.Subscriptions()[calls[0].Connection]) != 1 {
+		t.Error("rejected subscription was added")
+	}
+
+	ws.Close()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+	if len(manager.CallsOf(testutil.MethodRemoveSubscriptions)) != 1 || len(manager.Subscriptions()) != 0 {
+		t.Error("subscriptions of closed connection were not removed")
+	}
+}
+
+func TestSubscriptionManager_AddErrorsRejectSubscriptions(t *testing.T) {
+	manager := testutil.NewSubscriptionManager(testutil.SubscriptionManagerConfig{
+		AddErrors: func(conn graphqlws.Connection, s *graphqlws.Subscription) []error {
+			if s.ID == "bad" {
+				return []error{errors.New("Bad subscription")}
+			}
+			return nil
+		},
+	})
+	conn := testutil.NewConnection(testutil.ConnectionConfig{})
+
+	if errs := manager.AddSubscription(conn, &graphqlws.Subscription{ID: "bad"}); len(errs) != 1 {
+		t.Errorf("expected an error, received: %v", errs)
+	}
+	if errs := manager.AddSubscription(conn, &graphqlws.Subscription{ID: "good"}); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	manager.RemoveSubscription(conn, &graphqlws.Subscription{ID: "good"})
+
+	methods := []string{}
+	for _, call := range manager.Calls() {
+		methods = append(methods, call.Method)
+	}
+	if strings.Join(methods, ",") != "AddSubscription,AddSubscription,RemoveSubscription" {
+		t.Errorf("unexpected calls: %v", methods)
+	}
+	if len(manager.Subscriptions()) != 0 {
+		t.Errorf("unexpected subscriptions: %v", manager.Subscriptions())
+	}
+}
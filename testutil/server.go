@@ -0,0 +1,269 @@
+package testutil
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/meandrewdev/graphqlws"
+)
+
+// Time that helpers wait for messages from the server
+const readTimeout = 2 * time.Second
+
+// Server is a handler running on an httptest.Server, for end-to-end
+// protocol tests:
+//
+//	srv := testutil.NewServer(graphqlws.HandlerConfig{SubscriptionManager: manager})
+//	defer srv.Close()
+//
+//	ws := srv.Dial(t, graphqlws.SubprotocolGraphQLTransportWS)
+//	ws.Init(nil)
+//	ws.Start("1", "subscription { ticks }", nil)
+//	data := ws.ExpectData("1")
+type Server struct {
+	*httptest.Server
+	Handler *graphqlws.Handler
+}
+
+// NewServer starts a server running a handler with the given
+// configuration.
+func NewServer(config graphqlws.HandlerConfig) *Server {
+	handler := graphqlws.NewHandler(config)
+	return &Server{
+		Server:  httptest.NewServer(handler),
+		Handler: handler,
+	}
+}
+
+// WebSocketURL returns the ws:// URL of the server.
+func (srv *Server) WebSocketURL() string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// Dial connects to the server with the given subprotocol, failing the
+// test if the connection can't be established.
+func (srv *Server) Dial(t testing.TB, subprotocol string) *Client {
+	t.Helper()
+	return srv.DialWithHeader(t, subprotocol, http.Header{})
+}
+
+// DialWithHeader is like Dial, with additional headers of the upgrade
+// request, e.g. an Origin or Authorization header.
+func (srv *Server) DialWithHeader(t testing.TB, subprotocol string, header http.Header) *Client {
+	t.Helper()
+
+	header = header.Clone()
+	header.Set("Sec-WebSocket-Protocol", subprotocol)
+	ws, _, err := websocket.DefaultDialer.Dial(srv.WebSocketURL(), header)
+	if err != nil {
+		t.Fatalf("could not connect to %s: %v", srv.WebSocketURL(), err)
+	}
+	return &Client{t: t, Conn: ws, transportWS: subprotocol == graphqlws.SubprotocolGraphQLTransportWS}
+}
+
+/**
+ * Clients driving the message sequence of the protocols.
+ */
+
+// Message is a message received from the server.
+type Message struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Decode decodes the payload of the message into v.
+func (msg Message) Decode(v interface{}) error {
+	return json.Unmarshal(msg.Payload, v)
+}
+
+// Client is a connection to a Server that speaks the negotiated protocol,
+// graphql-ws or graphql-transport-ws, and fails the test whenever the
+// server doesn't respond as expected.
+type Client struct {
+	*websocket.Conn
+	t           testing.TB
+	transportWS bool
+}
+
+// Send sends a message to the server.
+func (c *Client) Send(msg graphqlws.OperationMessage) {
+	c.t.Helper()
+	if err := c.WriteJSON(msg); err != nil {
+		c.t.Fatalf("could not send %s message: %v", msg.Type, err)
+	}
+}
+
+// Init initializes the connection with the given payload and returns
+// the server's connection_ack message.
+func (c *Client) Init(payload map[string]interface{}) Message {
+	c.t.Helper()
+	c.Send(graphqlws.OperationMessage{Type: "connection_init", Payload: payload})
+	return c.Expect("connection_ack")
+}
+
+// Start starts an operation.
+func (c *Client) Start(opID string, query string, variables map[string]interface{}) {
+	c.t.Helper()
+	c.Send(graphqlws.OperationMessage{
+		ID:   opID,
+		Type: c.messageType("start", "subscribe"),
+		Payload: &graphqlws.StartMessagePayload{
+			Query:     query,
+			Variables: variables,
+		},
+	})
+}
+
+// Stop stops an operation.
+func (c *Client) Stop(opID string) {
+	c.t.Helper()
+	c.Send(graphqlws.OperationMessage{ID: opID, Type: c.messageType("stop", "complete")})
+}
+
+// Terminate terminates the connection: graphql-ws clients send a
+// connection_terminate message and graphql-transport-ws clients, which
+// have none, close the connection normally.
+func (c *Client) Terminate() {
+	c.t.Helper()
+	if !c.transportWS {
+		c.Send(graphqlws.OperationMessage{Type: "connection_terminate"})
+		return
+	}
+	err := c.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(readTimeout),
+	)
+	if err != nil {
+		c.t.Fatalf("could not close connection: %v", err)
+	}
+}
+
+// Read returns the next message from the server, skipping keep-alive
+// messages and answering pings of graphql-transport-ws servers.
+func (c *Client) Read() Message {
+	c.t.Helper()
+	c.SetReadDeadline(time.Now().Add(readTimeout))
+	for {
+		msg := Message{}
+		if err := c.ReadJSON(&msg); err != nil {
+			c.t.Fatalf("could not read message: %v", err)
+		}
+		switch msg.Type {
+		case "ka":
+		case "ping":
+			c.Send(graphqlws.OperationMessage{Type: "pong"})
+		default:
+			return msg
+		}
+	}
+}
+
+// Expect reads the next message from the server and fails the test if
+// it isn't of the given type.
+func (c *Client) Expect(messageType string) Message {
+	c.t.Helper()
+	msg := c.Read()
+	if msg.Type != messageType {
+		c.t.Fatalf("expected %s message, received %s: %s", messageType, msg.Type, msg.Payload)
+	}
+	return msg
+}
+
+// ExpectData reads the next message, which must be a data message of the
+// given operation without errors, and returns its data.
+func (c *Client) ExpectData(opID string) map[string]interface{} {
+	c.t.Helper()
+	msg := c.expectOperation(c.messageType("data", "next"), opID)
+	payload := struct {
+		Data   map[string]interface{}     `json:"data"`
+		Errors []gqlerrors.FormattedError `json:"errors"`
+	}{}
+	if err := msg.Decode(&payload); err != nil {
+		c.t.Fatalf("invalid data message: %v", err)
+	}
+	if len(payload.Errors) > 0 {
+		c.t.Fatalf("data message of %s has errors: %v", opID, payload.Errors)
+	}
+	return payload.Data
+}
+
+// ExpectError reads the next message, which must be an error message of
+// the given operation, and returns its errors.
+func (c *Client) ExpectError(opID string) []gqlerrors.FormattedError {
+	c.t.Helper()
+	msg := c.expectOperation("error", opID)
+	errs := []gqlerrors.FormattedError{}
+	if err := msg.Decode(&errs); err != nil {
+		single := gqlerrors.FormattedError{}
+		if err := msg.Decode(&single); err != nil {
+			c.t.Fatalf("invalid error message: %v", err)
+		}
+		errs = append(errs, single)
+	}
+	return errs
+}
+
+// ExpectComplete reads the next message, which must be a complete
+// message of the given operation.
+func (c *Client) ExpectComplete(opID string) {
+	c.t.Helper()
+	c.expectOperation("complete", opID)
+}
+
+// ExpectClose reads until the server closes the connection and fails the
+// test unless it closes it with the given close code.
+func (c *Client) ExpectClose(code int) {
+	c.t.Helper()
+	c.SetReadDeadline(time.Now().Add(readTimeout))
+	for {
+		_, _, err := c.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, code) {
+			c.t.Fatalf("expected close code %d, received: %v", code, err)
+		}
+		return
+	}
+}
+
+// ExpectDisconnect reads until the connection is closed, with or without
+// a close frame, e.g. after a graphql-ws client has terminated it.
+func (c *Client) ExpectDisconnect() {
+	c.t.Helper()
+	c.SetReadDeadline(time.Now().Add(readTimeout))
+	for {
+		if _, _, err := c.ReadMessage(); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				c.t.Fatal("connection was not closed")
+			}
+			return
+		}
+	}
+}
+
+func (c *Client) expectOperation(messageType string, opID string) Message {
+	c.t.Helper()
+	msg := c.Expect(messageType)
+	if msg.ID != opID {
+		c.t.Fatalf("expected %s message of %s, received one of %s", messageType, opID, msg.ID)
+	}
+	return msg
+}
+
+// messageType returns the type of a message in the negotiated protocol.
+func (c *Client) messageType(graphqlWS string, graphqlTransportWS string) string {
+	if c.transportWS {
+		return graphqlTransportWS
+	}
+	return graphqlWS
+}
@@ -0,0 +1,64 @@
+package testutil_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/testutil"
+)
+
+func TestServer_ClientsDriveTheProtocols(t *testing.T) {
+	for _, subprotocol := range []string{graphqlws.SubprotocolGraphQLWS, graphqlws.SubprotocolGraphQLTransportWS} {
+		t.Run(subprotocol, func(t *testing.T) {
+			subscriptions := make(chan *graphqlws.Subscription, 1)
+			srv := testutil.NewServer(graphqlws.HandlerConfig{
+				SubscriptionManager: testutil.NewSubscriptionManager(testutil.SubscriptionManagerConfig{}),
+				EventHandlers: graphqlws.CustomEventHandlers{
+					NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+						subscriptions <- s
+					},
+				},
+			})
+			defer srv.Close()
+
+			ws := srv.Dial(t, subprotocol)
+			defer ws.Close()
+			ws.Init(map[string]interface{}{"token": "secret"})
+
+			ws.Start("1", "subscription { ticks }", nil)
+			s := <-subscriptions
+			s.SendData(&graphqlws.DataMessagePayload{Data: map[string]interface{}{"ticks": 1}})
+			if data := ws.ExpectData("1"); data["ticks"] != float64(1) {
+				t.Errorf("unexpected data: %v", data)
+			}
+
+			if subprotocol == graphqlws.SubprotocolGraphQLTransportWS {
+				// Subscribing twice with the same ID is a protocol error
+				ws.Start("1", "subscription { ticks }", nil)
+				ws.ExpectClose(4409)
+				return
+			}
+
+			ws.Stop("1")
+			ws.Terminate()
+			ws.ExpectDisconnect()
+		})
+	}
+}
+
+func TestServer_ClientsReceiveOperationErrors(t *testing.T) {
+	manager := testutil.NewSubscriptionManager(testutil.SubscriptionManagerConfig{})
+	manager.FailAdd(errors.New("Not allowed"))
+	srv := testutil.NewServer(graphqlws.HandlerConfig{SubscriptionManager: manager})
+	defer srv.Close()
+
+	ws := srv.Dial(t, graphqlws.SubprotocolGraphQLTransportWS)
+	defer ws.Close()
+	ws.Init(nil)
+
+	ws.Start("1", "subscription { ticks }", nil)
+	if errs := ws.ExpectError("1"); len(errs) != 1 || errs[0].Message != "Not allowed" {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
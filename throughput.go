@@ -0,0 +1,124 @@
+package graphqlws
+
+import (
+	"sync/atomic"
+)
+
+// MessageTypeUnknown is the type under which messages of types that are
+// neither part of the protocol nor handled by MessageTypes are counted
+// and rate limited.
+const MessageTypeUnknown = "unknown"
+
+// MessageRateLimit limits the rate of messages of one type a client may
+// send: Rate messages per second on average, with bursts of up to Burst
+// messages. Exceeding messages are dropped, except that starts are
+// rejected with an error with code RATE_LIMITED and stops are still
+// processed so that no operation is left running. If Close is set,
+// exceeding the rate closes the connection with code 4429 instead.
+type MessageRateLimit struct {
+	Rate  float64
+	Burst int
+	Close bool
+}
+
+// Types of the protocol under which incoming messages are counted,
+// regardless of the subprotocol they were received with
+var countedMessageTypes = []string{
+	gqlConnectionInit,
+	gqlConnectionTerminate,
+	gqlConnectionRefresh,
+	gqlStart,
+	gqlStop,
+	gqlPing,
+	gqlPong,
+	gqlAck,
+}
+
+// newMessageTypeCounters creates a counter for each protocol message
+// type, each custom type and unknown messages. The map isn't modified
+// afterwards, so its counters can be read concurrently.
+func newMessageTypeCounters(custom MessageTypes) map[string]*uint64 {
+	counters := make(map[string]*uint64, len(countedMessageTypes)+len(custom)+1)
+	for _, messageType := range countedMessageTypes {
+		counters[messageType] = new(uint64)
+	}
+	for messageType := range custom {
+		counters[messageType] = new(uint64)
+	}
+	counters[MessageTypeUnknown] = new(uint64)
+	return counters
+}
+
+// newMessageRates creates a token bucket for each limited message type.
+func newMessageRates(limits map[string]MessageRateLimit) map[string]*tokenBucket {
+	if len(limits) == 0 {
+		return nil
+	}
+	rates := make(map[string]*tokenBucket, len(limits))
+	for messageType, limit := range limits {
+		if bucket := newTokenBucket(limit.Rate, limit.Burst); bucket != nil {
+			rates[messageType] = bucket
+		}
+	}
+	return rates
+}
+
+// countedMessageType returns the type under which a message with the
+// given internal type is counted.
+func (conn *connection) countedMessageType(messageType string, msg OperationMessage) string {
+	for _, counted := range countedMessageTypes {
+		if counted == messageType {
+			return messageType
+		}
+	}
+	if _, ok := conn.config.MessageTypes[msg.Type]; ok {
+		return msg.Type
+	}
+	return MessageTypeUnknown
+}
+
+// allowMessageType counts a received message and reports whether it
+// should be handled under the rate limit of its type. Messages that
+// aren't handled have been answered as their limit requires.
+func (conn *connection) allowMessageType(messageType string, msg OperationMessage) bool {
+	atomic.AddUint64(conn.counters.byType[messageType], 1)
+
+	if conn.messageRates[messageType].allow() {
+		return true
+	}
+	conn.logger.WithFields(Fields{
+		"op":   msg.ID,
+		"type": msg.Type,
+	}).Warn("Message rate limit exceeded")
+
+	if conn.config.MessageRateLimits[messageType].Close {
+		conn.terminate(closeTooManyRequests, "Too many requests")
+		return false
+	}
+	switch messageType {
+	case gqlStart:
+		conn.sendOperationErrors(msg.ID, []error{newOperationError(
+			"Too many subscriptions started, try again later",
+			ErrCodeRateLimit,
+		)})
+		return false
+	case gqlStop:
+		return true
+	}
+	return false
+}
+
+// messagesByType returns the numbers of messages received by type,
+// omitting types of which none have been received.
+func (c *connectionCounters) messagesByType() map[string]uint64 {
+	var counts map[string]uint64
+	for messageType, counter := range c.byType {
+		if count := atomic.LoadUint64(counter); count > 0 {
+			if counts == nil {
+				counts = make(map[string]uint64)
+			}
+			counts[messageType] = count
+		}
+	}
+	return counts
+}
@@ -0,0 +1,290 @@
+// Package tracing instruments graphqlws handlers with OpenTelemetry spans
+// for the lifecycle of connections and their operations.
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/meandrewdev/graphqlws"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the tracer of the package.
+const instrumentationName = "github.com/meandrewdev/graphqlws/tracing"
+
+// Attribute keys of the spans.
+const (
+	ConnectionIDKey = attribute.Key("graphqlws.connection.id")
+	OperationIDKey  = attribute.Key("graphqlws.operation.id")
+)
+
+// Config defines the configuration of the tracing.
+type Config struct {
+	// TracerProvider creates the tracer of the spans; defaults to the
+	// global tracer provider.
+	TracerProvider trace.TracerProvider
+
+	// Propagator extracts trace contexts from the headers of upgrade
+	// requests and the payloads of connection_init messages; defaults to
+	// the global propagator.
+	Propagator propagation.TextMapPropagator
+}
+
+// Tracing traces the connections of instrumented handlers.
+//
+// Each connection is traced with one span, which has child spans for
+// every operation started or stopped and every data message sent. The
+// connection span continues the client's trace if the upgrade request
+// carries a trace context in its headers or, failing that, if the
+// connection_init payload carries one in its (string) fields, e.g. a
+// "traceparent" field. Connection spans start when connections are
+// established either way.
+type Tracing interface {
+	// Instrument returns a copy of a handler configuration that traces the
+	// handler's connections. Event handlers that are configured already
+	// are still called.
+	Instrument(config graphqlws.HandlerConfig) graphqlws.HandlerConfig
+}
+
+// connectionTrace holds the tracing state of a connection.
+type connectionTrace struct {
+	opened time.Time
+
+	// The trace context extracted from the upgrade request
+	parent context.Context
+
+	// The connection span, once it has been started
+	span trace.Span
+
+	// The spans of the operations being started or stopped, by ID
+	operations map[string]trace.Span
+}
+
+/**
+ * The default implementation of the Tracing interface.
+ */
+
+type tracing struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+
+	connections map[graphqlws.Connection]*connectionTrace
+	mutex       *sync.Mutex
+}
+
+// New creates the tracing of graphqlws handlers.
+func New(config Config) Tracing {
+	provider := config.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	propagator := config.Propagator
+	if propagator == nil {
+		propagator = otel.GetTextMapPropagator()
+	}
+
+	return &tracing{
+		tracer:      provider.Tracer(instrumentationName),
+		propagator:  propagator,
+		connections: make(map[graphqlws.Connection]*connectionTrace),
+		mutex:       &sync.Mutex{},
+	}
+}
+
+func (t *tracing) Instrument(config graphqlws.HandlerConfig) graphqlws.HandlerConfig {
+	handlers := config.EventHandlers
+
+	config.EventHandlers.Open = func(conn graphqlws.Connection, r *http.Request) {
+		t.open(conn, r)
+		if handlers.Open != nil {
+			handlers.Open(conn, r)
+		}
+	}
+	config.EventHandlers.Init = func(conn graphqlws.Connection, payload map[string]interface{}) {
+		t.init(conn, payload)
+		if handlers.Init != nil {
+			handlers.Init(conn, payload)
+		}
+	}
+	config.EventHandlers.NewSubscription = func(s *graphqlws.Subscription, errs []error) {
+		t.newSubscription(s, errs)
+		if handlers.NewSubscription != nil {
+			handlers.NewSubscription(s, errs)
+		}
+	}
+	config.EventHandlers.Close = func(conn graphqlws.Connection) {
+		if handlers.Close != nil {
+			handlers.Close(conn)
+		}
+		t.close(conn)
+	}
+
+	config.OperationMiddleware = append([]graphqlws.Middleware{t.operation}, config.OperationMiddleware...)
+	config.OutgoingMiddleware = append(append([]graphqlws.Middleware{}, config.OutgoingMiddleware...), t.outgoing)
+
+	return config
+}
+
+func (t *tracing) open(conn graphqlws.Connection, r *http.Request) {
+	ct := &connectionTrace{
+		opened:     time.Now(),
+		operations: make(map[string]trace.Span),
+		parent:     t.propagator.Extract(context.Background(), propagation.HeaderCarrier(r.Header)),
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.connections[conn] = ct
+
+	// Wait for the init payload unless the request continues a trace
+	if trace.SpanContextFromContext(ct.parent).IsValid() {
+		t.startConnectionSpan(conn, ct, ct.parent)
+	}
+}
+
+// startConnectionSpan starts the span of a connection as of the time it
+// was established; t.mutex must be held by the caller.
+func (t *tracing) startConnectionSpan(conn graphqlws.Connection, ct *connectionTrace, parent context.Context) {
+	_, ct.span = t.tracer.Start(parent, "graphqlws.connection",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(ct.opened),
+		trace.WithAttributes(ConnectionIDKey.String(conn.ID())),
+	)
+}
+
+// connectionSpan returns the span of a connection, starting it if it
+// hasn't been started yet.
+func (t *tracing) connectionSpan(conn graphqlws.Connection) (*connectionTrace, trace.Span) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	ct := t.connections[conn]
+	if ct == nil {
+		return nil, nil
+	}
+	if ct.span == nil {
+		t.startConnectionSpan(conn, ct, ct.parent)
+	}
+	return ct, ct.span
+}
+
+func (t *tracing) init(conn graphqlws.Connection, payload map[string]interface{}) {
+	t.mutex.Lock()
+	ct := t.connections[conn]
+	if ct != nil && ct.span == nil {
+		carrier := propagation.MapCarrier{}
+		for key, value := range payload {
+			if s, ok := value.(string); ok {
+				carrier[key] = s
+			}
+		}
+		t.startConnectionSpan(conn, ct, t.propagator.Extract(ct.parent, carrier))
+	}
+	t.mutex.Unlock()
+
+	if _, span := t.connectionSpan(conn); span != nil {
+		span.AddEvent("connection_init")
+	}
+}
+
+func (t *tracing) close(conn graphqlws.Connection) {
+	_, span := t.connectionSpan(conn)
+
+	t.mutex.Lock()
+	delete(t.connections, conn)
+	t.mutex.Unlock()
+
+	if span != nil {
+		span.End()
+	}
+}
+
+// newSubscription records the errors of subscriptions that couldn't be
+// started on the span of their start message.
+func (t *tracing) newSubscription(s *graphqlws.Subscription, errs []error) {
+	if len(errs) == 0 || s.Connection == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	var span trace.Span
+	if ct := t.connections[s.Connection]; ct != nil {
+		span = ct.operations[s.ID]
+	}
+	t.mutex.Unlock()
+
+	if span == nil {
+		return
+	}
+	for _, err := range errs {
+		span.RecordError(err)
+	}
+	span.SetStatus(codes.Error, errs[0].Error())
+}
+
+// startSpan starts a child span of a connection's span.
+func (t *tracing) startSpan(conn graphqlws.Connection, name string, opID string) (*connectionTrace, trace.Span) {
+	ct, parent := t.connectionSpan(conn)
+	if ct == nil {
+		return nil, nil
+	}
+
+	_, span := t.tracer.Start(trace.ContextWithSpan(context.Background(), parent), name,
+		trace.WithAttributes(
+			ConnectionIDKey.String(conn.ID()),
+			OperationIDKey.String(opID),
+		),
+	)
+	return ct, span
+}
+
+// operation traces the handling of start and stop messages, which runs
+// on the connection's workers if it has any.
+func (t *tracing) operation(next graphqlws.MessageHandler) graphqlws.MessageHandler {
+	return func(conn graphqlws.Connection, msg graphqlws.OperationMessage) {
+		name := "graphqlws.stop"
+		if msg.Type == "start" || msg.Type == "subscribe" {
+			name = "graphqlws.start"
+		}
+
+		ct, span := t.startSpan(conn, name, msg.ID)
+		if span == nil {
+			next(conn, msg)
+			return
+		}
+
+		t.mutex.Lock()
+		ct.operations[msg.ID] = span
+		t.mutex.Unlock()
+
+		next(conn, msg)
+
+		t.mutex.Lock()
+		delete(ct.operations, msg.ID)
+		t.mutex.Unlock()
+		span.End()
+	}
+}
+
+func (t *tracing) outgoing(next graphqlws.MessageHandler) graphqlws.MessageHandler {
+	return func(conn graphqlws.Connection, msg graphqlws.OperationMessage) {
+		if msg.Type != "data" && msg.Type != "next" {
+			next(conn, msg)
+			return
+		}
+
+		_, span := t.startSpan(conn, "graphqlws.data", msg.ID)
+		next(conn, msg)
+		if span != nil {
+			span.End()
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/tracing"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	m.Run()
+}
+
+const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func buildSchema(t *testing.T) *graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"hello": &graphql.Field{Type: graphql.String},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"ticks": &graphql.Field{
+					Type: graphql.Int,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source, nil
+					},
+				},
+			},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("could not build schema: %v", err)
+	}
+	return &schema
+}
+
+func serve(t *testing.T, config graphqlws.HandlerConfig) (*httptest.Server, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	tr := tracing.New(tracing.Config{
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+		Propagator:     propagation.TraceContext{},
+	})
+
+	srv := httptest.NewServer(graphqlws.NewHandler(tr.Instrument(config)))
+	t.Cleanup(srv.Close)
+	return srv, recorder
+}
+
+func dial(t *testing.T, srv *httptest.Server, header http.Header) *websocket.Conn {
+	header.Set("Sec-WebSocket-Protocol", graphqlws.SubprotocolGraphQLWS)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	return ws
+}
+
+// spans waits until the recorder has ended a span with the given name and
+// returns all ended spans by name.
+func spans(t *testing.T, recorder *tracetest.SpanRecorder, name string) map[string][]sdktrace.ReadOnlySpan {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		byName := map[string][]sdktrace.ReadOnlySpan{}
+		for _, span := range recorder.Ended() {
+			byName[span.Name()] = append(byName[span.Name()], span)
+		}
+		if len(byName[name]) > 0 {
+			return byName
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("span %s was not ended", name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTracing_ConnectionsContinueTracesFromHeaders(t *testing.T) {
+	sm := graphqlws.NewPublishingSubscriptionManager(buildSchema(t))
+	srv, recorder := serve(t, graphqlws.HandlerConfig{SubscriptionManager: sm})
+
+	ws := dial(t, srv, http.Header{"Traceparent": []string{traceparent}})
+	ws.WriteJSON(map[string]interface{}{"type": "connection_init"})
+	ws.WriteJSON(map[string]interface{}{
+		"id":      "1",
+		"type":    "start",
+		"payload": map[string]interface{}{"query": "subscription { ticks }"},
+	})
+
+	// Publish once the subscription has been started
+	spans(t, recorder, "graphqlws.start")
+	sm.Publish(context.Background(), "ticks", 1)
+	spans(t, recorder, "graphqlws.data")
+
+	ws.Close()
+	byName := spans(t, recorder, "graphqlws.connection")
+
+	connection := byName["graphqlws.connection"][0]
+	if connection.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("connection span doesn't continue the client's trace: %v", connection.SpanContext().TraceID())
+	}
+	for _, name := range []string{"graphqlws.start", "graphqlws.data"} {
+		if span := byName[name][0]; span.Parent().SpanID() != connection.SpanContext().SpanID() {
+			t.Errorf("%s span isn't a child of the connection span", name)
+		}
+	}
+}
+
+func TestTracing_ConnectionsContinueTracesFromInitPayloads(t *testing.T) {
+	srv, recorder := serve(t, graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildSchema(t)),
+	})
+
+	ws := dial(t, srv, http.Header{})
+	ws.WriteJSON(map[string]interface{}{
+		"type":    "connection_init",
+		"payload": map[string]interface{}{"traceparent": traceparent},
+	})
+	ws.WriteJSON(map[string]interface{}{
+		"id":      "1",
+		"type":    "start",
+		"payload": map[string]interface{}{"query": "subscription { unknown }"},
+	})
+
+	start := spans(t, recorder, "graphqlws.start")["graphqlws.start"][0]
+	if start.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("spans don't continue the client's trace: %v", start.SpanContext().TraceID())
+	}
+	if start.Status().Code.String() != "Error" {
+		t.Errorf("failed starts aren't recorded: %v", start.Status())
+	}
+	ws.Close()
+}
+
+func TestTracing_OperationsHandledByWorkersAreTraced(t *testing.T) {
+	srv, recorder := serve(t, graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildSchema(t)),
+		Workers:             graphqlws.NewWorkerPool(4),
+	})
+
+	ws := dial(t, srv, http.Header{})
+	ws.WriteJSON(map[string]interface{}{"type": "connection_init"})
+	for _, id := range []string{"1", "2"} {
+		ws.WriteJSON(map[string]interface{}{
+			"id":      id,
+			"type":    "start",
+			"payload": map[string]interface{}{"query": "subscription { unknown }"},
+		})
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(spans(t, recorder, "graphqlws.start")["graphqlws.start"]) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("start spans were not ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Errors are recorded on the span of the operation that failed, which
+	// ends once the worker started it
+	for _, start := range spans(t, recorder, "graphqlws.start")["graphqlws.start"] {
+		if start.Status().Code.String() != "Error" || len(start.Events()) == 0 {
+			t.Errorf("failed start isn't recorded on its span: %v", start.Status())
+		}
+	}
+	ws.Close()
+}
@@ -0,0 +1,140 @@
+package graphqlws
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Default number of messages kept in the transcript of a connection
+const defaultTranscriptSize = 100
+
+// Directions of the messages in transcripts.
+const (
+	TranscriptInbound  = "inbound"
+	TranscriptOutbound = "outbound"
+)
+
+// TranscriptEntry is a protocol message recorded in the transcript of a
+// connection.
+type TranscriptEntry struct {
+	// Time is the time the message was read from or written to the
+	// WebSocket connection.
+	Time time.Time
+
+	// Direction is TranscriptInbound for messages from the client and
+	// TranscriptOutbound for messages to the client.
+	Direction string
+
+	// ID, Type and Payload are those of the message; message types are
+	// those of the connection's subprotocol. Payloads are JSON,
+	// regardless of the connection's codec.
+	ID      string
+	Type    string
+	Payload json.RawMessage
+}
+
+// TranscriptConfig enables recording the protocol messages of connections,
+// e.g. to debug reports of clients that missed messages. Each connection
+// keeps its most recent messages in a ring buffer; inbound messages are
+// recorded as they are read and outbound messages once they have been
+// written, so messages dropped or stuck in the send queue are missing.
+type TranscriptConfig struct {
+	// Size is the number of messages kept per connection; defaults to
+	// 100.
+	Size int
+
+	// OnClose is called with the transcript of each connection once it
+	// has been closed (optional), e.g. to log the transcripts of
+	// connections that failed.
+	OnClose func(conn Connection, entries []TranscriptEntry)
+}
+
+/**
+ * Ring buffers of transcript entries.
+ */
+
+type transcript struct {
+	// The entries, the position of the next entry and whether the buffer
+	// has wrapped around, guarded by mutex
+	entries []TranscriptEntry
+	next    int
+	full    bool
+	mutex   *sync.Mutex
+}
+
+func newTranscript(config *TranscriptConfig) *transcript {
+	size := config.Size
+	if size <= 0 {
+		size = defaultTranscriptSize
+	}
+	return &transcript{
+		entries: make([]TranscriptEntry, size),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+func (t *transcript) record(direction string, msg OperationMessage, payload json.RawMessage) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.entries[t.next] = TranscriptEntry{
+		Time:      time.Now(),
+		Direction: direction,
+		ID:        msg.ID,
+		Type:      msg.Type,
+		Payload:   payload,
+	}
+	t.next++
+	if t.next == len(t.entries) {
+		t.next = 0
+		t.full = true
+	}
+}
+
+// snapshot returns the recorded entries, oldest first.
+func (t *transcript) snapshot() []TranscriptEntry {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.full {
+		return append([]TranscriptEntry(nil), t.entries[:t.next]...)
+	}
+	entries := make([]TranscriptEntry, 0, len(t.entries))
+	entries = append(entries, t.entries[t.next:]...)
+	return append(entries, t.entries[:t.next]...)
+}
+
+// transcriptPayload returns a copy of the payload of a message as JSON.
+func transcriptPayload(msg OperationMessage) json.RawMessage {
+	switch payload := msg.Payload.(type) {
+	case nil:
+		return nil
+	case *json.RawMessage:
+		if payload == nil || len(*payload) == 0 {
+			return nil
+		}
+		return append(json.RawMessage(nil), *payload...)
+	default:
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil
+		}
+		return data
+	}
+}
+
+// Transcript returns the recorded messages of a live connection of the
+// handler, oldest first. It returns false if the connection is unknown or
+// doesn't record a transcript; see HandlerConfig.Transcript.
+func (h *Handler) Transcript(connID string) ([]TranscriptEntry, bool) {
+	conn, ok := h.connections.Get(connID)
+	if !ok {
+		return nil, false
+	}
+	c, ok := conn.(*connection)
+	if !ok || c.transcript == nil {
+		return nil, false
+	}
+	return c.transcript.snapshot(), true
+}
@@ -0,0 +1,85 @@
+package graphqlws_test
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+func TestHandler_TranscriptsKeepTheMostRecentMessages(t *testing.T) {
+	schema, _ := buildSchema()
+	subscriptions := make(chan *graphqlws.Subscription, 1)
+	transcripts := make(chan []graphqlws.TranscriptEntry, 1)
+	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Transcript: &graphqlws.TranscriptConfig{
+			Size: 3,
+			OnClose: func(conn graphqlws.Connection, entries []graphqlws.TranscriptEntry) {
+				transcripts <- entries
+			},
+		},
+		EventHandlers: graphqlws.CustomEventHandlers{
+			NewSubscription: func(s *graphqlws.Subscription, errs []error) {
+				subscriptions <- s
+			},
+		},
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+	writeMessage(t, ws, map[string]interface{}{"type": "connection_init"})
+	readOperationMessage(t, ws)
+	startSubscription(t, ws, "1")
+	s := receiveSubscription(t, subscriptions)
+	s.SendData(&graphqlws.DataMessagePayload{Data: map[string]interface{}{"ticks": 1}})
+	readOperationMessage(t, ws)
+
+	// Outbound messages are recorded once they have been written
+	var entries []graphqlws.TranscriptEntry
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		entries, _ = handler.Transcript(s.Connection.ID())
+		if len(entries) > 0 && entries[len(entries)-1].Type == "data" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The connection_init message has been overwritten
+	expected := []struct{ direction, typ string }{
+		{graphqlws.TranscriptOutbound, "connection_ack"},
+		{graphqlws.TranscriptInbound, "start"},
+		{graphqlws.TranscriptOutbound, "data"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("unexpected transcript: %v", entries)
+	}
+	for i, entry := range entries {
+		if entry.Direction != expected[i].direction || entry.Type != expected[i].typ {
+			t.Errorf("unexpected entry %d: %s %s", i, entry.Direction, entry.Type)
+		}
+		if i > 0 && entry.Time.Before(entries[i-1].Time) {
+			t.Errorf("entry %d is out of order", i)
+		}
+	}
+	if string(entries[2].Payload) != `{"data":{"ticks":1},"errors":null}` || entries[2].ID != "1" {
+		t.Errorf("unexpected data entry: %s %s", entries[2].ID, entries[2].Payload)
+	}
+
+	ws.Close()
+	select {
+	case entries := <-transcripts:
+		if len(entries) != 3 {
+			t.Errorf("unexpected transcript of closed connection: %v", entries)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("transcript of closed connection was not reported")
+	}
+	if _, ok := handler.Transcript(s.Connection.ID()); ok {
+		t.Error("closed connection has a transcript")
+	}
+}
@@ -0,0 +1,61 @@
+package graphqlws
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Socket is a WebSocket connection that GraphQL WebSocket connections run
+// on. It's implemented by *websocket.Conn and can be implemented for other
+// WebSocket libraries; see Transport.
+//
+// Message types are the opcodes of RFC 6455 as defined by gorilla/websocket,
+// e.g. websocket.TextMessage. ReadMessage must handle control frames and
+// return close frames received from the peer as *websocket.CloseError and
+// messages exceeding the read limit as websocket.ErrReadLimit. WriteControl
+// and Close may be called concurrently with the other methods, which are
+// called by one goroutine at a time.
+type Socket interface {
+	Subprotocol() string
+	RemoteAddr() net.Addr
+
+	ReadMessage() (messageType int, data []byte, err error)
+	SetReadDeadline(t time.Time) error
+	SetReadLimit(limit int64)
+	SetPongHandler(h func(appData string) error)
+
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetWriteDeadline(t time.Time) error
+	EnableWriteCompression(enable bool)
+
+	Close() error
+}
+
+// Transport upgrades HTTP requests to WebSocket connections, so that
+// handlers can run on WebSocket libraries other than gorilla/websocket.
+type Transport interface {
+	// Upgrade upgrades a request, negotiating the first of the given
+	// subprotocols that the client offers. If the upgrade fails, Upgrade
+	// has replied to the request.
+	Upgrade(w http.ResponseWriter, r *http.Request, subprotocols []string) (Socket, error)
+}
+
+/**
+ * The default transport, which uses gorilla/websocket.
+ */
+
+type gorillaTransport struct {
+	upgrader *websocket.Upgrader
+}
+
+func (t *gorillaTransport) Upgrade(w http.ResponseWriter, r *http.Request, subprotocols []string) (Socket, error) {
+	ws, err := t.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
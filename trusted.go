@@ -0,0 +1,88 @@
+package graphqlws
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// ErrCodeUntrustedDocument is the code of errors rejecting operations
+// whose documents aren't trusted; see HandlerConfig.TrustedDocuments.
+const ErrCodeUntrustedDocument = "UNTRUSTED_DOCUMENT"
+
+// TrustedDocumentStore holds the documents that clients may start by ID,
+// e.g. those extracted from client code at build time. Implementations
+// need to be safe for concurrent use.
+type TrustedDocumentStore interface {
+	// Get returns the document with the given ID.
+	Get(id string) (string, bool)
+}
+
+// trustedDocuments is a fixed set of trusted documents.
+type trustedDocuments map[string]string
+
+// NewTrustedDocuments creates a store of trusted documents by ID, e.g. a
+// persisted query manifest.
+func NewTrustedDocuments(documents map[string]string) TrustedDocumentStore {
+	docs := make(trustedDocuments, len(documents))
+	for id, document := range documents {
+		docs[id] = document
+	}
+	return docs
+}
+
+// NewTrustedDocumentsFromQueries creates a store of trusted documents
+// whose IDs are the hex-encoded SHA-256 hashes of their queries, as
+// sent by Apollo clients with persisted queries.
+func NewTrustedDocumentsFromQueries(queries ...string) TrustedDocumentStore {
+	docs := make(trustedDocuments, len(queries))
+	for _, query := range queries {
+		docs[documentHash(query)] = query
+	}
+	return docs
+}
+
+func (d trustedDocuments) Get(id string) (string, bool) {
+	document, ok := d[id]
+	return document, ok
+}
+
+// documentHash returns the hex-encoded SHA-256 hash of a document.
+func documentHash(document string) string {
+	sum := sha256.Sum256([]byte(document))
+	return hex.EncodeToString(sum[:])
+}
+
+// resolveDocument fills in the query of a start message from the trusted
+// documents, if they are configured, or from the persisted queries. It
+// returns the hash of a persisted query to register once the operation
+// has been accepted, if any.
+func resolveDocument(config HandlerConfig, data *StartMessagePayload) (string, error) {
+	if config.TrustedDocuments == nil {
+		return resolvePersistedQuery(config.PersistedQueries, data)
+	}
+	return "", resolveTrustedDocument(config.TrustedDocuments, data)
+}
+
+// resolveTrustedDocument fills in the query of a start message that refers
+// to a trusted document by its ID or by the hash of a persisted query.
+// Queries sent in full are only accepted if they are trusted.
+func resolveTrustedDocument(store TrustedDocumentStore, data *StartMessagePayload) error {
+	id := data.DocumentID
+	if id == "" {
+		if extension, ok := data.Extensions[persistedQueryExtension].(map[string]interface{}); ok {
+			hash, _ := extension["sha256Hash"].(string)
+			id = strings.ToLower(hash)
+		}
+	}
+	if id == "" && data.Query != "" {
+		id = documentHash(data.Query)
+	}
+
+	document, ok := store.Get(id)
+	if !ok || (data.Query != "" && data.Query != document) {
+		return newOperationError("Document is not trusted", ErrCodeUntrustedDocument)
+	}
+	data.Query = document
+	return nil
+}
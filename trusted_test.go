@@ -0,0 +1,44 @@
+package graphqlws_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/meandrewdev/graphqlws"
+)
+
+func TestTrustedDocuments_OnlyTrustedDocumentsAreStarted(t *testing.T) {
+	schema, _ := buildSchema()
+	sm := graphqlws.NewSubscriptionManager(schema)
+	query := "subscription { " + subscriptionName + " { payload } }"
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		TrustedDocuments:    graphqlws.NewTrustedDocuments(map[string]string{"payloads": query}),
+	}))
+	defer srv.Close()
+
+	ws := dialServer(t, srv)
+	defer ws.Close()
+
+	// Unknown IDs and queries are rejected
+	for opID, payload := range map[string]map[string]interface{}{
+		"1": {"documentId": "unknown"},
+		"2": {"query": "subscription { " + subscriptionName + " { __typename } }"},
+	} {
+		writeMessage(t, ws, map[string]interface{}{"id": opID, "type": "start", "payload": payload})
+		if code := errorCode(t, readOperationMessage(t, ws)); code != graphqlws.ErrCodeUntrustedDocument {
+			t.Fatalf("unexpected error code: %s", code)
+		}
+	}
+
+	// Trusted documents are started by ID
+	writeMessage(t, ws, map[string]interface{}{
+		"id":      "3",
+		"type":    "start",
+		"payload": map[string]interface{}{"documentId": "payloads"},
+	})
+	conn := waitForConnection(t, sm)
+	if s := sm.Subscriptions()[conn]["3"]; s == nil || s.Query != query {
+		t.Errorf("trusted document not looked up: %v", s)
+	}
+}
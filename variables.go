@@ -0,0 +1,196 @@
+package graphqlws
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// checkVariables returns errors for variables of the selected operation
+// of a document that are missing or can't be coerced to their declared
+// types in schema. Variables of types unknown to the schema are left to
+// the subscription manager to reject.
+func checkVariables(schema *graphql.Schema, doc *ast.Document, operationName string, variables map[string]interface{}) []error {
+	operation := selectOperation(doc, operationName)
+	if operation == nil {
+		return nil
+	}
+
+	var errs []error
+	for _, definition := range operation.VariableDefinitions {
+		if definition.Variable == nil || definition.Variable.Name == nil {
+			continue
+		}
+		name := definition.Variable.Name.Value
+		typ := inputTypeFromAST(schema, definition.Type)
+		if typ == nil {
+			continue
+		}
+
+		value, provided := variables[name]
+		if !provided || value == nil {
+			if nonNull, ok := typ.(*graphql.NonNull); ok && definition.DefaultValue == nil {
+				if provided {
+					errs = append(errs, invalidVariable(fmt.Sprintf(
+						"Variable \"$%s\" of non-null type \"%s\" must not be null.", name, nonNull,
+					)))
+				} else {
+					errs = append(errs, invalidVariable(fmt.Sprintf(
+						"Variable \"$%s\" of required type \"%s\" was not provided.", name, nonNull,
+					)))
+				}
+			}
+			continue
+		}
+
+		if problem := coercionProblem(typ, value, ""); problem != "" {
+			errs = append(errs, invalidVariable(fmt.Sprintf(
+				"Variable \"$%s\" got invalid value %s; %s", name, displayValue(value), problem,
+			)))
+		}
+	}
+	return errs
+}
+
+func invalidVariable(message string) error {
+	return newOperationError(message, ErrCodeInvalidVariables)
+}
+
+// selectOperation returns the operation of a document with the given
+// name, or its only operation if the name is empty.
+func selectOperation(doc *ast.Document, operationName string) *ast.OperationDefinition {
+	var selected *ast.OperationDefinition
+	for _, node := range doc.Definitions {
+		operation, ok := node.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if operationName == "" {
+			if selected != nil {
+				return nil
+			}
+			selected = operation
+		} else if operation.Name != nil && operation.Name.Value == operationName {
+			return operation
+		}
+	}
+	return selected
+}
+
+// inputTypeFromAST resolves a declared variable type against a schema;
+// it returns nil if the type is unknown or not an input type.
+func inputTypeFromAST(schema *graphql.Schema, t ast.Type) graphql.Input {
+	switch t := t.(type) {
+	case *ast.Named:
+		if t.Name == nil {
+			return nil
+		}
+		switch named := schema.Type(t.Name.Value).(type) {
+		case *graphql.Scalar, *graphql.Enum, *graphql.InputObject:
+			return named
+		}
+	case *ast.List:
+		if ofType := inputTypeFromAST(schema, t.Type); ofType != nil {
+			return graphql.NewList(ofType)
+		}
+	case *ast.NonNull:
+		if ofType := inputTypeFromAST(schema, t.Type); ofType != nil {
+			return graphql.NewNonNull(ofType)
+		}
+	}
+	return nil
+}
+
+// coercionProblem describes why value can't be coerced to typ, or
+// returns an empty string if it can. Nested values are reported with
+// their path.
+func coercionProblem(typ graphql.Input, value interface{}, path string) string {
+	if nonNull, ok := typ.(*graphql.NonNull); ok {
+		if value == nil {
+			return fmt.Sprintf("expected non-nullable type \"%s\" not to be null%s.", nonNull, atPath(path))
+		}
+		return coercionProblem(nonNull.OfType, value, path)
+	}
+	if value == nil {
+		return ""
+	}
+
+	switch typ := typ.(type) {
+	case *graphql.List:
+		items, ok := value.([]interface{})
+		if !ok {
+			// A single value is coerced to a list of one
+			return coercionProblem(typ.OfType, value, path)
+		}
+		for i, item := range items {
+			if problem := coercionProblem(typ.OfType, item, fmt.Sprintf("%s[%d]", path, i)); problem != "" {
+				return problem
+			}
+		}
+	case *graphql.InputObject:
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Sprintf("expected type \"%s\" to be an object%s.", typ, atPath(path))
+		}
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		definitions := typ.Fields()
+		for _, name := range names {
+			if _, ok := definitions[name]; !ok {
+				return fmt.Sprintf("field \"%s\" is not defined by type \"%s\"%s.", name, typ, atPath(path))
+			}
+		}
+		names = names[:0]
+		for name := range definitions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			field := definitions[name]
+			fieldValue, provided := fields[name]
+			if !provided && field.DefaultValue != nil {
+				continue
+			}
+			if problem := coercionProblem(field.Type, fieldValue, joinPath(path, name)); problem != "" {
+				return problem
+			}
+		}
+	case *graphql.Scalar:
+		if typ.ParseValue(value) == nil {
+			return fmt.Sprintf("expected type \"%s\"%s.", typ, atPath(path))
+		}
+	case *graphql.Enum:
+		if typ.ParseValue(value) == nil {
+			return fmt.Sprintf("expected a value of enum \"%s\"%s.", typ, atPath(path))
+		}
+	}
+	return ""
+}
+
+func joinPath(path string, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+func atPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	return fmt.Sprintf(" at \"%s\"", path)
+}
+
+func displayValue(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(encoded)
+}
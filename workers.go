@@ -0,0 +1,35 @@
+package graphqlws
+
+// WorkerPool runs the handling of operation messages, so that starting
+// expensive operations (parsing, validation, authorization checks)
+// doesn't hold up the other messages received from a client. Worker pools
+// must be safe for concurrent use.
+type WorkerPool interface {
+	// Go runs f once a worker is available without waiting for it.
+	Go(f func())
+}
+
+/**
+ * The default implementation of the WorkerPool interface.
+ */
+
+type workerPool struct {
+	slots chan struct{}
+}
+
+// NewWorkerPool creates a worker pool that runs up to size functions at
+// the same time.
+func NewWorkerPool(size int) WorkerPool {
+	if size <= 0 {
+		size = 1
+	}
+	return &workerPool{slots: make(chan struct{}, size)}
+}
+
+func (p *workerPool) Go(f func()) {
+	go func() {
+		p.slots <- struct{}{}
+		defer func() { <-p.slots }()
+		f()
+	}()
+}
@@ -0,0 +1,58 @@
+// Package zaplogger adapts zap loggers to the Logger interface of
+// graphqlws, so that projects using zap can log graphqlws messages with
+// their zap configuration:
+//
+//	graphqlws.SetLogger(zaplogger.New(logger))
+package zaplogger
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/meandrewdev/graphqlws"
+	"go.uber.org/zap"
+)
+
+type logger struct {
+	logger *zap.SugaredLogger
+}
+
+// New creates a graphqlws logger that logs with a zap logger.
+func New(l *zap.Logger) graphqlws.Logger {
+	return &logger{logger: l.Sugar()}
+}
+
+func (l *logger) WithField(key string, value interface{}) graphqlws.Logger {
+	return &logger{logger: l.logger.With(key, value)}
+}
+
+func (l *logger) WithFields(fields graphqlws.Fields) graphqlws.Logger {
+	// Add the fields in a stable order
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	args := make([]interface{}, 0, 2*len(fields))
+	for _, key := range keys {
+		args = append(args, key, fields[key])
+	}
+	return &logger{logger: l.logger.With(args...)}
+}
+
+func (l *logger) Debug(args ...interface{}) {
+	l.logger.Debug(fmt.Sprint(args...))
+}
+
+func (l *logger) Info(args ...interface{}) {
+	l.logger.Info(fmt.Sprint(args...))
+}
+
+func (l *logger) Warn(args ...interface{}) {
+	l.logger.Warn(fmt.Sprint(args...))
+}
+
+func (l *logger) Error(args ...interface{}) {
+	l.logger.Error(fmt.Sprint(args...))
+}
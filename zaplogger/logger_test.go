@@ -0,0 +1,30 @@
+package zaplogger_test
+
+import (
+	"testing"
+
+	"github.com/meandrewdev/graphqlws"
+	"github.com/meandrewdev/graphqlws/zaplogger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogger_MessagesAreLoggedWithFields(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	graphqlws.SetLogger(zaplogger.New(zap.New(core)))
+	defer graphqlws.SetLogger(nil)
+
+	logger := graphqlws.NewLogger("handler")
+	logger.WithFields(graphqlws.Fields{"conn": "1"}).Info("Start operation")
+	logger.Debug("Not logged")
+
+	entries := logs.All()
+	if len(entries) != 1 || entries[0].Message != "Start operation" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	fields := entries[0].ContextMap()
+	if fields["prefix"] != "graphqlws/handler" || fields["conn"] != "1" {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+}